@@ -1,9 +1,19 @@
 package main
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/caarlos0/env"
 
 	"github.com/iryonetwork/wwm/config"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+)
+
+// Sync directions
+const (
+	directionPush = "push"
+	directionPull = "pull"
 )
 
 // Config represents configuration of batchStorageSync
@@ -13,6 +23,22 @@ type Config struct {
 	CloudStoragePath             string `env:"CLOUD_STORAGE_PATH" envDefault:"storage"`
 	BoltDBFilepath               string `env:"BOLT_DB_FILEPATH" envDefault:"/data/batchStorageSync.db"`
 	PrometheusPushGatewayAddress string `env:"PROMETHEUS_PUSH_GATEWAY_ADDRESS" envDefault:"http://localPrometheusPushGateway:9091"`
+
+	Direction          string        `env:"SYNC_DIRECTION" envDefault:"push"`
+	Incremental        bool          `env:"INCREMENTAL_SYNC" envDefault:"true"`
+	LocationID         string        `env:"LOCATION_ID"`
+	CloudDiscoveryHost string        `env:"CLOUD_DISCOVERY_HOST" envDefault:"cloudDiscovery"`
+	CloudDiscoveryPath string        `env:"CLOUD_DISCOVERY_PATH" envDefault:"discovery"`
+	PullLookback       time.Duration `env:"PULL_LOOKBACK" envDefault:"24h"`
+
+	ConflictPolicy string `env:"CONFLICT_POLICY" envDefault:"park"`
+	ConflictsPath  string `env:"CONFLICTS_PATH" envDefault:"/data/conflicts.db"`
+
+	RateLimit        int64  `env:"SYNC_RATE_LIMIT" envDefault:"0"`
+	ScheduleFilepath string `env:"SYNC_SCHEDULE_FILEPATH"`
+
+	Compress     bool  `env:"SYNC_COMPRESS" envDefault:"true"`
+	DeltaMinSize int64 `env:"SYNC_DELTA_MIN_SIZE" envDefault:"1048576"`
 }
 
 // GetConfig parses environment variables and returns pointer to config and error
@@ -24,5 +50,34 @@ func GetConfig() (*Config, error) {
 
 	cfg := &Config{Config: *common}
 
-	return cfg, env.Parse(cfg)
+	err = env.Parse(cfg)
+	if err != nil {
+		return cfg, err
+	}
+
+	switch cfg.Direction {
+	case directionPush:
+	case directionPull:
+		if cfg.LocationID == "" {
+			return cfg, fmt.Errorf("LOCATION_ID is required for pull sync")
+		}
+	default:
+		return cfg, fmt.Errorf("invalid sync direction '%s'", cfg.Direction)
+	}
+
+	switch storageSync.ConflictPolicy(cfg.ConflictPolicy) {
+	case storageSync.ConflictKeepBoth, storageSync.ConflictLastWriterWins, storageSync.ConflictPark:
+	default:
+		return cfg, fmt.Errorf("invalid conflict policy '%s'", cfg.ConflictPolicy)
+	}
+
+	if cfg.RateLimit < 0 {
+		return cfg, fmt.Errorf("SYNC_RATE_LIMIT can not be negative")
+	}
+
+	if cfg.DeltaMinSize < 0 {
+		return cfg, fmt.Errorf("SYNC_DELTA_MIN_SIZE can not be negative")
+	}
+
+	return cfg, nil
 }
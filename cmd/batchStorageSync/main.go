@@ -7,22 +7,30 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/go-openapi/runtime"
 	runtimeClient "github.com/go-openapi/runtime/client"
 	"github.com/go-openapi/strfmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/push"
 	"github.com/rs/zerolog"
 
+	discoveryClient "github.com/iryonetwork/wwm/gen/discovery/client"
+	discoveryOperations "github.com/iryonetwork/wwm/gen/discovery/client/operations"
 	"github.com/iryonetwork/wwm/gen/storage/client"
 	"github.com/iryonetwork/wwm/storage/keyvalue"
 	storageSync "github.com/iryonetwork/wwm/sync/storage"
 	"github.com/iryonetwork/wwm/sync/storage/batch"
+	"github.com/iryonetwork/wwm/sync/storage/conflicts"
+	"github.com/iryonetwork/wwm/sync/storage/throttle"
 	"github.com/iryonetwork/wwm/utils"
 )
 
 const (
-	storageBucket string = "batchStorageSync"
-	storageKey    string = "lastSuccessfulRun"
+	storageBucket  string = "batchStorageSync"
+	storageKey     string = "lastSuccessfulRun"
+	storageKeyPull string = "lastSuccessfulPull"
+	// sequence number of the last change synced by incremental push
+	storageKeyChanges string = "lastSyncedChange"
 )
 
 func main() {
@@ -59,8 +67,12 @@ func main() {
 		metricsRegistry.MustRegister(metric)
 	}
 
-	// read last succesful run
-	storedTimestamp := storage.Get(storageBucket, storageKey)
+	// read last succesful run; runs of each direction are tracked separately
+	key := storageKey
+	if cfg.Direction == directionPull {
+		key = storageKeyPull
+	}
+	storedTimestamp := storage.Get(storageBucket, key)
 	if storedTimestamp != nil {
 		timestamp, err := strfmt.ParseDateTime(string(storedTimestamp))
 		if err == nil {
@@ -84,11 +96,52 @@ func main() {
 		logger.Fatal().Err(err).Msg("failed to initialize storage API request authenticator")
 	}
 
-	// initialize handlers
-	handlers := storageSync.NewHandlers(localClient.Operations, auth, cloudClient.Operations, auth, logger)
+	// initialize store of conflicts parked for manual resolution
+	conflictStore, err := conflicts.NewBolt(cfg.ConflictsPath)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize conflicts store")
+	}
+
+	// initialize throttle of transfers
+	var th storageSync.Throttle
+	if cfg.ScheduleFilepath != "" || cfg.RateLimit > 0 {
+		var schedule *throttle.Schedule
+		if cfg.ScheduleFilepath != "" {
+			schedule, err = throttle.LoadSchedule(cfg.ScheduleFilepath)
+			if err != nil {
+				logger.Fatal().Err(err).Msg("failed to load sync schedule")
+			}
+		}
+		th = throttle.New(schedule, cfg.RateLimit)
+	}
+	opts := storageSync.Options{
+		Direction:      storageSync.Direction(cfg.Direction),
+		ConflictPolicy: storageSync.ConflictPolicy(cfg.ConflictPolicy),
+		Conflicts:      conflictStore,
+		Throttle:       th,
+		Transfer:       storageSync.TransferOptions{Compress: cfg.Compress, DeltaMinSize: cfg.DeltaMinSize},
+	}
 
 	// initialize batchStorageSync
-	s := batch.New(handlers, logger)
+	var s storageSync.BatchSync
+	if cfg.Direction == directionPull {
+		// cloud storage is the source of files of linked patients
+		handlers := storageSync.NewHandlers(cloudClient.Operations, auth, localClient.Operations, auth, opts, logger)
+
+		// initialize cloud discovery API client
+		cloudDiscovery := runtimeClient.New(cfg.CloudDiscoveryHost, cfg.CloudDiscoveryPath, []string{"https"})
+		cloudDiscoveryClient := discoveryClient.New(cloudDiscovery, strfmt.Default)
+
+		s = batch.NewPull(handlers, linkedBuckets(cloudDiscoveryClient.Operations, auth, strfmt.UUID(cfg.LocationID)), cfg.PullLookback, logger)
+	} else {
+		handlers := storageSync.NewHandlers(localClient.Operations, auth, cloudClient.Operations, auth, opts, logger)
+		if cfg.Incremental {
+			// only files changed since the checkpoint are synced
+			s = batch.NewIncremental(handlers, batch.KeyValueCheckpoint(storage, storageBucket, storageKeyChanges), logger)
+		} else {
+			s = batch.New(handlers, logger)
+		}
+	}
 	// get prometheus metrics collection for batch sync and register in registry
 	m = s.GetPrometheusMetricsCollection()
 	for _, metric := range m {
@@ -121,7 +174,7 @@ Loop:
 			} else {
 				logger.Info().Msg("batch sync successfull")
 				// save lastSuccesfulRun
-				storage.Update(storageBucket, storageKey, []byte(startTime.String()))
+				storage.Update(storageBucket, key, []byte(startTime.String()))
 			}
 			break Loop
 		case <-signalChan:
@@ -137,3 +190,23 @@ Loop:
 		logger.Error().Err(err).Msg("failed to push metrics to push gateway")
 	}
 }
+
+// linkedBuckets returns function listing buckets of patients linked to the
+// location in cloud discovery
+func linkedBuckets(discovery *discoveryOperations.Client, auth runtime.ClientAuthInfoWriter, locationID strfmt.UUID) batch.LinkedBuckets {
+	return func(ctx context.Context) ([]string, error) {
+		params := discoveryOperations.NewLinkedPatientsParams().
+			WithLocationID(locationID).
+			WithContext(ctx)
+		resp, err := discovery.LinkedPatients(params, auth)
+		if err != nil {
+			return nil, err
+		}
+
+		bucketIDs := make([]string, len(resp.Payload))
+		for i, patientID := range resp.Payload {
+			bucketIDs[i] = patientID.String()
+		}
+		return bucketIDs, nil
+	}
+}
@@ -94,6 +94,7 @@ func main() {
 	api.FetchHandler = discoveryHandlers.Fetch()
 	api.LinkHandler = discoveryHandlers.Link()
 	api.UnlinkHandler = discoveryHandlers.Unlink()
+	api.LinkedPatientsHandler = discoveryHandlers.LinkedPatients()
 	api.CodesGetHandler = discoveryHandlers.CodesGet()
 	api.CodeGetHandler = discoveryHandlers.CodeGet()
 
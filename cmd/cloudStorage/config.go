@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/caarlos0/env"
 
 	"github.com/iryonetwork/wwm/config"
@@ -15,9 +18,36 @@ type Config struct {
 	S3Region    string `env:"S3_REGION" envDefault:"us-east-1"`
 	S3Secret    string `env:"S3_SECRET,required"`
 
+	MetadataIndexFilepath string `env:"METADATA_INDEX_FILEPATH" envDefault:"/data/cloudStorageIndex.db"`
+
 	StorageEncryptionKey string `env:"STORAGE_ENCRYPTION_KEY,required"`
+
+	KeyProvider        string `env:"KEY_PROVIDER" envDefault:"static"`
+	KeysFilepath       string `env:"KEYS_FILEPATH" envDefault:"/data/cloudStorageKeys.db"`
+	KeysBackupFilepath string `env:"KEYS_BACKUP_FILEPATH"`
+	VaultAddr          string `env:"VAULT_ADDR"`
+	VaultToken         string `env:"VAULT_TOKEN"`
+	VaultTransitMount  string `env:"VAULT_TRANSIT_MOUNT" envDefault:"transit"`
+	VaultTransitKey    string `env:"VAULT_TRANSIT_KEY" envDefault:"storage"`
+
+	RetentionPolicyFilepath string        `env:"RETENTION_POLICY_FILEPATH"`
+	RetentionInterval       time.Duration `env:"RETENTION_INTERVAL" envDefault:"24h"`
+
+	ArchetypeSchemasDir string `env:"ARCHETYPE_SCHEMAS_DIR"`
+	ArchetypeValidation string `env:"ARCHETYPE_VALIDATION" envDefault:"reject"`
+
+	ArchiveCAPath string `env:"ARCHIVE_CA_PATH"`
+
+	SyncMaxDecodedSize int64 `env:"SYNC_MAX_DECODED_SIZE" envDefault:"1073741824"`
 }
 
+// Key providers
+const (
+	KeyProviderStatic = "static"
+	KeyProviderLocal  = "local"
+	KeyProviderVault  = "vault"
+)
+
 // GetConfig parses environment variables and returns pointer to config and error
 func GetConfig() (*Config, error) {
 	common, err := config.New()
@@ -27,5 +57,28 @@ func GetConfig() (*Config, error) {
 
 	cfg := &Config{Config: *common}
 
-	return cfg, env.Parse(cfg)
+	err = env.Parse(cfg)
+	if err != nil {
+		return cfg, err
+	}
+
+	switch cfg.KeyProvider {
+	case KeyProviderVault:
+		if cfg.VaultAddr == "" || cfg.VaultToken == "" {
+			return cfg, fmt.Errorf("VAULT_ADDR and VAULT_TOKEN are required for %s key provider", KeyProviderVault)
+		}
+	case KeyProviderStatic, KeyProviderLocal:
+	default:
+		return cfg, fmt.Errorf("invalid key provider '%s'", cfg.KeyProvider)
+	}
+
+	if cfg.RetentionInterval <= 0 {
+		return cfg, fmt.Errorf("RETENTION_INTERVAL must be positive")
+	}
+
+	if cfg.SyncMaxDecodedSize <= 0 {
+		return cfg, fmt.Errorf("SYNC_MAX_DECODED_SIZE must be positive")
+	}
+
+	return cfg, nil
 }
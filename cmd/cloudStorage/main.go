@@ -15,6 +15,8 @@ import (
 
 	loads "github.com/go-openapi/loads"
 	flags "github.com/jessevdk/go-flags"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/cors"
 	"github.com/rs/zerolog"
 
@@ -26,6 +28,7 @@ import (
 	"github.com/iryonetwork/wwm/service/authorizer"
 	storage "github.com/iryonetwork/wwm/service/storage"
 	statusServer "github.com/iryonetwork/wwm/status/server"
+	"github.com/iryonetwork/wwm/storage/keyvalue"
 	"github.com/iryonetwork/wwm/storage/s3"
 	"github.com/iryonetwork/wwm/sync/storage/publisher"
 	"github.com/iryonetwork/wwm/utils"
@@ -54,12 +57,29 @@ func main() {
 		return
 	}
 
-	// initialize keyProvider
+	// decode storage encryption key
 	key, err := base64.StdEncoding.DecodeString(cfg.StorageEncryptionKey)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("failed to decode storage encryption key")
 	}
-	keys := keyProvider.New(string(key))
+
+	// initialize metadata index
+	index, err := keyvalue.NewBolt(ctx, cfg.MetadataIndexFilepath, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize metadata index")
+	}
+
+	// initialize keyProvider
+	keys, err := newKeyProvider(ctx, cfg, string(key), index, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize key provider")
+	}
+
+	// Register metrics
+	for _, metric := range index.GetPrometheusMetricsCollection() {
+		prometheus.MustRegister(metric)
+		defer prometheus.Unregister(metric)
+	}
 
 	// initialize storage
 	s3cfg := &s3.Config{
@@ -69,13 +89,41 @@ func main() {
 		Secure:       true,
 		Region:       cfg.S3Region,
 	}
-	s3, err := s3.New(s3cfg, keys, logger)
+	s3, err := s3.New(s3cfg, keys, index, logger)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
+	// load schemas documents are validated against if configured
+	var archetypes *storage.ArchetypeRegistry
+	if cfg.ArchetypeSchemasDir != "" {
+		archetypes, err = storage.LoadArchetypeRegistry(cfg.ArchetypeSchemasDir, storage.ValidationMode(cfg.ArchetypeValidation))
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to load archetype schemas")
+		}
+	}
+
+	// archives are signed with the certificate of the service
+	signer, err := storage.NewArchiveSigner(cfg.CertPath, cfg.KeyPath, cfg.ArchiveCAPath)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize archive signer")
+	}
+
 	// initialize the service
-	service := storage.New(s3, keys, publisher.NewNullPublisher(ctx), logger)
+	service := storage.New(s3, keys, publisher.NewNullPublisher(ctx), storage.Options{
+		Archetypes:     archetypes,
+		Signer:         signer,
+		MaxDecodedSize: cfg.SyncMaxDecodedSize,
+	}, logger)
+
+	// apply retention policy periodically if configured
+	if cfg.RetentionPolicyFilepath != "" {
+		policy, err := storage.LoadRetentionPolicy(cfg.RetentionPolicyFilepath)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to load retention policy")
+		}
+		go storage.RunRetention(ctx, service, policy, cfg.RetentionInterval, logger.With().Str("component", "retention").Logger())
+	}
 
 	// initialize authorizer
 	auth := authorizer.New(cfg.DomainType, cfg.DomainID, fmt.Sprintf("https://%s/%s/validate", cfg.AuthHost, cfg.AuthPath), logger.With().Str("component", "service/authorizer").Logger())
@@ -97,16 +145,26 @@ func main() {
 	api.Logger = serverLogger.Msgf
 	api.TokenAuth = auth.GetPrincipalFromToken
 	api.APIAuthorizer = auth.Authorizer()
+	api.BucketNewHandler = storageHandlers.BucketNew()
+	api.BucketGetHandler = storageHandlers.BucketGet()
+	api.BucketArchiveHandler = storageHandlers.BucketArchive()
+	api.BucketDeleteHandler = storageHandlers.BucketDelete()
+	api.BucketExportHandler = storageHandlers.BucketExport()
+	api.BucketImportHandler = storageHandlers.BucketImport()
 	api.FileListHandler = storageHandlers.FileList()
+	api.FileSearchHandler = storageHandlers.FileSearch()
 	api.FileGetHandler = storageHandlers.FileGet()
 	api.FileGetVersionHandler = storageHandlers.FileGetVersion()
 	api.FileListVersionsHandler = storageHandlers.FileListVersions()
 	api.FileNewHandler = storageHandlers.FileNew()
 	api.FileUpdateHandler = storageHandlers.FileUpdate()
 	api.FileDeleteHandler = storageHandlers.FileDelete()
+	api.SyncFileGetHandler = storageHandlers.SyncFileGet()
 	api.SyncFileMetadataHandler = storageHandlers.SyncFileMetadata()
+	api.SyncFileSignatureHandler = storageHandlers.SyncFileSignature()
 	api.SyncFileHandler = storageHandlers.SyncFile()
 	api.SyncFileDeleteHandler = storageHandlers.SyncFileDelete()
+	api.SyncFilePurgeHandler = storageHandlers.SyncFilePurge()
 	api.SyncBucketListHandler = storageHandlers.SyncBucketList()
 	api.SyncFileListHandler = storageHandlers.SyncFileList()
 	api.SyncFileListVersionsHandler = storageHandlers.SyncFileListVersions()
@@ -115,7 +173,7 @@ func main() {
 
 	// initialize metrics middleware
 	m := APIMetrics.NewMetrics("api", "").
-		WithURLSanitize(utils.WhitelistURLSanitize([]string{"storage", "versions", "sync"}))
+		WithURLSanitize(utils.WhitelistURLSanitize([]string{"storage", "versions", "sync", "buckets", "archive", "export", "import", "purge", "search", "signature"}))
 
 	// set API handler with middlewares
 	handler := cors.New(cors.Options{
@@ -198,3 +256,53 @@ func (w *WildcardConsumer) Consume(r io.Reader, in interface{}) error {
 	fmt.Println("WildcardConsumer::Consume", err, in, b)
 	return nil
 }
+
+// newKeyProvider initializes key provider selected in the config
+func newKeyProvider(ctx context.Context, cfg *Config, key string, index keyProvider.Storage, logger zerolog.Logger) (s3.KeyProvider, error) {
+	var wrapper keyProvider.Wrapper
+	switch cfg.KeyProvider {
+	case KeyProviderLocal:
+		w, err := keyProvider.NewLocalWrapper(key)
+		if err != nil {
+			return nil, err
+		}
+		wrapper = w
+	case KeyProviderVault:
+		wrapper = keyProvider.NewVaultWrapper(&keyProvider.VaultConfig{
+			Address: cfg.VaultAddr,
+			Token:   cfg.VaultToken,
+			Mount:   cfg.VaultTransitMount,
+			Key:     cfg.VaultTransitKey,
+		}, logger)
+	default:
+		return keyProvider.New(key), nil
+	}
+
+	storage, err := newKeyStorage(ctx, cfg, index, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return keyProvider.NewBucketKeys(key, storage, wrapper, logger), nil
+}
+
+// newKeyStorage initializes storage of wrapped bucket keys kept apart from the
+// metadata index; keys stored in the index by earlier versions are moved on
+// first use
+func newKeyStorage(ctx context.Context, cfg *Config, index keyProvider.Storage, logger zerolog.Logger) (keyProvider.Storage, error) {
+	keys, err := keyvalue.NewBolt(ctx, cfg.KeysFilepath, logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize key storage")
+	}
+	storage := keyProvider.NewMigratedStorage(keys, index, logger)
+
+	if cfg.KeysBackupFilepath == "" {
+		return storage, nil
+	}
+	backup, err := keyvalue.NewBolt(ctx, cfg.KeysBackupFilepath, logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize key storage backup")
+	}
+
+	return keyProvider.NewBackedUpStorage(storage, backup, logger), nil
+}
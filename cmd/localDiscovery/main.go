@@ -100,6 +100,7 @@ func main() {
 	api.FetchHandler = discoveryHandlers.Fetch()
 	api.LinkHandler = discoveryHandlers.ProxyLink()
 	api.UnlinkHandler = discoveryHandlers.ProxyUnlink()
+	api.LinkedPatientsHandler = discoveryHandlers.ProxyLinkedPatients()
 	api.CodesGetHandler = discoveryHandlers.CodesGet()
 	api.CodeGetHandler = discoveryHandlers.CodeGet()
 
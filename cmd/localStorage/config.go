@@ -1,34 +1,92 @@
 package main
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/caarlos0/env"
 
 	"github.com/iryonetwork/wwm/config"
+	"github.com/iryonetwork/wwm/sync/storage/bus"
 )
 
 // Config represents configuration of localStorage
 type Config struct {
 	config.Config
 
+	StorageBackend string `env:"STORAGE_BACKEND" envDefault:"s3"`
+	FilesystemRoot string `env:"FILESYSTEM_ROOT" envDefault:"/data/storage"`
+
+	MetadataIndexFilepath string        `env:"METADATA_INDEX_FILEPATH" envDefault:"/data/localStorageIndex.db"`
+	UploadsDir            string        `env:"UPLOADS_DIR" envDefault:"/data/uploads"`
+	UploadTTL             time.Duration `env:"UPLOAD_TTL" envDefault:"168h"`
+	UploadSweepInterval   time.Duration `env:"UPLOAD_SWEEP_INTERVAL" envDefault:"1h"`
+
 	S3Endpoint  string `env:"S3_ENDPOINT" envDefault:"localMinio:9000"`
 	S3AccessKey string `env:"S3_ACCESS_KEY" envDefault:"local"`
 	S3Region    string `env:"S3_REGION" envDefault:"us-east-1"`
-	S3Secret    string `env:"S3_SECRET,required"`
+	S3Secret    string `env:"S3_SECRET"`
 
 	StorageEncryptionKey string `env:"STORAGE_ENCRYPTION_KEY,required"`
 
+	KeyProvider        string `env:"KEY_PROVIDER" envDefault:"static"`
+	KeysFilepath       string `env:"KEYS_FILEPATH" envDefault:"/data/localStorageKeys.db"`
+	KeysBackupFilepath string `env:"KEYS_BACKUP_FILEPATH"`
+	VaultAddr          string `env:"VAULT_ADDR"`
+	VaultToken         string `env:"VAULT_TOKEN"`
+	VaultTransitMount  string `env:"VAULT_TRANSIT_MOUNT" envDefault:"transit"`
+	VaultTransitKey    string `env:"VAULT_TRANSIT_KEY" envDefault:"storage"`
+
+	RetentionPolicyFilepath string        `env:"RETENTION_POLICY_FILEPATH"`
+	RetentionInterval       time.Duration `env:"RETENTION_INTERVAL" envDefault:"24h"`
+
+	QuotaBucketBytes  int64   `env:"QUOTA_BUCKET_BYTES" envDefault:"0"`
+	QuotaBucketFiles  int64   `env:"QUOTA_BUCKET_FILES" envDefault:"0"`
+	QuotaTotalBytes   int64   `env:"QUOTA_TOTAL_BYTES" envDefault:"0"`
+	QuotaTotalFiles   int64   `env:"QUOTA_TOTAL_FILES" envDefault:"0"`
+	QuotaWarningRatio float64 `env:"QUOTA_WARNING_RATIO" envDefault:"0.9"`
+
+	ArchetypeSchemasDir string `env:"ARCHETYPE_SCHEMAS_DIR"`
+	ArchetypeValidation string `env:"ARCHETYPE_VALIDATION" envDefault:"reject"`
+
+	ArchiveCAPath string `env:"ARCHIVE_CA_PATH"`
+
+	SyncMaxDecodedSize int64 `env:"SYNC_MAX_DECODED_SIZE" envDefault:"1073741824"`
+
+	ScrubInterval    time.Duration `env:"SCRUB_INTERVAL" envDefault:"168h"`
+	ScrubRefetch     bool          `env:"SCRUB_REFETCH" envDefault:"false"`
+	CloudStorageHost string        `env:"CLOUD_STORAGE_HOST" envDefault:"cloudStorage"`
+	CloudStoragePath string        `env:"CLOUD_STORAGE_PATH" envDefault:"storage"`
+
+	EventBus             string        `env:"EVENT_BUS" envDefault:"stan"`
+	EventBusPath         string        `env:"EVENT_BUS_PATH" envDefault:"/data/events.db"`
+	EventBusPollInterval time.Duration `env:"EVENT_BUS_POLL_INTERVAL" envDefault:"1s"`
+	OutboxPath           string        `env:"OUTBOX_PATH" envDefault:"/data/outbox.db"`
+	ChangeLogPath        string        `env:"CHANGE_LOG_PATH" envDefault:"/data/changes.db"`
+
 	NatsAddr           string        `env:"NATS_ADDR" envDefault:"localNats:4242"`
 	NatsClusterID      string        `env:"NATS_CLUSTER_ID" envDefault:"localNats"`
 	NatsClientID       string        `env:"NATS_CLIENT_ID" envDefault:"localStorage"`
 	NatsUsername       string        `env:"NATS_USERNAME" envDefault:"nats"`
-	NatsSecret         string        `env:"NATS_SECRET,required"`
+	NatsSecret         string        `env:"NATS_SECRET"`
 	NatsConnRetries    int           `env:"NATS_CONN_RETRIES" envDefault:"5"`
 	NatsConnWait       time.Duration `env:"NATS_CONN_WAIT" envDefault:"500ms"`
 	NatsConnWaitFactor float32       `env:"NATS_CONN_WAIT_FACTOR" envDefault:"3.0"`
 }
 
+// Storage backends
+const (
+	BackendS3         = "s3"
+	BackendFilesystem = "filesystem"
+)
+
+// Key providers
+const (
+	KeyProviderStatic = "static"
+	KeyProviderLocal  = "local"
+	KeyProviderVault  = "vault"
+)
+
 // GetConfig parses environment variables and returns pointer to config and error
 func GetConfig() (*Config, error) {
 	common, err := config.New()
@@ -38,5 +96,63 @@ func GetConfig() (*Config, error) {
 
 	cfg := &Config{Config: *common}
 
-	return cfg, env.Parse(cfg)
+	err = env.Parse(cfg)
+	if err != nil {
+		return cfg, err
+	}
+
+	switch cfg.StorageBackend {
+	case BackendS3:
+		if cfg.S3Secret == "" {
+			return cfg, fmt.Errorf("S3_SECRET is required for %s storage backend", BackendS3)
+		}
+	case BackendFilesystem:
+	default:
+		return cfg, fmt.Errorf("invalid storage backend '%s'", cfg.StorageBackend)
+	}
+
+	switch cfg.KeyProvider {
+	case KeyProviderVault:
+		if cfg.VaultAddr == "" || cfg.VaultToken == "" {
+			return cfg, fmt.Errorf("VAULT_ADDR and VAULT_TOKEN are required for %s key provider", KeyProviderVault)
+		}
+	case KeyProviderStatic, KeyProviderLocal:
+	default:
+		return cfg, fmt.Errorf("invalid key provider '%s'", cfg.KeyProvider)
+	}
+
+	if cfg.RetentionInterval <= 0 {
+		return cfg, fmt.Errorf("RETENTION_INTERVAL must be positive")
+	}
+
+	if cfg.SyncMaxDecodedSize <= 0 {
+		return cfg, fmt.Errorf("SYNC_MAX_DECODED_SIZE must be positive")
+	}
+
+	if cfg.UploadsDir != "" && (cfg.UploadTTL <= 0 || cfg.UploadSweepInterval <= 0) {
+		return cfg, fmt.Errorf("UPLOAD_TTL and UPLOAD_SWEEP_INTERVAL must be positive")
+	}
+
+	if cfg.ScrubInterval < 0 {
+		return cfg, fmt.Errorf("SCRUB_INTERVAL can not be negative")
+	}
+
+	if cfg.QuotaBucketBytes < 0 || cfg.QuotaBucketFiles < 0 || cfg.QuotaTotalBytes < 0 || cfg.QuotaTotalFiles < 0 {
+		return cfg, fmt.Errorf("quotas can not be negative")
+	}
+
+	switch cfg.EventBus {
+	case bus.TransportStan:
+		if cfg.NatsSecret == "" {
+			return cfg, fmt.Errorf("NATS_SECRET is required for %s event bus", cfg.EventBus)
+		}
+	case bus.TransportBolt:
+		if cfg.EventBusPollInterval <= 0 {
+			return cfg, fmt.Errorf("EVENT_BUS_POLL_INTERVAL must be positive")
+		}
+	default:
+		return cfg, fmt.Errorf("invalid event bus '%s'", cfg.EventBus)
+	}
+
+	return cfg, nil
 }
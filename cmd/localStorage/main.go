@@ -15,13 +15,15 @@ import (
 	"time"
 
 	loads "github.com/go-openapi/loads"
+	runtimeClient "github.com/go-openapi/runtime/client"
+	"github.com/go-openapi/strfmt"
 	flags "github.com/jessevdk/go-flags"
-	"github.com/nats-io/go-nats"
-	"github.com/nats-io/go-nats-streaming"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/cors"
 	"github.com/rs/zerolog"
 
+	"github.com/iryonetwork/wwm/gen/storage/client"
 	"github.com/iryonetwork/wwm/gen/storage/restapi"
 	"github.com/iryonetwork/wwm/gen/storage/restapi/operations"
 	logMW "github.com/iryonetwork/wwm/log"
@@ -30,8 +32,10 @@ import (
 	"github.com/iryonetwork/wwm/service/authorizer"
 	storage "github.com/iryonetwork/wwm/service/storage"
 	statusServer "github.com/iryonetwork/wwm/status/server"
+	"github.com/iryonetwork/wwm/storage/keyvalue"
 	"github.com/iryonetwork/wwm/storage/s3"
 	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	"github.com/iryonetwork/wwm/sync/storage/bus"
 	"github.com/iryonetwork/wwm/sync/storage/publisher"
 	"github.com/iryonetwork/wwm/utils"
 	"github.com/iryonetwork/wwm/utils/keyProvider"
@@ -60,80 +64,153 @@ func main() {
 		return
 	}
 
-	// initialize keyProvider
+	// decode storage encryption key
 	key, err := base64.StdEncoding.DecodeString(cfg.StorageEncryptionKey)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("failed to decode storage encryption key")
 	}
-	keys := keyProvider.New(string(key))
 
-	// initialize storage
-	s3cfg := &s3.Config{
-		Endpoint:     cfg.S3Endpoint,
-		AccessKey:    cfg.S3AccessKey,
-		AccessSecret: cfg.S3Secret,
-		Secure:       true,
-		Region:       cfg.S3Region,
+	// initialize metadata index
+	index, err := keyvalue.NewBolt(ctx, cfg.MetadataIndexFilepath, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize metadata index")
 	}
-	s3, err := s3.New(s3cfg, keys, logger)
+
+	// initialize keyProvider
+	keys, err := newKeyProvider(ctx, cfg, string(key), index, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize key provider")
+	}
+
+	// Register metrics
+	for _, metric := range index.GetPrometheusMetricsCollection() {
+		prometheus.MustRegister(metric)
+		defer prometheus.Unregister(metric)
+	}
+
+	// initialize storage
+	s3, err := newStorage(cfg, keys, index, logger)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
 	// initialize storageSync publisher
-	// create nats/nats-streaming connection
-	URLs := fmt.Sprintf("tls://%s:%s@%s", cfg.NatsUsername, cfg.NatsSecret, cfg.NatsAddr)
-	ClusterID := cfg.NatsClusterID
-	ClientID := cfg.NatsClientID
-	ClientCert := cfg.CertPath
-	ClientKey := cfg.KeyPath
-	var nc *nats.Conn
-	var sc publisher.StanConnection
 	var p storageSync.Publisher
-
-	// Connect to NATS
-	// retry connectng to nats if unsuccesful
-	err = utils.Retry(cfg.NatsConnRetries, cfg.NatsConnWait, cfg.NatsConnWaitFactor, logger.With().Str("connect", "nats").Logger(), func() error {
-		var err error
-		nc, err = nats.Connect(URLs, nats.ClientCert(ClientCert, ClientKey))
-		return err
-	})
-
-	// Connect to NATS-Streaming if NATS connection succesful
-	if err == nil {
-		// retry connecting to nats-straming if unsuccesful
-		err = utils.Retry(cfg.NatsConnRetries, cfg.NatsConnWait, cfg.NatsConnWaitFactor, logger.With().Str("connect", "nats-streaming").Logger(), func() error {
-			var err error
-			sc, err = stan.Connect(ClusterID, ClientID, stan.NatsConn(nc))
-			return err
-		})
-	}
-
-	// Initialize publisher
-	if err != nil {
-		// if connection to nats-streaming was unsuccesful use null publisher
-		p = publisher.NewNullPublisher(context.Background())
-		logger.Error().Msg("storage service will be started with null storage sync publisher due to failed nats-streaming connection attempts")
-	} else {
-		// if connection to nats-streaming was succesful use nats-streaming publisher
-		cfg := publisher.Cfg{
-			Connection:      sc,
-			Retries:         5,
+	if cfg.OutboxPath != "" {
+		// events are kept in the outbox until the event bus is reachable
+		outbox, err := publisher.OpenOutbox(cfg.OutboxPath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		pCfg := publisher.Cfg{
+			Connect: func() (publisher.Connection, error) {
+				return bus.Connect(busConfig(cfg), logger)
+			},
+			Outbox:          outbox,
 			StartRetryWait:  time.Duration(10 * time.Second),
 			RetryWaitFactor: 2.0,
 		}
-		p = publisher.New(context.Background(), cfg, logger)
-		// Register metrics
-		m := p.GetPrometheusMetricsCollection()
-		for _, metric := range m {
-			prometheus.MustRegister(metric)
-			defer prometheus.Unregister(metric)
+		p = publisher.New(context.Background(), pCfg, logger)
+	} else {
+		// connect to the event bus
+		b, err := bus.Connect(busConfig(cfg), logger)
+		if err != nil {
+			// if connection to the event bus was unsuccesful use null publisher
+			p = publisher.NewNullPublisher(context.Background())
+			logger.Error().Err(err).Msg("storage service will be started with null storage sync publisher due to failed event bus connection attempts")
+		} else {
+			// if connection to the event bus was succesful use event bus publisher
+			pCfg := publisher.Cfg{
+				Connection:      b,
+				Retries:         5,
+				StartRetryWait:  time.Duration(10 * time.Second),
+				RetryWaitFactor: 2.0,
+			}
+			p = publisher.New(context.Background(), pCfg, logger)
 		}
 	}
+	// Register metrics
+	for _, metric := range p.GetPrometheusMetricsCollection() {
+		prometheus.MustRegister(metric)
+		defer prometheus.Unregister(metric)
+	}
 	defer p.Close()
 
+	// initialize quota; usage of the storage is calculated in the background
+	quota := storage.NewQuota(s3, storage.QuotaLimits{
+		BucketBytes:  cfg.QuotaBucketBytes,
+		BucketFiles:  cfg.QuotaBucketFiles,
+		TotalBytes:   cfg.QuotaTotalBytes,
+		TotalFiles:   cfg.QuotaTotalFiles,
+		WarningRatio: cfg.QuotaWarningRatio,
+	}, logger)
+	for _, metric := range quota.GetPrometheusMetricsCollection() {
+		prometheus.MustRegister(metric)
+		defer prometheus.Unregister(metric)
+	}
+	go quota.Load(ctx)
+
+	// load schemas documents are validated against if configured
+	var archetypes *storage.ArchetypeRegistry
+	if cfg.ArchetypeSchemasDir != "" {
+		archetypes, err = storage.LoadArchetypeRegistry(cfg.ArchetypeSchemasDir, storage.ValidationMode(cfg.ArchetypeValidation))
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to load archetype schemas")
+		}
+	}
+
+	// archives are signed with the certificate of the service
+	signer, err := storage.NewArchiveSigner(cfg.CertPath, cfg.KeyPath, cfg.ArchiveCAPath)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize archive signer")
+	}
+
+	// record writes in the change log used by batch sync if configured
+	var changes *storage.ChangeLog
+	if cfg.ChangeLogPath != "" {
+		changes, err = storage.OpenChangeLog(cfg.ChangeLogPath)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to open change log")
+		}
+		defer changes.Close()
+	}
+
 	// initialize the servicex
-	service := storage.New(s3, keys, p, logger)
+	service := storage.New(s3, keys, p, storage.Options{
+		UploadsDir:     cfg.UploadsDir,
+		Quota:          quota,
+		Archetypes:     archetypes,
+		Signer:         signer,
+		Changes:        changes,
+		MaxDecodedSize: cfg.SyncMaxDecodedSize,
+	}, logger)
+
+	// remove stale upload sessions periodically
+	if cfg.UploadsDir != "" {
+		go storage.RunUploadSweep(ctx, service, cfg.UploadTTL, cfg.UploadSweepInterval, logger.With().Str("component", "uploads").Logger())
+	}
+
+	// apply retention policy periodically if configured
+	if cfg.RetentionPolicyFilepath != "" {
+		policy, err := storage.LoadRetentionPolicy(cfg.RetentionPolicyFilepath)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to load retention policy")
+		}
+		go storage.RunRetention(ctx, service, policy, cfg.RetentionInterval, logger.With().Str("component", "retention").Logger())
+	}
+
+	// scrub stored files periodically if enabled
+	scrubber, err := newScrubber(cfg, s3, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize scrubber")
+	}
+	for _, metric := range scrubber.GetPrometheusMetricsCollection() {
+		prometheus.MustRegister(metric)
+		defer prometheus.Unregister(metric)
+	}
+	if cfg.ScrubInterval > 0 {
+		go scrubber.Run(ctx, cfg.ScrubInterval)
+	}
 
 	// initialize authorizer
 	auth := authorizer.New(cfg.DomainType, cfg.DomainID, fmt.Sprintf("https://%s/%s/validate", cfg.AuthHost, cfg.AuthPath), logger.With().Str("component", "service/authorizer").Logger())
@@ -155,14 +232,34 @@ func main() {
 	api.Logger = serverLogger.Msgf
 	api.TokenAuth = auth.GetPrincipalFromToken
 	api.APIAuthorizer = auth.Authorizer()
+	api.BucketNewHandler = storageHandlers.BucketNew()
+	api.BucketGetHandler = storageHandlers.BucketGet()
+	api.BucketArchiveHandler = storageHandlers.BucketArchive()
+	api.BucketDeleteHandler = storageHandlers.BucketDelete()
+	api.BucketExportHandler = storageHandlers.BucketExport()
+	api.BucketImportHandler = storageHandlers.BucketImport()
 	api.FileListHandler = storageHandlers.FileList()
+	api.FileSearchHandler = storageHandlers.FileSearch()
 	api.FileGetHandler = storageHandlers.FileGet()
 	api.FileGetVersionHandler = storageHandlers.FileGetVersion()
 	api.FileListVersionsHandler = storageHandlers.FileListVersions()
 	api.FileNewHandler = storageHandlers.FileNew()
 	api.FileUpdateHandler = storageHandlers.FileUpdate()
 	api.FileDeleteHandler = storageHandlers.FileDelete()
+	api.UploadNewHandler = storageHandlers.UploadNew()
+	api.UploadGetHandler = storageHandlers.UploadGet()
+	api.UploadChunkHandler = storageHandlers.UploadChunk()
+	api.UploadCommitHandler = storageHandlers.UploadCommit()
+	api.UploadDeleteHandler = storageHandlers.UploadDelete()
+	// sync writes are used by batchStorageSync pulling files from cloud storage
+	api.SyncFileGetHandler = storageHandlers.SyncFileGet()
+	api.SyncFileMetadataHandler = storageHandlers.SyncFileMetadata()
+	api.SyncFileSignatureHandler = storageHandlers.SyncFileSignature()
+	api.SyncFileHandler = storageHandlers.SyncFile()
+	api.SyncFileDeleteHandler = storageHandlers.SyncFileDelete()
+	api.SyncFilePurgeHandler = storageHandlers.SyncFilePurge()
 	api.SyncBucketListHandler = storageHandlers.SyncBucketList()
+	api.SyncChangeListHandler = storageHandlers.SyncChangeList()
 	api.SyncFileListHandler = storageHandlers.SyncFileList()
 	api.SyncFileListVersionsHandler = storageHandlers.SyncFileListVersions()
 
@@ -170,7 +267,7 @@ func main() {
 
 	// initialize metrics middleware
 	m := APIMetrics.NewMetrics("api", "").
-		WithURLSanitize(utils.WhitelistURLSanitize([]string{"storage", "versions", "sync"}))
+		WithURLSanitize(utils.WhitelistURLSanitize([]string{"storage", "versions", "sync", "buckets", "archive", "export", "import", "search", "uploads", "commit", "purge", "changes", "signature"}))
 
 	// set API handler with middlewares
 	handler := cors.New(cors.Options{
@@ -193,6 +290,8 @@ func main() {
 	// start serving status
 	go func() {
 		ss := statusServer.New(logger)
+		ss.AddComponent("quota", quota)
+		ss.AddComponent("scrubber", scrubber)
 		exitCh <- ss.ListenAndServeHTTPs(ctx, fmt.Sprintf("%s:%d", cfg.ServerHost, cfg.StatusPort), cfg.StatusNamespace, cfg.CertPath, cfg.KeyPath)
 	}()
 	// start serving API
@@ -246,6 +345,63 @@ func main() {
 	}
 }
 
+// newScrubber returns scrubber re-fetching corrupted files from cloud storage
+// if enabled
+func newScrubber(cfg *Config, s s3.Storage, logger zerolog.Logger) (*storage.Scrubber, error) {
+	if !cfg.ScrubRefetch {
+		return storage.NewScrubber(s, nil, logger), nil
+	}
+
+	cloud := runtimeClient.New(cfg.CloudStorageHost, cfg.CloudStoragePath, []string{"https"})
+	cloud.Consumers = utils.ConsumersForSync()
+	cloudClient := client.New(cloud, strfmt.Default)
+
+	auth, err := storageSync.NewRequestAuthenticator(cfg.CertPath, cfg.KeyPath, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// only destination of the handlers is used to fetch files
+	handlers := storageSync.NewHandlers(nil, nil, cloudClient.Operations, auth, storageSync.Options{}, logger)
+
+	return storage.NewScrubber(s, handlers, logger), nil
+}
+
+// newStorage initializes storage backend selected in the config
+func newStorage(cfg *Config, keys s3.KeyProvider, index s3.MetadataIndex, logger zerolog.Logger) (s3.Storage, error) {
+	if cfg.StorageBackend == BackendFilesystem {
+		return s3.NewFilesystem(&s3.FilesystemConfig{Root: cfg.FilesystemRoot}, keys, index, logger)
+	}
+
+	s3cfg := &s3.Config{
+		Endpoint:     cfg.S3Endpoint,
+		AccessKey:    cfg.S3AccessKey,
+		AccessSecret: cfg.S3Secret,
+		Secure:       true,
+		Region:       cfg.S3Region,
+	}
+	return s3.New(s3cfg, keys, index, logger)
+}
+
+// busConfig returns configuration of the connection to the event bus
+func busConfig(cfg *Config) bus.Cfg {
+	return bus.Cfg{
+		Transport:        cfg.EventBus,
+		NatsAddr:         cfg.NatsAddr,
+		NatsUsername:     cfg.NatsUsername,
+		NatsSecret:       cfg.NatsSecret,
+		NatsClusterID:    cfg.NatsClusterID,
+		NatsClientID:     cfg.NatsClientID,
+		CertPath:         cfg.CertPath,
+		KeyPath:          cfg.KeyPath,
+		BoltPath:         cfg.EventBusPath,
+		BoltPollInterval: cfg.EventBusPollInterval,
+		ConnRetries:      cfg.NatsConnRetries,
+		ConnWait:         cfg.NatsConnWait,
+		ConnWaitFactor:   cfg.NatsConnWaitFactor,
+	}
+}
+
 type WildcardConsumer struct{}
 
 func (w *WildcardConsumer) Consume(r io.Reader, in interface{}) error {
@@ -253,3 +409,53 @@ func (w *WildcardConsumer) Consume(r io.Reader, in interface{}) error {
 	fmt.Println("WildcardConsumer::Consume", err, in, b)
 	return nil
 }
+
+// newKeyProvider initializes key provider selected in the config
+func newKeyProvider(ctx context.Context, cfg *Config, key string, index keyProvider.Storage, logger zerolog.Logger) (s3.KeyProvider, error) {
+	var wrapper keyProvider.Wrapper
+	switch cfg.KeyProvider {
+	case KeyProviderLocal:
+		w, err := keyProvider.NewLocalWrapper(key)
+		if err != nil {
+			return nil, err
+		}
+		wrapper = w
+	case KeyProviderVault:
+		wrapper = keyProvider.NewVaultWrapper(&keyProvider.VaultConfig{
+			Address: cfg.VaultAddr,
+			Token:   cfg.VaultToken,
+			Mount:   cfg.VaultTransitMount,
+			Key:     cfg.VaultTransitKey,
+		}, logger)
+	default:
+		return keyProvider.New(key), nil
+	}
+
+	storage, err := newKeyStorage(ctx, cfg, index, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return keyProvider.NewBucketKeys(key, storage, wrapper, logger), nil
+}
+
+// newKeyStorage initializes storage of wrapped bucket keys kept apart from the
+// metadata index; keys stored in the index by earlier versions are moved on
+// first use
+func newKeyStorage(ctx context.Context, cfg *Config, index keyProvider.Storage, logger zerolog.Logger) (keyProvider.Storage, error) {
+	keys, err := keyvalue.NewBolt(ctx, cfg.KeysFilepath, logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize key storage")
+	}
+	storage := keyProvider.NewMigratedStorage(keys, index, logger)
+
+	if cfg.KeysBackupFilepath == "" {
+		return storage, nil
+	}
+	backup, err := keyvalue.NewBolt(ctx, cfg.KeysBackupFilepath, logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize key storage backup")
+	}
+
+	return keyProvider.NewBackedUpStorage(storage, backup, logger), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/caarlos0/env"
+)
+
+// Config represents configuration of storageMigrate
+type Config struct {
+	StorageBackend string `env:"STORAGE_BACKEND" envDefault:"s3"`
+	FilesystemRoot string `env:"FILESYSTEM_ROOT" envDefault:"/data/storage"`
+
+	MetadataIndexFilepath string `env:"METADATA_INDEX_FILEPATH" envDefault:"/data/localStorageIndex.db"`
+
+	S3Endpoint  string `env:"S3_ENDPOINT" envDefault:"localMinio:9000"`
+	S3AccessKey string `env:"S3_ACCESS_KEY" envDefault:"local"`
+	S3Region    string `env:"S3_REGION" envDefault:"us-east-1"`
+	S3Secret    string `env:"S3_SECRET"`
+
+	StorageEncryptionKey string `env:"STORAGE_ENCRYPTION_KEY,required"`
+
+	KeyProvider       string `env:"KEY_PROVIDER" envDefault:"static"`
+	VaultAddr         string `env:"VAULT_ADDR"`
+	VaultToken        string `env:"VAULT_TOKEN"`
+	VaultTransitMount string `env:"VAULT_TRANSIT_MOUNT" envDefault:"transit"`
+	VaultTransitKey   string `env:"VAULT_TRANSIT_KEY" envDefault:"storage"`
+}
+
+// Storage backends
+const (
+	BackendS3         = "s3"
+	BackendFilesystem = "filesystem"
+)
+
+// Key providers
+const (
+	KeyProviderStatic = "static"
+	KeyProviderLocal  = "local"
+	KeyProviderVault  = "vault"
+)
+
+// GetConfig parses environment variables and returns pointer to config and error
+func GetConfig() (*Config, error) {
+	cfg := &Config{}
+
+	err := env.Parse(cfg)
+	if err != nil {
+		return cfg, err
+	}
+
+	switch cfg.StorageBackend {
+	case BackendS3:
+		if cfg.S3Secret == "" {
+			return cfg, fmt.Errorf("S3_SECRET is required for %s storage backend", BackendS3)
+		}
+	case BackendFilesystem:
+	default:
+		return cfg, fmt.Errorf("invalid storage backend '%s'", cfg.StorageBackend)
+	}
+
+	switch cfg.KeyProvider {
+	case KeyProviderVault:
+		if cfg.VaultAddr == "" || cfg.VaultToken == "" {
+			return cfg, fmt.Errorf("VAULT_ADDR and VAULT_TOKEN are required for %s key provider", KeyProviderVault)
+		}
+	case KeyProviderStatic, KeyProviderLocal:
+	default:
+		return cfg, fmt.Errorf("invalid key provider '%s'", cfg.KeyProvider)
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/storage/keyvalue"
+	"github.com/iryonetwork/wwm/storage/s3"
+	"github.com/iryonetwork/wwm/utils/keyProvider"
+)
+
+func main() {
+	// initialize logger
+	logger := zerolog.New(os.Stdout).With().
+		Timestamp().
+		Str("service", "storageRotateKeys").
+		Logger()
+
+	// Create context with cancel func
+	ctx, cancelContext := context.WithCancel(context.Background())
+	defer cancelContext()
+
+	// get config
+	cfg, err := GetConfig()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to get config")
+	}
+
+	// decode storage encryption key
+	key, err := base64.StdEncoding.DecodeString(cfg.StorageEncryptionKey)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to decode storage encryption key")
+	}
+
+	// initialize metadata index; storage service has to be stopped as bolt
+	// allows only a single process to open the file
+	index, err := keyvalue.NewBolt(ctx, cfg.MetadataIndexFilepath, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize metadata index")
+	}
+
+	// initialize keyProvider; versioned bucket keys are kept in the metadata index
+	keys, err := newKeyProvider(cfg, string(key), index, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize key provider")
+	}
+
+	// initialize storage
+	storage, err := newStorage(cfg, keys, index, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize storage")
+	}
+	rekeyer, ok := storage.(s3.Rekeyer)
+	if !ok {
+		logger.Fatal().Msg("storage backend does not support key rotation")
+	}
+	ring, ok := keys.(rotator)
+	if !ok {
+		logger.Fatal().Msg("key provider does not support key rotation")
+	}
+
+	// Run rotation
+	exitCh := make(chan error)
+	go func() {
+		exitCh <- rotate(ctx, cfg.Buckets, storage, rekeyer, ring, logger)
+	}()
+
+	// Run cleanup when sigint or sigterm is received
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case err := <-exitCh:
+		if err != nil {
+			logger.Error().Err(err).Msg("key rotation failed")
+		} else {
+			logger.Info().Msg("key rotation successful")
+		}
+	case <-signalChan:
+		logger.Info().Msg("stopping key rotation due to interrupt")
+		cancelContext()
+		<-exitCh
+	}
+}
+
+// rotator creates new versions of bucket keys
+type rotator interface {
+	Rotate(bucketID string) (string, error)
+}
+
+// rotate creates a new key for each bucket and re-encrypts bucket's files with
+// it. All buckets are rotated if none are listed.
+func rotate(ctx context.Context, buckets []string, storage s3.Storage, rekeyer s3.Rekeyer, ring rotator, logger zerolog.Logger) error {
+	if len(buckets) == 0 {
+		list, err := storage.ListBuckets(ctx)
+		if err != nil {
+			return err
+		}
+		for _, bucket := range list {
+			buckets = append(buckets, bucket.Name)
+		}
+	}
+
+	for _, bucket := range buckets {
+		// stop between buckets if context was cancelled
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		keyID, err := ring.Rotate(bucket)
+		if err != nil {
+			return err
+		}
+
+		rekeyed, err := rekeyer.Rekey(ctx, bucket)
+		logger.Info().Str("bucket", bucket).Str("keyID", keyID).Int("rekeyed", rekeyed).Msg("bucket key rotated")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newStorage initializes storage backend selected in the config
+func newStorage(cfg *Config, keys s3.KeyProvider, index s3.MetadataIndex, logger zerolog.Logger) (s3.Storage, error) {
+	if cfg.StorageBackend == BackendFilesystem {
+		return s3.NewFilesystem(&s3.FilesystemConfig{Root: cfg.FilesystemRoot}, keys, index, logger)
+	}
+
+	s3cfg := &s3.Config{
+		Endpoint:     cfg.S3Endpoint,
+		AccessKey:    cfg.S3AccessKey,
+		AccessSecret: cfg.S3Secret,
+		Secure:       true,
+		Region:       cfg.S3Region,
+	}
+	return s3.New(s3cfg, keys, index, logger)
+}
+
+// newKeyProvider initializes key provider selected in the config
+func newKeyProvider(cfg *Config, key string, index keyProvider.Storage, logger zerolog.Logger) (s3.KeyProvider, error) {
+	switch cfg.KeyProvider {
+	case KeyProviderLocal:
+		wrapper, err := keyProvider.NewLocalWrapper(key)
+		if err != nil {
+			return nil, err
+		}
+		return keyProvider.NewBucketKeys(key, index, wrapper, logger), nil
+	case KeyProviderVault:
+		wrapper := keyProvider.NewVaultWrapper(&keyProvider.VaultConfig{
+			Address: cfg.VaultAddr,
+			Token:   cfg.VaultToken,
+			Mount:   cfg.VaultTransitMount,
+			Key:     cfg.VaultTransitKey,
+		}, logger)
+		return keyProvider.NewBucketKeys(key, index, wrapper, logger), nil
+	default:
+		return keyProvider.New(key), nil
+	}
+}
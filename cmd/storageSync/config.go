@@ -1,23 +1,44 @@
 package main
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/caarlos0/env"
 
 	"github.com/iryonetwork/wwm/config"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	"github.com/iryonetwork/wwm/sync/storage/bus"
 )
 
 // Config represents configuration of storageSync
 type Config struct {
 	config.Config
-	CloudStorageHost   string        `env:"CLOUD_STORAGE_HOST" envDefault:"cloudStorage"`
-	CloudStoragePath   string        `env:"CLOUD_STORAGE_PATH" envDefault:"storage"`
+	CloudStorageHost string `env:"CLOUD_STORAGE_HOST" envDefault:"cloudStorage"`
+	CloudStoragePath string `env:"CLOUD_STORAGE_PATH" envDefault:"storage"`
+
+	EventBus             string        `env:"EVENT_BUS" envDefault:"stan"`
+	EventBusPath         string        `env:"EVENT_BUS_PATH" envDefault:"/data/events.db"`
+	EventBusPollInterval time.Duration `env:"EVENT_BUS_POLL_INTERVAL" envDefault:"1s"`
+
+	ConflictPolicy string `env:"CONFLICT_POLICY" envDefault:"park"`
+	ConflictsPath  string `env:"CONFLICTS_PATH" envDefault:"/data/conflicts.db"`
+
+	RateLimit        int64  `env:"SYNC_RATE_LIMIT" envDefault:"0"`
+	ScheduleFilepath string `env:"SYNC_SCHEDULE_FILEPATH"`
+
+	Compress     bool  `env:"SYNC_COMPRESS" envDefault:"true"`
+	DeltaMinSize int64 `env:"SYNC_DELTA_MIN_SIZE" envDefault:"1048576"`
+
+	MaxDeliveries   int           `env:"MAX_DELIVERIES" envDefault:"20"`
+	DeadLetterAfter time.Duration `env:"DEAD_LETTER_AFTER" envDefault:"1h"`
+	DeadLettersPath string        `env:"DEAD_LETTERS_PATH" envDefault:"/data/deadLetters.db"`
+
 	NatsAddr           string        `env:"NATS_ADDR" envDefault:"localNats:4242"`
 	NatsClusterID      string        `env:"NATS_CLUSTER_ID" envDefault:"localNats"`
 	NatsClientID       string        `env:"NATS_CLIENT_ID" envDefault:"storageSync"`
 	NatsUsername       string        `env:"NATS_USERNAME" envDefault:"nats"`
-	NatsSecret         string        `env:"NATS_SECRET,required"`
+	NatsSecret         string        `env:"NATS_SECRET"`
 	NatsConnRetries    int           `env:"NATS_CONN_RETRIES" envDefault:"10"`
 	NatsConnWait       time.Duration `env:"NATS_CONN_WAIT" envDefault:"500ms"`
 	NatsConnWaitFactor float32       `env:"NATS_CONN_WAIT_FACTOR" envDefault:"3.0"`
@@ -32,5 +53,45 @@ func GetConfig() (*Config, error) {
 
 	cfg := &Config{Config: *common}
 
-	return cfg, env.Parse(cfg)
+	err = env.Parse(cfg)
+	if err != nil {
+		return cfg, err
+	}
+
+	switch cfg.EventBus {
+	case bus.TransportStan:
+		if cfg.NatsSecret == "" {
+			return cfg, fmt.Errorf("NATS_SECRET is required for %s event bus", cfg.EventBus)
+		}
+	case bus.TransportBolt:
+		if cfg.EventBusPollInterval <= 0 {
+			return cfg, fmt.Errorf("EVENT_BUS_POLL_INTERVAL must be positive")
+		}
+	default:
+		return cfg, fmt.Errorf("invalid event bus '%s'", cfg.EventBus)
+	}
+
+	switch storageSync.ConflictPolicy(cfg.ConflictPolicy) {
+	case storageSync.ConflictKeepBoth, storageSync.ConflictLastWriterWins, storageSync.ConflictPark:
+	default:
+		return cfg, fmt.Errorf("invalid conflict policy '%s'", cfg.ConflictPolicy)
+	}
+
+	if cfg.RateLimit < 0 {
+		return cfg, fmt.Errorf("SYNC_RATE_LIMIT can not be negative")
+	}
+
+	if cfg.DeltaMinSize < 0 {
+		return cfg, fmt.Errorf("SYNC_DELTA_MIN_SIZE can not be negative")
+	}
+
+	if cfg.MaxDeliveries < 0 {
+		return cfg, fmt.Errorf("MAX_DELIVERIES can not be negative")
+	}
+
+	if cfg.DeadLetterAfter < 0 {
+		return cfg, fmt.Errorf("DEAD_LETTER_AFTER can not be negative")
+	}
+
+	return cfg, nil
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	"github.com/iryonetwork/wwm/sync/storage/deadletters"
+)
+
+const deadLettersUsage = "usage: storageSync deadLetters list|get ID|replay ID|discard ID"
+
+// runDeadLetters runs the dead letters command given by the arguments and
+// prints dead letters as JSON to stdout
+func runDeadLetters(args []string, store storageSync.DeadLetterStore, handlers storageSync.Handlers) error {
+	if len(args) == 1 && args[0] == "list" {
+		list, err := store.List()
+		if err != nil {
+			return err
+		}
+		return printJSON(list)
+	}
+
+	if len(args) != 2 {
+		return fmt.Errorf(deadLettersUsage)
+	}
+
+	switch args[0] {
+	case "get":
+		l, err := store.Get(args[1])
+		if err != nil {
+			return err
+		}
+		return printJSON(l)
+	case "replay":
+		result, err := deadletters.Replay(context.Background(), store, handlers, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Replayed dead letter %s: %s\n", args[1], result)
+		return nil
+	case "discard":
+		if err := store.Remove(args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Discarded dead letter %s\n", args[1])
+		return nil
+	}
+
+	return fmt.Errorf(deadLettersUsage)
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -1,28 +1,40 @@
-// storageSync is a worker receiving messages from localStorage published to NATS to resiliently sync everything to cloudStorage
+// storageSync is a worker receiving messages from localStorage published to the event bus to resiliently sync everything to cloudStorage
 package main
 
 //go:generate sh -c "mkdir -p ../../gen/storage/ && swagger generate client -A storage -t ../../gen/storage/ -f ../../docs/api/storage.yml --principal string"
+//go:generate sh -c "mkdir -p ../../gen/storageSync && swagger generate server -A storageSync -t ../../gen/storageSync -f ../../docs/api/storageSync.yml --exclude-main --principal string"
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	loads "github.com/go-openapi/loads"
 	runtimeClient "github.com/go-openapi/runtime/client"
 	"github.com/go-openapi/strfmt"
-	"github.com/nats-io/go-nats"
-	"github.com/nats-io/go-nats-streaming"
+	flags "github.com/jessevdk/go-flags"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/cors"
 	"github.com/rs/zerolog"
 
 	"github.com/iryonetwork/wwm/gen/storage/client"
+	"github.com/iryonetwork/wwm/gen/storageSync/restapi"
+	"github.com/iryonetwork/wwm/gen/storageSync/restapi/operations"
+	logMW "github.com/iryonetwork/wwm/log"
+	APIMetrics "github.com/iryonetwork/wwm/metrics/api"
 	metricsServer "github.com/iryonetwork/wwm/metrics/server"
+	"github.com/iryonetwork/wwm/service/authorizer"
 	statusServer "github.com/iryonetwork/wwm/status/server"
 	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	"github.com/iryonetwork/wwm/sync/storage/bus"
+	"github.com/iryonetwork/wwm/sync/storage/conflicts"
 	"github.com/iryonetwork/wwm/sync/storage/consumer"
+	"github.com/iryonetwork/wwm/sync/storage/deadletters"
+	"github.com/iryonetwork/wwm/sync/storage/throttle"
 	"github.com/iryonetwork/wwm/utils"
 )
 
@@ -59,42 +71,70 @@ func main() {
 		logger.Fatal().Err(err).Msg("failed to initialize storage API request authenticator")
 	}
 
-	// initialize handlers
-	handlers := storageSync.NewHandlers(localClient.Operations, auth, cloudClient.Operations, auth, logger)
-
-	// create nats/nats-streaming connection
-	URLs := fmt.Sprintf("tls://%s:%s@%s", cfg.NatsUsername, cfg.NatsSecret, cfg.NatsAddr)
-	ClusterID := cfg.NatsClusterID
-	ClientID := cfg.NatsClientID
-	ClientCert := cfg.CertPath
-	ClientKey := cfg.KeyPath
-	var nc *nats.Conn
-	var sc stan.Conn
-
-	// retry connection to nats if unsuccesful
-	err = utils.Retry(cfg.NatsConnRetries, cfg.NatsConnWait, cfg.NatsConnWaitFactor, logger.With().Str("connection", "nats").Logger(), func() error {
-		var err error
-		nc, err = nats.Connect(URLs, nats.ClientCert(ClientCert, ClientKey))
-		return err
-	})
+	// initialize store of conflicts parked for manual resolution
+	conflictStore, err := conflicts.NewBolt(cfg.ConflictsPath)
 	if err != nil {
-		logger.Fatal().Msg("failed to connect to nats")
+		logger.Fatal().Err(err).Msg("failed to initialize conflicts store")
+	}
+
+	// initialize store of events that repeatedly failed to be handled
+	deadLetterStore, err := deadletters.NewBolt(cfg.DeadLettersPath)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize dead letters store")
+	}
+
+	// initialize throttle of transfers
+	var th storageSync.Throttle
+	if cfg.ScheduleFilepath != "" || cfg.RateLimit > 0 {
+		var schedule *throttle.Schedule
+		if cfg.ScheduleFilepath != "" {
+			schedule, err = throttle.LoadSchedule(cfg.ScheduleFilepath)
+			if err != nil {
+				logger.Fatal().Err(err).Msg("failed to load sync schedule")
+			}
+		}
+		th = throttle.New(schedule, cfg.RateLimit)
+	}
+
+	// initialize handlers
+	opts := storageSync.Options{
+		Direction:      storageSync.DirectionPush,
+		ConflictPolicy: storageSync.ConflictPolicy(cfg.ConflictPolicy),
+		Conflicts:      conflictStore,
+		Throttle:       th,
+		Transfer:       storageSync.TransferOptions{Compress: cfg.Compress, DeltaMinSize: cfg.DeltaMinSize},
+	}
+	handlers := storageSync.NewHandlers(localClient.Operations, auth, cloudClient.Operations, auth, opts, logger)
+
+	// conflicts parked by batchStorageSync pull are resolved with cloud
+	// storage as the source
+	opts.Direction = storageSync.DirectionPull
+	pullHandlers := storageSync.NewHandlers(cloudClient.Operations, auth, localClient.Operations, auth, opts, logger)
+
+	// run dead letters command instead of the service if requested
+	flag.Parse()
+	if flag.Arg(0) == "deadLetters" {
+		if err := runDeadLetters(flag.Args()[1:], deadLetterStore, handlers); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	err = utils.Retry(cfg.NatsConnRetries, cfg.NatsConnWait, cfg.NatsConnWaitFactor, logger.With().Str("connection", "nats").Logger(), func() error {
-		var err error
-		sc, err = stan.Connect(ClusterID, ClientID, stan.NatsConn(nc))
-		return err
-	})
+	// connect to the event bus
+	b, err := bus.Connect(busConfig(cfg), logger)
 	if err != nil {
-		logger.Fatal().Msg("failed to connect to nats-streaming")
+		logger.Fatal().Err(err).Msg("failed to connect to the event bus")
 	}
 
 	// initalize consumer
 	consumerCfg := consumer.Cfg{
-		Connection: sc,
-		AckWait:    time.Duration(time.Second),
-		Handlers:   handlers,
+		Connection:      b,
+		AckWait:         time.Duration(time.Second),
+		Handlers:        handlers,
+		MaxDeliveries:   cfg.MaxDeliveries,
+		DeadLetterAfter: cfg.DeadLetterAfter,
+		DeadLetters:     deadLetterStore,
 	}
 	c := consumer.New(ctx, consumerCfg, logger)
 	// Register metrics
@@ -108,10 +148,58 @@ func main() {
 	c.StartSubscription(storageSync.FileNew)
 	c.StartSubscription(storageSync.FileUpdate)
 	c.StartSubscription(storageSync.FileDelete)
+	c.StartSubscription(storageSync.FilePurge)
+
+	// initialize conflicts and dead letters API
+	swaggerSpec, err := loads.Analyzed(restapi.SwaggerJSON, "")
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to load swagger spec")
+	}
+
+	// initialize authorizer
+	apiAuth := authorizer.New(cfg.DomainType, cfg.DomainID, fmt.Sprintf("https://%s/%s/validate", cfg.AuthHost, cfg.AuthPath), logger.With().Str("component", "service/authorizer").Logger())
+
+	api := operations.NewStorageSyncAPI(swaggerSpec)
+	api.ServeError = utils.ServeError
+	server := restapi.NewServer(api)
+	server.TLSHost = cfg.ServerHost
+	server.TLSPort = cfg.ServerPort
+	server.EnabledListeners = []string{"https"}
+	server.TLSCertificateKey = flags.Filename(cfg.KeyPath)
+	server.TLSCertificate = flags.Filename(cfg.CertPath)
+
+	conflictHandlers := conflicts.NewHandlers(conflictStore, handlers, pullHandlers, logger)
+	deadLetterHandlers := deadletters.NewHandlers(deadLetterStore, handlers, logger)
+
+	serverLogger := logger.WithLevel(zerolog.InfoLevel).Str("component", "server")
+	api.Logger = serverLogger.Msgf
+	api.TokenAuth = apiAuth.GetPrincipalFromToken
+	api.APIAuthorizer = apiAuth.Authorizer()
+	api.ConflictListHandler = conflictHandlers.ConflictList()
+	api.ConflictGetHandler = conflictHandlers.ConflictGet()
+	api.ConflictResolveHandler = conflictHandlers.ConflictResolve()
+	api.DeadLetterListHandler = deadLetterHandlers.DeadLetterList()
+	api.DeadLetterGetHandler = deadLetterHandlers.DeadLetterGet()
+	api.DeadLetterReplayHandler = deadLetterHandlers.DeadLetterReplay()
+	api.DeadLetterDiscardHandler = deadLetterHandlers.DeadLetterDiscard()
+
+	// initialize metrics middleware
+	apiMetrics := APIMetrics.NewMetrics("api", "").
+		WithURLSanitize(utils.WhitelistURLSanitize([]string{"storageSync", "conflicts", "resolve", "deadLetters", "replay"}))
+
+	// set API handler with middlewares
+	handler := cors.New(cors.Options{
+		AllowedMethods: []string{"GET", "POST", "DELETE"},
+		AllowedHeaders: []string{"Authorization", "Content-Type"},
+	}).Handler(api.Serve(nil))
+	handler = logMW.APILogMiddleware(handler, logger)
+	handler = apiMetrics.Middleware(handler)
+
+	server.SetHandler(handler)
 
 	// Start servers
 	// create exit channel that is used to wait for all servers goroutines to exit orderly and carry the errors
-	exitCh := make(chan error, 2)
+	exitCh := make(chan error, 3)
 
 	// start serving metrics
 	go func() {
@@ -122,6 +210,27 @@ func main() {
 		ss := statusServer.New(logger)
 		exitCh <- ss.ListenAndServeHTTPs(ctx, fmt.Sprintf("%s:%d", cfg.ServerHost, cfg.StatusPort), cfg.StatusNamespace, cfg.CertPath, cfg.KeyPath)
 	}()
+	// start serving conflicts and dead letters API
+	go func() {
+		defer server.Shutdown()
+
+		errCh := make(chan error)
+		go func() {
+			errCh <- server.Serve()
+		}()
+
+		for {
+			select {
+			case err := <-errCh:
+				exitCh <- err
+				return
+			case <-ctx.Done():
+				exitCh <- fmt.Errorf("API server exiting because of cancelled context")
+				// do nothing, shutdown is deferred
+				return
+			}
+		}
+	}()
 
 	// run cleanup when sigint or sigterm is received or error on starting server happened
 	signalChan := make(chan os.Signal, 1)
@@ -144,10 +253,29 @@ func main() {
 	}()
 
 	<-ctx.Done()
-	for i := 0; i < 2; i++ {
+	for i := 0; i < 3; i++ {
 		err := <-exitCh
 		if err != nil {
 			logger.Debug().Err(err).Msg("gouroutine exit message")
 		}
 	}
 }
+
+// busConfig returns configuration of the connection to the event bus
+func busConfig(cfg *Config) bus.Cfg {
+	return bus.Cfg{
+		Transport:        cfg.EventBus,
+		NatsAddr:         cfg.NatsAddr,
+		NatsUsername:     cfg.NatsUsername,
+		NatsSecret:       cfg.NatsSecret,
+		NatsClusterID:    cfg.NatsClusterID,
+		NatsClientID:     cfg.NatsClientID,
+		CertPath:         cfg.CertPath,
+		KeyPath:          cfg.KeyPath,
+		BoltPath:         cfg.EventBusPath,
+		BoltPollInterval: cfg.EventBusPollInterval,
+		ConnRetries:      cfg.NatsConnRetries,
+		ConnWait:         cfg.NatsConnWait,
+		ConnWaitFactor:   cfg.NatsConnWaitFactor,
+	}
+}
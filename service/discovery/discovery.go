@@ -48,6 +48,12 @@ type (
 		// ProxyUnlink calls Unlink on cloud instance
 		ProxyUnlink(patientID, locationID strfmt.UUID, authToken string) error
 
+		// LinkedPatients returns IDs of patients linked to a location
+		LinkedPatients(locationID strfmt.UUID) (models.PatientIDs, error)
+
+		// ProxyLinkedPatients calls LinkedPatients on cloud instance
+		ProxyLinkedPatients(locationID strfmt.UUID, authToken string) (models.PatientIDs, error)
+
 		// CodesGet returns matching codes
 		CodesGet(category, query, parentID, locale string) (models.Codes, error)
 
@@ -162,6 +168,25 @@ func (svc *service) ProxyUnlink(patientID, locationID strfmt.UUID, authToken str
 	return nil
 }
 
+func (svc *service) LinkedPatients(locationID strfmt.UUID) (models.PatientIDs, error) {
+	return svc.storage.LinkedPatients(locationID)
+}
+
+func (svc *service) ProxyLinkedPatients(locationID strfmt.UUID, authToken string) (models.PatientIDs, error) {
+	if svc.client == nil {
+		return nil, errors.New("client not available")
+	}
+
+	params := &operations.LinkedPatientsParams{LocationID: locationID}
+	params.WithContext(svc.ctx).WithTimeout(5 * time.Second)
+	res, err := svc.client.Operations.LinkedPatients(params, newAuthWriter(authToken))
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to proxy linked patients call")
+	}
+	return res.Payload, nil
+}
+
 func (svc *service) CodesGet(category, query, parentID, locale string) (models.Codes, error) {
 	return svc.storage.CodesGet(category, query, parentID, locale)
 }
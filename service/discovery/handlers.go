@@ -21,6 +21,8 @@ type Handlers interface {
 	ProxyLink() operations.LinkHandler
 	Unlink() operations.UnlinkHandler
 	ProxyUnlink() operations.UnlinkHandler
+	LinkedPatients() operations.LinkedPatientsHandler
+	ProxyLinkedPatients() operations.LinkedPatientsHandler
 	CodesGet() operations.CodesGetHandler
 	CodeGet() operations.CodeGetHandler
 }
@@ -204,6 +206,35 @@ func (h *handlers) ProxyUnlink() operations.UnlinkHandler {
 	})
 }
 
+func (h *handlers) LinkedPatients() operations.LinkedPatientsHandler {
+	return operations.LinkedPatientsHandlerFunc(func(params operations.LinkedPatientsParams, principal *string) middleware.Responder {
+		p, err := h.service.LinkedPatients(params.LocationID)
+		if err != nil {
+			return operations.NewLinkedPatientsInternalServerError().WithPayload(&models.Error{
+				Code:    "server_error",
+				Message: err.Error(),
+			})
+		}
+
+		return operations.NewLinkedPatientsOK().WithPayload(p)
+	})
+}
+
+func (h *handlers) ProxyLinkedPatients() operations.LinkedPatientsHandler {
+	return operations.LinkedPatientsHandlerFunc(func(params operations.LinkedPatientsParams, principal *string) middleware.Responder {
+		authToken := params.HTTPRequest.Header.Get("Authorization")
+		p, err := h.service.ProxyLinkedPatients(params.LocationID, authToken)
+		if err != nil {
+			return operations.NewLinkedPatientsInternalServerError().WithPayload(&models.Error{
+				Code:    "server_error",
+				Message: err.Error(),
+			})
+		}
+
+		return operations.NewLinkedPatientsOK().WithPayload(p)
+	})
+}
+
 func (h *handlers) CodesGet() operations.CodesGetHandler {
 	return operations.CodesGetHandlerFunc(func(params operations.CodesGetParams, principal *string) middleware.Responder {
 		q := ""
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-openapi/spec"
+	"github.com/go-openapi/strfmt"
+	"github.com/go-openapi/validate"
+	"github.com/pkg/errors"
+
+	"github.com/iryonetwork/wwm/utils"
+)
+
+// Document does not conform to the schema of its archetype
+var ErrInvalidDocument = errors.New("Document does not conform to the schema of its archetype")
+
+// labelInvalidArchetype marks files that do not conform to the schema of
+// their archetype
+const labelInvalidArchetype = "invalidArchetype"
+
+// ValidationMode sets what happens to documents not conforming to the schema
+type ValidationMode string
+
+// Validation modes
+const (
+	// ValidationReject refuses to store non-conforming documents
+	ValidationReject ValidationMode = "reject"
+	// ValidationFlag stores non-conforming documents labelled with
+	// invalidArchetype label
+	ValidationFlag ValidationMode = "flag"
+)
+
+// ArchetypeRegistry holds JSON schemas of archetypes. Only JSON documents of
+// archetypes with a schema are validated, other files are stored as they are.
+type ArchetypeRegistry struct {
+	mode    ValidationMode
+	schemas map[string]*spec.Schema
+}
+
+// LoadArchetypeRegistry reads JSON schemas of archetypes from the directory;
+// each schema is stored in a file named by the archetype with .json
+// extension, e.g. openEHR-EHR-OBSERVATION.blood_pressure.v1.json
+func LoadArchetypeRegistry(dir string, mode ValidationMode) (*ArchetypeRegistry, error) {
+	if mode != ValidationReject && mode != ValidationFlag {
+		return nil, errors.Errorf("invalid validation mode '%s'", mode)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list archetype schemas")
+	}
+
+	r := &ArchetypeRegistry{mode: mode, schemas: map[string]*spec.Schema{}}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read archetype schema")
+		}
+
+		schema := &spec.Schema{}
+		if err := json.Unmarshal(b, schema); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse archetype schema %s", filepath.Base(f))
+		}
+		if err := spec.ExpandSchema(schema, schema, nil); err != nil {
+			return nil, errors.Wrapf(err, "failed to resolve references of archetype schema %s", filepath.Base(f))
+		}
+
+		r.schemas[strings.TrimSuffix(filepath.Base(f), ".json")] = schema
+	}
+
+	return r, nil
+}
+
+// isJSON reports whether documents of the content type can be validated
+func isJSON(contentType string) bool {
+	switch strings.TrimSpace(strings.Split(contentType, ";")[0]) {
+	case "application/json", "text/openEhrJson":
+		return true
+	}
+	return false
+}
+
+// validate checks the document against the schema of its archetype. Returned
+// reader holds the same contents as r and needs to be used instead of it.
+// ErrInvalidDocument is returned in reject mode, labels are extended with
+// invalidArchetype label in flag mode and the label is dropped from labels of
+// conforming documents.
+func (a *ArchetypeRegistry) validate(archetype, contentType string, r io.Reader, labels []string) (io.Reader, []string, error) {
+	if a == nil || !isJSON(contentType) {
+		return r, labels, nil
+	}
+	schema, ok := a.schemas[archetype]
+	if !ok {
+		return r, labels, nil
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var doc interface{}
+	err = json.Unmarshal(b, &doc)
+	if err == nil {
+		err = validate.AgainstSchema(schema, doc, strfmt.Default)
+	}
+
+	switch {
+	case err == nil && hasLabel(labels, labelInvalidArchetype):
+		labels = utils.DiffSlice(labels, []string{labelInvalidArchetype})
+	case err == nil:
+	case a.mode == ValidationReject:
+		return nil, nil, ErrInvalidDocument
+	case !hasLabel(labels, labelInvalidArchetype):
+		labels = append(append([]string{}, labels...), labelInvalidArchetype)
+	}
+
+	return bytes.NewReader(b), labels, nil
+}
@@ -0,0 +1,402 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"path"
+	"time"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/pkg/errors"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/storage/s3"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+)
+
+// Archive is not a valid archive of the bucket
+var ErrInvalidArchive = errors.New("Invalid archive")
+
+// Signature of the archive manifest is not valid or trusted
+var ErrArchiveSignature = errors.New("Archive signature is not valid")
+
+// Service was not configured to sign archives
+var ErrArchivesDisabled = errors.New("Archives are not enabled")
+
+// Entries of the archive; manifest, its signature and certificate need to be
+// the first entries followed by contents of file versions in the order of
+// the manifest
+const (
+	archiveManifest    = "manifest.json"
+	archiveSignature   = "manifest.sig"
+	archiveCertificate = "certificate.pem"
+	archiveFilesDir    = "files"
+)
+
+// ArchiveManifest describes contents of the bucket archive. Files are listed
+// oldest first so they can be imported in the order they were created.
+type ArchiveManifest struct {
+	Bucket      string                   `json:"bucket"`
+	Created     strfmt.DateTime          `json:"created"`
+	AllVersions bool                     `json:"allVersions"`
+	Files       []*models.FileDescriptor `json:"files"`
+}
+
+// ArchiveSigner signs manifests of exported archives with the key of the
+// service and verifies signatures of imported ones
+type ArchiveSigner struct {
+	cert    *x509.Certificate
+	certPEM []byte
+	key     crypto.Signer
+	roots   *x509.CertPool
+}
+
+// NewArchiveSigner returns a new signer using the certificate and key of the
+// service. Imported archives need to be signed by a certificate issued by
+// the CA if caPath is set and by the same certificate otherwise.
+func NewArchiveSigner(certPath, keyPath, caPath string) (*ArchiveSigner, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load certificate")
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse certificate")
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key can not be used for signing")
+	}
+
+	a := &ArchiveSigner{
+		cert:    cert,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pair.Certificate[0]}),
+		key:     key,
+	}
+
+	if caPath != "" {
+		b, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read CA certificate")
+		}
+		a.roots = x509.NewCertPool()
+		if !a.roots.AppendCertsFromPEM(b) {
+			return nil, errors.New("failed to parse CA certificate")
+		}
+	}
+
+	return a, nil
+}
+
+// sign returns signature of sha256 hash of the manifest
+func (a *ArchiveSigner) sign(manifest []byte) ([]byte, error) {
+	h := sha256.Sum256(manifest)
+	return a.key.Sign(rand.Reader, h[:], crypto.SHA256)
+}
+
+// verify checks the signature of the manifest was made by the trusted
+// certificate
+func (a *ArchiveSigner) verify(manifest, signature, certPEM []byte) error {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return ErrArchiveSignature
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return ErrArchiveSignature
+	}
+
+	if a.roots != nil {
+		if _, err := cert.Verify(x509.VerifyOptions{Roots: a.roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+			return ErrArchiveSignature
+		}
+	} else if !cert.Equal(a.cert) {
+		return ErrArchiveSignature
+	}
+
+	var algorithm x509.SignatureAlgorithm
+	switch cert.PublicKeyAlgorithm {
+	case x509.RSA:
+		algorithm = x509.SHA256WithRSA
+	case x509.ECDSA:
+		algorithm = x509.ECDSAWithSHA256
+	default:
+		return ErrArchiveSignature
+	}
+	if err := cert.CheckSignature(algorithm, manifest, signature); err != nil {
+		return ErrArchiveSignature
+	}
+
+	return nil
+}
+
+func (s *service) BucketExport(ctx context.Context, bucketID string, allVersions bool) (io.ReadCloser, error) {
+	if s.signer == nil {
+		return nil, ErrArchivesDisabled
+	}
+
+	exists, err := s.s3.BucketExists(ctx, bucketID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	list, err := s.s3.List(ctx, bucketID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// list is sorted newest first so the first version of each file is the
+	// latest one
+	files := []*models.FileDescriptor{}
+	seen := map[string]bool{}
+	for _, fd := range list {
+		if !allVersions {
+			if seen[fd.Name] {
+				continue
+			}
+			seen[fd.Name] = true
+			if s3.Operation(fd.Operation) == s3.Delete {
+				continue
+			}
+		}
+		files = append(files, fd)
+	}
+
+	manifest := &ArchiveManifest{Bucket: bucketID, Created: getTime(), AllVersions: allVersions, Files: make([]*models.FileDescriptor, len(files))}
+	for i, fd := range files {
+		manifest.Files[len(files)-1-i] = fd
+	}
+
+	m, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := s.signer.sign(m)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to sign archive manifest")
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		err := s.writeArchive(ctx, pw, bucketID, manifest, m, signature)
+		if err != nil {
+			s.logger.Error().Err(err).Str("bucket", bucketID).Msg("Failed to export bucket")
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
+
+func (s *service) BucketImport(ctx context.Context, bucketID string, r io.Reader) (*models.ImportSummary, error) {
+	if s.signer == nil {
+		return nil, ErrArchivesDisabled
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, ErrInvalidArchive
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	// nothing is stored until the manifest is verified
+	m, err := readArchiveEntry(tr, archiveManifest)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := readArchiveEntry(tr, archiveSignature)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, err := readArchiveEntry(tr, archiveCertificate)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.signer.verify(m, signature, certPEM); err != nil {
+		s.logger.Error().Str("bucket", bucketID).Msg("Archive signature is not valid")
+		return nil, err
+	}
+
+	manifest := &ArchiveManifest{}
+	if err := json.Unmarshal(m, manifest); err != nil {
+		return nil, ErrInvalidArchive
+	}
+	if manifest.Bucket != bucketID {
+		s.logger.Error().Str("bucket", bucketID).Msgf("Archive of bucket %s can not be imported", manifest.Bucket)
+		return nil, ErrInvalidArchive
+	}
+
+	if err := s.EnsureBucket(ctx, bucketID); err != nil {
+		return nil, err
+	}
+
+	summary := &models.ImportSummary{Bucket: bucketID}
+	for _, fd := range manifest.Files {
+		var imported bool
+		if s3.Operation(fd.Operation) == s3.Delete {
+			imported, err = s.importDelete(ctx, bucketID, fd)
+		} else {
+			imported, err = s.importFile(ctx, bucketID, fd, tr)
+		}
+		if err != nil {
+			s.logger.Error().Err(err).Str("bucket", bucketID).Str("fileID", fd.Name).Str("version", fd.Version).Msg("Failed to import file version")
+			return nil, err
+		}
+
+		if imported {
+			summary.Imported++
+		} else {
+			summary.Existing++
+		}
+	}
+
+	return summary, nil
+}
+
+// writeArchive writes gzip compressed tar archive of the manifest and
+// contents of its file versions
+func (s *service) writeArchive(ctx context.Context, w io.Writer, bucketID string, manifest *ArchiveManifest, m, signature []byte) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	modTime := time.Time(manifest.Created)
+
+	for _, e := range []struct {
+		name string
+		b    []byte
+	}{
+		{archiveManifest, m},
+		{archiveSignature, signature},
+		{archiveCertificate, s.signer.certPEM},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0600, Size: int64(len(e.b)), ModTime: modTime}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(e.b); err != nil {
+			return err
+		}
+	}
+
+	for _, fd := range manifest.Files {
+		if s3.Operation(fd.Operation) == s3.Delete {
+			continue
+		}
+
+		r, _, err := s.s3.Read(ctx, bucketID, fd.Name, fd.Version)
+		if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{Name: archiveFileName(fd), Mode: 0600, Size: fd.Size, ModTime: time.Time(fd.Created)})
+		if err != nil {
+			r.Close()
+			return err
+		}
+
+		// contents are verified so corrupted files do not end up in the
+		// archive under a valid signature
+		h := sha256.New()
+		_, err = io.Copy(tw, io.TeeReader(r, h))
+		r.Close()
+		if err != nil {
+			return err
+		}
+		if base64.URLEncoding.EncodeToString(h.Sum(nil)) != fd.Checksum {
+			return errors.Errorf("contents of %s version %s do not match checksum", fd.Name, fd.Version)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// importFile stores the next file version of the archive and returns false
+// if it already existed
+func (s *service) importFile(ctx context.Context, bucketID string, fd *models.FileDescriptor, tr *tar.Reader) (bool, error) {
+	b, err := readArchiveEntry(tr, archiveFileName(fd))
+	if err != nil {
+		return false, err
+	}
+	checksum, err := s.Checksum(bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+	if int64(len(b)) != fd.Size || checksum != fd.Checksum {
+		return false, ErrInvalidArchive
+	}
+
+	_, err = s.SyncFile(ctx, bucketID, fd.Name, fd.Version, bytes.NewReader(b), fd.ContentType, fd.Created, fd.Archetype, fd.Labels)
+	switch {
+	case err == ErrAlreadyExists:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	s.publisher.PublishAsyncWithRetries(
+		context.TODO(),
+		storageSync.FileNew,
+		&storageSync.FileInfo{BucketID: bucketID, FileID: fd.Name, Version: fd.Version, Created: fd.Created},
+	)
+
+	return true, nil
+}
+
+// importDelete marks the file as deleted and returns false if it already was
+func (s *service) importDelete(ctx context.Context, bucketID string, fd *models.FileDescriptor) (bool, error) {
+	latest, err := s.s3.Stat(ctx, bucketID, fd.Name, "")
+	if err == nil && latest.Version == fd.Version && s3.Operation(latest.Operation) == s3.Delete {
+		return false, nil
+	}
+
+	if err := s.SyncFileDelete(ctx, bucketID, fd.Name, fd.Version, fd.Created); err != nil {
+		return false, err
+	}
+
+	s.publisher.PublishAsyncWithRetries(
+		context.TODO(),
+		storageSync.FileDelete,
+		&storageSync.FileInfo{BucketID: bucketID, FileID: fd.Name, Version: fd.Version, Created: fd.Created},
+	)
+
+	return true, nil
+}
+
+// archiveFileName returns name of the archive entry with contents of the
+// file version
+func archiveFileName(fd *models.FileDescriptor) string {
+	return path.Join(archiveFilesDir, fd.Name, fd.Version)
+}
+
+// readArchiveEntry reads the next entry of the archive which needs to have
+// the name
+func readArchiveEntry(tr *tar.Reader, name string) ([]byte, error) {
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != name {
+		return nil, ErrInvalidArchive
+	}
+
+	b, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return nil, ErrInvalidArchive
+	}
+
+	return b, nil
+}
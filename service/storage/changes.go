@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/pkg/errors"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+)
+
+var changesBucket = []byte("changes")
+
+// ChangeLog records writes of the storage in bolt database file with
+// monotonic sequence numbers, so batch sync can transfer only the files
+// changed since its last checkpoint instead of listing all the buckets.
+type ChangeLog struct {
+	db *bolt.DB
+}
+
+// OpenChangeLog opens the change log stored in the file
+func OpenChangeLog(path string) (*ChangeLog, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open change log")
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(changesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "failed to ensure change log bucket")
+	}
+
+	return &ChangeLog{db: db}, nil
+}
+
+// Close closes the database file
+func (l *ChangeLog) Close() error {
+	return l.db.Close()
+}
+
+// record appends the change with the next sequence number
+func (l *ChangeLog) record(typ storageSync.EventType, f *storageSync.FileInfo) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(changesBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		value, err := json.Marshal(&models.Change{
+			Sequence: int64(seq),
+			Type:     string(typ),
+			Bucket:   f.BucketID,
+			FileID:   f.FileID,
+			Version:  f.Version,
+			Created:  f.Created,
+		})
+		if err != nil {
+			return err
+		}
+		return b.Put(sequenceKey(seq), value)
+	})
+}
+
+// List returns up to limit changes with sequence number greater than since,
+// all of them if limit is not positive, together with the sequence number of
+// the latest change
+func (l *ChangeLog) List(since int64, limit int) ([]*models.Change, int64, error) {
+	changes := []*models.Change{}
+	var last int64
+
+	err := l.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(changesBucket)
+		last = int64(b.Sequence())
+
+		c := b.Cursor()
+		for k, v := c.Seek(sequenceKey(uint64(since + 1))); k != nil && (limit <= 0 || len(changes) < limit); k, v = c.Next() {
+			change := &models.Change{}
+			if err := json.Unmarshal(v, change); err != nil {
+				return err
+			}
+			changes = append(changes, change)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return changes, last, nil
+}
+
+// Publisher returns publisher recording the published events in the change
+// log before passing them to p
+func (l *ChangeLog) Publisher(p storageSync.Publisher) storageSync.Publisher {
+	return &changeLogPublisher{Publisher: p, changes: l}
+}
+
+func sequenceKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// changeLogPublisher passes methods other than publishing to the wrapped
+// publisher
+type changeLogPublisher struct {
+	storageSync.Publisher
+	changes *ChangeLog
+}
+
+func (p *changeLogPublisher) Publish(ctx context.Context, typ storageSync.EventType, f *storageSync.FileInfo) error {
+	// event is published even if it failed to be recorded so the sync
+	// consumer still gets it
+	if err := p.changes.record(typ, f); err != nil {
+		p.Publisher.Publish(ctx, typ, f)
+		return errors.Wrap(err, "failed to record change")
+	}
+
+	return p.Publisher.Publish(ctx, typ, f)
+}
+
+func (p *changeLogPublisher) PublishAsyncWithRetries(ctx context.Context, typ storageSync.EventType, f *storageSync.FileInfo) error {
+	// event is published even if it failed to be recorded so the sync
+	// consumer still gets it
+	if err := p.changes.record(typ, f); err != nil {
+		p.Publisher.PublishAsyncWithRetries(ctx, typ, f)
+		return errors.Wrap(err, "failed to record change")
+	}
+
+	return p.Publisher.PublishAsyncWithRetries(ctx, typ, f)
+}
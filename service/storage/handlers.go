@@ -1,32 +1,53 @@
 package storage
 
 import (
+	"fmt"
+	"io"
+	"strconv"
 	"strings"
 
 	"github.com/go-openapi/runtime/middleware"
+	"github.com/go-openapi/strfmt"
 	"github.com/go-openapi/swag"
 	"github.com/rs/zerolog"
 
 	"github.com/iryonetwork/wwm/gen/storage/models"
 	"github.com/iryonetwork/wwm/gen/storage/restapi/operations"
+	"github.com/iryonetwork/wwm/storage/s3"
 	"github.com/iryonetwork/wwm/utils"
 )
 
 // Handlers describes the actions supported by the storage handlers
 type Handlers interface {
+	BucketNew() operations.BucketNewHandler
+	BucketGet() operations.BucketGetHandler
+	BucketArchive() operations.BucketArchiveHandler
+	BucketDelete() operations.BucketDeleteHandler
+	BucketExport() operations.BucketExportHandler
+	BucketImport() operations.BucketImportHandler
 	FileList() operations.FileListHandler
+	FileSearch() operations.FileSearchHandler
 	FileGet() operations.FileGetHandler
 	FileGetVersion() operations.FileGetVersionHandler
 	FileListVersions() operations.FileListVersionsHandler
 	FileNew() operations.FileNewHandler
 	FileUpdate() operations.FileUpdateHandler
 	FileDelete() operations.FileDeleteHandler
+	UploadNew() operations.UploadNewHandler
+	UploadGet() operations.UploadGetHandler
+	UploadChunk() operations.UploadChunkHandler
+	UploadCommit() operations.UploadCommitHandler
+	UploadDelete() operations.UploadDeleteHandler
 	SyncBucketList() operations.SyncBucketListHandler
+	SyncChangeList() operations.SyncChangeListHandler
 	SyncFileList() operations.SyncFileListHandler
 	SyncFileListVersions() operations.SyncFileListVersionsHandler
+	SyncFileGet() operations.SyncFileGetHandler
 	SyncFileMetadata() operations.SyncFileMetadataHandler
+	SyncFileSignature() operations.SyncFileSignatureHandler
 	SyncFile() operations.SyncFileHandler
 	SyncFileDelete() operations.SyncFileDeleteHandler
+	SyncFilePurge() operations.SyncFilePurgeHandler
 }
 
 type handlers struct {
@@ -34,79 +55,262 @@ type handlers struct {
 	logger  zerolog.Logger
 }
 
-func (h *handlers) FileList() operations.FileListHandler {
-	return operations.FileListHandlerFunc(func(params operations.FileListParams, principal *string) middleware.Responder {
-		list, err := h.service.FileList(params.HTTPRequest.Context(), params.Bucket)
+func (h *handlers) BucketNew() operations.BucketNewHandler {
+	return operations.BucketNewHandlerFunc(func(params operations.BucketNewParams, principal *string) middleware.Responder {
+		bd, err := h.service.BucketNew(params.HTTPRequest.Context(), swag.StringValue(params.Bucket.Name), params.Bucket.Metadata)
 
 		if err != nil {
-			return operations.NewFileListInternalServerError().WithPayload(&models.Error{
-				Code:    "server_error",
-				Message: err.Error(),
-			})
+			switch err {
+			case ErrAlreadyExists:
+				return operations.NewBucketNewConflict().WithPayload(&models.Error{
+					Code:    "conflict",
+					Message: err.Error(),
+				})
+			case ErrInvalidBucketName:
+				return operations.NewBucketNewBadRequest().WithPayload(&models.Error{
+					Code:    "bad_request",
+					Message: err.Error(),
+				})
+			default:
+				return operations.NewBucketNewInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
 		}
-		if len(list) == 0 {
-			return operations.NewFileListNotFound()
+
+		return operations.NewBucketNewCreated().WithPayload(bd)
+	})
+}
+
+func (h *handlers) BucketGet() operations.BucketGetHandler {
+	return operations.BucketGetHandlerFunc(func(params operations.BucketGetParams, principal *string) middleware.Responder {
+		bd, err := h.service.BucketGet(params.HTTPRequest.Context(), params.Bucket)
+
+		if err != nil {
+			switch err {
+			case ErrNotFound, ErrInvalidBucketName:
+				return operations.NewBucketGetNotFound()
+			default:
+				return operations.NewBucketGetInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
 		}
 
-		return operations.NewFileListOK().WithPayload(list)
+		return operations.NewBucketGetOK().WithPayload(bd)
 	})
 }
 
-func (h *handlers) FileGet() operations.FileGetHandler {
-	return operations.FileGetHandlerFunc(func(params operations.FileGetParams, principal *string) middleware.Responder {
-		r, fd, err := h.service.FileGet(params.HTTPRequest.Context(), params.Bucket, params.FileID)
+func (h *handlers) BucketArchive() operations.BucketArchiveHandler {
+	return operations.BucketArchiveHandlerFunc(func(params operations.BucketArchiveParams, principal *string) middleware.Responder {
+		bd, err := h.service.BucketArchive(params.HTTPRequest.Context(), params.Bucket)
 
 		if err != nil {
 			switch err {
-			case ErrNotFound:
-				return operations.NewFileGetNotFound()
+			case ErrNotFound, ErrInvalidBucketName:
+				return operations.NewBucketArchiveNotFound()
 			default:
-				return operations.NewFileGetInternalServerError().WithPayload(&models.Error{
+				return operations.NewBucketArchiveInternalServerError().WithPayload(&models.Error{
 					Code:    "server_error",
 					Message: err.Error(),
 				})
 			}
 		}
 
-		return utils.UseProducer(operations.NewFileGetOK().
-			WithPayload(r).
-			WithContentType(fd.ContentType).
-			WithXCreated(fd.Created).
-			WithXVersion(fd.Version).
-			WithXArchetype(fd.Archetype).
-			WithXChecksum(fd.Checksum).
-			WithXName(fd.Name).
-			WithXPath(fd.Path).
-			WithXLabels(formatLabelsHeader(fd.Labels)), utils.FileProducer)
+		return operations.NewBucketArchiveOK().WithPayload(bd)
 	})
 }
 
-func (h *handlers) FileGetVersion() operations.FileGetVersionHandler {
-	return operations.FileGetVersionHandlerFunc(func(params operations.FileGetVersionParams, principal *string) middleware.Responder {
-		r, fd, err := h.service.FileGetVersion(params.HTTPRequest.Context(), params.Bucket, params.FileID, params.Version)
+func (h *handlers) BucketDelete() operations.BucketDeleteHandler {
+	return operations.BucketDeleteHandlerFunc(func(params operations.BucketDeleteParams, principal *string) middleware.Responder {
+		err := h.service.BucketDelete(params.HTTPRequest.Context(), params.Bucket)
 
 		if err != nil {
 			switch err {
-			case ErrNotFound:
-				return operations.NewFileGetVersionNotFound()
+			case ErrNotFound, ErrInvalidBucketName:
+				return operations.NewBucketDeleteNotFound()
 			default:
-				return operations.NewFileGetVersionInternalServerError().WithPayload(&models.Error{
+				return operations.NewBucketDeleteInternalServerError().WithPayload(&models.Error{
 					Code:    "server_error",
 					Message: err.Error(),
 				})
 			}
 		}
 
-		return utils.UseProducer(operations.NewFileGetVersionOK().
-			WithPayload(r).
-			WithContentType(fd.ContentType).
-			WithXCreated(fd.Created).
-			WithXVersion(fd.Version).
-			WithXArchetype(fd.Archetype).
-			WithXChecksum(fd.Checksum).
-			WithXName(fd.Name).
-			WithXPath(fd.Path).
-			WithXLabels(formatLabelsHeader(fd.Labels)), utils.FileProducer)
+		return operations.NewBucketDeleteNoContent()
+	})
+}
+
+func (h *handlers) BucketExport() operations.BucketExportHandler {
+	return operations.BucketExportHandlerFunc(func(params operations.BucketExportParams, principal *string) middleware.Responder {
+		allVersions := swag.StringValue(params.Versions) == "all"
+		r, err := h.service.BucketExport(params.HTTPRequest.Context(), params.Bucket, allVersions)
+
+		if err != nil {
+			switch err {
+			case ErrNotFound, ErrInvalidBucketName:
+				return operations.NewBucketExportNotFound()
+			default:
+				return operations.NewBucketExportInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return utils.UseProducer(operations.NewBucketExportOK().WithPayload(r), utils.FileProducer)
+	})
+}
+
+func (h *handlers) BucketImport() operations.BucketImportHandler {
+	return operations.BucketImportHandlerFunc(func(params operations.BucketImportParams, principal *string) middleware.Responder {
+		defer params.Archive.Close()
+
+		summary, err := h.service.BucketImport(params.HTTPRequest.Context(), params.Bucket, params.Archive)
+
+		if err != nil {
+			switch err {
+			case ErrInvalidArchive, ErrArchiveSignature, ErrInvalidBucketName:
+				return operations.NewBucketImportBadRequest().WithPayload(&models.Error{
+					Code:    "bad_request",
+					Message: err.Error(),
+				})
+			case ErrArchived, ErrAlreadyExistsConflict, ErrDeleted:
+				return operations.NewBucketImportConflict().WithPayload(&models.Error{
+					Code:    "conflict",
+					Message: err.Error(),
+				})
+			case ErrInvalidDocument:
+				return operations.NewBucketImportUnprocessableEntity().WithPayload(&models.Error{
+					Code:    "invalid_document",
+					Message: err.Error(),
+				})
+			default:
+				return operations.NewBucketImportInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return operations.NewBucketImportOK().WithPayload(summary)
+	})
+}
+
+func (h *handlers) FileList() operations.FileListHandler {
+	return operations.FileListHandlerFunc(func(params operations.FileListParams, principal *string) middleware.Responder {
+		opts := &ListOptions{
+			Cursor:      swag.StringValue(params.Cursor),
+			Limit:       int(swag.Int64Value(params.Limit)),
+			Archetype:   swag.StringValue(params.Archetype),
+			Label:       swag.StringValue(params.Label),
+			ContentType: swag.StringValue(params.ContentType),
+			CreatedFrom: params.CreatedFrom,
+			CreatedTo:   params.CreatedTo,
+			AsOf:        params.AsOf,
+		}
+		list, next, err := h.service.FileList(params.HTTPRequest.Context(), params.Bucket, opts)
+
+		if err != nil {
+			switch err {
+			case ErrInvalidCursor:
+				return operations.NewFileListBadRequest().WithPayload(&models.Error{
+					Code:    "bad_request",
+					Message: err.Error(),
+				})
+			default:
+				return operations.NewFileListInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+		if len(list) == 0 {
+			return operations.NewFileListNotFound()
+		}
+
+		return operations.NewFileListOK().WithPayload(list).WithXNextCursor(next)
+	})
+}
+
+func (h *handlers) FileSearch() operations.FileSearchHandler {
+	return operations.FileSearchHandlerFunc(func(params operations.FileSearchParams, principal *string) middleware.Responder {
+		opts := &ListOptions{
+			Cursor:      swag.StringValue(params.Cursor),
+			Limit:       int(swag.Int64Value(params.Limit)),
+			Archetype:   swag.StringValue(params.Archetype),
+			Label:       params.Label,
+			ContentType: swag.StringValue(params.ContentType),
+			CreatedFrom: params.CreatedFrom,
+			CreatedTo:   params.CreatedTo,
+		}
+		list, next, err := h.service.FileSearch(params.HTTPRequest.Context(), params.Bucket, opts)
+
+		if err != nil {
+			switch err {
+			case ErrInvalidCursor, ErrLabelRequired:
+				return operations.NewFileSearchBadRequest().WithPayload(&models.Error{
+					Code:    "bad_request",
+					Message: err.Error(),
+				})
+			default:
+				return operations.NewFileSearchInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return operations.NewFileSearchOK().WithPayload(list).WithXNextCursor(next)
+	})
+}
+
+func (h *handlers) FileGet() operations.FileGetHandler {
+	return operations.FileGetHandlerFunc(func(params operations.FileGetParams, principal *string) middleware.Responder {
+		rng := parseRange(swag.StringValue(params.Range))
+		var r io.ReadCloser
+		var fd *models.FileDescriptor
+		var err error
+
+		// resolve the version valid at the time, the latest one is used
+		// otherwise
+		version := ""
+		if params.AsOf != nil {
+			fd, err = h.service.FileVersionAsOf(params.HTTPRequest.Context(), params.Bucket, params.FileID, *params.AsOf)
+			if err == nil {
+				version = fd.Version
+			}
+		}
+
+		switch {
+		case err != nil:
+		case params.Rendition != nil:
+			r, fd, err = h.service.FileGetRendition(params.HTTPRequest.Context(), params.Bucket, params.FileID, version, *params.Rendition, rng)
+		case version != "":
+			r, fd, err = h.service.FileGetVersion(params.HTTPRequest.Context(), params.Bucket, params.FileID, version, rng)
+		default:
+			r, fd, err = h.service.FileGet(params.HTTPRequest.Context(), params.Bucket, params.FileID, rng)
+		}
+
+		return respondFile(fileGetResponses, r, fd, err, rng, swag.StringValue(params.IfNoneMatch))
+	})
+}
+
+func (h *handlers) FileGetVersion() operations.FileGetVersionHandler {
+	return operations.FileGetVersionHandlerFunc(func(params operations.FileGetVersionParams, principal *string) middleware.Responder {
+		rng := parseRange(swag.StringValue(params.Range))
+		var r io.ReadCloser
+		var fd *models.FileDescriptor
+		var err error
+		if params.Rendition != nil {
+			r, fd, err = h.service.FileGetRendition(params.HTTPRequest.Context(), params.Bucket, params.FileID, params.Version, *params.Rendition, rng)
+		} else {
+			r, fd, err = h.service.FileGetVersion(params.HTTPRequest.Context(), params.Bucket, params.FileID, params.Version, rng)
+		}
+
+		return respondFile(fileGetVersionResponses, r, fd, err, rng, swag.StringValue(params.IfNoneMatch))
 	})
 }
 
@@ -139,10 +343,28 @@ func (h *handlers) FileNew() operations.FileNewHandler {
 		fd, err := h.service.FileNew(params.HTTPRequest.Context(), params.Bucket, params.File, params.ContentType, archetype, params.Labels)
 
 		if err != nil {
-			return operations.NewFileNewInternalServerError().WithPayload(&models.Error{
-				Code:    "server_error",
-				Message: err.Error(),
-			})
+			switch err {
+			case ErrArchived:
+				return operations.NewFileNewConflict().WithPayload(&models.Error{
+					Code:    "conflict",
+					Message: err.Error(),
+				})
+			case ErrQuotaExceeded:
+				return operations.NewFileNewInsufficientStorage().WithPayload(&models.Error{
+					Code:    "quota_exceeded",
+					Message: err.Error(),
+				})
+			case ErrInvalidDocument:
+				return operations.NewFileNewUnprocessableEntity().WithPayload(&models.Error{
+					Code:    "invalid_document",
+					Message: err.Error(),
+				})
+			default:
+				return operations.NewFileNewInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
 		}
 
 		return operations.NewFileNewCreated().WithPayload(fd)
@@ -163,6 +385,21 @@ func (h *handlers) FileUpdate() operations.FileUpdateHandler {
 			switch err {
 			case ErrNotFound:
 				return operations.NewFileUpdateNotFound()
+			case ErrArchived:
+				return operations.NewFileUpdateConflict().WithPayload(&models.Error{
+					Code:    "conflict",
+					Message: err.Error(),
+				})
+			case ErrQuotaExceeded:
+				return operations.NewFileUpdateInsufficientStorage().WithPayload(&models.Error{
+					Code:    "quota_exceeded",
+					Message: err.Error(),
+				})
+			case ErrInvalidDocument:
+				return operations.NewFileUpdateUnprocessableEntity().WithPayload(&models.Error{
+					Code:    "invalid_document",
+					Message: err.Error(),
+				})
 			default:
 				return operations.NewFileUpdateInternalServerError().WithPayload(&models.Error{
 					Code:    "server_error",
@@ -183,6 +420,11 @@ func (h *handlers) FileDelete() operations.FileDeleteHandler {
 			switch err {
 			case ErrNotFound:
 				return operations.NewFileDeleteNotFound()
+			case ErrArchived:
+				return operations.NewFileDeleteConflict().WithPayload(&models.Error{
+					Code:    "conflict",
+					Message: err.Error(),
+				})
 			default:
 				return operations.NewFileDeleteInternalServerError().WithPayload(&models.Error{
 					Code:    "server_error",
@@ -195,6 +437,143 @@ func (h *handlers) FileDelete() operations.FileDeleteHandler {
 	})
 }
 
+func (h *handlers) UploadNew() operations.UploadNewHandler {
+	return operations.UploadNewHandlerFunc(func(params operations.UploadNewParams, principal *string) middleware.Responder {
+		u, err := h.service.UploadNew(params.HTTPRequest.Context(), params.Bucket, params.Upload.FileID, swag.StringValue(params.Upload.ContentType), params.Upload.Archetype, params.Upload.Labels)
+
+		if err != nil {
+			switch err {
+			case ErrNotFound:
+				return operations.NewUploadNewNotFound()
+			case ErrArchived:
+				return operations.NewUploadNewConflict().WithPayload(&models.Error{
+					Code:    "conflict",
+					Message: err.Error(),
+				})
+			case ErrQuotaExceeded:
+				return operations.NewUploadNewInsufficientStorage().WithPayload(&models.Error{
+					Code:    "quota_exceeded",
+					Message: err.Error(),
+				})
+			default:
+				return operations.NewUploadNewInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return operations.NewUploadNewCreated().WithPayload(u)
+	})
+}
+
+func (h *handlers) UploadGet() operations.UploadGetHandler {
+	return operations.UploadGetHandlerFunc(func(params operations.UploadGetParams, principal *string) middleware.Responder {
+		u, err := h.service.UploadGet(params.HTTPRequest.Context(), params.Bucket, params.UploadID)
+
+		if err != nil {
+			switch err {
+			case ErrNotFound:
+				return operations.NewUploadGetNotFound()
+			default:
+				return operations.NewUploadGetInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return operations.NewUploadGetOK().WithPayload(u)
+	})
+}
+
+func (h *handlers) UploadChunk() operations.UploadChunkHandler {
+	return operations.UploadChunkHandlerFunc(func(params operations.UploadChunkParams, principal *string) middleware.Responder {
+		defer params.Chunk.Close()
+
+		u, err := h.service.UploadChunk(params.HTTPRequest.Context(), params.Bucket, params.UploadID, params.Offset, params.Chunk)
+
+		if err != nil {
+			switch err {
+			case ErrNotFound:
+				return operations.NewUploadChunkNotFound()
+			case ErrUploadOffset:
+				return operations.NewUploadChunkConflict().WithPayload(&models.Error{
+					Code:    "conflict",
+					Message: err.Error(),
+				})
+			case ErrQuotaExceeded:
+				return operations.NewUploadChunkInsufficientStorage().WithPayload(&models.Error{
+					Code:    "quota_exceeded",
+					Message: err.Error(),
+				})
+			default:
+				return operations.NewUploadChunkInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return operations.NewUploadChunkOK().WithPayload(u)
+	})
+}
+
+func (h *handlers) UploadCommit() operations.UploadCommitHandler {
+	return operations.UploadCommitHandlerFunc(func(params operations.UploadCommitParams, principal *string) middleware.Responder {
+		fd, err := h.service.UploadCommit(params.HTTPRequest.Context(), params.Bucket, params.UploadID)
+
+		if err != nil {
+			switch err {
+			case ErrNotFound:
+				return operations.NewUploadCommitNotFound()
+			case ErrArchived:
+				return operations.NewUploadCommitConflict().WithPayload(&models.Error{
+					Code:    "conflict",
+					Message: err.Error(),
+				})
+			case ErrQuotaExceeded:
+				return operations.NewUploadCommitInsufficientStorage().WithPayload(&models.Error{
+					Code:    "quota_exceeded",
+					Message: err.Error(),
+				})
+			case ErrInvalidDocument:
+				return operations.NewUploadCommitUnprocessableEntity().WithPayload(&models.Error{
+					Code:    "invalid_document",
+					Message: err.Error(),
+				})
+			default:
+				return operations.NewUploadCommitInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return operations.NewUploadCommitCreated().WithPayload(fd)
+	})
+}
+
+func (h *handlers) UploadDelete() operations.UploadDeleteHandler {
+	return operations.UploadDeleteHandlerFunc(func(params operations.UploadDeleteParams, principal *string) middleware.Responder {
+		err := h.service.UploadDelete(params.HTTPRequest.Context(), params.Bucket, params.UploadID)
+
+		if err != nil {
+			switch err {
+			case ErrNotFound:
+				return operations.NewUploadDeleteNotFound()
+			default:
+				return operations.NewUploadDeleteInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return operations.NewUploadDeleteNoContent()
+	})
+}
+
 func (h *handlers) SyncBucketList() operations.SyncBucketListHandler {
 	return operations.SyncBucketListHandlerFunc(func(params operations.SyncBucketListParams, principal *string) middleware.Responder {
 		list, err := h.service.BucketList(params.HTTPRequest.Context())
@@ -213,21 +592,56 @@ func (h *handlers) SyncBucketList() operations.SyncBucketListHandler {
 	})
 }
 
+func (h *handlers) SyncChangeList() operations.SyncChangeListHandler {
+	return operations.SyncChangeListHandlerFunc(func(params operations.SyncChangeListParams, principal *string) middleware.Responder {
+		list, last, err := h.service.SyncChangeList(params.HTTPRequest.Context(), swag.Int64Value(params.Since), int(swag.Int64Value(params.Limit)))
+
+		if err != nil {
+			switch err {
+			case ErrNoChangeLog:
+				return operations.NewSyncChangeListNotFound().WithPayload(&models.Error{
+					Code:    "not_found",
+					Message: err.Error(),
+				})
+			default:
+				return operations.NewSyncChangeListInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return operations.NewSyncChangeListOK().WithPayload(list).WithXLastSequence(last)
+	})
+}
+
 func (h *handlers) SyncFileList() operations.SyncFileListHandler {
 	return operations.SyncFileListHandlerFunc(func(params operations.SyncFileListParams, principal *string) middleware.Responder {
-		list, err := h.service.SyncFileList(params.HTTPRequest.Context(), params.Bucket)
+		opts := &ListOptions{
+			Cursor: swag.StringValue(params.Cursor),
+			Limit:  int(swag.Int64Value(params.Limit)),
+		}
+		list, next, err := h.service.SyncFileList(params.HTTPRequest.Context(), params.Bucket, opts)
 
 		if err != nil {
-			return operations.NewSyncFileListInternalServerError().WithPayload(&models.Error{
-				Code:    "server_error",
-				Message: err.Error(),
-			})
+			switch err {
+			case ErrInvalidCursor:
+				return operations.NewSyncFileListBadRequest().WithPayload(&models.Error{
+					Code:    "bad_request",
+					Message: err.Error(),
+				})
+			default:
+				return operations.NewSyncFileListInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
 		}
 		if len(list) == 0 {
 			return operations.NewSyncFileListNotFound()
 		}
 
-		return operations.NewSyncFileListOK().WithPayload(list)
+		return operations.NewSyncFileListOK().WithPayload(list).WithXNextCursor(next)
 	})
 }
 
@@ -249,16 +663,45 @@ func (h *handlers) SyncFileListVersions() operations.SyncFileListVersionsHandler
 	})
 }
 
+func (h *handlers) SyncFileGet() operations.SyncFileGetHandler {
+	return operations.SyncFileGetHandlerFunc(func(params operations.SyncFileGetParams, principal *string) middleware.Responder {
+		r, fd, err := h.service.FileGetVersion(params.HTTPRequest.Context(), params.Bucket, params.FileID, params.Version, nil)
+
+		if err != nil {
+			switch err {
+			case ErrNotFound:
+				return operations.NewSyncFileGetNotFound()
+			default:
+				return operations.NewSyncFileGetInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return utils.UseProducer(operations.NewSyncFileGetOK().
+			WithPayload(r).
+			WithContentType(fd.ContentType).
+			WithXCreated(fd.Created).
+			WithXVersion(fd.Version).
+			WithXArchetype(fd.Archetype).
+			WithXChecksum(fd.Checksum).
+			WithXName(fd.Name).
+			WithXPath(fd.Path).
+			WithXLabels(formatLabelsHeader(fd.Labels)), utils.FileProducer)
+	})
+}
+
 func (h *handlers) SyncFileMetadata() operations.SyncFileMetadataHandler {
 	return operations.SyncFileMetadataHandlerFunc(func(params operations.SyncFileMetadataParams, principal *string) middleware.Responder {
-		_, fd, err := h.service.FileGetVersion(params.HTTPRequest.Context(), params.Bucket, params.FileID, params.Version)
+		fd, err := h.service.FileStat(params.HTTPRequest.Context(), params.Bucket, params.FileID, params.Version)
 
 		if err != nil {
 			switch err {
 			case ErrNotFound:
-				return operations.NewSyncFileMetadataNotFound()
+				return operations.NewSyncFileMetadataNotFound().WithAcceptEncoding(strings.Join(SyncEncodings, ","))
 			default:
-				h.logger.Error().Err(err).Msg("Failed to fetch the file to return metadata")
+				h.logger.Error().Err(err).Msg("Failed to stat the file to return metadata")
 				return operations.NewSyncFileMetadataInternalServerError()
 			}
 		}
@@ -271,7 +714,29 @@ func (h *handlers) SyncFileMetadata() operations.SyncFileMetadataHandler {
 			WithXChecksum(fd.Checksum).
 			WithXName(fd.Name).
 			WithXPath(fd.Path).
-			WithXLabels(formatLabelsHeader(fd.Labels))
+			WithXLabels(formatLabelsHeader(fd.Labels)).
+			WithXSize(fd.Size).
+			WithAcceptEncoding(strings.Join(SyncEncodings, ","))
+	})
+}
+
+func (h *handlers) SyncFileSignature() operations.SyncFileSignatureHandler {
+	return operations.SyncFileSignatureHandlerFunc(func(params operations.SyncFileSignatureParams, principal *string) middleware.Responder {
+		sig, err := h.service.SyncFileSignature(params.HTTPRequest.Context(), params.Bucket, params.FileID, params.Version, int(swag.Int64Value(params.BlockSize)))
+
+		if err != nil {
+			switch err {
+			case ErrNotFound, ErrDeleted:
+				return operations.NewSyncFileSignatureNotFound()
+			default:
+				return operations.NewSyncFileSignatureInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return operations.NewSyncFileSignatureOK().WithPayload(sig)
 	})
 }
 
@@ -280,12 +745,36 @@ func (h *handlers) SyncFile() operations.SyncFileHandler {
 		defer params.File.Close()
 		archetype := swag.StringValue(params.Archetype)
 
+		r, err := h.service.SyncFileDecode(
+			params.HTTPRequest.Context(),
+			params.Bucket,
+			params.FileID,
+			params.File,
+			params.Encoding,
+			swag.StringValue(params.Base),
+			swag.StringValue(params.Checksum),
+		)
+		if err != nil {
+			switch err {
+			case ErrInvalidEncoding, ErrChecksumMismatch:
+				return operations.NewSyncFileBadRequest().WithPayload(&models.Error{
+					Code:    "bad_request",
+					Message: err.Error(),
+				})
+			default:
+				return operations.NewSyncFileInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
 		fd, err := h.service.SyncFile(
 			params.HTTPRequest.Context(),
 			params.Bucket,
 			params.FileID,
 			params.Version,
-			params.File,
+			r,
 			params.ContentType,
 			params.Created,
 			archetype,
@@ -298,6 +787,11 @@ func (h *handlers) SyncFile() operations.SyncFileHandler {
 				return operations.NewSyncFileOK().WithPayload(fd)
 			case ErrAlreadyExistsConflict:
 				return operations.NewSyncFileConflict()
+			case ErrInvalidDocument:
+				return operations.NewSyncFileUnprocessableEntity().WithPayload(&models.Error{
+					Code:    "invalid_document",
+					Message: err.Error(),
+				})
 			default:
 				return operations.NewSyncFileInternalServerError().WithPayload(&models.Error{
 					Code:    "server_error",
@@ -331,6 +825,25 @@ func (h *handlers) SyncFileDelete() operations.SyncFileDeleteHandler {
 	})
 }
 
+func (h *handlers) SyncFilePurge() operations.SyncFilePurgeHandler {
+	return operations.SyncFilePurgeHandlerFunc(func(params operations.SyncFilePurgeParams, principal *string) middleware.Responder {
+		err := h.service.SyncFilePurge(params.HTTPRequest.Context(), params.Bucket, params.FileID, params.Version)
+		if err != nil {
+			switch err {
+			case ErrNotFound:
+				return operations.NewSyncFilePurgeNotFound()
+			default:
+				return operations.NewSyncFilePurgeInternalServerError().WithPayload(&models.Error{
+					Code:    "server_error",
+					Message: err.Error(),
+				})
+			}
+		}
+
+		return operations.NewSyncFilePurgeNoContent()
+	})
+}
+
 // NewHandlers returns a new instance of authenticator handlers
 func NewHandlers(service Service, logger zerolog.Logger) Handlers {
 	logger = logger.With().Str("component", "service/storage/handlers").Logger()
@@ -341,3 +854,186 @@ func NewHandlers(service Service, logger zerolog.Logger) Handlers {
 func formatLabelsHeader(l []string) string {
 	return strings.Join(l, "|")
 }
+
+// acceptRanges is the range unit supported by file endpoints
+const acceptRanges = "bytes"
+
+// fileContents is implemented by responses of file endpoints carrying file
+// contents
+type fileContents interface {
+	middleware.Responder
+	SetPayload(io.ReadCloser)
+	SetContentType(string)
+	SetETag(string)
+	SetAcceptRanges(string)
+	SetXCreated(strfmt.DateTime)
+	SetXVersion(string)
+	SetXArchetype(string)
+	SetXChecksum(string)
+	SetXName(string)
+	SetXPath(string)
+	SetXLabels(string)
+}
+
+// partialFileContents is implemented by responses of file endpoints carrying
+// part of file contents
+type partialFileContents interface {
+	fileContents
+	SetContentRange(string)
+}
+
+// fileResponses creates responses of a file endpoint
+type fileResponses struct {
+	ok           func() fileContents
+	partial      func() partialFileContents
+	notModified  func(etag string) middleware.Responder
+	notFound     func() middleware.Responder
+	invalidRange func(contentRange string) middleware.Responder
+	serverError  func(payload *models.Error) middleware.Responder
+}
+
+// fileGetResponses creates responses of fileGet operation
+var fileGetResponses = fileResponses{
+	ok:      func() fileContents { return operations.NewFileGetOK() },
+	partial: func() partialFileContents { return operations.NewFileGetPartialContent() },
+	notModified: func(etag string) middleware.Responder {
+		return operations.NewFileGetNotModified().WithETag(etag)
+	},
+	notFound: func() middleware.Responder { return operations.NewFileGetNotFound() },
+	invalidRange: func(contentRange string) middleware.Responder {
+		return operations.NewFileGetRequestedRangeNotSatisfiable().WithContentRange(contentRange)
+	},
+	serverError: func(payload *models.Error) middleware.Responder {
+		return operations.NewFileGetInternalServerError().WithPayload(payload)
+	},
+}
+
+// fileGetVersionResponses creates responses of fileGetVersion operation
+var fileGetVersionResponses = fileResponses{
+	ok:      func() fileContents { return operations.NewFileGetVersionOK() },
+	partial: func() partialFileContents { return operations.NewFileGetVersionPartialContent() },
+	notModified: func(etag string) middleware.Responder {
+		return operations.NewFileGetVersionNotModified().WithETag(etag)
+	},
+	notFound: func() middleware.Responder { return operations.NewFileGetVersionNotFound() },
+	invalidRange: func(contentRange string) middleware.Responder {
+		return operations.NewFileGetVersionRequestedRangeNotSatisfiable().WithContentRange(contentRange)
+	},
+	serverError: func(payload *models.Error) middleware.Responder {
+		return operations.NewFileGetVersionInternalServerError().WithPayload(payload)
+	},
+}
+
+// respondFile returns response to reading the file with requested range, the
+// file is not sent if it matches value of If-None-Match header
+func respondFile(responses fileResponses, r io.ReadCloser, fd *models.FileDescriptor, err error, rng *s3.Range, ifNoneMatch string) middleware.Responder {
+	if err != nil {
+		switch {
+		case err == ErrNotFound:
+			return responses.notFound()
+		case err == ErrInvalidRange && matchETag(ifNoneMatch, fd.Checksum):
+			return responses.notModified(formatETag(fd.Checksum))
+		case err == ErrInvalidRange:
+			return responses.invalidRange(fmt.Sprintf("bytes */%d", fd.Size))
+		default:
+			return responses.serverError(&models.Error{
+				Code:    "server_error",
+				Message: err.Error(),
+			})
+		}
+	}
+
+	// client already has the file
+	if matchETag(ifNoneMatch, fd.Checksum) {
+		r.Close()
+		return responses.notModified(formatETag(fd.Checksum))
+	}
+
+	var resp fileContents
+	if rng != nil {
+		partial := responses.partial()
+		partial.SetContentRange(formatContentRange(rng, fd.Size))
+		resp = partial
+	} else {
+		resp = responses.ok()
+	}
+
+	resp.SetPayload(r)
+	resp.SetContentType(fd.ContentType)
+	resp.SetETag(formatETag(fd.Checksum))
+	resp.SetAcceptRanges(acceptRanges)
+	resp.SetXCreated(fd.Created)
+	resp.SetXVersion(fd.Version)
+	resp.SetXArchetype(fd.Archetype)
+	resp.SetXChecksum(fd.Checksum)
+	resp.SetXName(fd.Name)
+	resp.SetXPath(fd.Path)
+	resp.SetXLabels(formatLabelsHeader(fd.Labels))
+
+	return utils.UseProducer(resp, utils.FileProducer)
+}
+
+// parseRange parses value of Range header. Only a single byte range is
+// supported, nil is returned for other values so the whole file is served.
+func parseRange(header string) *s3.Range {
+	if !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return nil
+	}
+
+	items := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(header, "bytes=")), "-", 2)
+	if len(items) != 2 {
+		return nil
+	}
+
+	// suffix range selecting the last bytes
+	if items[0] == "" {
+		n, err := strconv.ParseInt(items[1], 10, 64)
+		if err != nil || n <= 0 {
+			return nil
+		}
+		return &s3.Range{Start: -n, End: -1}
+	}
+
+	start, err := strconv.ParseInt(items[0], 10, 64)
+	if err != nil || start < 0 {
+		return nil
+	}
+	end := int64(-1)
+	if items[1] != "" {
+		end, err = strconv.ParseInt(items[1], 10, 64)
+		if err != nil || end < start {
+			return nil
+		}
+	}
+
+	return &s3.Range{Start: start, End: end}
+}
+
+// formatContentRange returns value of Content-Range header for the range
+func formatContentRange(rng *s3.Range, size int64) string {
+	offset, length, _ := rng.Resolve(size)
+	return fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size)
+}
+
+// formatETag returns entity tag of the file with given checksum
+func formatETag(checksum string) string {
+	return fmt.Sprintf("\"%s\"", checksum)
+}
+
+// matchETag checks if value of If-None-Match header matches the file with
+// given checksum; weak comparison is used as required for If-None-Match
+func matchETag(header, checksum string) bool {
+	if header == "" {
+		return false
+	}
+
+	etag := formatETag(checksum)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/iryonetwork/wwm/storage/s3"
+)
+
+func TestParseRange(t *testing.T) {
+	testCases := []struct {
+		header   string
+		expected *s3.Range
+	}{
+		{"", nil},
+		{"bytes=0-99", &s3.Range{Start: 0, End: 99}},
+		{"bytes=100-", &s3.Range{Start: 100, End: -1}},
+		{"bytes=-100", &s3.Range{Start: -100, End: -1}},
+		{"bytes=-0", nil},
+		{"bytes=5-1", nil},
+		{"bytes=0-1,5-9", nil},
+		{"items=0-1", nil},
+		{"bytes=a-b", nil},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.header, func(t *testing.T) {
+			if rng := parseRange(test.header); !reflect.DeepEqual(rng, test.expected) {
+				t.Errorf("Expected range to equal %+v, got %+v", test.expected, rng)
+			}
+		})
+	}
+}
+
+func TestMatchETag(t *testing.T) {
+	testCases := []struct {
+		header   string
+		expected bool
+	}{
+		{"", false},
+		{`"CHS"`, true},
+		{`W/"CHS"`, true},
+		{`"OTHER", "CHS"`, true},
+		{`"OTHER"`, false},
+		{"*", true},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.header, func(t *testing.T) {
+			if match := matchETag(test.header, "CHS"); match != test.expected {
+				t.Errorf("Expected match to be %t, got %t", test.expected, match)
+			}
+		})
+	}
+}
+
+func TestFormatContentRange(t *testing.T) {
+	if cr := formatContentRange(&s3.Range{Start: -10, End: -1}, 100); cr != "bytes 90-99/100" {
+		t.Errorf("Expected content range to equal 'bytes 90-99/100', got '%s'", cr)
+	}
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-openapi/strfmt"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/storage/s3"
+)
+
+// ListOptions holds filters and pagination parameters used when listing files.
+// Zero values disable the filter, Limit of 0 returns all the files.
+type ListOptions struct {
+	Cursor      string
+	Limit       int
+	Archetype   string
+	Label       string
+	ContentType string
+	CreatedFrom *strfmt.DateTime
+	CreatedTo   *strfmt.DateTime
+	// AsOf lists versions of files valid at the time instead of the latest
+	// ones
+	AsOf *strfmt.DateTime
+}
+
+// ErrInvalidCursor indicates cursor could not be decoded
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// matches checks if file descriptor passes all the filters
+func (o *ListOptions) matches(fd *models.FileDescriptor) bool {
+	if o.Archetype != "" && fd.Archetype != o.Archetype {
+		return false
+	}
+	if o.ContentType != "" && fd.ContentType != o.ContentType {
+		return false
+	}
+	if o.Label != "" && !hasLabel(fd.Labels, o.Label) {
+		return false
+	}
+	created := time.Time(fd.Created)
+	if o.CreatedFrom != nil && created.Before(time.Time(*o.CreatedFrom)) {
+		return false
+	}
+	if o.CreatedTo != nil && !created.Before(time.Time(*o.CreatedTo)) {
+		return false
+	}
+
+	return true
+}
+
+// valid checks if the version already existed at the AsOf time
+func (o *ListOptions) valid(fd *models.FileDescriptor) bool {
+	return o.AsOf == nil || validAt(fd, *o.AsOf)
+}
+
+// validAt checks if the version was created at or before the time
+func validAt(fd *models.FileDescriptor, t strfmt.DateTime) bool {
+	return !time.Time(fd.Created).After(time.Time(t))
+}
+
+// page sorts the list newest first and returns files following the cursor
+// together with the cursor of the next page. Files with the same created time
+// are sorted by name so the order is stable between requests. The list is
+// returned unchanged if pagination was not requested.
+func (o *ListOptions) page(list []*models.FileDescriptor) ([]*models.FileDescriptor, string, error) {
+	if o.Cursor == "" && o.Limit == 0 {
+		return list, "", nil
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return before(list[i], list[j])
+	})
+
+	if o.Cursor != "" {
+		last, err := decodeCursor(o.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		start := sort.Search(len(list), func(i int) bool {
+			return before(last, list[i])
+		})
+		list = list[start:]
+	}
+
+	if o.Limit == 0 || len(list) <= o.Limit {
+		return list, "", nil
+	}
+
+	list = list[:o.Limit]
+	return list, encodeCursor(list[len(list)-1]), nil
+}
+
+// before reports whether a is listed before b
+func before(a, b *models.FileDescriptor) bool {
+	ta, tb := time.Time(a.Created), time.Time(b.Created)
+	if !ta.Equal(tb) {
+		return ta.After(tb)
+	}
+	return a.Name < b.Name
+}
+
+// encodeCursor returns cursor pointing at the file descriptor
+func encodeCursor(fd *models.FileDescriptor) string {
+	c := fmt.Sprintf("%d.%s", time.Time(fd.Created).UnixNano(), fd.Name)
+	return base64.RawURLEncoding.EncodeToString([]byte(c))
+}
+
+// decodeCursor returns the file descriptor the cursor points at; only name and
+// created time are set
+func decodeCursor(cursor string) (*models.FileDescriptor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	items := strings.SplitN(string(b), ".", 2)
+	if len(items) != 2 {
+		return nil, ErrInvalidCursor
+	}
+	ns, err := strconv.ParseInt(items[0], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return &models.FileDescriptor{
+		Name:    items[1],
+		Created: strfmt.DateTime(time.Unix(0, ns).UTC()),
+	}, nil
+}
+
+// bucketStats summarizes all versions of files stored in a bucket, the list
+// needs to be sorted newest first
+func bucketStats(list []*models.FileDescriptor) *models.BucketStats {
+	stats := &models.BucketStats{Versions: int64(len(list))}
+	if len(list) > 0 {
+		stats.LastModified = list[0].Created
+	}
+
+	seen := map[string]bool{}
+	for _, fd := range list {
+		stats.Size += fd.Size
+		if seen[fd.Name] {
+			continue
+		}
+		seen[fd.Name] = true
+		if s3.Operation(fd.Operation) == s3.Write {
+			stats.Files++
+		}
+	}
+
+	return stats
+}
+
+func hasLabel(labels []string, label string) bool {
+	for _, l := range labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/metrics"
+	"github.com/iryonetwork/wwm/status"
+	"github.com/iryonetwork/wwm/storage/s3"
+)
+
+// Storage quota does not allow to store the file
+var ErrQuotaExceeded = errors.New("Storage quota exceeded")
+
+const (
+	quotaUsed     metrics.ID = "quotaUsed"
+	quotaLimit    metrics.ID = "quotaLimit"
+	quotaExceeded metrics.ID = "quotaExceeded"
+)
+
+// QuotaLimits holds limits of stored bytes and files. Bytes include all the
+// versions of files, files count only files that were not deleted. Zero
+// disables the limit.
+type QuotaLimits struct {
+	BucketBytes int64
+	BucketFiles int64
+	TotalBytes  int64
+	TotalFiles  int64
+	// WarningRatio is the part of a limit after which status reports warning
+	WarningRatio float64
+}
+
+type usage struct {
+	bytes int64
+	files int64
+}
+
+// Quota tracks usage of the storage and enforces quota limits. Usage is
+// calculated from listing of the buckets when first needed and then kept up
+// to date as files are written; buckets are listed again after their files
+// are purged. All methods can be called on nil Quota which does not limit
+// anything.
+type Quota struct {
+	s3     s3.Storage
+	limits QuotaLimits
+	logger zerolog.Logger
+
+	mu      sync.Mutex
+	loaded  bool
+	buckets map[string]*usage
+	total   usage
+
+	metricsCollection map[metrics.ID]prometheus.Collector
+}
+
+// NewQuota returns a new quota tracking usage of the storage
+func NewQuota(storage s3.Storage, limits QuotaLimits, logger zerolog.Logger) *Quota {
+	logger = logger.With().Str("component", "service/storage/quota").Logger()
+
+	metricsCollection := make(map[metrics.ID]prometheus.Collector)
+	metricsCollection[quotaUsed] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "storage_quota",
+		Name:      "used",
+		Help:      "Bytes and files stored in all the buckets",
+	}, []string{"resource"})
+	metricsCollection[quotaLimit] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "storage_quota",
+		Name:      "limit",
+		Help:      "Quota limits of bytes and files, zero if not limited",
+	}, []string{"scope", "resource"})
+	metricsCollection[quotaExceeded] = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "storage_quota",
+		Name:      "exceeded_total",
+		Help:      "Number of writes rejected because of exceeded quota",
+	}, []string{"scope"})
+
+	limit := metricsCollection[quotaLimit].(*prometheus.GaugeVec)
+	limit.WithLabelValues("bucket", "bytes").Set(float64(limits.BucketBytes))
+	limit.WithLabelValues("bucket", "files").Set(float64(limits.BucketFiles))
+	limit.WithLabelValues("total", "bytes").Set(float64(limits.TotalBytes))
+	limit.WithLabelValues("total", "files").Set(float64(limits.TotalFiles))
+
+	return &Quota{
+		s3:                storage,
+		limits:            limits,
+		logger:            logger,
+		buckets:           make(map[string]*usage),
+		metricsCollection: metricsCollection,
+	}
+}
+
+// Load calculates usage of all the buckets
+func (q *Quota) Load(ctx context.Context) error {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.load(ctx)
+}
+
+// check returns ErrQuotaExceeded if the bucket is full or adding the files
+// would exceed files limits
+func (q *Quota) check(ctx context.Context, bucketID string, files int64) error {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, err := q.bucket(ctx, bucketID)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case full(u.bytes, 0, q.limits.BucketBytes) || full(u.files, files, q.limits.BucketFiles):
+		return q.exceeded("bucket")
+	case full(q.total.bytes, 0, q.limits.TotalBytes) || full(q.total.files, files, q.limits.TotalFiles):
+		return q.exceeded("total")
+	}
+
+	return nil
+}
+
+// room returns the number of bytes that can still be added to the bucket, -1
+// is returned if bytes are not limited
+func (q *Quota) room(ctx context.Context, bucketID string) (int64, error) {
+	if q == nil {
+		return -1, nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, err := q.bucket(ctx, bucketID)
+	if err != nil {
+		return 0, err
+	}
+
+	room := int64(-1)
+	for _, l := range []struct{ used, limit int64 }{
+		{u.bytes, q.limits.BucketBytes},
+		{q.total.bytes, q.limits.TotalBytes},
+	} {
+		if l.limit <= 0 {
+			continue
+		}
+		left := l.limit - l.used
+		if left < 0 {
+			left = 0
+		}
+		if room < 0 || left < room {
+			room = left
+		}
+	}
+
+	return room, nil
+}
+
+// add adds stored bytes and files to the usage. ErrQuotaExceeded is returned
+// and usage is left unchanged if limits would be exceeded.
+func (q *Quota) add(ctx context.Context, bucketID string, files, bytes int64) error {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, err := q.bucket(ctx, bucketID)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case over(u.bytes+bytes, q.limits.BucketBytes) || over(u.files+files, q.limits.BucketFiles):
+		return q.exceeded("bucket")
+	case over(q.total.bytes+bytes, q.limits.TotalBytes) || over(q.total.files+files, q.limits.TotalFiles):
+		return q.exceeded("total")
+	}
+
+	q.change(u, files, bytes)
+	return nil
+}
+
+// update changes the usage without checking limits
+func (q *Quota) update(bucketID string, files, bytes int64) {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if u, ok := q.buckets[bucketID]; ok {
+		q.change(u, files, bytes)
+	}
+}
+
+// invalidate makes the bucket to be listed again when its usage is needed
+func (q *Quota) invalidate(bucketID string) {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if u, ok := q.buckets[bucketID]; ok {
+		q.change(u, -u.files, -u.bytes)
+		delete(q.buckets, bucketID)
+	}
+}
+
+// Status reports warning when usage gets close to the limits and error when
+// the storage is full
+func (q *Quota) Status() *status.Response {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.loaded {
+		return &status.Response{Status: status.OK, Msg: "Usage of the storage is not known yet"}
+	}
+
+	used := ratio(q.total.bytes, q.limits.TotalBytes)
+	if r := ratio(q.total.files, q.limits.TotalFiles); r > used {
+		used = r
+	}
+	if used >= 1 {
+		return &status.Response{Status: status.Error, Msg: "Storage quota exceeded"}
+	}
+	if q.limits.WarningRatio > 0 && used >= q.limits.WarningRatio {
+		return &status.Response{Status: status.Warning, Msg: fmt.Sprintf("Storage usage is at %.0f%% of the quota", used*100)}
+	}
+
+	var closeToLimit int
+	for _, u := range q.buckets {
+		if q.limits.WarningRatio <= 0 {
+			break
+		}
+		if ratio(u.bytes, q.limits.BucketBytes) >= q.limits.WarningRatio || ratio(u.files, q.limits.BucketFiles) >= q.limits.WarningRatio {
+			closeToLimit++
+		}
+	}
+	if closeToLimit > 0 {
+		return &status.Response{Status: status.Warning, Msg: fmt.Sprintf("Buckets close to their quota: %d", closeToLimit)}
+	}
+
+	return &status.Response{Status: status.OK}
+}
+
+// GetPrometheusMetricsCollection returns all prometheus metrics collectors to be registered
+func (q *Quota) GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector {
+	return q.metricsCollection
+}
+
+// load lists all the buckets, needs to be called with the lock held
+func (q *Quota) load(ctx context.Context) error {
+	buckets, err := q.s3.ListBuckets(ctx)
+	if err != nil {
+		q.logger.Error().Err(err).Msg("Failed to list buckets to calculate usage")
+		return err
+	}
+
+	q.buckets = make(map[string]*usage)
+	q.total = usage{}
+	for _, b := range buckets {
+		if _, err := q.list(ctx, b.Name); err != nil {
+			return err
+		}
+	}
+	q.loaded = true
+
+	return nil
+}
+
+// bucket returns usage of the bucket, needs to be called with the lock held
+func (q *Quota) bucket(ctx context.Context, bucketID string) (*usage, error) {
+	if !q.loaded {
+		if err := q.load(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if u, ok := q.buckets[bucketID]; ok {
+		return u, nil
+	}
+	return q.list(ctx, bucketID)
+}
+
+// list calculates usage of the bucket from the list of its files
+func (q *Quota) list(ctx context.Context, bucketID string) (*usage, error) {
+	list, err := q.s3.List(ctx, bucketID, "")
+	if err != nil {
+		q.logger.Error().Err(err).Str("bucket", bucketID).Msg("Failed to list files to calculate usage")
+		return nil, err
+	}
+	stats := bucketStats(list)
+
+	u := &usage{}
+	q.buckets[bucketID] = u
+	q.change(u, stats.Files, stats.Size)
+
+	return u, nil
+}
+
+func (q *Quota) change(u *usage, files, bytes int64) {
+	u.files += files
+	u.bytes += bytes
+	q.total.files += files
+	q.total.bytes += bytes
+
+	used := q.metricsCollection[quotaUsed].(*prometheus.GaugeVec)
+	used.WithLabelValues("bytes").Set(float64(q.total.bytes))
+	used.WithLabelValues("files").Set(float64(q.total.files))
+}
+
+func (q *Quota) exceeded(scope string) error {
+	q.metricsCollection[quotaExceeded].(*prometheus.CounterVec).WithLabelValues(scope).Inc()
+	return ErrQuotaExceeded
+}
+
+// full reports whether no more bytes or files can be added
+func full(used, added, limit int64) bool {
+	if added == 0 {
+		return limit > 0 && used >= limit
+	}
+	return over(used+added, limit)
+}
+
+// over reports whether the limit is exceeded
+func over(used, limit int64) bool {
+	return limit > 0 && used > limit
+}
+
+// ratio returns used part of the limit, zero if not limited
+func ratio(used, limit int64) float64 {
+	if limit <= 0 {
+		return 0
+	}
+	return float64(used) / float64(limit)
+}
@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	_ "image/gif" // register gif decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/storage/s3"
+	"github.com/iryonetwork/wwm/storage/s3/object"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+)
+
+// labelRendition marks files holding renditions of images
+const labelRendition = "rendition"
+
+// Renditions of images
+const (
+	RenditionThumb   = "thumb"
+	RenditionPreview = "preview"
+)
+
+// renditionSizes hold maximum width and height of renditions in pixels
+var renditionSizes = map[string]int{
+	RenditionThumb:   160,
+	RenditionPreview: 1024,
+}
+
+// maxRenditionPixels limits size of images renditions are generated for so
+// decoding them does not exhaust memory
+const maxRenditionPixels = 40000000
+
+// hasRenditions reports whether renditions are generated for the content type
+func hasRenditions(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// renditionName returns name of the file holding rendition of the file.
+// Rendition has the same version as the version of the file it was generated
+// from.
+func renditionName(fileID, rendition string) string {
+	return fileID + "-" + rendition
+}
+
+func (s *service) FileGetRendition(ctx context.Context, bucketID, fileID, version, rendition string, rng *s3.Range) (io.ReadCloser, *models.FileDescriptor, error) {
+	if _, ok := renditionSizes[rendition]; !ok {
+		return nil, nil, ErrNotFound
+	}
+
+	// find the version of the file; deleted files have no renditions
+	versions, err := s.s3.List(ctx, bucketID, fileID+".")
+	if err != nil {
+		return nil, nil, err
+	}
+	var fd *models.FileDescriptor
+	for _, v := range versions {
+		if version == "" || v.Version == version {
+			fd = v
+			break
+		}
+	}
+	if fd == nil || s3.Operation(fd.Operation) == s3.Delete {
+		return nil, nil, ErrNotFound
+	}
+
+	start := time.Now()
+	rc, rfd, err := s.read(ctx, bucketID, renditionName(fileID, rendition), fd.Version, rng)
+	s.logger.Info().Str("method", "FileGetRendition").Msgf("s3 read time %s", time.Since(start))
+
+	return rc, rfd, err
+}
+
+// storeRenditions generates and stores renditions of the image; failures are
+// only logged as the image itself was already stored
+func (s *service) storeRenditions(ctx context.Context, bucketID string, fd *models.FileDescriptor) {
+	logger := s.logger.With().Str("bucket", bucketID).Str("fileID", fd.Name).Str("version", fd.Version).Logger()
+
+	r, _, err := s.s3.Read(ctx, bucketID, fd.Name, fd.Version)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to read image to generate renditions")
+		return
+	}
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to read image to generate renditions")
+		return
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		logger.Info().Err(err).Msg("failed to decode image, renditions are not generated")
+		return
+	}
+	if cfg.Width*cfg.Height > maxRenditionPixels {
+		logger.Info().Msgf("image of %dx%d pixels is too large, renditions are not generated", cfg.Width, cfg.Height)
+		return
+	}
+	img, format, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		logger.Info().Err(err).Msg("failed to decode image, renditions are not generated")
+		return
+	}
+
+	for _, rendition := range []string{RenditionThumb, RenditionPreview} {
+		var buf bytes.Buffer
+		contentType, err := encodeImage(&buf, scaleImage(img, renditionSizes[rendition]), format)
+		if err != nil {
+			logger.Error().Err(err).Msgf("failed to encode %s rendition", rendition)
+			return
+		}
+
+		checksum, err := s.Checksum(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to calculate checksum")
+			return
+		}
+
+		no := &object.NewObjectInfo{
+			Checksum:    checksum,
+			Size:        int64(buf.Len()),
+			Created:     fd.Created,
+			ContentType: contentType,
+			Version:     fd.Version,
+			Name:        renditionName(fd.Name, rendition),
+			Operation:   string(s3.Write),
+			Labels:      []string{labelRendition},
+		}
+
+		rfd, err := s.s3.Write(ctx, bucketID, no, &buf)
+		if err != nil {
+			logger.Error().Err(err).Msgf("failed to write %s rendition", rendition)
+			return
+		}
+		s.quota.update(bucketID, 0, rfd.Size)
+
+		s.publisher.PublishAsyncWithRetries(
+			context.TODO(),
+			storageSync.FileNew,
+			&storageSync.FileInfo{BucketID: bucketID, FileID: rfd.Name, Version: rfd.Version, Created: rfd.Created},
+		)
+	}
+}
+
+// purgeRenditions purges renditions of the purged version of the file
+func (s *service) purgeRenditions(ctx context.Context, bucketID string, fd *models.FileDescriptor) error {
+	for _, rendition := range []string{RenditionThumb, RenditionPreview} {
+		name := renditionName(fd.Name, rendition)
+		err := s.s3.Purge(ctx, bucketID, name, fd.Version)
+		if err == s3.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		s.publisher.PublishAsyncWithRetries(
+			context.TODO(),
+			storageSync.FilePurge,
+			&storageSync.FileInfo{BucketID: bucketID, FileID: name, Version: fd.Version, Created: fd.Created},
+		)
+	}
+
+	return nil
+}
+
+// scaleImage downscales the image to fit into size x size pixels keeping its
+// aspect ratio; each pixel is the average of pixels of the source area
+func scaleImage(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+
+	dw, dh := size, size
+	if w > h {
+		dh = h * size / w
+	} else {
+		dw = w * size / h
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		sy0, sy1 := b.Min.Y+y*h/dh, b.Min.Y+(y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			sx0, sx1 := b.Min.X+x*w/dw, b.Min.X+(x+1)*w/dw
+
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+
+	return dst
+}
+
+// encodeImage encodes jpeg images as jpeg and others as png to keep their
+// transparency, returns content type of encoded image
+func encodeImage(w io.Writer, img image.Image, format string) (string, error) {
+	if format == "jpeg" {
+		return "image/jpeg", jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	}
+	return "image/png", png.Encode(w, img)
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v2"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/storage/s3"
+)
+
+// RetentionRule sets how long superseded versions and deleted files are kept.
+// Empty Bucket or Archetype matches any value.
+type RetentionRule struct {
+	Bucket    string `yaml:"bucket"`
+	Archetype string `yaml:"archetype"`
+	// VersionsDays is the number of days a version is kept after a newer one
+	// was created, zero keeps superseded versions forever
+	VersionsDays int `yaml:"versionsDays"`
+	// DeletedDays is the grace period in days after which all versions of a
+	// deleted file are purged, zero keeps deleted files forever
+	DeletedDays int `yaml:"deletedDays"`
+}
+
+// RetentionPolicy holds retention rules. The most specific rule matching the
+// file is applied: rules naming both the bucket and the archetype go first,
+// followed by rules naming only the archetype and rules naming only the
+// bucket. Files not matched by any rule are kept forever.
+type RetentionPolicy struct {
+	Rules []*RetentionRule `yaml:"rules"`
+}
+
+// LoadRetentionPolicy reads the retention policy from a yaml file
+func LoadRetentionPolicy(filepath string) (*RetentionPolicy, error) {
+	b, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read retention policy")
+	}
+
+	policy := &RetentionPolicy{}
+	if err := yaml.Unmarshal(b, policy); err != nil {
+		return nil, errors.Wrap(err, "failed to parse retention policy")
+	}
+
+	for _, r := range policy.Rules {
+		if r.VersionsDays < 0 || r.DeletedDays < 0 {
+			return nil, errors.Errorf("retention periods of bucket '%s' and archetype '%s' can not be negative", r.Bucket, r.Archetype)
+		}
+	}
+
+	return policy, nil
+}
+
+// rule returns the rule applied to files of the archetype stored in the
+// bucket, nil is returned if no rule matches
+func (p *RetentionPolicy) rule(bucketID, archetype string) *RetentionRule {
+	var match *RetentionRule
+	best := -1
+	for _, r := range p.Rules {
+		if (r.Bucket != "" && r.Bucket != bucketID) || (r.Archetype != "" && r.Archetype != archetype) {
+			continue
+		}
+
+		score := 0
+		if r.Archetype != "" {
+			score += 2
+		}
+		if r.Bucket != "" {
+			score++
+		}
+		if score > best {
+			match, best = r, score
+		}
+	}
+
+	return match
+}
+
+// expired returns versions of a single file to be purged, oldest first.
+// Versions need to be sorted newest first. The latest version is kept unless
+// the file was deleted and the grace period has passed; the deletion is then
+// purged last so an interrupted purge never brings the file back.
+func (r *RetentionRule) expired(versions []*models.FileDescriptor, now time.Time) []*models.FileDescriptor {
+	expired := []*models.FileDescriptor{}
+	if len(versions) == 0 {
+		return expired
+	}
+
+	latest := versions[0]
+	if r.DeletedDays > 0 && s3.Operation(latest.Operation) == s3.Delete &&
+		time.Time(latest.Created).Before(now.AddDate(0, 0, -r.DeletedDays)) {
+		for i := len(versions) - 1; i >= 0; i-- {
+			expired = append(expired, versions[i])
+		}
+		return expired
+	}
+
+	if r.VersionsDays == 0 {
+		return expired
+	}
+
+	// version is superseded when the following one is created
+	limit := now.AddDate(0, 0, -r.VersionsDays)
+	for i := len(versions) - 1; i > 0; i-- {
+		if time.Time(versions[i-1].Created).Before(limit) {
+			expired = append(expired, versions[i])
+		}
+	}
+
+	return expired
+}
+
+// RunRetention applies the retention policy to all the buckets straight away
+// and then on every interval until the context is cancelled
+func RunRetention(ctx context.Context, s Service, policy *RetentionPolicy, interval time.Duration, logger zerolog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		buckets, err := s.BucketList(ctx)
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to list buckets to apply retention policy")
+		}
+		for _, b := range buckets {
+			purged, err := s.ApplyRetention(ctx, b.Name, policy)
+			if err != nil {
+				logger.Error().Err(err).Str("bucket", b.Name).Msg("failed to apply retention policy")
+				continue
+			}
+			if purged > 0 {
+				logger.Info().Str("bucket", b.Name).Msgf("purged %d file versions", purged)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/metrics"
+	"github.com/iryonetwork/wwm/status"
+	"github.com/iryonetwork/wwm/storage/s3"
+	"github.com/iryonetwork/wwm/storage/s3/object"
+)
+
+const (
+	scrubChecked   metrics.ID = "scrubChecked"
+	scrubCorrupted metrics.ID = "scrubCorrupted"
+	scrubRepaired  metrics.ID = "scrubRepaired"
+	scrubDamaged   metrics.ID = "scrubDamaged"
+	scrubLastRun   metrics.ID = "scrubLastRun"
+)
+
+// Reasons of corrupted file versions
+const (
+	CorruptedChecksum   = "checksum"
+	CorruptedUnreadable = "unreadable"
+)
+
+// Fetcher fetches contents of file versions from another storage;
+// storageSync.Handlers fetch them from cloud storage.
+type Fetcher interface {
+	FetchDestinationFile(ctx context.Context, bucketID, fileID, version string, w io.Writer) error
+}
+
+// CorruptedVersion describes file version which contents do not match its
+// checksum or can not be read at all
+type CorruptedVersion struct {
+	Bucket  string
+	FileID  string
+	Version string
+	Reason  string
+}
+
+// Scrubber verifies integrity of stored files. Each version is read back,
+// its checksum recomputed and compared with the checksum kept in the object
+// key. Corrupted versions are re-fetched if a fetcher is set.
+type Scrubber struct {
+	s3      s3.Storage
+	fetcher Fetcher
+	logger  zerolog.Logger
+
+	mu        sync.Mutex
+	lastRun   time.Time
+	lastErr   error
+	corrupted []*CorruptedVersion
+
+	metricsCollection map[metrics.ID]prometheus.Collector
+}
+
+// NewScrubber returns a new scrubber of the storage; corrupted versions are
+// only reported if fetcher is nil
+func NewScrubber(storage s3.Storage, fetcher Fetcher, logger zerolog.Logger) *Scrubber {
+	logger = logger.With().Str("component", "service/storage/scrubber").Logger()
+
+	metricsCollection := make(map[metrics.ID]prometheus.Collector)
+	metricsCollection[scrubChecked] = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "storage_scrub",
+		Name:      "checked_total",
+		Help:      "Number of file versions checked",
+	})
+	metricsCollection[scrubCorrupted] = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "storage_scrub",
+		Name:      "corrupted_total",
+		Help:      "Number of corrupted file versions found",
+	}, []string{"reason"})
+	metricsCollection[scrubRepaired] = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "storage_scrub",
+		Name:      "repaired_total",
+		Help:      "Number of corrupted file versions re-fetched from cloud",
+	})
+	metricsCollection[scrubDamaged] = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "storage_scrub",
+		Name:      "corrupted",
+		Help:      "Number of corrupted file versions left after the last scrub",
+	})
+	metricsCollection[scrubLastRun] = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "storage_scrub",
+		Name:      "last_run_timestamp_seconds",
+		Help:      "Time the last scrub of all the buckets finished",
+	})
+
+	return &Scrubber{
+		s3:                storage,
+		fetcher:           fetcher,
+		logger:            logger,
+		metricsCollection: metricsCollection,
+	}
+}
+
+// Run scrubs all the buckets periodically until the context is cancelled
+func (s *Scrubber) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		corrupted, err := s.ScrubAll(ctx)
+		if err != nil {
+			s.logger.Error().Err(err).Msg("failed to scrub buckets")
+		} else if len(corrupted) > 0 {
+			s.logger.Error().Msgf("%d corrupted file versions left", len(corrupted))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ScrubAll scrubs all the buckets and returns corrupted versions that were
+// not repaired
+func (s *Scrubber) ScrubAll(ctx context.Context) ([]*CorruptedVersion, error) {
+	buckets, err := s.s3.ListBuckets(ctx)
+	if err != nil {
+		s.finish(nil, err)
+		return nil, err
+	}
+
+	corrupted := []*CorruptedVersion{}
+	for _, b := range buckets {
+		c, err := s.Scrub(ctx, b.Name)
+		if err != nil {
+			s.finish(nil, err)
+			return nil, err
+		}
+		corrupted = append(corrupted, c...)
+	}
+
+	s.finish(corrupted, nil)
+	return corrupted, nil
+}
+
+// Scrub verifies all the versions of files stored in the bucket and returns
+// corrupted versions that were not repaired
+func (s *Scrubber) Scrub(ctx context.Context, bucketID string) ([]*CorruptedVersion, error) {
+	list, err := s.s3.List(ctx, bucketID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	corrupted := []*CorruptedVersion{}
+	for _, fd := range list {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		// deletions have no contents
+		if s3.Operation(fd.Operation) == s3.Delete {
+			continue
+		}
+
+		reason, err := s.verify(ctx, bucketID, fd)
+		if err != nil {
+			return nil, err
+		}
+		s.metricsCollection[scrubChecked].(prometheus.Counter).Inc()
+		if reason == "" {
+			continue
+		}
+
+		s.metricsCollection[scrubCorrupted].(*prometheus.CounterVec).WithLabelValues(reason).Inc()
+		s.logger.Error().Str("bucket", bucketID).Str("fileID", fd.Name).Str("version", fd.Version).Msgf("file version is corrupted: %s", reason)
+
+		if s.repair(ctx, bucketID, fd) {
+			continue
+		}
+		corrupted = append(corrupted, &CorruptedVersion{Bucket: bucketID, FileID: fd.Name, Version: fd.Version, Reason: reason})
+	}
+
+	return corrupted, nil
+}
+
+// Status reports error if corrupted versions were found by the last scrub
+func (s *Scrubber) Status() *status.Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.lastErr != nil:
+		return &status.Response{Status: status.Warning, Msg: fmt.Sprintf("Last scrub failed: %v", s.lastErr)}
+	case len(s.corrupted) > 0:
+		return &status.Response{Status: status.Error, Msg: fmt.Sprintf("Corrupted file versions: %d", len(s.corrupted))}
+	case s.lastRun.IsZero():
+		return &status.Response{Status: status.OK, Msg: "Storage was not scrubbed yet"}
+	}
+
+	return &status.Response{Status: status.OK}
+}
+
+// GetPrometheusMetricsCollection returns all prometheus metrics collectors to be registered
+func (s *Scrubber) GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector {
+	return s.metricsCollection
+}
+
+// verify returns the reason the version is corrupted, empty if it is not
+func (s *Scrubber) verify(ctx context.Context, bucketID string, fd *models.FileDescriptor) (string, error) {
+	r, _, err := s.s3.Read(ctx, bucketID, fd.Name, fd.Version)
+	switch {
+	case err == s3.ErrNotFound:
+		// purged since the bucket was listed
+		return "", nil
+	case err != nil:
+		return CorruptedUnreadable, nil
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return CorruptedUnreadable, nil
+	}
+	if base64.URLEncoding.EncodeToString(h.Sum(nil)) != fd.Checksum {
+		return CorruptedChecksum, nil
+	}
+
+	return "", nil
+}
+
+// repair replaces contents of the corrupted version with contents fetched from
+// cloud and returns true if it succeeded
+func (s *Scrubber) repair(ctx context.Context, bucketID string, fd *models.FileDescriptor) bool {
+	if s.fetcher == nil {
+		return false
+	}
+	logger := s.logger.With().Str("bucket", bucketID).Str("fileID", fd.Name).Str("version", fd.Version).Logger()
+
+	// fetched contents are verified before the corrupted version is purged
+	var buf bytes.Buffer
+	if err := s.fetcher.FetchDestinationFile(ctx, bucketID, fd.Name, fd.Version, &buf); err != nil {
+		logger.Error().Err(err).Msg("failed to fetch file version")
+		return false
+	}
+	h := sha256.Sum256(buf.Bytes())
+	if base64.URLEncoding.EncodeToString(h[:]) != fd.Checksum {
+		logger.Error().Msg("fetched file version has different checksum")
+		return false
+	}
+
+	if err := s.s3.Purge(ctx, bucketID, fd.Name, fd.Version); err != nil {
+		logger.Error().Err(err).Msg("failed to purge corrupted file version")
+		return false
+	}
+
+	// contents are written without deduplication so they do not refer to
+	// other possibly corrupted contents
+	no := &object.NewObjectInfo{
+		Archetype:   fd.Archetype,
+		Checksum:    fd.Checksum,
+		Size:        int64(buf.Len()),
+		Created:     fd.Created,
+		ContentType: fd.ContentType,
+		Version:     fd.Version,
+		Name:        fd.Name,
+		Operation:   fd.Operation,
+		Labels:      fd.Labels,
+	}
+	if _, err := s.s3.Write(ctx, bucketID, no, &buf); err != nil {
+		logger.Error().Err(err).Msg("failed to write fetched file version; it was purged and is kept only in cloud")
+		return false
+	}
+
+	s.metricsCollection[scrubRepaired].(prometheus.Counter).Inc()
+	logger.Info().Msg("corrupted file version re-fetched from cloud")
+	return true
+}
+
+// finish records results of scrubbing all the buckets
+func (s *Scrubber) finish(corrupted []*CorruptedVersion, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastErr = err
+	if err != nil {
+		return
+	}
+
+	s.lastRun = time.Now()
+	s.corrupted = corrupted
+	s.metricsCollection[scrubDamaged].(prometheus.Gauge).Set(float64(len(corrupted)))
+	s.metricsCollection[scrubLastRun].(prometheus.Gauge).Set(float64(s.lastRun.Unix()))
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/storage/s3"
+)
+
+// ErrLabelRequired indicates files can not be searched without a label
+var ErrLabelRequired = errors.New("Label is required to search files")
+
+// ErrNotFilesCollection indicates file with ID of the label is not a files
+// collection
+var ErrNotFilesCollection = errors.New("File is not a files collection")
+
+func (s *service) FileSearch(ctx context.Context, buckets []string, opts *ListOptions) ([]*models.FileDescriptor, string, error) {
+	if opts == nil || opts.Label == "" {
+		return nil, "", ErrLabelRequired
+	}
+
+	if len(buckets) == 0 {
+		bds, err := s.s3.ListBuckets(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, bd := range bds {
+			buckets = append(buckets, bd.Name)
+		}
+	}
+
+	list := []*models.FileDescriptor{}
+	for _, bucketID := range buckets {
+		exists, err := s.s3.BucketExists(ctx, bucketID)
+		if err != nil {
+			s.logger.Info().Err(err).Str("bucket", bucketID).Msg("Failed to check if bucket exists")
+			return nil, "", err
+		}
+		if !exists {
+			continue
+		}
+
+		// missing collection is built only in memory, collections are stored
+		// when files with the label are written
+		c, err := s.loadFilesCollection(ctx, bucketID, opts.Label, true)
+		if err != nil {
+			return nil, "", err
+		}
+
+		for name := range *c {
+			fd := (*c)[name]
+			if opts.matches(&fd) {
+				list = append(list, &fd)
+			}
+		}
+	}
+
+	// collections are not ordered
+	sort.SliceStable(list, func(i, j int) bool {
+		return before(list[i], list[j])
+	})
+
+	return opts.page(list)
+}
+
+// loadFilesCollection reads the files collection of the label. Collection that
+// can not be decoded is rebuilt from the files stored in the bucket, missing
+// collection is rebuilt only if rebuildMissing is set and empty collection is
+// returned otherwise. File with ID of the label that is not labeled as files
+// collection is never replaced and ErrNotFilesCollection is returned.
+func (s *service) loadFilesCollection(ctx context.Context, bucketID, label string, rebuildMissing bool) (*filesCollection, error) {
+	r, fd, err := s.s3.Read(ctx, bucketID, label, "")
+	switch {
+	case err == s3.ErrNotFound && !rebuildMissing:
+		return &filesCollection{}, nil
+	case err == s3.ErrNotFound:
+	case err != nil:
+		return nil, err
+	case !hasLabel(fd.Labels, labelFilesCollection):
+		r.Close()
+		s.logger.Error().Str("bucket", bucketID).Msgf("file %s is not a files collection", label)
+		return nil, ErrNotFilesCollection
+	default:
+		c, err := FilesCollection(r)
+		r.Close()
+		if err == nil {
+			return c, nil
+		}
+		s.logger.Error().Err(err).Str("bucket", bucketID).Msgf("failed to parse files collection %s, rebuilding", label)
+	}
+
+	return s.rebuildFilesCollection(ctx, bucketID, label)
+}
+
+// rebuildFilesCollection collects latest versions of files with the label
+func (s *service) rebuildFilesCollection(ctx context.Context, bucketID, label string) (*filesCollection, error) {
+	l, err := s.s3.List(ctx, bucketID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// list is sorted newest first so the first version of the file is the
+	// latest one
+	c := &filesCollection{}
+	seen := map[string]bool{}
+	for _, fd := range l {
+		if seen[fd.Name] {
+			continue
+		}
+		seen[fd.Name] = true
+		if s3.Operation(fd.Operation) == s3.Write && hasLabel(fd.Labels, label) {
+			c.Update(fd)
+		}
+	}
+
+	return c, nil
+}
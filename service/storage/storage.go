@@ -28,16 +28,60 @@ type Service interface {
 	// BucketList returns list of all the buckets.
 	BucketList(ctx context.Context) ([]*models.BucketDescriptor, error)
 
-	// FileList returns a list of latest versions of files. Older versions and
-	// files marked as deleted are removed from the list.
-	FileList(ctx context.Context, bucketID string) ([]*models.FileDescriptor, error)
+	// BucketNew creates a new bucket with metadata.
+	BucketNew(ctx context.Context, bucketID string, metadata map[string]string) (*models.BucketDescriptor, error)
+
+	// BucketGet returns metadata of the bucket together with statistics of
+	// stored files.
+	BucketGet(ctx context.Context, bucketID string) (*models.BucketDescriptor, error)
+
+	// BucketArchive makes the bucket read-only.
+	BucketArchive(ctx context.Context, bucketID string) (*models.BucketDescriptor, error)
+
+	// BucketDelete removes the bucket together with all versions of its files.
+	BucketDelete(ctx context.Context, bucketID string) error
+
+	// BucketExport returns gzip compressed tar archive of latest versions of
+	// files in the bucket or all the versions if allVersions is set, together
+	// with their descriptors listed in a signed manifest.
+	BucketExport(ctx context.Context, bucketID string, allVersions bool) (io.ReadCloser, error)
+
+	// BucketImport verifies the archive made by BucketExport and syncs its
+	// file versions to the bucket.
+	BucketImport(ctx context.Context, bucketID string, r io.Reader) (*models.ImportSummary, error)
+
+	// FileList returns a page of latest versions of files matching the options
+	// and cursor of the next page. Older versions and files marked as deleted
+	// are removed from the list. Versions valid at opts.AsOf are returned
+	// instead of the latest ones if it is set.
+	FileList(ctx context.Context, bucketID string, opts *ListOptions) ([]*models.FileDescriptor, string, error)
+
+	// FileSearch returns a page of latest versions of files with the label
+	// found in the buckets and matching the other options, all the buckets
+	// are searched if none are given. Files collections of the label are
+	// used instead of listing the buckets.
+	FileSearch(ctx context.Context, buckets []string, opts *ListOptions) ([]*models.FileDescriptor, string, error)
 
 	// FileGet returns the latest version of the file by returning the reader
-	// and file details.
-	FileGet(ctx context.Context, bucketID, fileID string) (io.ReadCloser, *models.FileDescriptor, error)
+	// and file details. Only the selected part of contents is returned if rng
+	// is not nil.
+	FileGet(ctx context.Context, bucketID, fileID string, rng *s3.Range) (io.ReadCloser, *models.FileDescriptor, error)
 
-	// FileGetVersion returns a specific version of a file.
-	FileGetVersion(ctx context.Context, bucketID, fileID, version string) (io.ReadCloser, *models.FileDescriptor, error)
+	// FileGetVersion returns a specific version of a file or its part.
+	FileGetVersion(ctx context.Context, bucketID, fileID, version string, rng *s3.Range) (io.ReadCloser, *models.FileDescriptor, error)
+
+	// FileGetRendition returns rendition of the image generated when it was
+	// stored or its part; the latest version is used if version is empty.
+	FileGetRendition(ctx context.Context, bucketID, fileID, version, rendition string, rng *s3.Range) (io.ReadCloser, *models.FileDescriptor, error)
+
+	// FileStat returns descriptor of a specific version of a file without
+	// reading its contents; the latest version is used if version is empty.
+	FileStat(ctx context.Context, bucketID, fileID, version string) (*models.FileDescriptor, error)
+
+	// FileVersionAsOf returns descriptor of the version of the file valid at
+	// the time. ErrNotFound is returned if the file did not exist yet or was
+	// already deleted at that time.
+	FileVersionAsOf(ctx context.Context, bucketID, fileID string, asOf strfmt.DateTime) (*models.FileDescriptor, error)
 
 	// FileListVersions returns a list of all modifications to a file.
 	FileListVersions(ctx context.Context, bucketID, fileID string) ([]*models.FileDescriptor, error)
@@ -51,15 +95,57 @@ type Service interface {
 	// FileDelete marks file as deleted.
 	FileDelete(ctx context.Context, bucketID, fileID string) error
 
-	// SyncFileList returns a list of latest versions of files. Older versions are removed from the list.
-	// Files marked as deleted are kept in the list.
-	SyncFileList(ctx context.Context, bucketID string) ([]*models.FileDescriptor, error)
+	// SyncChangeList returns up to limit changes recorded in the change log
+	// after the sequence number since and the sequence number of the latest
+	// change. ErrNoChangeLog is returned if the change log is not enabled.
+	SyncChangeList(ctx context.Context, since int64, limit int) ([]*models.Change, int64, error)
+
+	// SyncFileList returns a page of latest versions of files and cursor of the next page. Older versions are
+	// removed from the list. Files marked as deleted are kept in the list.
+	SyncFileList(ctx context.Context, bucketID string, opts *ListOptions) ([]*models.FileDescriptor, string, error)
 
 	// SyncFile syncs file with provided fileID and version.
 	SyncFile(ctx context.Context, bucketID, fileID, version string, r io.Reader, contentType string, created strfmt.DateTime, archetype string, labels []string) (*models.FileDescriptor, error)
 
+	// SyncFileSignature returns signature of the file version used to
+	// compute delta of a new version against it; block size is chosen by the
+	// size of the file if it is 0.
+	SyncFileSignature(ctx context.Context, bucketID, fileID, version string, blockSize int) (*models.Signature, error)
+
+	// SyncFileDecode returns contents of synced file decoded from the
+	// encodings; delta is applied to the base version of the file. Decoded
+	// contents are verified if checksum is set.
+	SyncFileDecode(ctx context.Context, bucketID, fileID string, r io.Reader, encodings []string, base, checksum string) (io.Reader, error)
+
 	// SyncFileDelete sync file deletion.
 	SyncFileDelete(ctx context.Context, bucketID, fileID, version string, created strfmt.DateTime) error
+
+	// ApplyRetention purges versions of files in the bucket expired by the
+	// policy and returns the number of purged versions.
+	ApplyRetention(ctx context.Context, bucketID string, policy *RetentionPolicy) (int, error)
+
+	// SyncFilePurge syncs purge of file version.
+	SyncFilePurge(ctx context.Context, bucketID, fileID, version string) error
+
+	// UploadNew starts a resumable upload of a new file or a new version of
+	// the file if fileID is set.
+	UploadNew(ctx context.Context, bucketID, fileID, contentType, archetype string, labels []string) (*models.Upload, error)
+
+	// UploadGet returns the upload session with the number of received bytes.
+	UploadGet(ctx context.Context, bucketID, uploadID string) (*models.Upload, error)
+
+	// UploadChunk writes the chunk at the offset of uploaded contents.
+	UploadChunk(ctx context.Context, bucketID, uploadID string, offset int64, r io.Reader) (*models.Upload, error)
+
+	// UploadCommit stores uploaded contents as a file and removes the session.
+	UploadCommit(ctx context.Context, bucketID, uploadID string) (*models.FileDescriptor, error)
+
+	// UploadSweep removes upload sessions which received no contents for the
+	// ttl and returns the number of removed sessions.
+	UploadSweep(ctx context.Context, ttl time.Duration) (int, error)
+
+	// UploadDelete cancels the upload.
+	UploadDelete(ctx context.Context, bucketID, uploadID string) error
 }
 
 // Bucket or item was already deleted
@@ -71,14 +157,39 @@ var ErrNotFound = s3.ErrNotFound
 // Item already exists
 var ErrAlreadyExists = s3.ErrAlreadyExists
 
+// Requested range is outside of file contents
+var ErrInvalidRange = s3.ErrInvalidRange
+
+// Bucket is archived and its files can not be changed
+var ErrArchived = s3.ErrArchived
+
+// Bucket name can not be used
+var ErrInvalidBucketName = s3.ErrInvalidBucketName
+
 // Item already exists and conflicts
 var ErrAlreadyExistsConflict = errors.New("Item already exists and its checksum is different")
 
+// Changes are not recorded
+var ErrNoChangeLog = errors.New("Change log is not enabled")
+
+// Contents of synced file can not be decoded
+var ErrInvalidEncoding = errors.New("Contents can not be decoded")
+
+// Decoded contents of synced file do not match their checksum
+var ErrChecksumMismatch = errors.New("Checksum of decoded contents does not match")
+
 type service struct {
 	s3          s3.Storage
 	keyProvider s3.KeyProvider
 	publisher   storageSync.Publisher
-	logger      zerolog.Logger
+	uploads     *uploadStore
+	quota       *Quota
+	archetypes  *ArchetypeRegistry
+	signer      *ArchiveSigner
+	changes     *ChangeLog
+	// maxDecodedSize limits size of decoded synced file contents
+	maxDecodedSize int64
+	logger         zerolog.Logger
 }
 
 func (s *service) Checksum(r io.Reader) (string, error) {
@@ -95,7 +206,100 @@ func (s *service) BucketList(ctx context.Context) ([]*models.BucketDescriptor, e
 	return s.s3.ListBuckets(ctx)
 }
 
-func (s *service) FileList(ctx context.Context, bucketID string) ([]*models.FileDescriptor, error) {
+func (s *service) BucketNew(ctx context.Context, bucketID string, metadata map[string]string) (*models.BucketDescriptor, error) {
+	if err := s.s3.MakeBucket(ctx, bucketID); err != nil {
+		return nil, err
+	}
+
+	if err := s.s3.UpdateBucketMetadata(ctx, bucketID, &s3.BucketMetadata{Metadata: metadata}); err != nil {
+		s.logger.Error().Err(err).Str("bucket", bucketID).Msg("Failed to store bucket metadata")
+		return nil, err
+	}
+
+	return &models.BucketDescriptor{
+		Name:     bucketID,
+		Created:  getTime(),
+		Metadata: metadata,
+	}, nil
+}
+
+func (s *service) BucketGet(ctx context.Context, bucketID string) (*models.BucketDescriptor, error) {
+	md, err := s.s3.GetBucketMetadata(ctx, bucketID)
+	if err != nil {
+		return nil, err
+	}
+
+	bd := &models.BucketDescriptor{
+		Name:     bucketID,
+		Metadata: md.Metadata,
+		Archived: md.Archived,
+	}
+
+	buckets, err := s.s3.ListBuckets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range buckets {
+		if b.Name == bucketID {
+			bd.Created = b.Created
+		}
+	}
+
+	l, err := s.s3.List(ctx, bucketID, "")
+	if err != nil {
+		return nil, err
+	}
+	bd.Stats = bucketStats(l)
+
+	return bd, nil
+}
+
+func (s *service) BucketArchive(ctx context.Context, bucketID string) (*models.BucketDescriptor, error) {
+	md, err := s.s3.GetBucketMetadata(ctx, bucketID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !md.Archived {
+		md.Archived = true
+		if err := s.s3.UpdateBucketMetadata(ctx, bucketID, md); err != nil {
+			s.logger.Error().Err(err).Str("bucket", bucketID).Msg("Failed to archive bucket")
+			return nil, err
+		}
+	}
+
+	return s.BucketGet(ctx, bucketID)
+}
+
+func (s *service) BucketDelete(ctx context.Context, bucketID string) error {
+	l, err := s.s3.List(ctx, bucketID, "")
+	if err != nil {
+		return err
+	}
+
+	if err := s.s3.RemoveBucket(ctx, bucketID); err != nil {
+		return err
+	}
+	s.quota.invalidate(bucketID)
+
+	// files are purged from the destination one version at a time; list is
+	// sorted newest first so deletions are purged after the other versions
+	for i := len(l) - 1; i >= 0; i-- {
+		s.publisher.PublishAsyncWithRetries(
+			context.TODO(),
+			storageSync.FilePurge,
+			&storageSync.FileInfo{BucketID: bucketID, FileID: l[i].Name, Version: l[i].Version, Created: l[i].Created},
+		)
+	}
+
+	return nil
+}
+
+func (s *service) FileList(ctx context.Context, bucketID string, opts *ListOptions) ([]*models.FileDescriptor, string, error) {
+	if opts == nil {
+		opts = &ListOptions{}
+	}
+
 	// init list to return
 	list := []*models.FileDescriptor{}
 
@@ -103,49 +307,92 @@ func (s *service) FileList(ctx context.Context, bucketID string) ([]*models.File
 	exists, err := s.s3.BucketExists(ctx, bucketID)
 	if err != nil {
 		s.logger.Info().Err(err).Str("bucket", bucketID).Msg("Failed to check if bucket exists")
-		return nil, err
+		return nil, "", err
 	}
 	if !exists {
-		return list, nil
+		return list, "", nil
 	}
 
 	// collect the list
 	l, err := s.s3.List(ctx, bucketID, "")
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	// extract only latest versions; latest version is already sorted
 	// on top, add to return list; only include files with a write operation
+	// matching the filters. Versions created after the AsOf time are skipped
+	// so the version valid at that time is the latest one.
 	m := map[string]bool{}
 	for _, f := range l {
+		if !opts.valid(f) {
+			continue
+		}
 		if _, ok := m[f.Name]; !ok {
 			m[f.Name] = true
-			if s3.Operation(f.Operation) == s3.Write {
+			// renditions are fetched together with their images
+			if s3.Operation(f.Operation) == s3.Write && !hasLabel(f.Labels, labelRendition) && opts.matches(f) {
 				list = append(list, f)
 			}
 		}
 	}
 
-	return list, nil
+	return opts.page(list)
 }
 
-func (s *service) FileGet(ctx context.Context, bucketID, fileID string) (io.ReadCloser, *models.FileDescriptor, error) {
+func (s *service) FileGet(ctx context.Context, bucketID, fileID string, rng *s3.Range) (io.ReadCloser, *models.FileDescriptor, error) {
 	start := time.Now()
-	rc, fd, err := s.s3.Read(ctx, bucketID, fileID, "")
+	rc, fd, err := s.read(ctx, bucketID, fileID, "", rng)
 	s.logger.Info().Str("method", "FileGet").Msgf("s3 read time %s", time.Since(start))
 
 	return rc, fd, err
 }
 
-func (s *service) FileGetVersion(ctx context.Context, bucketID, fileID, version string) (io.ReadCloser, *models.FileDescriptor, error) {
+func (s *service) FileGetVersion(ctx context.Context, bucketID, fileID, version string, rng *s3.Range) (io.ReadCloser, *models.FileDescriptor, error) {
 	start := time.Now()
-	rc, fd, err := s.s3.Read(ctx, bucketID, fileID, version)
+	rc, fd, err := s.read(ctx, bucketID, fileID, version, rng)
 	s.logger.Info().Str("method", "FileGetVersion").Msgf("s3 read time %s", time.Since(start))
 
 	return rc, fd, err
 }
 
+func (s *service) FileStat(ctx context.Context, bucketID, fileID, version string) (*models.FileDescriptor, error) {
+	start := time.Now()
+	fd, err := s.s3.Stat(ctx, bucketID, fileID, version)
+	s.logger.Info().Str("method", "FileStat").Msgf("s3 stat time %s", time.Since(start))
+
+	return fd, err
+}
+
+// read fetches whole file or its part if range is set
+func (s *service) read(ctx context.Context, bucketID, fileID, version string, rng *s3.Range) (io.ReadCloser, *models.FileDescriptor, error) {
+	if rng == nil {
+		return s.s3.Read(ctx, bucketID, fileID, version)
+	}
+
+	return s.s3.ReadRange(ctx, bucketID, fileID, version, rng)
+}
+
+func (s *service) FileVersionAsOf(ctx context.Context, bucketID, fileID string, asOf strfmt.DateTime) (*models.FileDescriptor, error) {
+	versions, err := s.s3.List(ctx, bucketID, fileID+".")
+	if err != nil {
+		return nil, err
+	}
+
+	// versions are sorted newest first
+	for _, fd := range versions {
+		if !validAt(fd, asOf) {
+			continue
+		}
+		if s3.Operation(fd.Operation) == s3.Delete {
+			return nil, ErrNotFound
+		}
+		return fd, nil
+	}
+
+	return nil, ErrNotFound
+}
+
 func (s *service) FileListVersions(ctx context.Context, bucketID, fileID string) ([]*models.FileDescriptor, error) {
 	return s.s3.List(ctx, bucketID, fileID)
 }
@@ -156,21 +403,20 @@ func (s *service) FileNew(ctx context.Context, bucketID string, r io.Reader, con
 		return nil, err
 	}
 
-	// calculate the checksum
-	var buf bytes.Buffer
-	tee := io.TeeReader(r, &buf)
-	checksum, err := s.Checksum(tee)
+	if err := s.quota.check(ctx, bucketID, 1); err != nil {
+		return nil, err
+	}
+
+	r, labels, err = s.archetypes.validate(archetype, contentType, r, labels)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("Failed to calculate checksum")
 		return nil, err
 	}
 
+	// checksum and size are calculated by the storage while writing
 	fileID := getUUID()
 	version := getUUID()
 	no := &object.NewObjectInfo{
 		Archetype:   archetype,
-		Size:        int64(buf.Len()),
-		Checksum:    checksum,
 		Created:     getTime(),
 		ContentType: contentType,
 		Version:     version,
@@ -180,10 +426,14 @@ func (s *service) FileNew(ctx context.Context, bucketID string, r io.Reader, con
 	}
 
 	start := time.Now()
-	fd, err := s.s3.Write(ctx, bucketID, no, &buf)
+	fd, err := s.s3.WriteStream(ctx, bucketID, no, r)
 	s.logger.Info().Str("method", "FileNew").Msgf("s3 write time %s", time.Since(start))
 
 	if err == nil {
+		if err := s.enforceQuota(ctx, bucketID, 1, fd); err != nil {
+			return nil, err
+		}
+
 		s.publisher.PublishAsyncWithRetries(
 			context.TODO(),
 			storageSync.FileNew,
@@ -196,6 +446,10 @@ func (s *service) FileNew(ctx context.Context, bucketID string, r io.Reader, con
 				s.logger.Error().Err(err).Msgf("failed to update files collection %s", label)
 			}
 		}
+
+		if hasRenditions(contentType) {
+			s.storeRenditions(ctx, bucketID, fd)
+		}
 	}
 
 	return fd, err
@@ -204,27 +458,26 @@ func (s *service) FileNew(ctx context.Context, bucketID string, r io.Reader, con
 func (s *service) FileUpdate(ctx context.Context, bucketID, fileID string, r io.Reader, contentType string, archetype string, labels []string) (*models.FileDescriptor, error) {
 	// get the previous file
 	start := time.Now()
-	_, old, err := s.s3.Read(ctx, bucketID, fileID, "")
-	s.logger.Info().Str("method", "FileUpdate").Msgf("s3 read time %s", time.Since(start))
+	old, err := s.s3.Stat(ctx, bucketID, fileID, "")
+	s.logger.Info().Str("method", "FileUpdate").Msgf("s3 stat time %s", time.Since(start))
 
 	if err != nil {
 		return nil, err
 	}
 
-	// calculate the checksum
-	var buf bytes.Buffer
-	tee := io.TeeReader(r, &buf)
-	checksum, err := s.Checksum(tee)
+	if err := s.quota.check(ctx, bucketID, 0); err != nil {
+		return nil, err
+	}
+
+	r, labels, err = s.archetypes.validate(archetype, contentType, r, labels)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("Failed to calculate checksum")
 		return nil, err
 	}
 
+	// checksum and size are calculated by the storage while writing
 	version := getUUID()
 	no := &object.NewObjectInfo{
 		Archetype:   archetype,
-		Checksum:    checksum,
-		Size:        int64(buf.Len()),
 		Created:     getTime(),
 		ContentType: contentType,
 		Version:     version,
@@ -234,10 +487,14 @@ func (s *service) FileUpdate(ctx context.Context, bucketID, fileID string, r io.
 	}
 
 	start = time.Now()
-	fd, err := s.s3.Write(ctx, bucketID, no, &buf)
+	fd, err := s.s3.WriteStream(ctx, bucketID, no, r)
 	s.logger.Info().Str("method", "FileUpdate").Msgf("s3 write time %s", time.Since(start))
 
 	if err == nil {
+		if err := s.enforceQuota(ctx, bucketID, 0, fd); err != nil {
+			return nil, err
+		}
+
 		s.publisher.PublishAsyncWithRetries(
 			context.TODO(),
 			storageSync.FileUpdate,
@@ -251,6 +508,10 @@ func (s *service) FileUpdate(ctx context.Context, bucketID, fileID string, r io.
 			}
 		}
 
+		if hasRenditions(contentType) {
+			s.storeRenditions(ctx, bucketID, fd)
+		}
+
 		droppedLabels := utils.DiffSlice(old.Labels, labels)
 		for _, label := range droppedLabels {
 			err := s.updateFilesCollection(ctx, s3.Delete, bucketID, label, fd)
@@ -265,8 +526,8 @@ func (s *service) FileUpdate(ctx context.Context, bucketID, fileID string, r io.
 func (s *service) FileDelete(ctx context.Context, bucketID, fileID string) error {
 	// get the previous file
 	start := time.Now()
-	_, fd, err := s.s3.Read(ctx, bucketID, fileID, "")
-	s.logger.Info().Str("method", "FileDelete").Msgf("s3 read time %s", time.Since(start))
+	fd, err := s.s3.Stat(ctx, bucketID, fileID, "")
+	s.logger.Info().Str("method", "FileDelete").Msgf("s3 stat time %s", time.Since(start))
 
 	if err != nil {
 		return err
@@ -290,6 +551,7 @@ func (s *service) FileDelete(ctx context.Context, bucketID, fileID string) error
 	s.logger.Info().Str("method", "FileDelete").Msgf("s3 write time %s", time.Since(start))
 
 	if err == nil {
+		s.quota.update(bucketID, -1, 0)
 		s.publisher.PublishAsyncWithRetries(
 			context.TODO(),
 			storageSync.FileDelete,
@@ -305,7 +567,19 @@ func (s *service) FileDelete(ctx context.Context, bucketID, fileID string) error
 	return err
 }
 
-func (s *service) SyncFileList(ctx context.Context, bucketID string) ([]*models.FileDescriptor, error) {
+func (s *service) SyncChangeList(ctx context.Context, since int64, limit int) ([]*models.Change, int64, error) {
+	if s.changes == nil {
+		return nil, 0, ErrNoChangeLog
+	}
+
+	return s.changes.List(since, limit)
+}
+
+func (s *service) SyncFileList(ctx context.Context, bucketID string, opts *ListOptions) ([]*models.FileDescriptor, string, error) {
+	if opts == nil {
+		opts = &ListOptions{}
+	}
+
 	// init list to return
 	list := []*models.FileDescriptor{}
 
@@ -313,16 +587,16 @@ func (s *service) SyncFileList(ctx context.Context, bucketID string) ([]*models.
 	exists, err := s.s3.BucketExists(ctx, bucketID)
 	if err != nil {
 		s.logger.Info().Err(err).Str("bucket", bucketID).Msg("Failed to check if bucket exists")
-		return nil, err
+		return nil, "", err
 	}
 	if !exists {
-		return list, nil
+		return list, "", nil
 	}
 
 	// collect the list
 	l, err := s.s3.List(ctx, bucketID, "")
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	// extract only latest versions; latest version is already sorted
@@ -331,11 +605,13 @@ func (s *service) SyncFileList(ctx context.Context, bucketID string) ([]*models.
 	for _, f := range l {
 		if _, ok := m[f.Name]; !ok {
 			m[f.Name] = true
-			list = append(list, f)
+			if opts.matches(f) {
+				list = append(list, f)
+			}
 		}
 	}
 
-	return list, nil
+	return opts.page(list)
 }
 
 func (s *service) SyncFile(ctx context.Context, bucketID, fileID, version string, r io.Reader, contentType string, created strfmt.DateTime, archetype string, labels []string) (*models.FileDescriptor, error) {
@@ -344,42 +620,44 @@ func (s *service) SyncFile(ctx context.Context, bucketID, fileID, version string
 		return nil, err
 	}
 
-	// calculate the checksum
-	var buf bytes.Buffer
-	tee := io.TeeReader(r, &buf)
-	checksum, err := s.Checksum(tee)
-	if err != nil {
-		s.logger.Error().Err(err).Msg("Failed to calculate checksum")
-		return nil, err
-	}
-
 	// try to fetch
 	start := time.Now()
-	_, fd, err := s.s3.Read(ctx, bucketID, fileID, version)
-	s.logger.Info().Str("method", "SyncFile").Msgf("s3 read time %s", time.Since(start))
+	fd, err := s.s3.Stat(ctx, bucketID, fileID, version)
+	s.logger.Info().Str("method", "SyncFile").Msgf("s3 stat time %s", time.Since(start))
 
 	switch {
-	// Already exists and does not conflict
-	case err == nil && checksum == fd.Checksum:
-		s.logger.Info().
-			Msg("File already exists")
-		return fd, ErrAlreadyExists
-	// Already exists and conflicts
-	case err == nil && checksum != fd.Checksum:
-		s.logger.Error().
-			Msg("File already exists and has conflicting checksum")
-		return nil, ErrAlreadyExistsConflict
 	// Storage returned error and it is not "not found"
 	case err != nil && err != s3.ErrNotFound:
 		s.logger.Error().Err(err).
 			Msg("Error while trying to read file")
 		return nil, err
+	// Already exists, compare checksums without storing the contents
+	case err == nil:
+		checksum, err := s.Checksum(r)
+		if err != nil {
+			s.logger.Error().Err(err).Msg("Failed to calculate checksum")
+			return nil, err
+		}
+
+		if checksum == fd.Checksum {
+			s.logger.Info().
+				Msg("File already exists")
+			return fd, ErrAlreadyExists
+		}
+		s.logger.Error().
+			Msg("File already exists and has conflicting checksum")
+		return nil, ErrAlreadyExistsConflict
 	}
 
+	r, labels, err = s.archetypes.validate(archetype, contentType, r, labels)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Synced file does not conform to its archetype")
+		return nil, err
+	}
+
+	// checksum and size are calculated by the storage while writing
 	no := &object.NewObjectInfo{
 		Archetype:   archetype,
-		Checksum:    checksum,
-		Size:        int64(buf.Len()),
 		Created:     created,
 		ContentType: contentType,
 		Version:     version,
@@ -389,17 +667,24 @@ func (s *service) SyncFile(ctx context.Context, bucketID, fileID, version string
 	}
 
 	start = time.Now()
-	fd, err = s.s3.Write(ctx, bucketID, no, &buf)
+	fd, err = s.s3.WriteStream(ctx, bucketID, no, r)
 	s.logger.Info().Str("method", "SyncFile").Msgf("s3 write time %s", time.Since(start))
 
+	// synced files were already accepted by the source so they are counted
+	// without enforcing the quota; number of files is corrected when the
+	// bucket is listed again
+	if err == nil {
+		s.quota.update(bucketID, 0, fd.Size)
+	}
+
 	return fd, err
 }
 
 func (s *service) SyncFileDelete(ctx context.Context, bucketID, fileID, version string, created strfmt.DateTime) error {
 	// get the previous file
 	start := time.Now()
-	_, fd, err := s.s3.Read(ctx, bucketID, fileID, "")
-	s.logger.Info().Str("method", "SyncFileDelete").Msgf("s3 read time %s", time.Since(start))
+	fd, err := s.s3.Stat(ctx, bucketID, fileID, "")
+	s.logger.Info().Str("method", "SyncFileDelete").Msgf("s3 stat time %s", time.Since(start))
 
 	if err != nil {
 		return err
@@ -434,9 +719,94 @@ func (s *service) SyncFileDelete(ctx context.Context, bucketID, fileID, version
 	_, err = s.s3.Write(ctx, bucketID, no, &bytes.Buffer{})
 	s.logger.Info().Str("method", "SyncFileDelete").Msgf("s3 write time %s", time.Since(start))
 
+	if err == nil {
+		s.quota.update(bucketID, -1, 0)
+	}
+
 	return err
 }
 
+func (s *service) ApplyRetention(ctx context.Context, bucketID string, policy *RetentionPolicy) (int, error) {
+	l, err := s.s3.List(ctx, bucketID, "")
+	if err != nil {
+		return 0, err
+	}
+
+	// group versions by file; list is sorted newest first
+	names := []string{}
+	files := map[string][]*models.FileDescriptor{}
+	for _, f := range l {
+		if _, ok := files[f.Name]; !ok {
+			names = append(names, f.Name)
+		}
+		files[f.Name] = append(files[f.Name], f)
+	}
+
+	now := time.Time(getTime())
+	var purged int
+	for _, name := range names {
+		versions := files[name]
+		rule := policy.rule(bucketID, versions[0].Archetype)
+		if rule == nil {
+			continue
+		}
+
+		for _, fd := range rule.expired(versions, now) {
+			err := s.s3.Purge(ctx, bucketID, fd.Name, fd.Version)
+			if err != nil && err != s3.ErrNotFound {
+				s.logger.Error().Err(err).Str("bucket", bucketID).Str("fileID", fd.Name).Str("version", fd.Version).Msg("failed to purge file version")
+				return purged, err
+			}
+			purged++
+			s.quota.invalidate(bucketID)
+
+			if hasRenditions(fd.ContentType) {
+				if err := s.purgeRenditions(ctx, bucketID, fd); err != nil {
+					s.logger.Error().Err(err).Str("bucket", bucketID).Str("fileID", fd.Name).Str("version", fd.Version).Msg("failed to purge renditions")
+				}
+			}
+
+			s.publisher.PublishAsyncWithRetries(
+				context.TODO(),
+				storageSync.FilePurge,
+				&storageSync.FileInfo{BucketID: bucketID, FileID: fd.Name, Version: fd.Version, Created: fd.Created},
+			)
+		}
+	}
+
+	return purged, nil
+}
+
+func (s *service) SyncFilePurge(ctx context.Context, bucketID, fileID, version string) error {
+	versions, err := s.s3.List(ctx, bucketID, fileID+".")
+	if err != nil {
+		return err
+	}
+
+	for i, fd := range versions {
+		if fd.Version != version {
+			continue
+		}
+
+		// source purges the deletion of a file after all the other versions;
+		// purge them too in case their events were not received yet
+		purge := []*models.FileDescriptor{fd}
+		if i == 0 && s3.Operation(fd.Operation) == s3.Delete {
+			purge = versions
+		}
+
+		for j := len(purge) - 1; j >= 0; j-- {
+			if err := s.s3.Purge(ctx, bucketID, fileID, purge[j].Version); err != nil && err != s3.ErrNotFound {
+				return err
+			}
+		}
+		s.quota.invalidate(bucketID)
+		return nil
+	}
+
+	return ErrNotFound
+}
+
 func (s *service) EnsureBucket(ctx context.Context, bucketID string) error {
 	// make sure bucket exists
 	if err := s.s3.MakeBucket(ctx, bucketID); err != nil && err != s3.ErrAlreadyExists {
@@ -448,23 +818,12 @@ func (s *service) EnsureBucket(ctx context.Context, bucketID string) error {
 }
 
 func (s *service) updateFilesCollection(ctx context.Context, operation s3.Operation, bucketID, label string, fd *models.FileDescriptor) error {
-	var c *filesCollection
-
 	start := time.Now()
-	r, _, err := s.s3.Read(ctx, bucketID, label, "")
+	c, err := s.loadFilesCollection(ctx, bucketID, label, false)
 	s.logger.Info().Str("method", "updateFilesCollection").Msgf("s3 read time %s", time.Since(start))
 
 	if err != nil {
-		if err != s3.ErrNotFound {
-			return err
-		}
-		c = &filesCollection{}
-	} else {
-		c, err = FilesCollection(r)
-		if err != nil {
-			s.logger.Error().Err(err).Msg("failed to parse file collection file")
-			return err
-		}
+		return err
 	}
 
 	switch operation {
@@ -474,6 +833,11 @@ func (s *service) updateFilesCollection(ctx context.Context, operation s3.Operat
 		c.Remove(fd)
 	}
 
+	return s.writeFilesCollection(ctx, bucketID, label, c)
+}
+
+// writeFilesCollection stores a new version of the files collection
+func (s *service) writeFilesCollection(ctx context.Context, bucketID, label string, c *filesCollection) error {
 	f, err := c.GetFile()
 	if err != nil {
 		s.logger.Error().Err(err).Msg("failed to generate file collection file")
@@ -502,14 +866,15 @@ func (s *service) updateFilesCollection(ctx context.Context, operation s3.Operat
 		Labels:      []string{labelFilesCollection},
 	}
 
-	start = time.Now()
-	fd, err = s.s3.Write(ctx, bucketID, no, &buf)
-	s.logger.Info().Str("method", "updateFilesCollection").Msgf("s3 write time %s", time.Since(start))
+	start := time.Now()
+	fd, err := s.s3.Write(ctx, bucketID, no, &buf)
+	s.logger.Info().Str("method", "writeFilesCollection").Msgf("s3 write time %s", time.Since(start))
 
 	if err != nil {
 		s.logger.Error().Err(err).Msg("failed to write file collection file")
 		return err
 	}
+	s.quota.update(bucketID, 0, fd.Size)
 
 	s.publisher.PublishAsyncWithRetries(
 		context.TODO(),
@@ -520,12 +885,71 @@ func (s *service) updateFilesCollection(ctx context.Context, operation s3.Operat
 	return nil
 }
 
+// enforceQuota counts the written file in the usage of the bucket. File that
+// exceeds the quota is purged and ErrQuotaExceeded returned.
+func (s *service) enforceQuota(ctx context.Context, bucketID string, files int64, fd *models.FileDescriptor) error {
+	err := s.quota.add(ctx, bucketID, files, fd.Size)
+	switch {
+	case err == nil:
+		return nil
+	case err != ErrQuotaExceeded:
+		// usage is calculated again when the quota is checked next time
+		s.logger.Error().Err(err).Str("bucket", bucketID).Msg("failed to update usage of the bucket")
+		return nil
+	}
+
+	if err := s.s3.Purge(ctx, bucketID, fd.Name, fd.Version); err != nil {
+		s.logger.Error().Err(err).Str("bucket", bucketID).Str("fileID", fd.Name).Str("version", fd.Version).Msg("failed to purge file exceeding the quota")
+	}
+	return ErrQuotaExceeded
+}
+
+// Options holds optional features of storage service; zero value disables
+// all of them.
+type Options struct {
+	// UploadsDir keeps resumable upload sessions, uploads are disabled if it
+	// is empty.
+	UploadsDir string
+	// Quota limits the storage, it is not limited if nil.
+	Quota *Quota
+	// Archetypes validate documents, they are not validated if nil.
+	Archetypes *ArchetypeRegistry
+	// Signer signs and verifies bucket archives, archives are disabled if nil.
+	Signer *ArchiveSigner
+	// Changes records every write published for sync if set.
+	Changes *ChangeLog
+	// MaxDecodedSize limits size of decoded synced file contents,
+	// DefaultMaxDecodedSize is used if it is not set.
+	MaxDecodedSize int64
+}
+
 // New returns a new instance of storage service
-func New(s3 s3.Storage, keyProvider s3.KeyProvider, publisher storageSync.Publisher, logger zerolog.Logger) Service {
+func New(s3 s3.Storage, keyProvider s3.KeyProvider, publisher storageSync.Publisher, opts Options, logger zerolog.Logger) Service {
 	logger.Error().Msg("test")
 	logger = logger.With().Str("component", "service/storage").Logger()
 	logger.Error().Msg("test")
-	return &service{s3: s3, keyProvider: keyProvider, publisher: publisher, logger: logger}
+	if opts.Changes != nil {
+		// every write published for sync is recorded in the change log
+		publisher = opts.Changes.Publisher(publisher)
+	}
+	if opts.MaxDecodedSize <= 0 {
+		opts.MaxDecodedSize = DefaultMaxDecodedSize
+	}
+	svc := &service{
+		s3:             s3,
+		keyProvider:    keyProvider,
+		publisher:      publisher,
+		quota:          opts.Quota,
+		archetypes:     opts.Archetypes,
+		signer:         opts.Signer,
+		changes:        opts.Changes,
+		maxDecodedSize: opts.MaxDecodedSize,
+		logger:         logger,
+	}
+	if opts.UploadsDir != "" {
+		svc.uploads = newUploadStore(opts.UploadsDir, keyProvider)
+	}
+	return svc
 }
 
 var getUUID = func() string {
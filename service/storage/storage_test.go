@@ -2,23 +2,38 @@ package storage
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"image"
+	"image/png"
+	"io"
 	"io/ioutil"
+	"math/big"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/go-openapi/strfmt"
 	"github.com/golang/mock/gomock"
 	"github.com/rs/zerolog"
 
 	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/status"
 	"github.com/iryonetwork/wwm/storage/s3"
 	"github.com/iryonetwork/wwm/storage/s3/mock"
 	"github.com/iryonetwork/wwm/storage/s3/object"
 	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	"github.com/iryonetwork/wwm/sync/storage/delta"
 	mockStorageSync "github.com/iryonetwork/wwm/sync/storage/mock"
 )
 
@@ -284,57 +299,110 @@ func TestBucketList(t *testing.T) {
 	}
 }
 
-func TestFileList(t *testing.T) {
+func TestBucketGet(t *testing.T) {
 	testCases := []struct {
 		description   string
 		calls         func(*mock.MockStorage) []*gomock.Call
-		expected      []*models.FileDescriptor
+		expected      *models.BucketDescriptor
 		errorExpected bool
 		exactError    error
 	}{
 		{
-			"BucketExists fails",
+			"Bucket not found",
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
-					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(false, fmt.Errorf("Error")),
+					s.EXPECT().GetBucketMetadata(gomock.Any(), "BUCKET").Return(nil, s3.ErrNotFound),
 				}
 			},
 			nil,
 			withErrors,
-			nil,
+			ErrNotFound,
 		},
 		{
-			"List fails",
+			"Bucket with stats",
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
-					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
-					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return(nil, fmt.Errorf("Error")),
+					s.EXPECT().GetBucketMetadata(gomock.Any(), "BUCKET").Return(&s3.BucketMetadata{Metadata: map[string]string{"key": "value"}, Archived: true}, nil),
+					s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1, {Name: "BUCKET", Created: time2}}, nil),
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{file2V2, file1V2, file1V1, file2V1}, nil),
 				}
 			},
-			nil,
-			withErrors,
+			&models.BucketDescriptor{
+				Name:     "BUCKET",
+				Created:  time2,
+				Metadata: map[string]string{"key": "value"},
+				Archived: true,
+				Stats: &models.BucketStats{
+					Files:        1,
+					Versions:     4,
+					Size:         15714,
+					LastModified: time3,
+				},
+			},
+			noErrors,
 			nil,
 		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			// init service
+			svc, s, _, _, c := getTestService(t)
+			defer c()
+
+			// setup calls
+			test.calls(s)
+
+			bd, err := svc.BucketGet(context.TODO(), "BUCKET")
+
+			// assert error
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+
+			// assert actual error
+			if test.exactError != nil && test.exactError != err {
+				t.Errorf("Expected error to equal '%v'; got %v", test.exactError, err)
+			}
+
+			// assert bucket descriptor
+			if !reflect.DeepEqual(bd, test.expected) {
+				t.Errorf("Expected bucket descriptor to equal\n%+v\ngot\n%+v", test.expected, bd)
+			}
+		})
+	}
+}
+
+func TestBucketDelete(t *testing.T) {
+	testCases := []struct {
+		description   string
+		calls         func(*mock.MockStorage, *mockStorageSync.MockPublisher) []*gomock.Call
+		errorExpected bool
+		exactError    error
+	}{
 		{
-			"Bucket does not exist",
-			func(s *mock.MockStorage) []*gomock.Call {
+			"Bucket not found",
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
 				return []*gomock.Call{
-					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(false, nil),
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{}, nil),
+					s.EXPECT().RemoveBucket(gomock.Any(), "BUCKET").Return(s3.ErrNotFound),
 				}
 			},
-			[]*models.FileDescriptor{},
-			noErrors,
-			nil,
+			withErrors,
+			ErrNotFound,
 		},
 		{
-			"Successful call",
-			func(s *mock.MockStorage) []*gomock.Call {
+			"Bucket removed and files purged",
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
 				return []*gomock.Call{
-					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
-					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{file1V2, file2V2, file1V1, file2V1}, nil),
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{file2V2, file2V1}, nil),
+					s.EXPECT().RemoveBucket(gomock.Any(), "BUCKET").Return(nil),
+					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FilePurge, gomock.Eq(&storageSync.FileInfo{"BUCKET", "Image", "V1", time1})),
+					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FilePurge, gomock.Eq(&storageSync.FileInfo{"BUCKET", "Image", "UUID", time3})),
 				}
 			},
-			[]*models.FileDescriptor{file1V2},
 			noErrors,
 			nil,
 		},
@@ -343,23 +411,13 @@ func TestFileList(t *testing.T) {
 	for _, test := range testCases {
 		t.Run(test.description, func(t *testing.T) {
 			// init service
-			svc, s, _, _, c := getTestService(t)
+			svc, s, _, p, c := getTestService(t)
 			defer c()
 
 			// setup calls
-			test.calls(s)
-
-			// call the MakeBucket
-			out, err := svc.FileList(context.TODO(), "BUCKET")
+			test.calls(s, p)
 
-			// check expected results
-			if !reflect.DeepEqual(out, test.expected) {
-				fmt.Println("Expected")
-				printJson(test.expected)
-				fmt.Println("Got")
-				printJson(out)
-				t.Errorf("Expected list to equal\n%+v\ngot\n%+v", test.expected, out)
-			}
+			err := svc.BucketDelete(context.TODO(), "BUCKET")
 
 			// assert error
 			if test.errorExpected && err == nil {
@@ -376,157 +434,162 @@ func TestFileList(t *testing.T) {
 	}
 }
 
-func TestFileNew(t *testing.T) {
+func TestFileList(t *testing.T) {
+	listCall := func(s *mock.MockStorage) []*gomock.Call {
+		return []*gomock.Call{
+			s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
+			s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{file2V2, file1V2, file3V1ALT, file1V1, file2V1}, nil),
+		}
+	}
+
 	testCases := []struct {
 		description   string
-		calls         func(*mock.MockStorage, *mockStorageSync.MockPublisher) []*gomock.Call
-		expected      *models.FileDescriptor
+		opts          *ListOptions
+		calls         func(*mock.MockStorage) []*gomock.Call
+		expected      []*models.FileDescriptor
+		next          string
 		errorExpected bool
 		exactError    error
 	}{
 		{
-			"MakeBucket fails",
-			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
+			"BucketExists fails",
+			nil,
+			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
-					s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(fmt.Errorf("Error")),
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(false, fmt.Errorf("Error")),
 				}
 			},
 			nil,
+			"",
 			withErrors,
 			nil,
 		},
 		{
-			"Write fails",
-			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
+			"List fails",
+			nil,
+			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
-					s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
-					s.EXPECT().Write(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("Error")),
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return(nil, fmt.Errorf("Error")),
 				}
 			},
 			nil,
+			"",
 			withErrors,
 			nil,
 		},
 		{
-			"Write successfull, failed to write collection",
-			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
-				no := &object.NewObjectInfo{
-					Archetype:   "ARCH",
-					Size:        int64(8),
-					Checksum:    "0bKln76n4gB3r5-Rsn6V6GUGGycL4D_1Oas7c1h4gug=",
-					Created:     strfmt.DateTime(time1),
-					ContentType: "CONT/TYPE",
-					Version:     "UUID",
-					Name:        "UUID",
-					Operation:   "w",
-					Labels:      []string{"vitalSign", "basicPatientInfo"},
-				}
-				vitalNo := &object.NewObjectInfo{
-					Checksum:    "80kgXMtD7DCdGCoylexuoMsd2DYQE82Sc3NJ3SLNc2g=",
-					Size:        int64(268),
-					Created:     strfmt.DateTime(time1),
-					ContentType: "application/x-collection+json",
-					Version:     "UUID",
-					Name:        "vitalSign",
-					Operation:   string(s3.Write),
-					Labels:      []string{labelFilesCollection},
-				}
-				basicNo := &object.NewObjectInfo{
-					Checksum:    "80kgXMtD7DCdGCoylexuoMsd2DYQE82Sc3NJ3SLNc2g=",
-					Size:        int64(268),
-					Created:     strfmt.DateTime(time1),
-					ContentType: "application/x-collection+json",
-					Version:     "UUID",
-					Name:        "basicPatientInfo",
-					Operation:   string(s3.Write),
-					Labels:      []string{labelFilesCollection},
-				}
-
+			"Bucket does not exist",
+			nil,
+			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
-					s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
-					s.EXPECT().Write(gomock.Any(), "BUCKET", no, gomock.Any()).Return(file1V1, nil).Times(1),
-					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileNew, gomock.Eq(&storageSync.FileInfo{"BUCKET", "UUID", "UUID", time1})).Times(1),
-					s.EXPECT().Read(gomock.Any(), "BUCKET", "vitalSign", "").Return(nil, nil, s3.ErrNotFound),
-					s.EXPECT().Write(gomock.Any(), "BUCKET", vitalNo, gomock.Any()).Return(vital1, nil).Times(1),
-					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileUpdate, gomock.Eq(&storageSync.FileInfo{"BUCKET", "vitalSign", "UUID", time1})).Times(1),
-					s.EXPECT().Read(gomock.Any(), "BUCKET", "basicPatientInfo", "").Return(nil, nil, s3.ErrNotFound),
-					s.EXPECT().Write(gomock.Any(), "BUCKET", basicNo, gomock.Any()).Return(nil, fmt.Errorf("fail")).Times(1),
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(false, nil),
 				}
 			},
-			file1V1,
+			[]*models.FileDescriptor{},
+			"",
 			noErrors,
 			nil,
 		},
 		{
-			"Write successfull",
-			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
-				no := &object.NewObjectInfo{
-					Archetype:   "ARCH",
-					Size:        int64(8),
-					Checksum:    "0bKln76n4gB3r5-Rsn6V6GUGGycL4D_1Oas7c1h4gug=",
-					Created:     strfmt.DateTime(time1),
-					ContentType: "CONT/TYPE",
-					Version:     "UUID",
-					Name:        "UUID",
-					Operation:   "w",
-					Labels:      []string{"vitalSign", "basicPatientInfo"},
-				}
-				vitalNo := &object.NewObjectInfo{
-					Checksum:    "80kgXMtD7DCdGCoylexuoMsd2DYQE82Sc3NJ3SLNc2g=",
-					Size:        int64(268),
-					Created:     strfmt.DateTime(time1),
-					ContentType: "application/x-collection+json",
-					Version:     "UUID",
-					Name:        "vitalSign",
-					Operation:   string(s3.Write),
-					Labels:      []string{labelFilesCollection},
-				}
-				basicNo := &object.NewObjectInfo{
-					Checksum:    "80kgXMtD7DCdGCoylexuoMsd2DYQE82Sc3NJ3SLNc2g=",
-					Size:        int64(268),
-					Created:     strfmt.DateTime(time1),
-					ContentType: "application/x-collection+json",
-					Version:     "UUID",
-					Name:        "basicPatientInfo",
-					Operation:   string(s3.Write),
-					Labels:      []string{labelFilesCollection},
-				}
-
+			"Successful call",
+			nil,
+			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
-					s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
-					s.EXPECT().Write(gomock.Any(), "BUCKET", no, gomock.Any()).Return(file1V1, nil).Times(1),
-					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileNew, gomock.Eq(&storageSync.FileInfo{"BUCKET", "UUID", "UUID", time1})).Times(1),
-					s.EXPECT().Read(gomock.Any(), "BUCKET", "vitalSign", "").Return(nil, nil, s3.ErrNotFound),
-					s.EXPECT().Write(gomock.Any(), "BUCKET", vitalNo, gomock.Any()).Return(vital1, nil).Times(1),
-					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileUpdate, gomock.Eq(&storageSync.FileInfo{"BUCKET", "vitalSign", "UUID", time1})).Times(1),
-					s.EXPECT().Read(gomock.Any(), "BUCKET", "basicPatientInfo", "").Return(nil, nil, s3.ErrNotFound),
-					s.EXPECT().Write(gomock.Any(), "BUCKET", basicNo, gomock.Any()).Return(basic1, nil).Times(1),
-					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileUpdate, gomock.Eq(&storageSync.FileInfo{"BUCKET", "basicPatientInfo", "UUID", time1})).Times(1),
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{file1V2, file2V2, file1V1, file2V1}, nil),
 				}
 			},
-			file1V1,
+			[]*models.FileDescriptor{file1V2},
+			"",
+			noErrors,
+			nil,
+		},
+		{
+			"Filtered by label",
+			&ListOptions{Label: "vitalSign"},
+			listCall,
+			[]*models.FileDescriptor{file1V2},
+			"",
+			noErrors,
+			nil,
+		},
+		{
+			"Filtered by archetype and content type",
+			&ListOptions{Archetype: "ARCH", ContentType: "text/openEhrXml"},
+			listCall,
+			[]*models.FileDescriptor{file3V1ALT},
+			"",
+			noErrors,
+			nil,
+		},
+		{
+			"Filtered by created range",
+			&ListOptions{CreatedFrom: &time1, CreatedTo: &time2},
+			listCall,
+			[]*models.FileDescriptor{},
+			"",
+			noErrors,
+			nil,
+		},
+		{
+			"Versions valid at the time",
+			&ListOptions{AsOf: &time1},
+			listCall,
+			[]*models.FileDescriptor{file1V1, file2V1},
+			"",
+			noErrors,
+			nil,
+		},
+		{
+			"File deleted at the time",
+			&ListOptions{AsOf: &time3},
+			listCall,
+			[]*models.FileDescriptor{file1V2, file3V1ALT},
+			"",
+			noErrors,
+			nil,
+		},
+		{
+			"First page",
+			&ListOptions{Limit: 1},
+			listCall,
+			[]*models.FileDescriptor{file3V1ALT},
+			encodeCursor(file3V1ALT),
+			noErrors,
+			nil,
+		},
+		{
+			"Last page",
+			&ListOptions{Limit: 1, Cursor: encodeCursor(file3V1ALT)},
+			listCall,
+			[]*models.FileDescriptor{file1V2},
+			"",
 			noErrors,
 			nil,
 		},
+		{
+			"Invalid cursor",
+			&ListOptions{Cursor: "invalid"},
+			listCall,
+			nil,
+			"",
+			withErrors,
+			ErrInvalidCursor,
+		},
 	}
 
 	for _, test := range testCases {
 		t.Run(test.description, func(t *testing.T) {
 			// init service
-			svc, s, _, p, c := getTestService(t)
+			svc, s, _, _, c := getTestService(t)
 			defer c()
 
-			// mock getUUID and getTime
-			getUUID = func() string { return "UUID" }
-			getTime = func() strfmt.DateTime { return strfmt.DateTime(time1) }
-
 			// setup calls
-			test.calls(s, p)
-
-			// prepare the reader
-			r := bytes.NewReader([]byte("contents"))
+			test.calls(s)
 
-			out, err := svc.FileNew(context.TODO(), "BUCKET", r, "CONT/TYPE", "ARCH", []string{"vitalSign", "basicPatientInfo"})
+			// call the FileList
+			out, next, err := svc.FileList(context.TODO(), "BUCKET", test.opts)
 
 			// check expected results
 			if !reflect.DeepEqual(out, test.expected) {
@@ -534,7 +597,10 @@ func TestFileNew(t *testing.T) {
 				printJson(test.expected)
 				fmt.Println("Got")
 				printJson(out)
-				t.Errorf("Expected file descriptor to equal\n%+v\ngot\n%+v", test.expected, out)
+				t.Errorf("Expected list to equal\n%+v\ngot\n%+v", test.expected, out)
+			}
+			if next != test.next {
+				t.Errorf("Expected next cursor to equal '%s'; got '%s'", test.next, next)
 			}
 
 			// assert error
@@ -552,89 +618,121 @@ func TestFileNew(t *testing.T) {
 	}
 }
 
-func TestFileUpdate(t *testing.T) {
+func TestFileSearch(t *testing.T) {
+	image := &models.FileDescriptor{
+		Checksum:    "CHS",
+		ContentType: "image/jpeg",
+		Created:     time1,
+		Labels:      []string{"vitalSign", "basicPatientInfo"},
+		Name:        "Image",
+		Operation:   "w",
+		Path:        "BUCKET/Image/V1",
+		Size:        15698,
+		Version:     "V1",
+	}
+	// rebuilt collection is not stored by search
+	rebuildCalls := func(s *mock.MockStorage) []*gomock.Call {
+		return []*gomock.Call{
+			s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{file2V2, file1V2, file1V1, file2V1}, nil),
+		}
+	}
+
 	testCases := []struct {
 		description   string
+		buckets       []string
+		opts          *ListOptions
 		calls         func(*mock.MockStorage, *mockStorageSync.MockPublisher) []*gomock.Call
-		expected      *models.FileDescriptor
+		expected      []*models.FileDescriptor
 		errorExpected bool
 		exactError    error
 	}{
 		{
-			"Read fails",
+			"Label missing",
+			nil,
+			&ListOptions{Archetype: "ARCH"},
 			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
-				return []*gomock.Call{
-					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, nil, fmt.Errorf("Error")),
-				}
+				return []*gomock.Call{}
 			},
 			nil,
 			withErrors,
-			nil,
+			ErrLabelRequired,
 		},
 		{
-			"Write fails",
+			"All buckets searched using collections",
+			nil,
+			&ListOptions{Label: "vitalSign"},
 			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
+				r := ioutil.NopCloser(bytes.NewReader([]byte(collectionFileV1)))
 				return []*gomock.Call{
-					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, file1V1, nil),
-					s.EXPECT().Write(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("Error")),
+					s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{bucket1, bucket2}, nil),
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET1").Return(true, nil),
+					s.EXPECT().Read(gomock.Any(), "BUCKET1", "vitalSign", "").Return(r, vital1, nil),
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET2").Return(false, nil),
 				}
 			},
-			nil,
-			withErrors,
+			[]*models.FileDescriptor{image},
+			noErrors,
 			nil,
 		},
 		{
-			"Write successfull",
+			"Missing collection rebuilt",
+			[]string{"BUCKET"},
+			&ListOptions{Label: "vitalSign"},
 			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
-				no := &object.NewObjectInfo{
-					Archetype:   "ARCH",
-					Size:        int64(8),
-					Checksum:    "0bKln76n4gB3r5-Rsn6V6GUGGycL4D_1Oas7c1h4gug=",
-					Created:     strfmt.DateTime(time2),
-					ContentType: "CONT/TYPE",
-					Version:     "UUID",
-					Name:        "FILE",
-					Operation:   "w",
-					Labels:      []string{"vitalSign"},
+				calls := []*gomock.Call{
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "vitalSign", "").Return(nil, nil, s3.ErrNotFound),
 				}
-				// prepare the reader for existing collection file
-				r1 := ioutil.NopCloser(bytes.NewReader([]byte(collectionFileV1)))
-				r2 := ioutil.NopCloser(bytes.NewReader([]byte(collectionFileV1)))
-				vitalNo := &object.NewObjectInfo{
-					Checksum:    "RrSXqFYwVFSV7rWgHTqsPPyaOusdFZpb4MMrk4agGws=",
-					Size:        int64(458),
-					Created:     strfmt.DateTime(time2),
-					ContentType: "application/x-collection+json",
-					Version:     "UUID",
-					Name:        "vitalSign",
-					Operation:   string(s3.Write),
-					Labels:      []string{labelFilesCollection},
+				return append(calls, rebuildCalls(s)...)
+			},
+			[]*models.FileDescriptor{file1V2},
+			noErrors,
+			nil,
+		},
+		{
+			"Corrupt collection rebuilt",
+			[]string{"BUCKET"},
+			&ListOptions{Label: "vitalSign", Archetype: "ARCH"},
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
+				r := ioutil.NopCloser(bytes.NewReader([]byte("[{")))
+				calls := []*gomock.Call{
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "vitalSign", "").Return(r, vital1, nil),
 				}
-				basicNo := &object.NewObjectInfo{
-					Checksum:    "VcOTvk_6K1PiuBPl4jZuWo8A5Y_xgpnWumdFC1cbphY=",
-					Size:        int64(211),
-					Created:     strfmt.DateTime(time2),
-					ContentType: "application/x-collection+json",
-					Version:     "UUID",
-					Name:        "basicPatientInfo",
-					Operation:   string(s3.Write),
-					Labels:      []string{labelFilesCollection},
+				return append(calls, rebuildCalls(s)...)
+			},
+			[]*models.FileDescriptor{},
+			noErrors,
+			nil,
+		},
+		{
+			"File with ID of the label is not a collection",
+			[]string{"BUCKET"},
+			&ListOptions{Label: "vitalSign"},
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
+				r := ioutil.NopCloser(bytes.NewReader([]byte("contents")))
+				return []*gomock.Call{
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "vitalSign", "").Return(r, file1V1, nil),
 				}
-
+			},
+			nil,
+			withErrors,
+			ErrNotFilesCollection,
+		},
+		{
+			"Rebuild fails",
+			[]string{"BUCKET"},
+			&ListOptions{Label: "vitalSign"},
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
 				return []*gomock.Call{
-					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, file1V1, nil),
-					s.EXPECT().Write(gomock.Any(), "BUCKET", no, gomock.Any()).Return(file1V2, nil),
-					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileUpdate, gomock.Eq(&storageSync.FileInfo{"BUCKET", "FILE", "UUID", time2})),
-					s.EXPECT().Read(gomock.Any(), "BUCKET", "vitalSign", "").Return(r1, vital1, nil),
-					s.EXPECT().Write(gomock.Any(), "BUCKET", vitalNo, gomock.Any()).Return(vital2, nil).Times(1),
-					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileUpdate, gomock.Eq(&storageSync.FileInfo{"BUCKET", "vitalSign", "UUID", time2})).Times(1),
-					s.EXPECT().Read(gomock.Any(), "BUCKET", "basicPatientInfo", "").Return(r2, basic1, nil),
-					s.EXPECT().Write(gomock.Any(), "BUCKET", basicNo, gomock.Any()).Return(basic2, nil).Times(1),
-					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileUpdate, gomock.Eq(&storageSync.FileInfo{"BUCKET", "basicPatientInfo", "UUID", time2})).Times(1),
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "vitalSign", "").Return(nil, nil, s3.ErrNotFound),
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return(nil, fmt.Errorf("Error")),
 				}
 			},
-			file1V2,
-			noErrors,
+			nil,
+			withErrors,
 			nil,
 		},
 	}
@@ -650,12 +748,10 @@ func TestFileUpdate(t *testing.T) {
 			getTime = func() strfmt.DateTime { return strfmt.DateTime(time2) }
 
 			// setup calls
-			test.calls(s, p)
+			gomock.InOrder(test.calls(s, p)...)
 
-			// prepare the reader
-			r := bytes.NewReader([]byte("contents"))
-
-			out, err := svc.FileUpdate(context.TODO(), "BUCKET", "FILE", r, "CONT/TYPE", "ARCH", []string{"vitalSign"})
+			// call the FileSearch
+			out, _, err := svc.FileSearch(context.TODO(), test.buckets, test.opts)
 
 			// check expected results
 			if !reflect.DeepEqual(out, test.expected) {
@@ -663,7 +759,7 @@ func TestFileUpdate(t *testing.T) {
 				printJson(test.expected)
 				fmt.Println("Got")
 				printJson(out)
-				t.Errorf("Expected file descriptor to equal\n%+v\ngot\n%+v", test.expected, out)
+				t.Errorf("Expected list to equal\n%+v\ngot\n%+v", test.expected, out)
 			}
 
 			// assert error
@@ -681,20 +777,59 @@ func TestFileUpdate(t *testing.T) {
 	}
 }
 
-func TestFileDelete(t *testing.T) {
+func TestFileVersionAsOf(t *testing.T) {
+	before, _ := strfmt.ParseDateTime("2018-01-01T00:00:00.000Z")
+	between, _ := strfmt.ParseDateTime("2018-01-27T00:00:00.000Z")
+
+	testCases := []struct {
+		description string
+		fileID      string
+		asOf        strfmt.DateTime
+		versions    []*models.FileDescriptor
+		expected    *models.FileDescriptor
+		exactError  error
+	}{
+		{"Version created at the time", "File1", time1, []*models.FileDescriptor{file1V2, file1V1}, file1V1, nil},
+		{"Latest version", "File1", time3, []*models.FileDescriptor{file1V2, file1V1}, file1V2, nil},
+		{"File did not exist yet", "File1", before, []*models.FileDescriptor{file1V2, file1V1}, nil, ErrNotFound},
+		{"Version before deletion", "Image", between, []*models.FileDescriptor{file2V2, file2V1}, file2V1, nil},
+		{"File was deleted", "Image", time3, []*models.FileDescriptor{file2V2, file2V1}, nil, ErrNotFound},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			svc, s, _, _, c := getTestService(t)
+			defer c()
+
+			s.EXPECT().List(gomock.Any(), "BUCKET", test.fileID+".").Return(test.versions, nil)
+
+			fd, err := svc.FileVersionAsOf(context.TODO(), "BUCKET", test.fileID, test.asOf)
+			if err != test.exactError {
+				t.Fatalf("Expected error to equal '%v'; got %v", test.exactError, err)
+			}
+			if fd != test.expected {
+				t.Errorf("Expected version %+v, got %+v", test.expected, fd)
+			}
+		})
+	}
+}
+
+func TestFileNew(t *testing.T) {
 	testCases := []struct {
 		description   string
 		calls         func(*mock.MockStorage, *mockStorageSync.MockPublisher) []*gomock.Call
+		expected      *models.FileDescriptor
 		errorExpected bool
 		exactError    error
 	}{
 		{
-			"Read fails",
+			"MakeBucket fails",
 			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
 				return []*gomock.Call{
-					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, nil, fmt.Errorf("Error")),
+					s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(fmt.Errorf("Error")),
 				}
 			},
+			nil,
 			withErrors,
 			nil,
 		},
@@ -702,31 +837,88 @@ func TestFileDelete(t *testing.T) {
 			"Write fails",
 			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
 				return []*gomock.Call{
-					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, file2V1, nil),
-					s.EXPECT().Write(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("Error")),
+					s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
+					s.EXPECT().WriteStream(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("Error")),
 				}
 			},
+			nil,
 			withErrors,
 			nil,
 		},
+		{
+			"Write successfull, failed to write collection",
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
+				no := &object.NewObjectInfo{
+					Archetype:   "ARCH",
+					Created:     strfmt.DateTime(time1),
+					ContentType: "CONT/TYPE",
+					Version:     "UUID",
+					Name:        "UUID",
+					Operation:   "w",
+					Labels:      []string{"vitalSign", "basicPatientInfo"},
+				}
+				vitalNo := &object.NewObjectInfo{
+					Checksum:    "80kgXMtD7DCdGCoylexuoMsd2DYQE82Sc3NJ3SLNc2g=",
+					Size:        int64(268),
+					Created:     strfmt.DateTime(time1),
+					ContentType: "application/x-collection+json",
+					Version:     "UUID",
+					Name:        "vitalSign",
+					Operation:   string(s3.Write),
+					Labels:      []string{labelFilesCollection},
+				}
+				basicNo := &object.NewObjectInfo{
+					Checksum:    "80kgXMtD7DCdGCoylexuoMsd2DYQE82Sc3NJ3SLNc2g=",
+					Size:        int64(268),
+					Created:     strfmt.DateTime(time1),
+					ContentType: "application/x-collection+json",
+					Version:     "UUID",
+					Name:        "basicPatientInfo",
+					Operation:   string(s3.Write),
+					Labels:      []string{labelFilesCollection},
+				}
+
+				return []*gomock.Call{
+					s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
+					s.EXPECT().WriteStream(gomock.Any(), "BUCKET", no, gomock.Any()).Return(file1V1, nil).Times(1),
+					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileNew, gomock.Eq(&storageSync.FileInfo{"BUCKET", "UUID", "UUID", time1})).Times(1),
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "vitalSign", "").Return(nil, nil, s3.ErrNotFound),
+					s.EXPECT().Write(gomock.Any(), "BUCKET", vitalNo, gomock.Any()).Return(vital1, nil).Times(1),
+					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileUpdate, gomock.Eq(&storageSync.FileInfo{"BUCKET", "vitalSign", "UUID", time1})).Times(1),
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "basicPatientInfo", "").Return(nil, nil, s3.ErrNotFound),
+					s.EXPECT().Write(gomock.Any(), "BUCKET", basicNo, gomock.Any()).Return(nil, fmt.Errorf("fail")).Times(1),
+				}
+			},
+			file1V1,
+			noErrors,
+			nil,
+		},
 		{
 			"Write successfull",
 			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
 				no := &object.NewObjectInfo{
-					Archetype:   "",
-					Size:        int64(0),
-					Created:     strfmt.DateTime(time3),
-					ContentType: "image/jpeg",
+					Archetype:   "ARCH",
+					Created:     strfmt.DateTime(time1),
+					ContentType: "CONT/TYPE",
 					Version:     "UUID",
-					Name:        "FILE",
-					Operation:   "d",
-					Labels:      []string{"basicPatientInfo"},
+					Name:        "UUID",
+					Operation:   "w",
+					Labels:      []string{"vitalSign", "basicPatientInfo"},
+				}
+				vitalNo := &object.NewObjectInfo{
+					Checksum:    "80kgXMtD7DCdGCoylexuoMsd2DYQE82Sc3NJ3SLNc2g=",
+					Size:        int64(268),
+					Created:     strfmt.DateTime(time1),
+					ContentType: "application/x-collection+json",
+					Version:     "UUID",
+					Name:        "vitalSign",
+					Operation:   string(s3.Write),
+					Labels:      []string{labelFilesCollection},
 				}
-				r := ioutil.NopCloser(bytes.NewReader([]byte(collectionFileV2)))
 				basicNo := &object.NewObjectInfo{
-					Checksum:    "N1F-Xz3GaBn2H1p7uKzhkhKCQV8QVR0t76XD6wmFtXA=",
-					Size:        int64(3),
-					Created:     strfmt.DateTime(time3),
+					Checksum:    "80kgXMtD7DCdGCoylexuoMsd2DYQE82Sc3NJ3SLNc2g=",
+					Size:        int64(268),
+					Created:     strfmt.DateTime(time1),
 					ContentType: "application/x-collection+json",
 					Version:     "UUID",
 					Name:        "basicPatientInfo",
@@ -735,18 +927,18 @@ func TestFileDelete(t *testing.T) {
 				}
 
 				return []*gomock.Call{
-					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, file2V1, nil),
-					s.EXPECT().Write(gomock.Any(), "BUCKET", no, gomock.Any()).Return(file2V2, nil),
-					p.EXPECT().PublishAsyncWithRetries(
-						gomock.Any(),
-						storageSync.FileDelete,
-						gomock.Eq(&storageSync.FileInfo{"BUCKET", "FILE", "UUID", strfmt.DateTime(time3)}),
-					),
-					s.EXPECT().Read(gomock.Any(), "BUCKET", "basicPatientInfo", "").Return(r, basic2, nil),
-					s.EXPECT().Write(gomock.Any(), "BUCKET", basicNo, gomock.Any()).Return(basic3, nil).Times(1),
-					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileUpdate, gomock.Eq(&storageSync.FileInfo{"BUCKET", "basicPatientInfo", "UUID", time3})).Times(1),
+					s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
+					s.EXPECT().WriteStream(gomock.Any(), "BUCKET", no, gomock.Any()).Return(file1V1, nil).Times(1),
+					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileNew, gomock.Eq(&storageSync.FileInfo{"BUCKET", "UUID", "UUID", time1})).Times(1),
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "vitalSign", "").Return(nil, nil, s3.ErrNotFound),
+					s.EXPECT().Write(gomock.Any(), "BUCKET", vitalNo, gomock.Any()).Return(vital1, nil).Times(1),
+					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileUpdate, gomock.Eq(&storageSync.FileInfo{"BUCKET", "vitalSign", "UUID", time1})).Times(1),
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "basicPatientInfo", "").Return(nil, nil, s3.ErrNotFound),
+					s.EXPECT().Write(gomock.Any(), "BUCKET", basicNo, gomock.Any()).Return(basic1, nil).Times(1),
+					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileUpdate, gomock.Eq(&storageSync.FileInfo{"BUCKET", "basicPatientInfo", "UUID", time1})).Times(1),
 				}
 			},
+			file1V1,
 			noErrors,
 			nil,
 		},
@@ -760,13 +952,24 @@ func TestFileDelete(t *testing.T) {
 
 			// mock getUUID and getTime
 			getUUID = func() string { return "UUID" }
-			getTime = func() strfmt.DateTime { return strfmt.DateTime(time3) }
+			getTime = func() strfmt.DateTime { return strfmt.DateTime(time1) }
 
 			// setup calls
 			test.calls(s, p)
 
-			// call the MakeBucket
-			err := svc.FileDelete(context.TODO(), "BUCKET", "FILE")
+			// prepare the reader
+			r := bytes.NewReader([]byte("contents"))
+
+			out, err := svc.FileNew(context.TODO(), "BUCKET", r, "CONT/TYPE", "ARCH", []string{"vitalSign", "basicPatientInfo"})
+
+			// check expected results
+			if !reflect.DeepEqual(out, test.expected) {
+				fmt.Println("Expected")
+				printJson(test.expected)
+				fmt.Println("Got")
+				printJson(out)
+				t.Errorf("Expected file descriptor to equal\n%+v\ngot\n%+v", test.expected, out)
+			}
 
 			// assert error
 			if test.errorExpected && err == nil {
@@ -783,19 +986,19 @@ func TestFileDelete(t *testing.T) {
 	}
 }
 
-func TestSyncFileList(t *testing.T) {
+func TestFileUpdate(t *testing.T) {
 	testCases := []struct {
 		description   string
-		calls         func(*mock.MockStorage) []*gomock.Call
-		expected      []*models.FileDescriptor
+		calls         func(*mock.MockStorage, *mockStorageSync.MockPublisher) []*gomock.Call
+		expected      *models.FileDescriptor
 		errorExpected bool
 		exactError    error
 	}{
 		{
-			"BucketExsits fails",
-			func(s *mock.MockStorage) []*gomock.Call {
+			"Read fails",
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
 				return []*gomock.Call{
-					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(false, fmt.Errorf("Error")),
+					s.EXPECT().Stat(gomock.Any(), "BUCKET", "FILE", "").Return(nil, fmt.Errorf("Error")),
 				}
 			},
 			nil,
@@ -803,11 +1006,11 @@ func TestSyncFileList(t *testing.T) {
 			nil,
 		},
 		{
-			"List fails",
-			func(s *mock.MockStorage) []*gomock.Call {
+			"Write fails",
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
 				return []*gomock.Call{
-					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
-					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return(nil, fmt.Errorf("Error")),
+					s.EXPECT().Stat(gomock.Any(), "BUCKET", "FILE", "").Return(file1V1, nil),
+					s.EXPECT().WriteStream(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("Error")),
 				}
 			},
 			nil,
@@ -815,16 +1018,245 @@ func TestSyncFileList(t *testing.T) {
 			nil,
 		},
 		{
-			"Bucket does not exist",
-			func(s *mock.MockStorage) []*gomock.Call {
-				return []*gomock.Call{
-					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(false, nil),
-				}
-			},
-			[]*models.FileDescriptor{},
-			noErrors,
-			nil,
-		},
+			"Write successfull",
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
+				no := &object.NewObjectInfo{
+					Archetype:   "ARCH",
+					Created:     strfmt.DateTime(time2),
+					ContentType: "CONT/TYPE",
+					Version:     "UUID",
+					Name:        "FILE",
+					Operation:   "w",
+					Labels:      []string{"vitalSign"},
+				}
+				// prepare the reader for existing collection file
+				r1 := ioutil.NopCloser(bytes.NewReader([]byte(collectionFileV1)))
+				r2 := ioutil.NopCloser(bytes.NewReader([]byte(collectionFileV1)))
+				vitalNo := &object.NewObjectInfo{
+					Checksum:    "RrSXqFYwVFSV7rWgHTqsPPyaOusdFZpb4MMrk4agGws=",
+					Size:        int64(458),
+					Created:     strfmt.DateTime(time2),
+					ContentType: "application/x-collection+json",
+					Version:     "UUID",
+					Name:        "vitalSign",
+					Operation:   string(s3.Write),
+					Labels:      []string{labelFilesCollection},
+				}
+				basicNo := &object.NewObjectInfo{
+					Checksum:    "VcOTvk_6K1PiuBPl4jZuWo8A5Y_xgpnWumdFC1cbphY=",
+					Size:        int64(211),
+					Created:     strfmt.DateTime(time2),
+					ContentType: "application/x-collection+json",
+					Version:     "UUID",
+					Name:        "basicPatientInfo",
+					Operation:   string(s3.Write),
+					Labels:      []string{labelFilesCollection},
+				}
+
+				return []*gomock.Call{
+					s.EXPECT().Stat(gomock.Any(), "BUCKET", "FILE", "").Return(file1V1, nil),
+					s.EXPECT().WriteStream(gomock.Any(), "BUCKET", no, gomock.Any()).Return(file1V2, nil),
+					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileUpdate, gomock.Eq(&storageSync.FileInfo{"BUCKET", "FILE", "UUID", time2})),
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "vitalSign", "").Return(r1, vital1, nil),
+					s.EXPECT().Write(gomock.Any(), "BUCKET", vitalNo, gomock.Any()).Return(vital2, nil).Times(1),
+					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileUpdate, gomock.Eq(&storageSync.FileInfo{"BUCKET", "vitalSign", "UUID", time2})).Times(1),
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "basicPatientInfo", "").Return(r2, basic1, nil),
+					s.EXPECT().Write(gomock.Any(), "BUCKET", basicNo, gomock.Any()).Return(basic2, nil).Times(1),
+					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileUpdate, gomock.Eq(&storageSync.FileInfo{"BUCKET", "basicPatientInfo", "UUID", time2})).Times(1),
+				}
+			},
+			file1V2,
+			noErrors,
+			nil,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			// init service
+			svc, s, _, p, c := getTestService(t)
+			defer c()
+
+			// mock getUUID and getTime
+			getUUID = func() string { return "UUID" }
+			getTime = func() strfmt.DateTime { return strfmt.DateTime(time2) }
+
+			// setup calls
+			test.calls(s, p)
+
+			// prepare the reader
+			r := bytes.NewReader([]byte("contents"))
+
+			out, err := svc.FileUpdate(context.TODO(), "BUCKET", "FILE", r, "CONT/TYPE", "ARCH", []string{"vitalSign"})
+
+			// check expected results
+			if !reflect.DeepEqual(out, test.expected) {
+				fmt.Println("Expected")
+				printJson(test.expected)
+				fmt.Println("Got")
+				printJson(out)
+				t.Errorf("Expected file descriptor to equal\n%+v\ngot\n%+v", test.expected, out)
+			}
+
+			// assert error
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+
+			// assert actual error
+			if test.exactError != nil && test.exactError != err {
+				t.Errorf("Expected error to equal '%v'; got %v", test.exactError, err)
+			}
+		})
+	}
+}
+
+func TestFileDelete(t *testing.T) {
+	testCases := []struct {
+		description   string
+		calls         func(*mock.MockStorage, *mockStorageSync.MockPublisher) []*gomock.Call
+		errorExpected bool
+		exactError    error
+	}{
+		{
+			"Read fails",
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().Stat(gomock.Any(), "BUCKET", "FILE", "").Return(nil, fmt.Errorf("Error")),
+				}
+			},
+			withErrors,
+			nil,
+		},
+		{
+			"Write fails",
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().Stat(gomock.Any(), "BUCKET", "FILE", "").Return(file2V1, nil),
+					s.EXPECT().Write(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("Error")),
+				}
+			},
+			withErrors,
+			nil,
+		},
+		{
+			"Write successfull",
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
+				no := &object.NewObjectInfo{
+					Archetype:   "",
+					Size:        int64(0),
+					Created:     strfmt.DateTime(time3),
+					ContentType: "image/jpeg",
+					Version:     "UUID",
+					Name:        "FILE",
+					Operation:   "d",
+					Labels:      []string{"basicPatientInfo"},
+				}
+				r := ioutil.NopCloser(bytes.NewReader([]byte(collectionFileV2)))
+				basicNo := &object.NewObjectInfo{
+					Checksum:    "N1F-Xz3GaBn2H1p7uKzhkhKCQV8QVR0t76XD6wmFtXA=",
+					Size:        int64(3),
+					Created:     strfmt.DateTime(time3),
+					ContentType: "application/x-collection+json",
+					Version:     "UUID",
+					Name:        "basicPatientInfo",
+					Operation:   string(s3.Write),
+					Labels:      []string{labelFilesCollection},
+				}
+
+				return []*gomock.Call{
+					s.EXPECT().Stat(gomock.Any(), "BUCKET", "FILE", "").Return(file2V1, nil),
+					s.EXPECT().Write(gomock.Any(), "BUCKET", no, gomock.Any()).Return(file2V2, nil),
+					p.EXPECT().PublishAsyncWithRetries(
+						gomock.Any(),
+						storageSync.FileDelete,
+						gomock.Eq(&storageSync.FileInfo{"BUCKET", "FILE", "UUID", strfmt.DateTime(time3)}),
+					),
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "basicPatientInfo", "").Return(r, basic2, nil),
+					s.EXPECT().Write(gomock.Any(), "BUCKET", basicNo, gomock.Any()).Return(basic3, nil).Times(1),
+					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileUpdate, gomock.Eq(&storageSync.FileInfo{"BUCKET", "basicPatientInfo", "UUID", time3})).Times(1),
+				}
+			},
+			noErrors,
+			nil,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			// init service
+			svc, s, _, p, c := getTestService(t)
+			defer c()
+
+			// mock getUUID and getTime
+			getUUID = func() string { return "UUID" }
+			getTime = func() strfmt.DateTime { return strfmt.DateTime(time3) }
+
+			// setup calls
+			test.calls(s, p)
+
+			// call the MakeBucket
+			err := svc.FileDelete(context.TODO(), "BUCKET", "FILE")
+
+			// assert error
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+
+			// assert actual error
+			if test.exactError != nil && test.exactError != err {
+				t.Errorf("Expected error to equal '%v'; got %v", test.exactError, err)
+			}
+		})
+	}
+}
+
+func TestSyncFileList(t *testing.T) {
+	testCases := []struct {
+		description   string
+		calls         func(*mock.MockStorage) []*gomock.Call
+		expected      []*models.FileDescriptor
+		errorExpected bool
+		exactError    error
+	}{
+		{
+			"BucketExsits fails",
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(false, fmt.Errorf("Error")),
+				}
+			},
+			nil,
+			withErrors,
+			nil,
+		},
+		{
+			"List fails",
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil),
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return(nil, fmt.Errorf("Error")),
+				}
+			},
+			nil,
+			withErrors,
+			nil,
+		},
+		{
+			"Bucket does not exist",
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(false, nil),
+				}
+			},
+			[]*models.FileDescriptor{},
+			noErrors,
+			nil,
+		},
 		{
 			"Successful call",
 			func(s *mock.MockStorage) []*gomock.Call {
@@ -849,7 +1281,7 @@ func TestSyncFileList(t *testing.T) {
 			test.calls(s)
 
 			// call SyncFileList
-			out, err := svc.SyncFileList(context.TODO(), "BUCKET")
+			out, _, err := svc.SyncFileList(context.TODO(), "BUCKET", nil)
 
 			// check expected results
 			if !reflect.DeepEqual(out, test.expected) {
@@ -899,7 +1331,7 @@ func TestSyncFile(t *testing.T) {
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
 					s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
-					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE3", "V1").Return(nil, nil, fmt.Errorf("Error")),
+					s.EXPECT().Stat(gomock.Any(), "BUCKET", "FILE3", "V1").Return(nil, fmt.Errorf("Error")),
 				}
 			},
 			nil,
@@ -911,7 +1343,7 @@ func TestSyncFile(t *testing.T) {
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
 					s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
-					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE3", "V1").Return(nil, file3V1, nil),
+					s.EXPECT().Stat(gomock.Any(), "BUCKET", "FILE3", "V1").Return(file3V1, nil),
 				}
 			},
 			file3V1,
@@ -923,7 +1355,7 @@ func TestSyncFile(t *testing.T) {
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
 					s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
-					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE3", "V1").Return(nil, file3V1ALT, nil),
+					s.EXPECT().Stat(gomock.Any(), "BUCKET", "FILE3", "V1").Return(file3V1ALT, nil),
 				}
 			},
 			nil,
@@ -935,8 +1367,8 @@ func TestSyncFile(t *testing.T) {
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
 					s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
-					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE3", "V1").Return(nil, nil, s3.ErrNotFound),
-					s.EXPECT().Write(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("Error")),
+					s.EXPECT().Stat(gomock.Any(), "BUCKET", "FILE3", "V1").Return(nil, s3.ErrNotFound),
+					s.EXPECT().WriteStream(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("Error")),
 				}
 			},
 			nil,
@@ -948,8 +1380,6 @@ func TestSyncFile(t *testing.T) {
 			func(s *mock.MockStorage) []*gomock.Call {
 				no := &object.NewObjectInfo{
 					Archetype:   "ARCH",
-					Size:        int64(8),
-					Checksum:    "0bKln76n4gB3r5-Rsn6V6GUGGycL4D_1Oas7c1h4gug=",
 					Created:     strfmt.DateTime(time2),
 					ContentType: "text/openEhrXml",
 					Version:     "V1",
@@ -959,8 +1389,8 @@ func TestSyncFile(t *testing.T) {
 
 				return []*gomock.Call{
 					s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
-					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE3", "V1").Return(nil, nil, s3.ErrNotFound),
-					s.EXPECT().Write(gomock.Any(), "BUCKET", no, gomock.Any()).Return(file3V1, nil),
+					s.EXPECT().Stat(gomock.Any(), "BUCKET", "FILE3", "V1").Return(nil, s3.ErrNotFound),
+					s.EXPECT().WriteStream(gomock.Any(), "BUCKET", no, gomock.Any()).Return(file3V1, nil),
 				}
 			},
 			file3V1,
@@ -1012,36 +1442,189 @@ func TestSyncFile(t *testing.T) {
 	}
 }
 
-func TestSyncFileDelete(t *testing.T) {
+func TestSyncFileDecode(t *testing.T) {
+	base := make([]byte, 8*delta.MinBlockSize)
+	for i := range base {
+		base[i] = byte(i * 7 % 251)
+	}
+	contents := bytes.Join([][]byte{base[:5000], []byte("inserted"), base[5000:]}, nil)
+
+	compress := func(b []byte) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(b)
+		gz.Close()
+		return buf.Bytes()
+	}
+	sig, _ := delta.NewSignature(bytes.NewReader(base), delta.MinBlockSize)
+	var d bytes.Buffer
+	delta.Write(&d, sig, contents)
+
+	svc, _, _, _, c := getTestService(t)
+	defer c()
+	checksum, _ := svc.Checksum(bytes.NewReader(contents))
+
 	testCases := []struct {
 		description   string
 		calls         func(*mock.MockStorage) []*gomock.Call
+		body          []byte
+		encodings     []string
+		checksum      string
 		errorExpected bool
 		exactError    error
 	}{
 		{
-			"Read fails",
+			"Not encoded",
+			func(s *mock.MockStorage) []*gomock.Call { return nil },
+			contents,
+			nil,
+			"",
+			noErrors,
+			nil,
+		},
+		{
+			"Gzip compressed",
+			func(s *mock.MockStorage) []*gomock.Call { return nil },
+			compress(contents),
+			[]string{storageSync.EncodingGzip},
+			checksum,
+			noErrors,
+			nil,
+		},
+		{
+			"Compressed delta",
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
-					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, nil, fmt.Errorf("Error")),
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "V1").Return(ioutil.NopCloser(bytes.NewReader(base)), file1V1, nil),
 				}
 			},
-			withErrors,
+			compress(d.Bytes()),
+			[]string{storageSync.EncodingDelta, storageSync.EncodingGzip},
+			checksum,
+			noErrors,
 			nil,
 		},
 		{
-			"Write fails",
+			"Base version not found",
 			func(s *mock.MockStorage) []*gomock.Call {
 				return []*gomock.Call{
-					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, file1V1, nil),
-					s.EXPECT().Write(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("Error")),
+					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "V1").Return(nil, nil, s3.ErrNotFound),
 				}
 			},
+			d.Bytes(),
+			[]string{storageSync.EncodingDelta},
+			checksum,
 			withErrors,
-			nil,
+			ErrInvalidEncoding,
 		},
 		{
-			"Write successfull",
+			"Unsupported encoding, zstd is not offered yet",
+			func(s *mock.MockStorage) []*gomock.Call { return nil },
+			contents,
+			[]string{"zstd"},
+			checksum,
+			withErrors,
+			ErrInvalidEncoding,
+		},
+		{
+			"Checksum mismatch",
+			func(s *mock.MockStorage) []*gomock.Call { return nil },
+			compress(contents),
+			[]string{storageSync.EncodingGzip},
+			"CHS",
+			withErrors,
+			ErrChecksumMismatch,
+		},
+		{
+			"Checksum of encoded contents missing",
+			func(s *mock.MockStorage) []*gomock.Call { return nil },
+			compress(contents),
+			[]string{storageSync.EncodingGzip},
+			"",
+			withErrors,
+			ErrInvalidEncoding,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			// init service
+			svc, s, _, _, c := getTestService(t)
+			defer c()
+
+			// setup calls
+			test.calls(s)
+
+			// call the SyncFileDecode
+			r, err := svc.SyncFileDecode(context.TODO(), "BUCKET", "FILE", bytes.NewReader(test.body), test.encodings, "V1", test.checksum)
+
+			// assert error
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+
+			// assert actual error
+			if test.exactError != nil && test.exactError != err {
+				t.Errorf("Expected error to equal '%v'; got %v", test.exactError, err)
+			}
+
+			// check decoded contents
+			if err == nil {
+				out, _ := ioutil.ReadAll(r)
+				if !bytes.Equal(out, contents) {
+					t.Error("Expected decoded contents to equal the contents")
+				}
+			}
+		})
+	}
+
+	// decoded contents are limited
+	svc, s, _, _, c := getTestService(t)
+	defer c()
+	svc.maxDecodedSize = int64(len(contents) - 1)
+
+	if _, err := svc.SyncFileDecode(context.TODO(), "BUCKET", "FILE", bytes.NewReader(compress(contents)), []string{storageSync.EncodingGzip}, "", checksum); err != ErrInvalidEncoding {
+		t.Errorf("Expected error to equal '%v'; got %v", ErrInvalidEncoding, err)
+	}
+
+	s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "V1").Return(ioutil.NopCloser(bytes.NewReader(base)), file1V1, nil)
+	if _, err := svc.SyncFileDecode(context.TODO(), "BUCKET", "FILE", bytes.NewReader(d.Bytes()), []string{storageSync.EncodingDelta}, "V1", checksum); err != ErrInvalidEncoding {
+		t.Errorf("Expected error to equal '%v'; got %v", ErrInvalidEncoding, err)
+	}
+}
+
+func TestSyncFileDelete(t *testing.T) {
+	testCases := []struct {
+		description   string
+		calls         func(*mock.MockStorage) []*gomock.Call
+		errorExpected bool
+		exactError    error
+	}{
+		{
+			"Read fails",
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().Stat(gomock.Any(), "BUCKET", "FILE", "").Return(nil, fmt.Errorf("Error")),
+				}
+			},
+			withErrors,
+			nil,
+		},
+		{
+			"Write fails",
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().Stat(gomock.Any(), "BUCKET", "FILE", "").Return(file1V1, nil),
+					s.EXPECT().Write(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("Error")),
+				}
+			},
+			withErrors,
+			nil,
+		},
+		{
+			"Write successfull",
 			func(s *mock.MockStorage) []*gomock.Call {
 				no := &object.NewObjectInfo{
 					Archetype:   "openEHR-EHR-OBSERVATION.blood_pressure.v1",
@@ -1056,7 +1639,7 @@ func TestSyncFileDelete(t *testing.T) {
 				}
 
 				return []*gomock.Call{
-					s.EXPECT().Read(gomock.Any(), "BUCKET", "FILE", "").Return(nil, file1V1, nil),
+					s.EXPECT().Stat(gomock.Any(), "BUCKET", "FILE", "").Return(file1V1, nil),
 					s.EXPECT().Write(gomock.Any(), "BUCKET", no, gomock.Any()).Return(file1V2, nil),
 				}
 			},
@@ -1095,6 +1678,786 @@ func TestSyncFileDelete(t *testing.T) {
 	}
 }
 
+func TestApplyRetention(t *testing.T) {
+	list := []*models.FileDescriptor{file2V2, file1V2, file1V1, file2V1}
+	policy := &RetentionPolicy{Rules: []*RetentionRule{
+		{VersionsDays: 5},
+		{Archetype: "openEHR-EHR-OBSERVATION.blood_pressure.v1", VersionsDays: 30},
+		{Bucket: "BUCKET", DeletedDays: 7},
+	}}
+
+	testCases := []struct {
+		description   string
+		policy        *RetentionPolicy
+		calls         func(*mock.MockStorage, *mockStorageSync.MockPublisher) []*gomock.Call
+		expected      int
+		errorExpected bool
+	}{
+		{
+			"List fails",
+			policy,
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return(nil, fmt.Errorf("Error")),
+				}
+			},
+			0,
+			withErrors,
+		},
+		{
+			"Purge fails",
+			policy,
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return(list, nil),
+					s.EXPECT().Purge(gomock.Any(), "BUCKET", "Image", "V1").Return(fmt.Errorf("Error")),
+				}
+			},
+			0,
+			withErrors,
+		},
+		{
+			"Deleted file purged after grace period",
+			policy,
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return(list, nil),
+					s.EXPECT().Purge(gomock.Any(), "BUCKET", "Image", "V1").Return(nil),
+					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FilePurge, gomock.Eq(&storageSync.FileInfo{"BUCKET", "Image", "V1", time1})),
+					s.EXPECT().Purge(gomock.Any(), "BUCKET", "Image", "UUID").Return(nil),
+					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FilePurge, gomock.Eq(&storageSync.FileInfo{"BUCKET", "Image", "UUID", time3})),
+				}
+			},
+			2,
+			noErrors,
+		},
+		{
+			"Superseded versions purged",
+			&RetentionPolicy{Rules: []*RetentionRule{{VersionsDays: 5}}},
+			func(s *mock.MockStorage, p *mockStorageSync.MockPublisher) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().List(gomock.Any(), "BUCKET", "").Return(list, nil),
+					s.EXPECT().Purge(gomock.Any(), "BUCKET", "Image", "V1").Return(nil),
+					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FilePurge, gomock.Eq(&storageSync.FileInfo{"BUCKET", "Image", "V1", time1})),
+					s.EXPECT().Purge(gomock.Any(), "BUCKET", "File1", "V1").Return(nil),
+					p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FilePurge, gomock.Eq(&storageSync.FileInfo{"BUCKET", "File1", "V1", time1})),
+				}
+			},
+			2,
+			noErrors,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			// init service
+			svc, s, _, p, c := getTestService(t)
+			defer c()
+
+			// mock getTime
+			getTime = func() strfmt.DateTime { return strfmt.DateTime(time.Time(time3).AddDate(0, 0, 10)) }
+
+			// setup calls
+			test.calls(s, p)
+
+			purged, err := svc.ApplyRetention(context.TODO(), "BUCKET", test.policy)
+
+			// assert error
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+
+			// assert number of purged versions
+			if purged != test.expected {
+				t.Errorf("Expected %d purged versions, got %d", test.expected, purged)
+			}
+		})
+	}
+}
+
+func TestSyncFilePurge(t *testing.T) {
+	testCases := []struct {
+		description   string
+		version       string
+		calls         func(*mock.MockStorage) []*gomock.Call
+		errorExpected bool
+		exactError    error
+	}{
+		{
+			"Version not found",
+			"V3",
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().List(gomock.Any(), "BUCKET", "File1.").Return([]*models.FileDescriptor{file1V2, file1V1}, nil),
+				}
+			},
+			withErrors,
+			ErrNotFound,
+		},
+		{
+			"Superseded version purged",
+			"V1",
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().List(gomock.Any(), "BUCKET", "File1.").Return([]*models.FileDescriptor{file1V2, file1V1}, nil),
+					s.EXPECT().Purge(gomock.Any(), "BUCKET", "File1", "V1").Return(nil),
+				}
+			},
+			noErrors,
+			nil,
+		},
+		{
+			"Deletion purged with remaining versions",
+			"UUID",
+			func(s *mock.MockStorage) []*gomock.Call {
+				return []*gomock.Call{
+					s.EXPECT().List(gomock.Any(), "BUCKET", "File1.").Return([]*models.FileDescriptor{file2V2, file1V2, file1V1}, nil),
+					s.EXPECT().Purge(gomock.Any(), "BUCKET", "File1", "V1").Return(nil),
+					s.EXPECT().Purge(gomock.Any(), "BUCKET", "File1", "V2").Return(s3.ErrNotFound),
+					s.EXPECT().Purge(gomock.Any(), "BUCKET", "File1", "UUID").Return(nil),
+				}
+			},
+			noErrors,
+			nil,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			// init service
+			svc, s, _, _, c := getTestService(t)
+			defer c()
+
+			// setup calls
+			test.calls(s)
+
+			err := svc.SyncFilePurge(context.TODO(), "BUCKET", "File1", test.version)
+
+			// assert error
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+
+			// assert actual error
+			if test.exactError != nil && test.exactError != err {
+				t.Errorf("Expected error to equal '%v'; got %v", test.exactError, err)
+			}
+		})
+	}
+}
+
+func TestUploads(t *testing.T) {
+	svc, s, k, p, c := getTestService(t)
+	defer c()
+
+	// uploads are disabled without a directory
+	if _, err := svc.UploadGet(context.TODO(), "BUCKET", "UUID"); err != ErrUploadsDisabled {
+		t.Errorf("Expected error to equal '%v'; got %v", ErrUploadsDisabled, err)
+	}
+
+	dir, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	svc.uploads = newUploadStore(dir, k)
+
+	// mock getUUID and getTime
+	getUUID = func() string { return "UUID" }
+	getTime = func() strfmt.DateTime { return strfmt.DateTime(time1) }
+
+	k.EXPECT().Get("BUCKET").Return("SECRET", nil).AnyTimes()
+
+	// archived bucket can not be uploaded to
+	s.EXPECT().GetBucketMetadata(gomock.Any(), "BUCKET").Return(&s3.BucketMetadata{Archived: true}, nil)
+	if _, err := svc.UploadNew(context.TODO(), "BUCKET", "", "text/plain", "", nil); err != ErrArchived {
+		t.Errorf("Expected error to equal '%v'; got %v", ErrArchived, err)
+	}
+
+	s.EXPECT().GetBucketMetadata(gomock.Any(), "BUCKET").Return(nil, s3.ErrNotFound)
+	u, err := svc.UploadNew(context.TODO(), "BUCKET", "", "text/plain", "ARCH", nil)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if u.ID != "UUID" || u.Offset != 0 {
+		t.Errorf("Expected upload UUID at offset 0, got %+v", u)
+	}
+
+	// chunks are written at the offset replacing contents following it
+	chunks := []struct {
+		offset   int64
+		chunk    string
+		expected int64
+		err      error
+	}{
+		{0, "cont", 4, nil},
+		{2, "ntents", 8, nil},
+		{20, "gap", 0, ErrUploadOffset},
+	}
+	for _, chunk := range chunks {
+		u, err := svc.UploadChunk(context.TODO(), "BUCKET", "UUID", chunk.offset, bytes.NewBufferString(chunk.chunk))
+		if err != chunk.err {
+			t.Fatalf("Expected error to equal '%v'; got %v", chunk.err, err)
+		}
+		if err == nil && u.Offset != chunk.expected {
+			t.Errorf("Expected offset %d, got %d", chunk.expected, u.Offset)
+		}
+	}
+
+	// session survives restart
+	svc.uploads = newUploadStore(dir, k)
+	u, err = svc.UploadGet(context.TODO(), "BUCKET", "UUID")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if u.Offset != 8 || u.Archetype != "ARCH" {
+		t.Errorf("Expected upload with archetype ARCH at offset 8, got %+v", u)
+	}
+	if _, err := svc.UploadGet(context.TODO(), "OTHER", "UUID"); err != ErrNotFound {
+		t.Errorf("Expected error to equal '%v'; got %v", ErrNotFound, err)
+	}
+
+	// committed contents are stored as a new file
+	var contents string
+	gomock.InOrder(
+		s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
+		s.EXPECT().WriteStream(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).
+			Do(func(_ context.Context, _ string, _ *object.NewObjectInfo, r io.Reader) {
+				b, _ := ioutil.ReadAll(r)
+				contents = string(b)
+			}).
+			Return(file1V1, nil),
+		p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileNew, gomock.Any()),
+	)
+	fd, err := svc.UploadCommit(context.TODO(), "BUCKET", "UUID")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if fd != file1V1 || contents != "contents" {
+		t.Errorf("Expected 'contents' to be stored as %+v, got '%s' stored as %+v", file1V1, contents, fd)
+	}
+	if _, err := svc.UploadGet(context.TODO(), "BUCKET", "UUID"); err != ErrNotFound {
+		t.Errorf("Expected session to be removed, got %v", err)
+	}
+
+	// cancelled session is removed
+	s.EXPECT().GetBucketMetadata(gomock.Any(), "BUCKET").Return(&s3.BucketMetadata{}, nil)
+	if _, err := svc.UploadNew(context.TODO(), "BUCKET", "", "text/plain", "", nil); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if err := svc.UploadDelete(context.TODO(), "BUCKET", "UUID"); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if _, err := svc.UploadGet(context.TODO(), "BUCKET", "UUID"); err != ErrNotFound {
+		t.Errorf("Expected session to be removed, got %v", err)
+	}
+
+	// chunks not fitting in the quota are dropped
+	svc.quota = NewQuota(s, QuotaLimits{BucketBytes: 14}, zerolog.New(os.Stdout))
+	gomock.InOrder(
+		s.EXPECT().GetBucketMetadata(gomock.Any(), "BUCKET").Return(&s3.BucketMetadata{}, nil),
+		s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{{Name: "BUCKET", Created: time1}}, nil),
+		s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{file1V1}, nil),
+	)
+	if _, err := svc.UploadNew(context.TODO(), "BUCKET", "", "text/plain", "", nil); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if _, err := svc.UploadChunk(context.TODO(), "BUCKET", "UUID", 0, bytes.NewBufferString("cont")); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if _, err := svc.UploadChunk(context.TODO(), "BUCKET", "UUID", 2, bytes.NewBufferString("ntents")); err != ErrQuotaExceeded {
+		t.Fatalf("Expected error to equal '%v'; got %v", ErrQuotaExceeded, err)
+	}
+	if u, err := svc.UploadGet(context.TODO(), "BUCKET", "UUID"); err != nil || u.Offset != 4 {
+		t.Fatalf("Expected upload at offset 4, got %+v, %v", u, err)
+	}
+
+	// sessions which received no contents for the ttl are swept
+	if removed, err := svc.UploadSweep(context.TODO(), time.Hour); err != nil || removed != 0 {
+		t.Fatalf("Expected no sessions to be removed, got %d, %v", removed, err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "UUID.data"), old, old); err != nil {
+		t.Fatalf("Failed to change modification time: %v", err)
+	}
+	if removed, err := svc.UploadSweep(context.TODO(), time.Hour); err != nil || removed != 1 {
+		t.Fatalf("Expected 1 session to be removed, got %d, %v", removed, err)
+	}
+	if _, err := svc.UploadGet(context.TODO(), "BUCKET", "UUID"); err != ErrNotFound {
+		t.Errorf("Expected session to be removed, got %v", err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	svc, s, _, _, c := getTestService(t)
+	defer c()
+
+	svc.quota = NewQuota(s, QuotaLimits{BucketBytes: 20, BucketFiles: 1, WarningRatio: 0.5}, zerolog.New(os.Stdout))
+
+	// mock getUUID and getTime
+	getUUID = func() string { return "UUID" }
+	getTime = func() strfmt.DateTime { return strfmt.DateTime(time1) }
+
+	if st := svc.quota.Status(); st.Status != status.OK {
+		t.Errorf("Expected status to be ok before usage is loaded, got %+v", st)
+	}
+
+	gomock.InOrder(
+		s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{{Name: "BUCKET", Created: time1}}, nil),
+		s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{file1V2, file1V1}, nil),
+	)
+	if err := svc.quota.Load(context.TODO()); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if st := svc.quota.Status(); st.Status != status.Warning {
+		t.Errorf("Expected status to be warning, got %+v", st)
+	}
+
+	// new file exceeds the files quota and is not written
+	s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(s3.ErrAlreadyExists)
+	if _, err := svc.FileNew(context.TODO(), "BUCKET", bytes.NewBufferString("contents"), "text/plain", "", nil); err != ErrQuotaExceeded {
+		t.Errorf("Expected error to equal '%v'; got %v", ErrQuotaExceeded, err)
+	}
+
+	// new version exceeds the bytes quota and is purged
+	updated := &models.FileDescriptor{Name: "File1", Version: "UUID", Size: 8, Operation: "w"}
+	gomock.InOrder(
+		s.EXPECT().Stat(gomock.Any(), "BUCKET", "File1", "").Return(file1V2, nil),
+		s.EXPECT().WriteStream(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).Return(updated, nil),
+		s.EXPECT().Purge(gomock.Any(), "BUCKET", "File1", "UUID").Return(nil),
+	)
+	if _, err := svc.FileUpdate(context.TODO(), "BUCKET", "File1", bytes.NewBufferString("contents"), "text/plain", "", nil); err != ErrQuotaExceeded {
+		t.Errorf("Expected error to equal '%v'; got %v", ErrQuotaExceeded, err)
+	}
+
+	// purged bucket is listed again
+	svc.quota.invalidate("BUCKET")
+	s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{}, nil)
+	if err := svc.quota.check(context.TODO(), "BUCKET", 0); err != nil {
+		t.Errorf("Expected error to be nil, got %v", err)
+	}
+	if st := svc.quota.Status(); st.Status != status.OK {
+		t.Errorf("Expected status to be ok, got %+v", st)
+	}
+}
+
+func TestRenditions(t *testing.T) {
+	svc, s, _, p, c := getTestService(t)
+	defer c()
+
+	// mock getUUID and getTime
+	getUUID = func() string { return "UUID" }
+	getTime = func() strfmt.DateTime { return strfmt.DateTime(time1) }
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 2048, 512))); err != nil {
+		t.Fatalf("Failed to encode image: %v", err)
+	}
+	img := &models.FileDescriptor{Name: "UUID", Version: "UUID", Created: time1, ContentType: "image/png", Operation: "w"}
+
+	// renditions are stored with the same version as the image
+	sizes := map[string]image.Rectangle{}
+	gomock.InOrder(
+		s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
+		s.EXPECT().WriteStream(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).Return(img, nil),
+		s.EXPECT().Read(gomock.Any(), "BUCKET", "UUID", "UUID").Return(ioutil.NopCloser(bytes.NewReader(buf.Bytes())), img, nil),
+		s.EXPECT().Write(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).Times(2).Do(func(_ context.Context, _ string, no *object.NewObjectInfo, r io.Reader) {
+			cfg, err := png.DecodeConfig(r)
+			if err != nil {
+				t.Fatalf("Failed to decode rendition: %v", err)
+			}
+			if no.Version != "UUID" || no.ContentType != "image/png" || !reflect.DeepEqual(no.Labels, []string{labelRendition}) {
+				t.Errorf("Unexpected rendition %+v", no)
+			}
+			sizes[no.Name] = image.Rect(0, 0, cfg.Width, cfg.Height)
+		}).Return(&models.FileDescriptor{Name: "UUID-thumb", Version: "UUID"}, nil),
+	)
+	p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileNew, gomock.Any()).Times(3)
+
+	if _, err := svc.FileNew(context.TODO(), "BUCKET", bytes.NewReader(buf.Bytes()), "image/png", "", nil); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	expected := map[string]image.Rectangle{
+		"UUID-thumb":   image.Rect(0, 0, 160, 40),
+		"UUID-preview": image.Rect(0, 0, 1024, 256),
+	}
+	if !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("Expected renditions %v, got %v", expected, sizes)
+	}
+
+	// rendition of the latest version is returned
+	thumb := &models.FileDescriptor{Name: "UUID-thumb", Version: "UUID", ContentType: "image/png"}
+	gomock.InOrder(
+		s.EXPECT().List(gomock.Any(), "BUCKET", "UUID.").Return([]*models.FileDescriptor{img}, nil),
+		s.EXPECT().Read(gomock.Any(), "BUCKET", "UUID-thumb", "UUID").Return(ioutil.NopCloser(&bytes.Buffer{}), thumb, nil),
+	)
+	_, fd, err := svc.FileGetRendition(context.TODO(), "BUCKET", "UUID", "", RenditionThumb, nil)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if fd != thumb {
+		t.Errorf("Expected %+v, got %+v", thumb, fd)
+	}
+
+	// deleted image has no renditions
+	deleted := &models.FileDescriptor{Name: "UUID", Version: "UUID2", ContentType: "image/png", Operation: "d"}
+	s.EXPECT().List(gomock.Any(), "BUCKET", "UUID.").Return([]*models.FileDescriptor{deleted, img}, nil)
+	if _, _, err := svc.FileGetRendition(context.TODO(), "BUCKET", "UUID", "", RenditionThumb, nil); err != ErrNotFound {
+		t.Errorf("Expected error to equal '%v'; got %v", ErrNotFound, err)
+	}
+}
+
+func TestArchetypeValidation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archetypes")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	schema := `{"type": "object", "required": ["systolic"], "properties": {"systolic": {"type": "integer"}}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "openEHR-EHR-OBSERVATION.blood_pressure.v1.json"), []byte(schema), 0600); err != nil {
+		t.Fatalf("Failed to write schema: %v", err)
+	}
+
+	reject, err := LoadArchetypeRegistry(dir, ValidationReject)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	flag, err := LoadArchetypeRegistry(dir, ValidationFlag)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	testCases := []struct {
+		description    string
+		registry       *ArchetypeRegistry
+		archetype      string
+		contentType    string
+		contents       string
+		labels         []string
+		expectedLabels []string
+		exactError     error
+	}{
+		{"Conforming document", reject, "openEHR-EHR-OBSERVATION.blood_pressure.v1", "application/json", `{"systolic": 120}`, []string{"vitalSign"}, []string{"vitalSign"}, nil},
+		{"Non-conforming document is rejected", reject, "openEHR-EHR-OBSERVATION.blood_pressure.v1", "application/json", `{"systolic": "high"}`, nil, nil, ErrInvalidDocument},
+		{"Malformed document is rejected", reject, "openEHR-EHR-OBSERVATION.blood_pressure.v1", "text/openEhrJson", `{"systolic"`, nil, nil, ErrInvalidDocument},
+		{"Non-conforming document is flagged", flag, "openEHR-EHR-OBSERVATION.blood_pressure.v1", "application/json", `{}`, []string{"vitalSign"}, []string{"vitalSign", labelInvalidArchetype}, nil},
+		{"Flag is dropped from conforming document", flag, "openEHR-EHR-OBSERVATION.blood_pressure.v1", "application/json", `{"systolic": 120}`, []string{"vitalSign", labelInvalidArchetype}, []string{"vitalSign"}, nil},
+		{"Archetype without schema", reject, "openEHR-EHR-OBSERVATION.pulse.v1", "application/json", `{"systolic": "high"}`, nil, nil, nil},
+		{"Document that is not JSON", reject, "openEHR-EHR-OBSERVATION.blood_pressure.v1", "text/openEhrXml", `<systolic/>`, nil, nil, nil},
+		{"Validation disabled", nil, "openEHR-EHR-OBSERVATION.blood_pressure.v1", "application/json", `{"systolic": "high"}`, nil, nil, nil},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			r, labels, err := test.registry.validate(test.archetype, test.contentType, bytes.NewBufferString(test.contents), test.labels)
+			if err != test.exactError {
+				t.Fatalf("Expected error to equal '%v'; got %v", test.exactError, err)
+			}
+			if err != nil {
+				return
+			}
+
+			if !reflect.DeepEqual(labels, test.expectedLabels) {
+				t.Errorf("Expected labels %v, got %v", test.expectedLabels, labels)
+			}
+			b, _ := ioutil.ReadAll(r)
+			if string(b) != test.contents {
+				t.Errorf("Expected contents '%s', got '%s'", test.contents, b)
+			}
+		})
+	}
+
+	// rejected document is not stored
+	svc, s, _, _, c := getTestService(t)
+	defer c()
+	svc.archetypes = reject
+
+	s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil)
+	if _, err := svc.FileNew(context.TODO(), "BUCKET", bytes.NewBufferString(`{}`), "application/json", "openEHR-EHR-OBSERVATION.blood_pressure.v1", nil); err != ErrInvalidDocument {
+		t.Errorf("Expected error to equal '%v'; got %v", ErrInvalidDocument, err)
+	}
+}
+
+type fetcherFunc func(ctx context.Context, bucketID, fileID, version string, w io.Writer) error
+
+func (f fetcherFunc) FetchDestinationFile(ctx context.Context, bucketID, fileID, version string, w io.Writer) error {
+	return f(ctx, bucketID, fileID, version, w)
+}
+
+func TestScrubber(t *testing.T) {
+	svc, s, _, _, c := getTestService(t)
+	defer c()
+
+	checksum, _ := svc.Checksum(bytes.NewBufferString("contents"))
+	good := &models.FileDescriptor{Name: "File1", Version: "V1", Checksum: checksum, Operation: "w"}
+	tampered := &models.FileDescriptor{Name: "File2", Version: "V1", Checksum: checksum, Operation: "w"}
+	unreadable := &models.FileDescriptor{Name: "File3", Version: "V1", Checksum: checksum, Operation: "w"}
+	deleted := &models.FileDescriptor{Name: "File4", Version: "V2", Operation: "d"}
+
+	expectScrub := func() {
+		s.EXPECT().ListBuckets(gomock.Any()).Return([]*models.BucketDescriptor{{Name: "BUCKET", Created: time1}}, nil)
+		s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{good, tampered, unreadable, deleted}, nil)
+		s.EXPECT().Read(gomock.Any(), "BUCKET", "File1", "V1").Return(ioutil.NopCloser(bytes.NewBufferString("contents")), good, nil)
+		s.EXPECT().Read(gomock.Any(), "BUCKET", "File2", "V1").Return(ioutil.NopCloser(bytes.NewBufferString("tampered")), tampered, nil)
+		s.EXPECT().Read(gomock.Any(), "BUCKET", "File3", "V1").Return(nil, nil, fmt.Errorf("cipher: message authentication failed"))
+	}
+
+	// corrupted versions are reported
+	scrubber := NewScrubber(s, nil, zerolog.New(os.Stdout))
+	if st := scrubber.Status(); st.Status != status.OK {
+		t.Errorf("Expected status to be ok before scrubbing, got %+v", st)
+	}
+	expectScrub()
+	corrupted, err := scrubber.ScrubAll(context.TODO())
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	expected := []*CorruptedVersion{
+		{Bucket: "BUCKET", FileID: "File2", Version: "V1", Reason: CorruptedChecksum},
+		{Bucket: "BUCKET", FileID: "File3", Version: "V1", Reason: CorruptedUnreadable},
+	}
+	if !reflect.DeepEqual(corrupted, expected) {
+		t.Errorf("Expected corrupted versions to equal\n%+v\ngot\n%+v", expected, corrupted)
+	}
+	if st := scrubber.Status(); st.Status != status.Error {
+		t.Errorf("Expected status to be error, got %+v", st)
+	}
+
+	// corrupted versions are re-fetched
+	scrubber = NewScrubber(s, fetcherFunc(func(_ context.Context, bucketID, fileID, version string, w io.Writer) error {
+		if fileID != "File2" {
+			return fmt.Errorf("Not found")
+		}
+		_, err := w.Write([]byte("contents"))
+		return err
+	}), zerolog.New(os.Stdout))
+	expectScrub()
+	gomock.InOrder(
+		s.EXPECT().Purge(gomock.Any(), "BUCKET", "File2", "V1").Return(nil),
+		s.EXPECT().Write(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).Return(tampered, nil),
+	)
+	corrupted, err = scrubber.ScrubAll(context.TODO())
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if !reflect.DeepEqual(corrupted, expected[1:]) {
+		t.Errorf("Expected corrupted versions to equal\n%+v\ngot\n%+v", expected[1:], corrupted)
+	}
+}
+
+func TestSyncChangeList(t *testing.T) {
+	svc, _, _, p, c := getTestService(t)
+	defer c()
+
+	// change log is not enabled
+	if _, _, err := svc.SyncChangeList(context.TODO(), 0, 0); err != ErrNoChangeLog {
+		t.Fatalf("Expected error to be '%v', got %v", ErrNoChangeLog, err)
+	}
+
+	dir, err := ioutil.TempDir("", "changes")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	changes, err := OpenChangeLog(filepath.Join(dir, "changes.db"))
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	defer changes.Close()
+	svc.changes = changes
+	svc.publisher = changes.Publisher(p)
+
+	// published writes are recorded in order
+	f1 := &storageSync.FileInfo{BucketID: "BUCKET", FileID: "File1", Version: "V1", Created: time1}
+	f2 := &storageSync.FileInfo{BucketID: "BUCKET", FileID: "File1", Version: "V2", Created: time2}
+	f3 := &storageSync.FileInfo{BucketID: "BUCKET", FileID: "File2", Version: "V1", Created: time3}
+	gomock.InOrder(
+		p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileNew, f1),
+		p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileUpdate, f2),
+		p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileDelete, f3),
+	)
+	svc.publisher.PublishAsyncWithRetries(context.TODO(), storageSync.FileNew, f1)
+	svc.publisher.PublishAsyncWithRetries(context.TODO(), storageSync.FileUpdate, f2)
+	svc.publisher.PublishAsyncWithRetries(context.TODO(), storageSync.FileDelete, f3)
+
+	testCases := []struct {
+		description string
+		since       int64
+		limit       int
+		expected    []*models.Change
+	}{
+		{
+			"All changes",
+			0,
+			0,
+			[]*models.Change{
+				{Sequence: 1, Type: "file.new", Bucket: "BUCKET", FileID: "File1", Version: "V1", Created: time1},
+				{Sequence: 2, Type: "file.update", Bucket: "BUCKET", FileID: "File1", Version: "V2", Created: time2},
+				{Sequence: 3, Type: "file.delete", Bucket: "BUCKET", FileID: "File2", Version: "V1", Created: time3},
+			},
+		},
+		{
+			"Changes since sequence number with limit",
+			1,
+			1,
+			[]*models.Change{
+				{Sequence: 2, Type: "file.update", Bucket: "BUCKET", FileID: "File1", Version: "V2", Created: time2},
+			},
+		},
+		{
+			"No new changes",
+			3,
+			0,
+			[]*models.Change{},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			list, last, err := svc.SyncChangeList(context.TODO(), test.since, test.limit)
+			if err != nil {
+				t.Fatalf("Expected error to be nil, got %v", err)
+			}
+			if last != 3 {
+				t.Errorf("Expected last sequence number to be 3, got %d", last)
+			}
+			if len(list) != len(test.expected) {
+				t.Fatalf("Expected %d changes, got %d", len(test.expected), len(list))
+			}
+			for i := range list {
+				if !reflect.DeepEqual(*list[i], *test.expected[i]) {
+					t.Errorf("Expected change %d to equal\n%+v\ngot\n%+v", i, test.expected[i], list[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBucketArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	signer := getTestArchiveSigner(t, dir, "service")
+	other := getTestArchiveSigner(t, dir, "other")
+
+	svc, s, _, _, c := getTestService(t)
+	defer c()
+	svc.signer = signer
+
+	checksum, _ := svc.Checksum(bytes.NewBufferString("contents"))
+	written := &models.FileDescriptor{Name: "File1", Version: "V1", Checksum: checksum, Size: 8, ContentType: "text/plain", Created: time1, Operation: "w"}
+	deleted := &models.FileDescriptor{Name: "File1", Version: "V2", ContentType: "text/plain", Created: time2, Operation: "d"}
+
+	// all the versions are exported
+	s.EXPECT().BucketExists(gomock.Any(), "BUCKET").Return(true, nil)
+	s.EXPECT().List(gomock.Any(), "BUCKET", "").Return([]*models.FileDescriptor{deleted, written}, nil)
+	s.EXPECT().Read(gomock.Any(), "BUCKET", "File1", "V1").Return(ioutil.NopCloser(bytes.NewBufferString("contents")), written, nil)
+
+	rc, err := svc.BucketExport(context.TODO(), "BUCKET", true)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	archive, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	// archive is imported in the order of versions
+	svc, s, _, p, c := getTestService(t)
+	defer c()
+	svc.signer = signer
+
+	gomock.InOrder(
+		s.EXPECT().MakeBucket(gomock.Any(), "BUCKET").Return(nil),
+		s.EXPECT().Stat(gomock.Any(), "BUCKET", "File1", "V1").Return(nil, s3.ErrNotFound),
+		s.EXPECT().WriteStream(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).Return(written, nil),
+		p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileNew, gomock.Eq(&storageSync.FileInfo{"BUCKET", "File1", "V1", time1})),
+		s.EXPECT().Stat(gomock.Any(), "BUCKET", "File1", "").Return(written, nil).Times(2),
+		s.EXPECT().Write(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any()).Return(deleted, nil),
+		p.EXPECT().PublishAsyncWithRetries(gomock.Any(), storageSync.FileDelete, gomock.Eq(&storageSync.FileInfo{"BUCKET", "File1", "V2", time2})),
+	)
+
+	summary, err := svc.BucketImport(context.TODO(), "BUCKET", bytes.NewReader(archive))
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	expected := &models.ImportSummary{Bucket: "BUCKET", Imported: 2}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("Expected summary to equal %+v, got %+v", expected, summary)
+	}
+
+	// archives that can not be trusted are not imported
+	testCases := []struct {
+		description string
+		signer      *ArchiveSigner
+		bucket      string
+		archive     []byte
+		exactError  error
+	}{
+		{"Archive signed by another certificate", other, "BUCKET", archive, ErrArchiveSignature},
+		{"Archive of another bucket", signer, "OTHER", archive, ErrInvalidArchive},
+		{"Archive is not gzip compressed", signer, "BUCKET", []byte("contents"), ErrInvalidArchive},
+		{"Archive is truncated", signer, "BUCKET", archive[:20], ErrInvalidArchive},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			svc, _, _, _, c := getTestService(t)
+			defer c()
+			svc.signer = test.signer
+
+			if _, err := svc.BucketImport(context.TODO(), test.bucket, bytes.NewReader(test.archive)); err != test.exactError {
+				t.Errorf("Expected error to equal '%v'; got %v", test.exactError, err)
+			}
+		})
+	}
+}
+
+// getTestArchiveSigner returns signer using a new self-signed certificate
+func getTestArchiveSigner(t *testing.T, dir, name string) *ArchiveSigner {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	certPath, keyPath := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	signer, err := NewArchiveSigner(certPath, keyPath, "")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	return signer
+}
+
 func getTestService(t *testing.T) (*service, *mock.MockStorage, *mock.MockKeyProvider, *mockStorageSync.MockPublisher, func()) {
 	// setup s3 mock
 	storageCtrl := gomock.NewController(t)
@@ -1109,10 +2472,11 @@ func getTestService(t *testing.T) (*service, *mock.MockStorage, *mock.MockKeyPro
 	publisher := mockStorageSync.NewMockPublisher(publisherCtrl)
 
 	svc := &service{
-		s3:          s3storage,
-		keyProvider: keyProvider,
-		publisher:   publisher,
-		logger:      zerolog.New(os.Stdout),
+		s3:             s3storage,
+		keyProvider:    keyProvider,
+		publisher:      publisher,
+		maxDecodedSize: DefaultMaxDecodedSize,
+		logger:         zerolog.New(os.Stdout),
 	}
 
 	cleanup := func() {
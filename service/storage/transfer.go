@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	"github.com/iryonetwork/wwm/sync/storage/delta"
+)
+
+// SyncEncodings are encodings of synced file contents decoded by SyncFileDecode
+var SyncEncodings = []string{storageSync.EncodingGzip, storageSync.EncodingDelta}
+
+// DefaultMaxDecodedSize is the limit of decoded synced file contents used if
+// it is not set in Options
+const DefaultMaxDecodedSize = 1 << 30
+
+// errDecodedTooLarge stops writing decoded contents past the limit
+var errDecodedTooLarge = errors.New("decoded contents exceed the limit")
+
+// limitWriter writes to the buffer until the limit is reached
+type limitWriter struct {
+	buf   *bytes.Buffer
+	limit int64
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if int64(w.buf.Len()+len(p)) > w.limit {
+		return 0, errDecodedTooLarge
+	}
+	return w.buf.Write(p)
+}
+
+func (s *service) SyncFileSignature(ctx context.Context, bucketID, fileID, version string, blockSize int) (*models.Signature, error) {
+	r, fd, err := s.FileGetVersion(ctx, bucketID, fileID, version, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	if blockSize == 0 {
+		blockSize = delta.BlockSize(fd.Size)
+	}
+	sig, err := delta.NewSignature(r, blockSize)
+	if err != nil {
+		s.logger.Error().Err(err).Str("method", "SyncFileSignature").Msg("Failed to calculate signature")
+		return nil, err
+	}
+
+	out := &models.Signature{BlockSize: int64(sig.BlockSize), Size: sig.Size}
+	for _, b := range sig.Blocks {
+		out.Blocks = append(out.Blocks, &models.SignatureBlock{Weak: int64(b.Weak), Strong: b.Strong})
+	}
+
+	return out, nil
+}
+
+func (s *service) SyncFileDecode(ctx context.Context, bucketID, fileID string, r io.Reader, encodings []string, base, checksum string) (io.Reader, error) {
+	if len(encodings) == 0 && checksum == "" {
+		return r, nil
+	}
+	if len(encodings) > 0 && checksum == "" {
+		s.logger.Error().Str("method", "SyncFileDecode").Msg("Checksum of encoded contents is missing")
+		return nil, ErrInvalidEncoding
+	}
+
+	// encodings are decoded in reverse order
+	for i := len(encodings) - 1; i >= 0; i-- {
+		switch encodings[i] {
+		case storageSync.EncodingGzip:
+			gz, err := gzip.NewReader(r)
+			if err != nil {
+				s.logger.Error().Err(err).Str("method", "SyncFileDecode").Msg("Failed to read gzip header")
+				return nil, ErrInvalidEncoding
+			}
+			r = gz
+		case storageSync.EncodingDelta:
+			b, err := s.readBase(ctx, bucketID, fileID, base)
+			if err != nil {
+				s.logger.Error().Err(err).Str("method", "SyncFileDecode").Str("base", base).Msg("Failed to read base version")
+				return nil, ErrInvalidEncoding
+			}
+
+			var buf bytes.Buffer
+			if err := delta.Apply(&limitWriter{buf: &buf, limit: s.maxDecodedSize}, bytes.NewReader(b), r); err != nil {
+				s.logger.Error().Err(err).Str("method", "SyncFileDecode").Str("base", base).Msg("Failed to apply delta")
+				return nil, ErrInvalidEncoding
+			}
+			r = &buf
+		default:
+			s.logger.Error().Str("method", "SyncFileDecode").Msgf("Unsupported encoding '%s'", encodings[i])
+			return nil, ErrInvalidEncoding
+		}
+	}
+
+	// contents are verified before they are stored
+	b, err := ioutil.ReadAll(io.LimitReader(r, s.maxDecodedSize+1))
+	if err != nil {
+		s.logger.Error().Err(err).Str("method", "SyncFileDecode").Msg("Failed to decode contents")
+		return nil, ErrInvalidEncoding
+	}
+	if int64(len(b)) > s.maxDecodedSize {
+		s.logger.Error().Str("method", "SyncFileDecode").Msgf("Decoded contents exceed %d bytes", s.maxDecodedSize)
+		return nil, ErrInvalidEncoding
+	}
+	actual, err := s.Checksum(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if actual != checksum {
+		s.logger.Error().Str("method", "SyncFileDecode").Msgf("Checksum '%s' does not match '%s'", actual, checksum)
+		return nil, ErrChecksumMismatch
+	}
+
+	return bytes.NewReader(b), nil
+}
+
+// readBase returns contents of the version delta is computed against
+func (s *service) readBase(ctx context.Context, bucketID, fileID, version string) ([]byte, error) {
+	if version == "" {
+		return nil, errors.New("base version is not set")
+	}
+
+	r, _, err := s.FileGetVersion(ctx, bucketID, fileID, version, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,512 @@
+package storage
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/storage/s3"
+)
+
+// Chunk does not continue uploaded contents
+var ErrUploadOffset = errors.New("Offset is past the end of uploaded contents")
+
+// Uploads directory is not configured
+var ErrUploadsDisabled = errors.New("Resumable uploads are not enabled")
+
+// uploadSession holds details of an upload kept next to uploaded contents
+type uploadSession struct {
+	ID          string          `json:"id"`
+	Bucket      string          `json:"bucket"`
+	FileID      string          `json:"fileID,omitempty"`
+	ContentType string          `json:"contentType"`
+	Archetype   string          `json:"archetype,omitempty"`
+	Labels      []string        `json:"labels,omitempty"`
+	Created     strfmt.DateTime `json:"created"`
+	// KeyID identifies version of the bucket's key contents are encrypted
+	// with, empty if the key provider does not keep versions
+	KeyID string `json:"keyID,omitempty"`
+	// IV is the initialization vector of AES-CTR encrypted contents
+	IV []byte `json:"iv"`
+}
+
+// uploadReader closes the file of decrypted contents
+type uploadReader struct {
+	io.Reader
+	io.Closer
+}
+
+// uploadStore keeps upload sessions in a directory so they survive restarts.
+// Each session is stored in two files: ID.json holds the session and ID.data
+// the contents received so far encrypted with the bucket's key. Size of the
+// contents is the offset to resume the upload from; bytes are written in
+// order so contents written before a crash remain valid.
+type uploadStore struct {
+	dir  string
+	keys s3.KeyProvider
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func newUploadStore(dir string, keys s3.KeyProvider) *uploadStore {
+	return &uploadStore{dir: dir, keys: keys, locks: map[string]*sync.Mutex{}}
+}
+
+// lock serializes changes of the session
+func (u *uploadStore) lock(id string) func() {
+	u.mu.Lock()
+	l, ok := u.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		u.locks[id] = l
+	}
+	u.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+func (u *uploadStore) path(id, ext string) string {
+	return filepath.Join(u.dir, id+ext)
+}
+
+// create stores a new session with empty contents
+func (u *uploadStore) create(sess *uploadSession) error {
+	if err := os.MkdirAll(u.dir, 0700); err != nil {
+		return err
+	}
+
+	if ring, ok := u.keys.(s3.KeyRing); ok {
+		keyID, err := ring.CurrentID(sess.Bucket)
+		if err != nil {
+			return err
+		}
+		sess.KeyID = keyID
+	}
+	sess.IV = make([]byte, aes.BlockSize)
+	if _, err := rand.Read(sess.IV); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(u.path(sess.ID, ".data"), nil, 0600); err != nil {
+		return err
+	}
+
+	// session is written last and atomically so it is never found without
+	// its contents
+	tmp := u.path(sess.ID, ".json.tmp")
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, u.path(sess.ID, ".json"))
+}
+
+// get returns the session of the bucket and size of received contents
+func (u *uploadStore) get(bucketID, id string) (*uploadSession, int64, error) {
+	if id == "" || strings.HasPrefix(id, ".") || filepath.Base(id) != id {
+		return nil, 0, ErrNotFound
+	}
+
+	b, err := ioutil.ReadFile(u.path(id, ".json"))
+	if os.IsNotExist(err) {
+		return nil, 0, ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sess := &uploadSession{}
+	if err := json.Unmarshal(b, sess); err != nil {
+		return nil, 0, err
+	}
+	if sess.Bucket != bucketID {
+		return nil, 0, ErrNotFound
+	}
+
+	info, err := os.Stat(u.path(id, ".data"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return sess, info.Size(), nil
+}
+
+// write stores the chunk at the offset replacing contents following it and
+// returns the size of received contents. ErrQuotaExceeded is returned and the
+// chunk is dropped if the contents would be longer than limit bytes, they are
+// not limited if limit is negative.
+func (u *uploadStore) write(bucketID, id string, offset, limit int64, r io.Reader) (*uploadSession, int64, error) {
+	defer u.lock(id)()
+
+	sess, size, err := u.get(bucketID, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset > size {
+		return sess, size, ErrUploadOffset
+	}
+
+	stream, err := u.stream(sess, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	f, err := os.OpenFile(u.path(id, ".data"), os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	if err := f.Truncate(offset); err != nil {
+		return nil, 0, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+
+	// one byte past the limit is read to find out it is exceeded
+	if limit >= 0 {
+		r = io.LimitReader(r, limit-offset+1)
+	}
+
+	// contents written before a failure are kept so the upload can resume
+	n, err := io.Copy(cipher.StreamWriter{S: stream, W: f}, r)
+	if err == nil && limit >= 0 && offset+n > limit {
+		n, err = 0, ErrQuotaExceeded
+		if terr := f.Truncate(offset); terr != nil {
+			err = terr
+		}
+	}
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+
+	return sess, offset + n, err
+}
+
+// open returns the session with a reader of decrypted contents; the session
+// needs to be locked so it is not changed while it is read
+func (u *uploadStore) open(bucketID, id string) (io.ReadCloser, *uploadSession, error) {
+	sess, _, err := u.get(bucketID, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stream, err := u.stream(sess, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(u.path(id, ".data"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &uploadReader{Reader: cipher.StreamReader{S: stream, R: f}, Closer: f}, sess, nil
+}
+
+// remove removes the session and its contents
+func (u *uploadStore) remove(bucketID, id string) error {
+	defer u.lock(id)()
+
+	if _, _, err := u.get(bucketID, id); err != nil {
+		return err
+	}
+
+	return u.drop(id)
+}
+
+// drop removes files of the session, it needs to be locked
+func (u *uploadStore) drop(id string) error {
+	for _, ext := range []string{".json", ".data"} {
+		if err := os.Remove(u.path(id, ext)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	u.mu.Lock()
+	delete(u.locks, id)
+	u.mu.Unlock()
+
+	return nil
+}
+
+// sweep removes sessions which received no contents for the ttl and returns
+// the number of removed sessions. Contents left behind without their session
+// are removed as well.
+func (u *uploadStore) sweep(ttl time.Duration) (int, error) {
+	infos, err := ioutil.ReadDir(u.dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	ids := map[string]bool{}
+	for _, info := range infos {
+		if ext := filepath.Ext(info.Name()); ext == ".json" || ext == ".data" {
+			ids[strings.TrimSuffix(info.Name(), ext)] = true
+		}
+	}
+
+	var removed int
+	for id := range ids {
+		ok, err := u.expire(id, ttl)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// expire removes the session if it received no contents for the ttl
+func (u *uploadStore) expire(id string, ttl time.Duration) (bool, error) {
+	defer u.lock(id)()
+
+	// contents are written after the session so they were changed last
+	info, err := os.Stat(u.path(id, ".data"))
+	if os.IsNotExist(err) {
+		info, err = os.Stat(u.path(id, ".json"))
+	}
+	if os.IsNotExist(err) {
+		// removed meanwhile
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if time.Since(info.ModTime()) < ttl {
+		return false, nil
+	}
+
+	return true, u.drop(id)
+}
+
+// stream returns AES-CTR key stream of the session positioned at the offset
+func (u *uploadStore) stream(sess *uploadSession, offset int64) (cipher.Stream, error) {
+	var secret string
+	var err error
+	if ring, ok := u.keys.(s3.KeyRing); ok && sess.KeyID != "" {
+		secret, err = ring.GetVersion(sess.Bucket, sess.KeyID)
+	} else {
+		secret, err = u.keys.Get(sess.Bucket)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// counter is incremented once per block
+	n := uint64(offset / aes.BlockSize)
+	ctr := make([]byte, aes.BlockSize)
+	copy(ctr, sess.IV)
+	var carry uint64
+	for i := len(ctr) - 1; i >= 0; i-- {
+		sum := uint64(ctr[i]) + n&0xff + carry
+		ctr[i] = byte(sum)
+		carry = sum >> 8
+		n >>= 8
+	}
+	stream := cipher.NewCTR(block, ctr)
+
+	// skip the beginning of the first block
+	skip := make([]byte, offset%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
+
+	return stream, nil
+}
+
+func (u *uploadStore) upload(sess *uploadSession, size int64) *models.Upload {
+	return &models.Upload{
+		ID:          sess.ID,
+		Bucket:      sess.Bucket,
+		FileID:      sess.FileID,
+		ContentType: sess.ContentType,
+		Archetype:   sess.Archetype,
+		Labels:      sess.Labels,
+		Offset:      size,
+		Created:     sess.Created,
+	}
+}
+
+func (s *service) UploadNew(ctx context.Context, bucketID, fileID, contentType, archetype string, labels []string) (*models.Upload, error) {
+	if s.uploads == nil {
+		return nil, ErrUploadsDisabled
+	}
+
+	// fail early if the upload can not be committed; missing bucket is
+	// created on commit
+	md, err := s.s3.GetBucketMetadata(ctx, bucketID)
+	switch {
+	case err == nil && md.Archived:
+		return nil, ErrArchived
+	case err != nil && err != ErrNotFound:
+		return nil, err
+	}
+	bucketExists := err == nil
+	if fileID != "" {
+		if _, err := s.s3.Stat(ctx, bucketID, fileID, ""); err != nil {
+			return nil, err
+		}
+	}
+	if bucketExists {
+		var files int64
+		if fileID == "" {
+			files = 1
+		}
+		if err := s.quota.check(ctx, bucketID, files); err != nil {
+			return nil, err
+		}
+	}
+
+	sess := &uploadSession{
+		ID:          getUUID(),
+		Bucket:      bucketID,
+		FileID:      fileID,
+		ContentType: contentType,
+		Archetype:   archetype,
+		Labels:      labels,
+		Created:     getTime(),
+	}
+	if err := s.uploads.create(sess); err != nil {
+		s.logger.Error().Err(err).Str("bucket", bucketID).Msg("Failed to create upload session")
+		return nil, err
+	}
+
+	return s.uploads.upload(sess, 0), nil
+}
+
+func (s *service) UploadGet(_ context.Context, bucketID, uploadID string) (*models.Upload, error) {
+	if s.uploads == nil {
+		return nil, ErrUploadsDisabled
+	}
+
+	sess, size, err := s.uploads.get(bucketID, uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.uploads.upload(sess, size), nil
+}
+
+func (s *service) UploadChunk(ctx context.Context, bucketID, uploadID string, offset int64, r io.Reader) (*models.Upload, error) {
+	if s.uploads == nil {
+		return nil, ErrUploadsDisabled
+	}
+
+	// received contents are stored as a single file on commit
+	limit, err := s.quota.room(ctx, bucketID)
+	if err != nil {
+		return nil, err
+	}
+
+	sess, size, err := s.uploads.write(bucketID, uploadID, offset, limit, r)
+	if err != nil {
+		if err != ErrNotFound && err != ErrUploadOffset && err != ErrQuotaExceeded {
+			s.logger.Error().Err(err).Str("bucket", bucketID).Str("upload", uploadID).Msgf("Failed to write chunk, %d bytes received", size)
+		}
+		return nil, err
+	}
+
+	return s.uploads.upload(sess, size), nil
+}
+
+func (s *service) UploadCommit(ctx context.Context, bucketID, uploadID string) (*models.FileDescriptor, error) {
+	if s.uploads == nil {
+		return nil, ErrUploadsDisabled
+	}
+
+	// session is kept locked so chunks can not change the contents and it
+	// is not committed twice
+	defer s.uploads.lock(uploadID)()
+
+	r, sess, err := s.uploads.open(bucketID, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var fd *models.FileDescriptor
+	if sess.FileID == "" {
+		fd, err = s.FileNew(ctx, bucketID, r, sess.ContentType, sess.Archetype, sess.Labels)
+	} else {
+		fd, err = s.FileUpdate(ctx, bucketID, sess.FileID, r, sess.ContentType, sess.Archetype, sess.Labels)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.uploads.drop(uploadID); err != nil {
+		s.logger.Error().Err(err).Str("bucket", bucketID).Str("upload", uploadID).Msg("Failed to remove committed upload session")
+	}
+
+	return fd, nil
+}
+
+func (s *service) UploadDelete(_ context.Context, bucketID, uploadID string) error {
+	if s.uploads == nil {
+		return ErrUploadsDisabled
+	}
+
+	return s.uploads.remove(bucketID, uploadID)
+}
+
+func (s *service) UploadSweep(_ context.Context, ttl time.Duration) (int, error) {
+	if s.uploads == nil {
+		return 0, ErrUploadsDisabled
+	}
+
+	return s.uploads.sweep(ttl)
+}
+
+// RunUploadSweep removes upload sessions which received no contents for the
+// ttl straight away and then on every interval until the context is cancelled
+func RunUploadSweep(ctx context.Context, s Service, ttl, interval time.Duration, logger zerolog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		removed, err := s.UploadSweep(ctx, ttl)
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to remove stale upload sessions")
+		}
+		if removed > 0 {
+			logger.Info().Msgf("removed %d stale upload sessions", removed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -2,9 +2,11 @@ package auth
 
 import (
 	"fmt"
+	"io/ioutil"
 	"testing"
 
 	"github.com/go-openapi/swag"
+	yaml "gopkg.in/yaml.v2"
 
 	authCommon "github.com/iryonetwork/wwm/auth"
 	"github.com/iryonetwork/wwm/gen/auth/models"
@@ -464,3 +466,83 @@ func TestRules(t *testing.T) {
 		}
 	}
 }
+
+func TestInitDataStorageRules(t *testing.T) {
+	storage := newTestStorage(nil)
+	defer storage.Close()
+
+	// load roles and rules used by cloudAuth
+	file, err := ioutil.ReadFile("../../cmd/cloudAuth/rolesAndRules.yml")
+	if err != nil {
+		t.Fatalf("Failed to read init data: %v", err)
+	}
+	data := InitData{}
+	if err := yaml.Unmarshal(file, &data); err != nil {
+		t.Fatalf("Failed to parse init data: %v", err)
+	}
+	storage.LoadInitData(data)
+
+	roles := map[string]string{
+		"basic member": "a422f7f5-291b-4454-ae61-3d98c6091c3e",
+		"nurse":        "e359d9ae-6a68-4283-8458-24043a179f48",
+		"doctor":       "99aca094-fb08-4734-a0df-e50e66fa5531",
+		"admin":        "b87c6866-7fb2-48ba-88c8-fe444a6a7f43",
+	}
+	users := map[string]string{}
+	for name, roleID := range roles {
+		u, _ := storage.AddUser(&models.User{Username: swag.String(name)})
+		storage.AddUserRole(&models.UserRole{
+			UserID:     swag.String(u.ID),
+			RoleID:     swag.String(roleID),
+			DomainType: swag.String(authCommon.DomainTypeGlobal),
+			DomainID:   swag.String(authCommon.DomainIDWildcard),
+		})
+		users[name] = u.ID
+	}
+	storage.enforcer.LoadPolicy()
+
+	validation := func(action int64, resource string) *models.ValidationPair {
+		return &models.ValidationPair{
+			Actions:    swag.Int64(action),
+			Resource:   swag.String(resource),
+			DomainType: swag.String(authCommon.DomainTypeGlobal),
+			DomainID:   swag.String(authCommon.DomainIDWildcard),
+		}
+	}
+	validations := []*models.ValidationPair{
+		// reading files and buckets
+		validation(Read, "/api/storage/BUCKET/FILE"),
+		validation(Read, "/api/storage/buckets/BUCKET"),
+		validation(Read, "/api/storage/buckets/BUCKET/export"),
+		// writing and deleting files
+		validation(Write, "/api/storage/BUCKET"),
+		validation(Delete, "/api/storage/BUCKET/FILE"),
+		// managing buckets is for admins only
+		validation(Delete, "/api/storage/buckets/BUCKET"),
+		validation(Update, "/api/storage/buckets/BUCKET/archive"),
+		validation(Write, "/api/storage/buckets/BUCKET/import"),
+		// resolving conflicts and handling dead letters of storage sync is
+		// for admins only
+		validation(Read, "/api/storageSync/conflicts"),
+		validation(Write, "/api/storageSync/conflicts/ID/resolve"),
+		validation(Write, "/api/storageSync/deadLetters/ID/replay"),
+		validation(Delete, "/api/storageSync/deadLetters/ID"),
+	}
+
+	tests := map[string][]bool{
+		"basic member": {true, true, true, true, true, false, false, false, false, false, false, false},
+		"nurse":        {true, true, true, true, true, false, false, false, false, false, false, false},
+		"doctor":       {true, true, true, true, true, false, false, false, false, false, false, false},
+		"admin":        {true, true, true, true, true, true, true, true, true, true, true, true},
+	}
+
+	for name, expected := range tests {
+		results := storage.FindACL(users[name], validations)
+
+		for i, res := range results {
+			if *res.Result != expected[i] {
+				t.Errorf("%s: expected %d on %s to be %t; got %t", name, *validations[i].Actions, *validations[i].Resource, expected[i], *res.Result)
+			}
+		}
+	}
+}
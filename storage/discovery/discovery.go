@@ -43,6 +43,9 @@ type (
 		// Unlink removes a connection between a patient and a location
 		Unlink(patientID, locationID strfmt.UUID) error
 
+		// LinkedPatients returns IDs of patients linked to a location
+		LinkedPatients(locationID strfmt.UUID) (models.PatientIDs, error)
+
 		// CodesGet fetches matching codes
 		CodesGet(category, query, parentID, locale string) (models.Codes, error)
 
@@ -355,6 +358,26 @@ func (s *storage) Unlink(patientID, locationID strfmt.UUID) error {
 	return ErrNotFound
 }
 
+// LinkedPatients returns IDs of patients linked to a location
+func (s *storage) LinkedPatients(locationID strfmt.UUID) (models.PatientIDs, error) {
+	rows, err := s.db.Model(&location{}).
+		Where("location_id = ?", locationID.String()).
+		Select("patient_id").Rows()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to look up linked patients")
+	}
+	defer rows.Close()
+
+	patientIDs := models.PatientIDs{}
+	for rows.Next() {
+		var patientID string
+		rows.Scan(&patientID)
+		patientIDs = append(patientIDs, strfmt.UUID(patientID))
+	}
+
+	return patientIDs, nil
+}
+
 func (s *storage) CodesGet(category, query, parentID, locale string) (models.Codes, error) {
 	if locale == "" {
 		locale = "en"
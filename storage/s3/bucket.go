@@ -0,0 +1,63 @@
+package s3
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// bucketsIndex is the bucket of the metadata index holding bucket metadata;
+// storage buckets can not start with a dot so it does not clash with them
+const bucketsIndex = ".buckets"
+
+// ErrArchived indicates bucket was archived and its files can not be changed
+var ErrArchived = errors.New("Bucket is archived")
+
+// BucketMetadata holds metadata of a bucket kept in the metadata index. New
+// fields can be added freely, buckets created before the field existed decode
+// with its zero value.
+type BucketMetadata struct {
+	// Metadata holds values provided when the bucket was created
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Archived buckets are read-only
+	Archived bool `json:"archived,omitempty"`
+}
+
+// readBucketMetadata reads bucket's record from the metadata index, empty
+// metadata is returned for buckets without a record
+func readBucketMetadata(index MetadataIndex, bucketID string) (*BucketMetadata, error) {
+	md := &BucketMetadata{}
+
+	value := index.Get(bucketsIndex, bucketID)
+	if value == nil {
+		return md, nil
+	}
+	if err := json.Unmarshal(value, md); err != nil {
+		return nil, errors.Wrap(err, "Failed to decode bucket metadata")
+	}
+
+	return md, nil
+}
+
+// writeBucketMetadata stores bucket's record in the metadata index
+func writeBucketMetadata(index MetadataIndex, bucketID string, md *BucketMetadata) error {
+	value, err := json.Marshal(md)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode bucket metadata")
+	}
+
+	return index.Update(bucketsIndex, bucketID, value)
+}
+
+// checkWritable returns ErrArchived if files of the bucket can not be changed
+func checkWritable(index MetadataIndex, bucketID string) error {
+	md, err := readBucketMetadata(index, bucketID)
+	if err != nil {
+		return err
+	}
+	if md.Archived {
+		return ErrArchived
+	}
+
+	return nil
+}
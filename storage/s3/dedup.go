@@ -0,0 +1,237 @@
+package s3
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// blobIndexPrefix prefixes keys of content records in the metadata index;
+// object keys never start with a dot so they do not clash
+const blobIndexPrefix = ".blob."
+
+// blobRecord tracks files sharing the same contents. Contents are stored once
+// in the owner object, the other files are kept as empty objects referring to
+// the record by their checksum. Number of references to the contents is the
+// number of referring objects plus one for the owner.
+type blobRecord struct {
+	// Key of the object holding the contents
+	Key string `json:"key"`
+	// Refs lists keys of objects referring to the contents
+	Refs []string `json:"refs,omitempty"`
+}
+
+// dedupObjects is implemented by backends to manage objects sharing contents
+type dedupObjects interface {
+	// putRef stores an empty object referring to shared contents
+	putRef(ctx context.Context, bucketID, objectKey string) error
+	// moveObject moves contents of the object to another key replacing the
+	// object stored there
+	moveObject(ctx context.Context, bucketID, srcKey, dstKey string) error
+	// removeObject removes the object
+	removeObject(ctx context.Context, bucketID, objectKey string) error
+}
+
+// contentLocks serializes changes of records of the same contents
+type contentLocks struct {
+	mu    sync.Mutex
+	locks map[string]*contentLock
+}
+
+// contentLock is dropped once it is neither held nor waited for
+type contentLock struct {
+	sync.Mutex
+	users int
+}
+
+// dedupLocks locks content records by bucket and checksum
+var dedupLocks = &contentLocks{locks: map[string]*contentLock{}}
+
+// lock locks the record of contents with the checksum in the bucket and
+// returns the function unlocking it
+func (c *contentLocks) lock(bucketID, checksum string) func() {
+	key := bucketID + "/" + checksum
+
+	c.mu.Lock()
+	l, ok := c.locks[key]
+	if !ok {
+		l = &contentLock{}
+		c.locks[key] = l
+	}
+	l.users++
+	c.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		c.mu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(c.locks, key)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// readBlobRecord returns the record of contents with the checksum, nil is
+// returned if the contents are not stored or their owner no longer exists
+func readBlobRecord(index MetadataIndex, bucketID, checksum string) (*blobRecord, error) {
+	if checksum == "" {
+		return nil, nil
+	}
+
+	value := index.Get(bucketID, blobIndexPrefix+checksum)
+	if value == nil {
+		return nil, nil
+	}
+
+	r := &blobRecord{}
+	if err := json.Unmarshal(value, r); err != nil {
+		return nil, errors.Wrap(err, "Failed to decode content record")
+	}
+
+	// records outlive their bucket when it is removed
+	if index.Get(bucketID, r.Key) == nil {
+		return nil, nil
+	}
+
+	return r, nil
+}
+
+// writeBlobRecord stores the record of contents with the checksum
+func writeBlobRecord(index MetadataIndex, bucketID, checksum string, r *blobRecord) error {
+	value, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode content record")
+	}
+
+	return index.Update(bucketID, blobIndexPrefix+checksum, value)
+}
+
+// contents returns the entry of the object holding contents of the file
+func contents(index MetadataIndex, bucketID string, entry *objectEntry) (*objectEntry, error) {
+	if !entry.md.ref {
+		return entry, nil
+	}
+
+	r, err := readBlobRecord(index, bucketID, entry.md.checksum)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, errors.Errorf("Contents of %s not found", entry.key)
+	}
+
+	md, err := metadataFromIndex(index, bucketID, r.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &objectEntry{key: r.Key, md: md, size: entry.size}, nil
+}
+
+// addRef stores the file as a reference if contents with the same checksum
+// are already stored and returns true. Metadata of the new file needs to hold
+// its checksum. Record of the contents needs to be locked.
+func addRef(ctx context.Context, objects dedupObjects, index MetadataIndex, bucketID string, md *metadata, size int64) (bool, error) {
+	r, err := readBlobRecord(index, bucketID, md.checksum)
+	if err != nil || r == nil {
+		return false, err
+	}
+
+	md.ref = true
+	md.size = size
+	md.keyID = ""
+	if err := objects.putRef(ctx, bucketID, md.String()); err != nil {
+		return false, errors.Wrap(err, "Failed to store reference")
+	}
+	if err := writeIndex(index, bucketID, md); err != nil {
+		objects.removeObject(ctx, bucketID, md.String())
+		return false, errors.Wrap(err, "Failed to write metadata to the index")
+	}
+
+	r.Refs = append(r.Refs, md.String())
+	return true, writeBlobRecord(index, bucketID, md.checksum, r)
+}
+
+// addOwner records the file as the owner of its contents unless they are
+// already owned by another file. Record of the contents needs to be locked.
+func addOwner(index MetadataIndex, bucketID string, md *metadata) error {
+	r, err := readBlobRecord(index, bucketID, md.checksum)
+	if err != nil || r != nil || md.checksum == "" {
+		return err
+	}
+
+	return writeBlobRecord(index, bucketID, md.checksum, &blobRecord{Key: md.String()})
+}
+
+// purgeObject removes the object, its sidecar and its metadata. Shared
+// contents are kept while they are referred to; when the owner is removed the
+// contents are moved to the first referring object which becomes the new owner.
+func purgeObject(ctx context.Context, objects dedupObjects, index MetadataIndex, bucketID string, entry *objectEntry) error {
+	defer dedupLocks.lock(bucketID, entry.md.checksum)()
+
+	r, err := readBlobRecord(index, bucketID, entry.md.checksum)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case r != nil && entry.md.ref:
+		if err := objects.removeObject(ctx, bucketID, entry.key); err != nil {
+			return err
+		}
+		refs := []string{}
+		for _, ref := range r.Refs {
+			if ref != entry.key {
+				refs = append(refs, ref)
+			}
+		}
+		r.Refs = refs
+		if err := writeBlobRecord(index, bucketID, entry.md.checksum, r); err != nil {
+			return err
+		}
+
+	case r != nil && r.Key == entry.key && len(r.Refs) > 0:
+		heir, err := metadataFromIndex(index, bucketID, r.Refs[0])
+		if err != nil {
+			return err
+		}
+		if err := objects.moveObject(ctx, bucketID, entry.key, r.Refs[0]); err != nil {
+			return err
+		}
+		heir.ref = false
+		heir.size = 0
+		heir.keyID = entry.md.keyID
+		if err := writeIndex(index, bucketID, heir); err != nil {
+			return errors.Wrap(err, "Failed to write metadata to the index")
+		}
+		r.Key = r.Refs[0]
+		r.Refs = r.Refs[1:]
+		if err := writeBlobRecord(index, bucketID, entry.md.checksum, r); err != nil {
+			return err
+		}
+
+	case r != nil && r.Key == entry.key:
+		if err := objects.removeObject(ctx, bucketID, entry.key); err != nil {
+			return err
+		}
+		if err := index.Delete(bucketID, blobIndexPrefix+entry.md.checksum); err != nil {
+			return err
+		}
+
+	default:
+		if err := objects.removeObject(ctx, bucketID, entry.key); err != nil {
+			return err
+		}
+	}
+
+	if err := objects.removeObject(ctx, bucketID, sidecarKey(entry.key)); err != nil {
+		return errors.Wrap(err, "Failed to remove sidecar")
+	}
+
+	return index.Delete(bucketID, entry.key)
+}
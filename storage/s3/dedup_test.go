@@ -0,0 +1,48 @@
+package s3
+
+import (
+	"testing"
+	"time"
+)
+
+func TestContentLocks(t *testing.T) {
+	locks := &contentLocks{locks: map[string]*contentLock{}}
+
+	unlock := locks.lock("bucket", "CHS1")
+
+	// other contents are not held up
+	done := make(chan struct{})
+	go func() {
+		locks.lock("bucket", "CHS2")()
+		locks.lock("other", "CHS1")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected other contents not to be locked")
+	}
+
+	// the same contents wait to be unlocked
+	locked := make(chan struct{})
+	go func() {
+		locks.lock("bucket", "CHS1")()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("Expected contents to stay locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("Expected contents to be unlocked")
+	}
+
+	if len(locks.locks) != 0 {
+		t.Fatalf("Expected no locks to be kept, got %d", len(locks.locks))
+	}
+}
@@ -0,0 +1,812 @@
+package s3
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/storage/s3/object"
+)
+
+// FilesystemConfig holds all details required to store files on the local filesystem
+type FilesystemConfig struct {
+	Root string
+}
+
+type fsStorage struct {
+	cfg    *FilesystemConfig
+	keys   KeyProvider
+	index  MetadataIndex
+	logger zerolog.Logger
+}
+
+// bucketMarker is a file created inside every bucket directory, its modification
+// time is used as the bucket creation time
+const bucketMarker = ".bucket"
+
+// ErrInvalidBucketName indicates bucket name can not be used as a directory name
+var ErrInvalidBucketName = errors.New("Invalid bucket name")
+
+// NewFilesystem creates a new instance of storage keeping encrypted files on the
+// local filesystem
+func NewFilesystem(cfg *FilesystemConfig, keys KeyProvider, index MetadataIndex, logger zerolog.Logger) (Storage, error) {
+	logger = logger.With().Str("component", "storage/s3/filesystem").Logger()
+
+	if err := os.MkdirAll(cfg.Root, 0700); err != nil {
+		logger.Info().Err(err).Str("cmd", "fs::NewFilesystem").Msg("Failed to create root directory")
+		return nil, errors.Wrap(err, "Failed to create root directory")
+	}
+
+	return &fsStorage{
+		cfg:    cfg,
+		keys:   keys,
+		index:  index,
+		logger: logger,
+	}, nil
+}
+
+// BucketExists checks if bucket already exists
+func (s *fsStorage) BucketExists(_ context.Context, bucketID string) (bool, error) {
+	s.logger.Debug().Str("cmd", "fs::BucketExists").Msgf("('%s')", bucketID)
+
+	dir, err := s.bucketDir(bucketID)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(filepath.Join(dir, bucketMarker))
+	switch {
+	case err == nil:
+		return true, nil
+	case os.IsNotExist(err):
+		return false, nil
+	default:
+		s.logger.Info().Err(err).Str("cmd", "fs::BucketExists").Msg("Failed to check if bucket exists")
+		return false, errors.Wrap(err, "Failed to check if bucket exists")
+	}
+}
+
+// MakeBucket creates a bucket, return ErrAlreadyExists if bucket already exists
+func (s *fsStorage) MakeBucket(ctx context.Context, bucketID string) error {
+	s.logger.Debug().Str("cmd", "fs::MakeBucket").Msgf("('%s')", bucketID)
+
+	exists, err := s.BucketExists(ctx, bucketID)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrAlreadyExists
+	}
+
+	dir, _ := s.bucketDir(bucketID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::MakeBucket").Msg("Failed to create a new bucket")
+		return errors.Wrap(err, "Failed to create a new bucket")
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, bucketMarker), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			s.logger.Debug().Err(err).Msg("Looks like bucket actually existed when MakeBucket was called")
+			return ErrAlreadyExists
+		}
+		s.logger.Info().Err(err).Str("cmd", "fs::MakeBucket").Msg("Failed to create a new bucket")
+		return errors.Wrap(err, "Failed to create a new bucket")
+	}
+
+	return f.Close()
+}
+
+// ListBuckets returns a list of buckets
+func (s *fsStorage) ListBuckets(_ context.Context) ([]*models.BucketDescriptor, error) {
+	s.logger.Debug().Str("cmd", "fs::ListBuckets")
+
+	infos, err := ioutil.ReadDir(s.cfg.Root)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::ListBuckets").Msg("Failed to list buckets")
+		return nil, errors.Wrap(err, "Failed to list buckets")
+	}
+
+	buckets := []*models.BucketDescriptor{}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+
+		marker, err := os.Stat(filepath.Join(s.cfg.Root, info.Name(), bucketMarker))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// not a bucket
+				continue
+			}
+			s.logger.Info().Err(err).Str("cmd", "fs::ListBuckets").Msg("Failed to read bucket marker")
+			return nil, errors.Wrap(err, "Failed to read bucket marker")
+		}
+
+		buckets = append(buckets, &models.BucketDescriptor{
+			Name:    info.Name(),
+			Created: strfmt.DateTime(marker.ModTime()),
+		})
+	}
+
+	return buckets, nil
+}
+
+// GetBucketMetadata returns metadata of the bucket
+func (s *fsStorage) GetBucketMetadata(ctx context.Context, bucketID string) (*BucketMetadata, error) {
+	s.logger.Debug().Str("cmd", "fs::GetBucketMetadata").Msgf("('%s')", bucketID)
+
+	exists, err := s.BucketExists(ctx, bucketID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	md, err := readBucketMetadata(s.index, bucketID)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::GetBucketMetadata").Msg("Failed to read bucket metadata")
+		return nil, err
+	}
+
+	return md, nil
+}
+
+// UpdateBucketMetadata replaces metadata of the bucket
+func (s *fsStorage) UpdateBucketMetadata(ctx context.Context, bucketID string, md *BucketMetadata) error {
+	s.logger.Debug().Str("cmd", "fs::UpdateBucketMetadata").Msgf("('%s', '%+v')", bucketID, md)
+
+	exists, err := s.BucketExists(ctx, bucketID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+
+	if err := writeBucketMetadata(s.index, bucketID, md); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::UpdateBucketMetadata").Msg("Failed to write bucket metadata to the index")
+		return errors.Wrap(err, "Failed to write bucket metadata to the index")
+	}
+
+	return nil
+}
+
+// RemoveBucket removes the bucket directory and metadata of its files
+func (s *fsStorage) RemoveBucket(ctx context.Context, bucketID string) error {
+	s.logger.Debug().Str("cmd", "fs::RemoveBucket").Msgf("('%s')", bucketID)
+
+	exists, err := s.BucketExists(ctx, bucketID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+
+	dir, _ := s.bucketDir(bucketID)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::RemoveBucket").Msg("Failed to read bucket directory")
+		return errors.Wrap(err, "Failed to read bucket directory")
+	}
+	for _, info := range infos {
+		if err := s.index.Delete(bucketID, info.Name()); err != nil {
+			s.logger.Info().Err(err).Str("cmd", "fs::RemoveBucket").Msgf("Failed to remove metadata of %s", info.Name())
+			return errors.Wrapf(err, "Failed to remove metadata of %s", info.Name())
+		}
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::RemoveBucket").Msg("Failed to remove the bucket")
+		return errors.Wrap(err, "Failed to remove the bucket")
+	}
+
+	return s.index.Delete(bucketsIndex, bucketID)
+}
+
+// List returns a list of files stored inside a bucket
+func (s *fsStorage) List(ctx context.Context, bucketID, prefix string) ([]*models.FileDescriptor, error) {
+	s.logger.Debug().Str("cmd", "fs::List").Msgf("('%s', '%s')", bucketID, prefix)
+
+	entries, err := s.list(ctx, bucketID, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return entriesToFileDescriptors(entries, bucketID), nil
+}
+
+// Stat returns file descriptor without opening the file
+func (s *fsStorage) Stat(ctx context.Context, bucketID, fileID, version string) (*models.FileDescriptor, error) {
+	s.logger.Debug().Str("cmd", "fs::Stat").Msgf("('%s', '%s', '%s')", bucketID, fileID, version)
+
+	entry, err := s.latest(ctx, bucketID, fileID, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry.md.fileDescriptor(bucketID, entry.size), nil
+}
+
+// Read fetches contents from the storage
+func (s *fsStorage) Read(ctx context.Context, bucketID, fileID, version string) (io.ReadCloser, *models.FileDescriptor, error) {
+	s.logger.Debug().Str("cmd", "fs::Read").Msgf("('%s', '%s', '%s')", bucketID, fileID, version)
+
+	return s.ReadRange(ctx, bucketID, fileID, version, nil)
+}
+
+// ReadRange fetches part of contents from the storage, whole contents are
+// returned if rng is nil. File descriptor is returned together with
+// ErrInvalidRange so the size of contents is known.
+func (s *fsStorage) ReadRange(ctx context.Context, bucketID, fileID, version string, rng *Range) (io.ReadCloser, *models.FileDescriptor, error) {
+	s.logger.Debug().Str("cmd", "fs::ReadRange").Msgf("('%s', '%s', '%s', %+v)", bucketID, fileID, version, rng)
+
+	// find the file
+	entry, err := s.latest(ctx, bucketID, fileID, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	fd := entry.md.fileDescriptor(bucketID, entry.size)
+	src, err := contents(s.index, bucketID, entry)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::ReadRange").Msg("Failed to find contents")
+		return nil, nil, errors.Wrap(err, "Failed to find contents")
+	}
+
+	offset, length := int64(0), entry.size
+	if rng != nil {
+		if offset, length, err = rng.Resolve(entry.size); err != nil {
+			return nil, fd, err
+		}
+	}
+
+	secret, err := fileKey(s.keys, bucketID, src.md)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::Read").Msg("Failed to set the key")
+		return nil, nil, errors.Wrap(err, "Failed to set the key")
+	}
+
+	reader, err := s.readObjectAt(bucketID, src.key, secret, offset)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::Read").Msg("Failed to read file")
+		return nil, nil, errors.Wrap(err, "Failed to read file")
+	}
+	if rng != nil {
+		reader = &readCloser{Reader: io.LimitReader(reader, length), Closer: reader}
+	}
+
+	return reader, fd, nil
+}
+
+// Write creates a new file in the storage
+func (s *fsStorage) Write(ctx context.Context, bucketID string, newFile *object.NewObjectInfo, r io.Reader) (*models.FileDescriptor, error) {
+	s.logger.Debug().Str("cmd", "fs::Write").Msgf("('%s', '%+v', reader)", bucketID, newFile)
+
+	if err := checkWritable(s.index, bucketID); err != nil {
+		return nil, err
+	}
+
+	// validate operation
+	op := Operation(newFile.Operation)
+	if op != Write && op != Delete {
+		s.logger.Info().Str("cmd", "fs::Write").Msgf("Received an invalid operation '%s'", op)
+		return nil, fmt.Errorf("Received an invalid operation '%s'", op)
+	}
+
+	if _, err := s.bucketDir(bucketID); err != nil {
+		return nil, err
+	}
+
+	// get the key
+	keyID, secret, err := currentKey(s.keys, bucketID)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::Write").Msg("Failed to set the key")
+		return nil, errors.Wrap(err, "Failed to set the key")
+	}
+
+	// collect meta data
+	meta, err := metadataFromNewFile(newFile)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::Write").Msg("Failed to collect metadata from new file")
+		return nil, errors.Wrap(err, "Failed to collect metadata from new file")
+	}
+	meta.keyID = keyID
+
+	// store the metadata not kept in the key next to the file
+	if err := writeSidecar(ctx, s, s.keys, bucketID, meta); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::Write").Msg("Failed to write sidecar")
+		return nil, errors.Wrap(err, "Failed to write sidecar")
+	}
+
+	if err := s.writeObject(ctx, bucketID, meta.String(), secret, r); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::Write").Msg("Failed to write file")
+		s.removeObject(ctx, bucketID, sidecarKey(meta.String()))
+		return nil, errors.Wrap(err, "Failed to write file")
+	}
+
+	// store the metadata not kept in the key in the index
+	if err := writeIndex(s.index, bucketID, meta); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::Write").Msg("Failed to write metadata to the index")
+		s.removeObject(ctx, bucketID, meta.String())
+		s.removeObject(ctx, bucketID, sidecarKey(meta.String()))
+		return nil, errors.Wrap(err, "Failed to write metadata to the index")
+	}
+
+	// generate the file descriptor
+	fd := &models.FileDescriptor{
+		Name:        newFile.Name,
+		Version:     newFile.Version,
+		Archetype:   newFile.Archetype,
+		ContentType: newFile.ContentType,
+		Checksum:    newFile.Checksum,
+		Created:     newFile.Created,
+		Labels:      newFile.Labels,
+		Path:        fmt.Sprintf("%s/%s/%s", bucketID, meta.filename, meta.version),
+		Size:        newFile.Size,
+		Operation:   string(op),
+	}
+
+	return fd, nil
+}
+
+// WriteStream writes the file to a temporary file while calculating its
+// checksum and size, the file is then renamed to its versioned name before its
+// metadata is written to the index. If the same contents are already stored
+// only a reference is kept.
+func (s *fsStorage) WriteStream(ctx context.Context, bucketID string, newFile *object.NewObjectInfo, r io.Reader) (*models.FileDescriptor, error) {
+	s.logger.Debug().Str("cmd", "fs::WriteStream").Msgf("('%s', '%+v', reader)", bucketID, newFile)
+
+	if err := checkWritable(s.index, bucketID); err != nil {
+		return nil, err
+	}
+
+	// collect meta data
+	meta, err := metadataFromNewFile(newFile)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::WriteStream").Msg("Failed to collect metadata from new file")
+		return nil, errors.Wrap(err, "Failed to collect metadata from new file")
+	}
+
+	dir, err := s.bucketDir(bucketID)
+	if err != nil {
+		return nil, err
+	}
+
+	// get the key
+	keyID, secret, err := currentKey(s.keys, bucketID)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::WriteStream").Msg("Failed to set the key")
+		return nil, errors.Wrap(err, "Failed to set the key")
+	}
+	meta.keyID = keyID
+
+	h := newHashReader(r)
+	tmp, err := s.writeTemp(dir, secret, h)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::WriteStream").Msg("Failed to write file")
+		return nil, errors.Wrap(err, "Failed to write file")
+	}
+	defer os.Remove(tmp)
+	meta.checksum = h.checksum()
+
+	// store the metadata not kept in the key next to the file
+	if err := writeSidecar(ctx, s, s.keys, bucketID, meta); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::WriteStream").Msg("Failed to write sidecar")
+		return nil, errors.Wrap(err, "Failed to write sidecar")
+	}
+
+	// keep a reference if the contents are already stored; contents are
+	// not locked while they are moved into place so files with other
+	// contents are not held up, the same contents stored by two files at
+	// once are kept by both and only the first one recorded owns them
+	unlock := dedupLocks.lock(bucketID, meta.checksum)
+	ok, err := addRef(ctx, s, s.index, bucketID, meta, h.size)
+	unlock()
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::WriteStream").Msg("Failed to store reference to existing contents")
+		s.removeObject(ctx, bucketID, sidecarKey(meta.String()))
+		return nil, errors.Wrap(err, "Failed to store reference to existing contents")
+	}
+	if ok {
+		return meta.fileDescriptor(bucketID, h.size), nil
+	}
+
+	if err := os.Rename(tmp, filepath.Join(dir, meta.String())); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::WriteStream").Msg("Failed to move file into place")
+		s.removeObject(ctx, bucketID, sidecarKey(meta.String()))
+		return nil, errors.Wrap(err, "Failed to move file into place")
+	}
+
+	// store the metadata not kept in the key in the index
+	if err := writeIndex(s.index, bucketID, meta); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::WriteStream").Msg("Failed to write metadata to the index")
+		s.removeObject(ctx, bucketID, meta.String())
+		s.removeObject(ctx, bucketID, sidecarKey(meta.String()))
+		return nil, errors.Wrap(err, "Failed to write metadata to the index")
+	}
+
+	unlock = dedupLocks.lock(bucketID, meta.checksum)
+	err = addOwner(s.index, bucketID, meta)
+	unlock()
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::WriteStream").Msg("Failed to record contents")
+		return nil, errors.Wrap(err, "Failed to record contents")
+	}
+
+	return meta.fileDescriptor(bucketID, h.size), nil
+}
+
+// Purge removes files of the version and their metadata index records.
+// Contents shared with other files are kept.
+func (s *fsStorage) Purge(ctx context.Context, bucketID, fileID, version string) error {
+	s.logger.Debug().Str("cmd", "fs::Purge").Msgf("('%s', '%s', '%s')", bucketID, fileID, version)
+
+	list, err := s.list(ctx, bucketID, fmt.Sprintf("%s.%s.", fileID, version))
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::Purge").Msg("Failed to list files")
+		return errors.Wrap(err, "Failed to list files")
+	}
+	if len(list) == 0 {
+		return ErrNotFound
+	}
+
+	for _, entry := range list {
+		if err := purgeObject(ctx, s, s.index, bucketID, entry); err != nil {
+			s.logger.Info().Err(err).Str("cmd", "fs::Purge").Msgf("Failed to remove %s", entry.key)
+			return errors.Wrapf(err, "Failed to remove %s", entry.key)
+		}
+	}
+
+	return nil
+}
+
+// Migrate renames files stored in the bucket with the legacy layout and returns
+// the number of migrated files.
+func (s *fsStorage) Migrate(ctx context.Context, bucketID string) (int, error) {
+	s.logger.Debug().Str("cmd", "fs::Migrate").Msgf("('%s')", bucketID)
+
+	list, err := s.list(ctx, bucketID, "")
+	if err != nil {
+		return 0, err
+	}
+
+	dir, _ := s.bucketDir(bucketID)
+	var migrated int
+	for _, entry := range list {
+		if entry.md.layout != layoutLegacy {
+			continue
+		}
+
+		md := *entry.md
+		md.layout = layoutIndexed
+		if err := writeIndex(s.index, bucketID, &md); err != nil {
+			s.logger.Info().Err(err).Str("cmd", "fs::Migrate").Msg("Failed to write metadata to the index")
+			return migrated, errors.Wrap(err, "Failed to write metadata to the index")
+		}
+		if err := writeSidecar(ctx, s, s.keys, bucketID, &md); err != nil {
+			s.logger.Info().Err(err).Str("cmd", "fs::Migrate").Msg("Failed to write sidecar")
+			return migrated, errors.Wrap(err, "Failed to write sidecar")
+		}
+
+		if err := os.Rename(filepath.Join(dir, entry.key), filepath.Join(dir, md.String())); err != nil {
+			s.logger.Info().Err(err).Str("cmd", "fs::Migrate").Msgf("Failed to rename %s", entry.key)
+			return migrated, errors.Wrapf(err, "Failed to rename %s", entry.key)
+		}
+
+		migrated++
+	}
+
+	return migrated, nil
+}
+
+// Rekey migrates files stored with the legacy layout and re-encrypts files not
+// encrypted with the current key of the bucket. Returns the number of
+// re-encrypted files.
+func (s *fsStorage) Rekey(ctx context.Context, bucketID string) (int, error) {
+	s.logger.Debug().Str("cmd", "fs::Rekey").Msgf("('%s')", bucketID)
+
+	ring, ok := s.keys.(KeyRing)
+	if !ok {
+		return 0, ErrRekeyNotSupported
+	}
+
+	// files need to be in the index to record the key
+	if _, err := s.Migrate(ctx, bucketID); err != nil {
+		return 0, err
+	}
+
+	list, err := s.list(ctx, bucketID, "")
+	if err != nil {
+		return 0, err
+	}
+
+	rekeyed, err := rekey(ctx, s, s.index, ring, bucketID, list)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::Rekey").Msg("Failed to re-encrypt files")
+	}
+	return rekeyed, err
+}
+
+// RebuildIndex restores metadata index records of files stored in the bucket
+// that are missing in the index and returns the number of restored records.
+func (s *fsStorage) RebuildIndex(ctx context.Context, bucketID string) (int, error) {
+	s.logger.Debug().Str("cmd", "fs::RebuildIndex").Msgf("('%s')", bucketID)
+
+	entries, unindexed, err := s.scan(ctx, bucketID, "")
+	if err != nil {
+		return 0, err
+	}
+
+	rebuilt, err := rebuildIndex(ctx, s, s.index, s.keys, bucketID, entries, unindexed)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::RebuildIndex").Msg("Failed to rebuild metadata index")
+	}
+	return rebuilt, err
+}
+
+// readObject opens the file decrypting it with the key
+func (s *fsStorage) readObject(_ context.Context, bucketID, objectKey, secret string) (io.ReadCloser, error) {
+	return s.readObjectAt(bucketID, objectKey, secret, 0)
+}
+
+// readObjectAt opens the file decrypting it with the key starting at the
+// offset; AES-CTR allows to start decryption at any block
+func (s *fsStorage) readObjectAt(bucketID, objectKey, secret string, offset int64) (io.ReadCloser, error) {
+	block, err := getCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := s.bucketDir(bucketID)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(dir, objectKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to open file")
+	}
+
+	// file starts with the initialization vector
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(f, iv); err != nil && err != io.EOF {
+		f.Close()
+		return nil, errors.Wrap(err, "Failed to read initialization vector")
+	}
+
+	blocks := offset / aes.BlockSize
+	if blocks > 0 {
+		if _, err := f.Seek(blocks*aes.BlockSize, io.SeekCurrent); err != nil {
+			f.Close()
+			return nil, errors.Wrap(err, "Failed to seek")
+		}
+	}
+	stream := cipher.StreamReader{S: cipher.NewCTR(block, addCounter(iv, uint64(blocks))), R: f}
+
+	// skip the beginning of the first block
+	if _, err := io.CopyN(ioutil.Discard, stream, offset-blocks*aes.BlockSize); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "Failed to seek")
+	}
+
+	return &fsReader{Reader: stream, file: f}, nil
+}
+
+// writeObject writes the file encrypting it with the key; contents are written
+// to a temporary file first so partially written files never get listed
+func (s *fsStorage) writeObject(_ context.Context, bucketID, objectKey, secret string, r io.Reader) error {
+	dir, err := s.bucketDir(bucketID)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := s.writeTemp(dir, secret, r)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	return errors.Wrap(os.Rename(tmp, filepath.Join(dir, objectKey)), "Failed to move file into place")
+}
+
+// writeTemp writes encrypted contents to a new temporary file inside the
+// directory and returns its path
+func (s *fsStorage) writeTemp(dir, secret string, r io.Reader) (string, error) {
+	block, err := getCipher(secret)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := ioutil.TempFile(dir, tmpPrefix)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to create temporary file")
+	}
+
+	err = encryptTo(tmp, block, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
+
+// putRef stores an empty file referring to shared contents
+func (s *fsStorage) putRef(_ context.Context, bucketID, objectKey string) error {
+	dir, err := s.bucketDir(bucketID)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, objectKey), nil, 0600)
+}
+
+// moveObject renames the file replacing the file with the other name
+func (s *fsStorage) moveObject(_ context.Context, bucketID, srcKey, dstKey string) error {
+	dir, err := s.bucketDir(bucketID)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(filepath.Join(dir, srcKey), filepath.Join(dir, dstKey))
+}
+
+// removeObject removes the file, missing files are ignored
+func (s *fsStorage) removeObject(_ context.Context, bucketID, objectKey string) error {
+	dir, err := s.bucketDir(bucketID)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(dir, objectKey)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// list returns files stored inside a bucket sorted by created time, newest
+// first. Files missing in the metadata index are skipped.
+func (s *fsStorage) list(ctx context.Context, bucketID, prefix string) ([]*objectEntry, error) {
+	entries, _, err := s.scan(ctx, bucketID, prefix)
+	return entries, err
+}
+
+// scan returns files stored inside a bucket sorted by created time, newest
+// first, and files missing in the metadata index
+func (s *fsStorage) scan(ctx context.Context, bucketID, prefix string) ([]*objectEntry, []*objectEntry, error) {
+	// Check if bucket exists first
+	exists, err := s.BucketExists(ctx, bucketID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !exists {
+		// Nothing to list
+		return []*objectEntry{}, nil, nil
+	}
+
+	dir, _ := s.bucketDir(bucketID)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::List").Msg("Failed to read bucket directory")
+		return nil, nil, errors.Wrap(err, "Failed to read bucket directory")
+	}
+
+	entries := []*objectEntry{}
+	unindexed := []*objectEntry{}
+	sidecars := map[string]bool{}
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasPrefix(info.Name(), sidecarPrefix) {
+			sidecars[strings.TrimPrefix(info.Name(), sidecarPrefix)] = true
+			continue
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") || !strings.HasPrefix(info.Name(), prefix) {
+			continue
+		}
+
+		// stored file starts with the initialization vector
+		size := info.Size() - aes.BlockSize
+		if size < 0 {
+			size = 0
+		}
+
+		md, err := metadataFromIndex(s.index, bucketID, info.Name())
+		if err == errNotIndexed {
+			s.logger.Info().Str("cmd", "fs::List").Msgf("Skipping %s/%s missing in the metadata index", bucketID, info.Name())
+			unindexed = append(unindexed, &objectEntry{key: info.Name(), md: md, size: size})
+			continue
+		}
+		if err != nil {
+			s.logger.Info().Err(err).Str("cmd", "fs::List").Msg("Failed to convert file to fileDescriptor")
+			return nil, nil, errors.Wrap(err, "Failed to convert file to fileDescriptor")
+		}
+		if md.ref {
+			size = md.size
+		}
+
+		entries = append(entries, &objectEntry{key: info.Name(), md: md, size: size})
+	}
+	for _, entry := range unindexed {
+		entry.sidecar = sidecars[entry.key]
+	}
+
+	sort.Sort(entriesByCreated(entries))
+	return entries, unindexed, nil
+}
+
+// latest returns the latest version of the file or the requested version
+func (s *fsStorage) latest(ctx context.Context, bucketID, fileID, version string) (*objectEntry, error) {
+	prefix := fmt.Sprintf("%s.", fileID)
+	if version != "" {
+		prefix += fmt.Sprintf("%s.", version)
+	}
+	list, err := s.list(ctx, bucketID, prefix)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "fs::Read").Msg("Failed to list files")
+		return nil, errors.Wrap(err, "Failed to list files")
+	}
+	if len(list) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return list[0], nil
+}
+
+// bucketDir returns path of the directory holding bucket's files
+func (s *fsStorage) bucketDir(bucketID string) (string, error) {
+	if bucketID == "" || strings.HasPrefix(bucketID, ".") || filepath.Base(bucketID) != bucketID {
+		s.logger.Info().Str("cmd", "fs::bucketDir").Msgf("Received an invalid bucket name '%s'", bucketID)
+		return "", ErrInvalidBucketName
+	}
+
+	return filepath.Join(s.cfg.Root, bucketID), nil
+}
+
+// getCipher returns AES cipher for the key; the key is hashed to support keys
+// of any length
+func getCipher(secret string) (cipher.Block, error) {
+	key := sha256.Sum256([]byte(secret))
+	return aes.NewCipher(key[:])
+}
+
+// encryptTo writes a random initialization vector followed by encrypted
+// contents of the reader
+func encryptTo(w io.Writer, block cipher.Block, r io.Reader) error {
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return err
+	}
+	if _, err := w.Write(iv); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(cipher.StreamWriter{S: cipher.NewCTR(block, iv), W: w}, r)
+	return err
+}
+
+// fsReader decrypts file contents and closes the underlying file
+type fsReader struct {
+	io.Reader
+	file *os.File
+}
+
+func (r *fsReader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,766 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/storage/s3/object"
+)
+
+// staticKeys is a key provider returning the same key for all buckets
+type staticKeys string
+
+func (k staticKeys) Get(string) (string, error) {
+	return string(k), nil
+}
+
+func getTestFilesystem(t *testing.T) (*fsStorage, func()) {
+	root, err := ioutil.TempDir("", "fsStorage")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+
+	s, err := NewFilesystem(&FilesystemConfig{Root: root}, staticKeys("SECRET"), memIndex{}, zerolog.New(os.Stdout))
+	if err != nil {
+		t.Fatalf("Failed to initialize filesystem storage: %v", err)
+	}
+
+	return s.(*fsStorage), func() { os.RemoveAll(root) }
+}
+
+func TestFilesystemMigrate(t *testing.T) {
+	s, c := getTestFilesystem(t)
+	defer c()
+
+	if err := s.MakeBucket(context.TODO(), "BUCKET"); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	// write a file with the legacy layout
+	block, _ := getCipher("SECRET")
+	f, _ := os.Create(filepath.Join(s.cfg.Root, "BUCKET", info1V1.Key))
+	if err := encryptTo(f, block, bytes.NewBufferString("version1")); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	f.Close()
+
+	migrated, err := s.Migrate(context.TODO(), "BUCKET")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if migrated != 1 {
+		t.Errorf("Expected 1 migrated file, got %d", migrated)
+	}
+
+	list, err := s.List(context.TODO(), "BUCKET", "")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if !reflect.DeepEqual(list, []*models.FileDescriptor{file1V1}) {
+		t.Errorf("Expected list to equal\n%+v\ngot\n%+v", []*models.FileDescriptor{file1V1}, list)
+	}
+	if _, err := os.Stat(filepath.Join(s.cfg.Root, "BUCKET", info1V1.Key)); !os.IsNotExist(err) {
+		t.Errorf("Expected legacy file to be removed, got %v", err)
+	}
+}
+
+func TestFilesystemBuckets(t *testing.T) {
+	s, c := getTestFilesystem(t)
+	defer c()
+
+	// bucket does not exist yet
+	exists, err := s.BucketExists(context.TODO(), "BUCKET")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if exists {
+		t.Error("Expected bucket not to exist")
+	}
+
+	// create the bucket
+	if err := s.MakeBucket(context.TODO(), "BUCKET"); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if err := s.MakeBucket(context.TODO(), "BUCKET"); err != ErrAlreadyExists {
+		t.Errorf("Expected error to equal '%v'; got %v", ErrAlreadyExists, err)
+	}
+
+	exists, err = s.BucketExists(context.TODO(), "BUCKET")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if !exists {
+		t.Error("Expected bucket to exist")
+	}
+
+	// list buckets
+	buckets, err := s.ListBuckets(context.TODO())
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if len(buckets) != 1 || buckets[0].Name != "BUCKET" {
+		t.Errorf("Expected to get single bucket 'BUCKET', got %+v", buckets)
+	}
+
+	// invalid bucket names
+	for _, name := range []string{"", "..", ".hidden", "a/b"} {
+		if err := s.MakeBucket(context.TODO(), name); err != ErrInvalidBucketName {
+			t.Errorf("Expected error to equal '%v' for bucket '%s'; got %v", ErrInvalidBucketName, name, err)
+		}
+	}
+}
+
+func TestFilesystemBucketMetadata(t *testing.T) {
+	s, c := getTestFilesystem(t)
+	defer c()
+
+	if _, err := s.GetBucketMetadata(context.TODO(), "BUCKET"); err != ErrNotFound {
+		t.Errorf("Expected error to be ErrNotFound, got %v", err)
+	}
+	if err := s.MakeBucket(context.TODO(), "BUCKET"); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	// buckets without a record have empty metadata
+	md, err := s.GetBucketMetadata(context.TODO(), "BUCKET")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if !reflect.DeepEqual(md, &BucketMetadata{}) {
+		t.Errorf("Expected empty metadata, got %+v", md)
+	}
+
+	archived := &BucketMetadata{Metadata: map[string]string{"patientID": "ID"}, Archived: true}
+	if err := s.UpdateBucketMetadata(context.TODO(), "BUCKET", archived); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	md, err = s.GetBucketMetadata(context.TODO(), "BUCKET")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if !reflect.DeepEqual(md, archived) {
+		t.Errorf("Expected metadata to equal\n%+v\ngot\n%+v", archived, md)
+	}
+
+	// files of archived bucket can not be changed
+	newFile := &object.NewObjectInfo{
+		ContentType: "text/plain",
+		Created:     time1,
+		Name:        "File1",
+		Version:     "V1",
+		Operation:   string(Write),
+	}
+	if _, err := s.WriteStream(context.TODO(), "BUCKET", newFile, bytes.NewBufferString("contents")); err != ErrArchived {
+		t.Errorf("Expected error to be ErrArchived, got %v", err)
+	}
+
+	if err := s.RemoveBucket(context.TODO(), "BUCKET"); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if exists, _ := s.BucketExists(context.TODO(), "BUCKET"); exists {
+		t.Error("Expected bucket to be removed")
+	}
+	if value := s.index.Get(bucketsIndex, "BUCKET"); value != nil {
+		t.Errorf("Expected bucket metadata to be removed, got %s", value)
+	}
+}
+
+func TestFilesystemWriteRead(t *testing.T) {
+	s, c := getTestFilesystem(t)
+	defer c()
+
+	if err := s.MakeBucket(context.TODO(), "BUCKET"); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	newV1 := &object.NewObjectInfo{
+		Archetype:   "openEHR-EHR-OBSERVATION.blood_pressure.v1",
+		Checksum:    "CHS",
+		ContentType: "text/openEhrXml",
+		Created:     time1,
+		Name:        "File1",
+		Version:     "V1",
+		Size:        8,
+		Operation:   string(Write),
+		Labels:      []string{"vitalSign"},
+	}
+	newV2 := &object.NewObjectInfo{
+		Archetype:   "openEHR-EHR-OBSERVATION.blood_pressure.v1",
+		Checksum:    "CHS",
+		ContentType: "text/openEhrXml",
+		Created:     time2,
+		Name:        "File1",
+		Version:     "V2",
+		Size:        8,
+		Operation:   string(Write),
+		Labels:      []string{"vitalSign", "basicPatientInfo"},
+	}
+
+	fd, err := s.Write(context.TODO(), "BUCKET", newV1, bytes.NewBufferString("version1"))
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if !reflect.DeepEqual(fd, file1V1) {
+		t.Errorf("Expected file descriptor to equal\n%+v\ngot\n%+v", file1V1, fd)
+	}
+	if _, err := s.Write(context.TODO(), "BUCKET", newV2, bytes.NewBufferString("version2")); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	// contents on disk are encrypted
+	matches, _ := filepath.Glob(filepath.Join(s.cfg.Root, "BUCKET", "File1.V1.*"))
+	if len(matches) != 1 {
+		t.Fatalf("Expected single file on disk, got %v", matches)
+	}
+	raw, _ := ioutil.ReadFile(matches[0])
+	if bytes.Contains(raw, []byte("version1")) {
+		t.Error("Expected file contents to be encrypted")
+	}
+
+	// list returns latest version first
+	list, err := s.List(context.TODO(), "BUCKET", "")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if !reflect.DeepEqual(list, []*models.FileDescriptor{file1V2, file1V1}) {
+		t.Errorf("Expected list to equal\n%+v\ngot\n%+v", []*models.FileDescriptor{file1V2, file1V1}, list)
+	}
+
+	// read latest version
+	r, fd, err := s.Read(context.TODO(), "BUCKET", "File1", "")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	body, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(body) != "version2" {
+		t.Errorf("Expected contents to equal 'version2', got '%s'", body)
+	}
+	if fd.Version != "V2" {
+		t.Errorf("Expected version to equal 'V2', got '%s'", fd.Version)
+	}
+
+	// read specific version
+	r, _, err = s.Read(context.TODO(), "BUCKET", "File1", "V1")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	body, _ = ioutil.ReadAll(r)
+	r.Close()
+	if string(body) != "version1" {
+		t.Errorf("Expected contents to equal 'version1', got '%s'", body)
+	}
+
+	// stat matches the descriptor returned by read
+	stat, err := s.Stat(context.TODO(), "BUCKET", "File1", "")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if !reflect.DeepEqual(stat, fd) {
+		t.Errorf("Expected file descriptor to equal\n%+v\ngot\n%+v", fd, stat)
+	}
+
+	// missing file
+	if _, _, err := s.Read(context.TODO(), "BUCKET", "File2", ""); err != ErrNotFound {
+		t.Errorf("Expected error to equal '%v'; got %v", ErrNotFound, err)
+	}
+	if _, err := s.Stat(context.TODO(), "BUCKET", "File2", ""); err != ErrNotFound {
+		t.Errorf("Expected error to equal '%v'; got %v", ErrNotFound, err)
+	}
+
+	// metadata is kept in the index, not in the file name
+	if _, err := os.Stat(filepath.Join(s.cfg.Root, "BUCKET", "File1.V1.w.1516288966123.CHS")); err != nil {
+		t.Errorf("Expected file to be stored under the indexed layout name, got %v", err)
+	}
+
+	// invalid operation
+	if _, err := s.Write(context.TODO(), "BUCKET", &object.NewObjectInfo{Name: "File1", Operation: "x"}, &bytes.Buffer{}); err == nil {
+		t.Error("Expected error, got nil")
+	}
+}
+
+func TestFilesystemWriteStream(t *testing.T) {
+	s, c := getTestFilesystem(t)
+	defer c()
+
+	if err := s.MakeBucket(context.TODO(), "BUCKET"); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	newV1 := &object.NewObjectInfo{
+		Archetype:   "openEHR-EHR-OBSERVATION.blood_pressure.v1",
+		ContentType: "text/openEhrXml",
+		Created:     time1,
+		Name:        "File1",
+		Version:     "V1",
+		Operation:   string(Write),
+		Labels:      []string{"vitalSign"},
+	}
+
+	fd, err := s.WriteStream(context.TODO(), "BUCKET", newV1, bytes.NewBufferString("contents"))
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	// checksum and size are calculated while writing
+	checksum := "0bKln76n4gB3r5-Rsn6V6GUGGycL4D_1Oas7c1h4gug="
+	if fd.Checksum != checksum || fd.Size != 8 {
+		t.Errorf("Expected checksum '%s' and size 8, got '%s' and %d", checksum, fd.Checksum, fd.Size)
+	}
+
+	// file is readable and listed with the same descriptor
+	r, read, err := s.Read(context.TODO(), "BUCKET", "File1", "V1")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	body, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(body) != "contents" {
+		t.Errorf("Expected contents to equal 'contents', got '%s'", body)
+	}
+	if !reflect.DeepEqual(read, fd) {
+		t.Errorf("Expected file descriptor to equal\n%+v\ngot\n%+v", fd, read)
+	}
+
+	// no temporary files are left behind
+	matches, _ := filepath.Glob(filepath.Join(s.cfg.Root, "BUCKET", tmpPrefix+"*"))
+	if len(matches) != 0 {
+		t.Errorf("Expected no temporary files, got %v", matches)
+	}
+}
+
+func TestFilesystemPurge(t *testing.T) {
+	s, c := getTestFilesystem(t)
+	defer c()
+
+	if err := s.MakeBucket(context.TODO(), "BUCKET"); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	var v1 *models.FileDescriptor
+	for i, created := range []strfmt.DateTime{time1, time2} {
+		newFile := &object.NewObjectInfo{
+			ContentType: "text/plain",
+			Created:     created,
+			Name:        "File1",
+			Version:     fmt.Sprintf("V%d", i+1),
+			Operation:   string(Write),
+		}
+		fd, err := s.WriteStream(context.TODO(), "BUCKET", newFile, bytes.NewBufferString("contents"))
+		if err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+		if v1 == nil {
+			v1 = fd
+		}
+	}
+
+	if err := s.Purge(context.TODO(), "BUCKET", "File1", "V1"); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	list, err := s.List(context.TODO(), "BUCKET", "")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if len(list) != 1 || list[0].Version != "V2" {
+		t.Errorf("Expected only V2 to be listed, got %+v", list)
+	}
+
+	// metadata of the purged version is removed from the index
+	key := fmt.Sprintf("File1.V1.W.%d.%s", time.Time(time1).UnixNano()/1000000, v1.Checksum)
+	if value := s.index.Get("BUCKET", key); value != nil {
+		t.Errorf("Expected metadata of %s to be removed, got %s", key, value)
+	}
+
+	if err := s.Purge(context.TODO(), "BUCKET", "File1", "V1"); err != ErrNotFound {
+		t.Errorf("Expected error to be ErrNotFound, got %v", err)
+	}
+}
+
+func TestFilesystemDedup(t *testing.T) {
+	s, c := getTestFilesystem(t)
+	defer c()
+
+	if err := s.MakeBucket(context.TODO(), "BUCKET"); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	// the same contents are written three times
+	files := []*object.NewObjectInfo{
+		{Created: time1, Name: "File1", Version: "V1", Operation: string(Write)},
+		{Created: time2, Name: "File1", Version: "V2", Operation: string(Write)},
+		{Created: time2, Name: "File2", Version: "V1", Operation: string(Write)},
+	}
+	var checksum string
+	for _, newFile := range files {
+		fd, err := s.WriteStream(context.TODO(), "BUCKET", newFile, bytes.NewBufferString("contents"))
+		if err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+		if fd.Size != 8 {
+			t.Errorf("Expected size 8, got %d", fd.Size)
+		}
+		checksum = fd.Checksum
+	}
+
+	// contents are stored only once
+	dir, _ := s.bucketDir("BUCKET")
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	var stored int
+	for _, info := range infos {
+		if info.Size() > 0 && info.Name() != bucketMarker && !strings.HasPrefix(info.Name(), sidecarPrefix) {
+			stored++
+		}
+	}
+	if stored != 1 {
+		t.Errorf("Expected contents to be stored once, got %d files with contents", stored)
+	}
+
+	assertContents := func(fileID, version string) {
+		r, fd, err := s.Read(context.TODO(), "BUCKET", fileID, version)
+		if err != nil {
+			t.Fatalf("Expected error to be nil reading %s/%s, got %v", fileID, version, err)
+		}
+		defer r.Close()
+		b, _ := ioutil.ReadAll(r)
+		if string(b) != "contents" || fd.Size != 8 {
+			t.Errorf("Expected %s/%s to read 'contents' of size 8, got '%s' of size %d", fileID, version, b, fd.Size)
+		}
+	}
+	assertContents("File1", "V2")
+	assertContents("File2", "V1")
+
+	// contents are handed over when their owner is purged
+	if err := s.Purge(context.TODO(), "BUCKET", "File1", "V1"); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	assertContents("File1", "V2")
+	assertContents("File2", "V1")
+
+	if err := s.Purge(context.TODO(), "BUCKET", "File2", "V1"); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	assertContents("File1", "V2")
+
+	// contents are removed with the last reference
+	if err := s.Purge(context.TODO(), "BUCKET", "File1", "V2"); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	list, err := s.List(context.TODO(), "BUCKET", "")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if len(list) != 0 {
+		t.Errorf("Expected no files to be listed, got %+v", list)
+	}
+	if value := s.index.Get("BUCKET", blobIndexPrefix+checksum); value != nil {
+		t.Errorf("Expected content record to be removed, got %s", value)
+	}
+}
+
+func TestFilesystemReadRange(t *testing.T) {
+	s, c := getTestFilesystem(t)
+	defer c()
+
+	if err := s.MakeBucket(context.TODO(), "BUCKET"); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	newV1 := &object.NewObjectInfo{
+		Created:   time1,
+		Name:      "File1",
+		Version:   "V1",
+		Operation: string(Write),
+	}
+	contents := "0123456789abcdefghijklmnopqrstuvwxyz"
+	if _, err := s.WriteStream(context.TODO(), "BUCKET", newV1, bytes.NewBufferString(contents)); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	testCases := []struct {
+		description   string
+		rng           *Range
+		expected      string
+		errorExpected bool
+	}{
+		{"whole file", nil, contents, noErrors},
+		{"within first block", &Range{Start: 2, End: 5}, "2345", noErrors},
+		{"across blocks", &Range{Start: 14, End: 17}, "efgh", noErrors},
+		{"suffix", &Range{Start: -4, End: -1}, "wxyz", noErrors},
+		{"past contents", &Range{Start: 36, End: -1}, "", withErrors},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			r, fd, err := s.ReadRange(context.TODO(), "BUCKET", "File1", "", test.rng)
+			if fd == nil || fd.Size != int64(len(contents)) {
+				t.Fatalf("Expected file descriptor with size %d, got %+v", len(contents), fd)
+			}
+			if test.errorExpected {
+				if err != ErrInvalidRange {
+					t.Errorf("Expected error to equal '%v'; got %v", ErrInvalidRange, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected error to be nil, got %v", err)
+			}
+
+			body, _ := ioutil.ReadAll(r)
+			r.Close()
+			if string(body) != test.expected {
+				t.Errorf("Expected contents to equal '%s', got '%s'", test.expected, body)
+			}
+		})
+	}
+}
+
+// testKeyRing is a key ring with a settable current key; key "" is the legacy key
+type testKeyRing struct {
+	current string
+	keys    map[string]string
+}
+
+func (k *testKeyRing) Get(string) (string, error) {
+	return k.keys[k.current], nil
+}
+
+func (k *testKeyRing) CurrentID(string) (string, error) {
+	return k.current, nil
+}
+
+func (k *testKeyRing) GetVersion(_, keyID string) (string, error) {
+	return k.keys[keyID], nil
+}
+
+func (k *testKeyRing) KeyIDs(string) ([]string, error) {
+	ids := []string{}
+	for id := range k.keys {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	return ids, nil
+}
+
+func TestFilesystemRekey(t *testing.T) {
+	s, c := getTestFilesystem(t)
+	defer c()
+
+	ring := &testKeyRing{current: "1", keys: map[string]string{"": "SECRET", "1": "SECRET1", "2": "SECRET2"}}
+	s.keys = ring
+
+	if err := s.MakeBucket(context.TODO(), "BUCKET"); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	// legacy file encrypted with the legacy key
+	block, _ := getCipher("SECRET")
+	f, _ := os.Create(filepath.Join(s.cfg.Root, "BUCKET", info1V1.Key))
+	if err := encryptTo(f, block, bytes.NewBufferString("version1")); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	f.Close()
+
+	// file encrypted with key 1
+	sum := sha256.Sum256([]byte("version2"))
+	newV2 := &object.NewObjectInfo{
+		Checksum:  base64.URLEncoding.EncodeToString(sum[:]),
+		Created:   time2,
+		Name:      "File1",
+		Version:   "V2",
+		Size:      8,
+		Operation: string(Write),
+	}
+	if _, err := s.Write(context.TODO(), "BUCKET", newV2, bytes.NewBufferString("version2")); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	// rotate the key and simulate rotation interrupted after the file was
+	// re-encrypted but before the index was updated
+	ring.current = "2"
+	list, _ := s.list(context.TODO(), "BUCKET", "File1.V2.")
+	md := *list[0].md
+	md.rekeyTo = "2"
+	writeIndex(s.index, "BUCKET", &md)
+	if err := s.writeObject(context.TODO(), "BUCKET", list[0].key, "SECRET2", bytes.NewBufferString("version2")); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	rekeyed, err := s.Rekey(context.TODO(), "BUCKET")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if rekeyed != 2 {
+		t.Errorf("Expected 2 re-encrypted files, got %d", rekeyed)
+	}
+
+	// all files are encrypted with the current key
+	list, _ = s.list(context.TODO(), "BUCKET", "")
+	for _, entry := range list {
+		if entry.md.keyID != "2" || entry.md.rekeyTo != "" {
+			t.Errorf("Expected %s to be encrypted with key '2', got '%s' (rekeyTo '%s')", entry.key, entry.md.keyID, entry.md.rekeyTo)
+		}
+	}
+	for version, expected := range map[string]string{"V1": "version1", "V2": "version2"} {
+		r, _, err := s.Read(context.TODO(), "BUCKET", "File1", version)
+		if err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+		body, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(body) != expected {
+			t.Errorf("Expected contents to equal '%s', got '%s'", expected, body)
+		}
+	}
+
+	// nothing left to do on the second run
+	if rekeyed, _ := s.Rekey(context.TODO(), "BUCKET"); rekeyed != 0 {
+		t.Errorf("Expected 0 re-encrypted files, got %d", rekeyed)
+	}
+
+	// static keys can not be rotated
+	s.keys = staticKeys("SECRET")
+	if _, err := s.Rekey(context.TODO(), "BUCKET"); err != ErrRekeyNotSupported {
+		t.Errorf("Expected error to equal '%v'; got %v", ErrRekeyNotSupported, err)
+	}
+}
+
+func TestFilesystemRebuildIndex(t *testing.T) {
+	s, c := getTestFilesystem(t)
+	defer c()
+
+	ring := &testKeyRing{current: "1", keys: map[string]string{"": "SECRET", "1": "SECRET1", "2": "SECRET2"}}
+	s.keys = ring
+
+	if err := s.MakeBucket(context.TODO(), "BUCKET"); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	// the same contents are written twice, the second file is a reference
+	files := []*object.NewObjectInfo{
+		{Created: time1, Name: "File1", Version: "V1", ContentType: "text/plain", Archetype: "ARCHETYPE", Labels: []string{"label1"}, Operation: string(Write)},
+		{Created: time2, Name: "File2", Version: "V1", ContentType: "text/plain", Operation: string(Write)},
+	}
+	for _, newFile := range files {
+		if _, err := s.WriteStream(context.TODO(), "BUCKET", newFile, bytes.NewBufferString("contents")); err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+	}
+
+	// records of both files are lost
+	list, _ := s.list(context.TODO(), "BUCKET", "")
+	for _, entry := range list {
+		s.index.Delete("BUCKET", entry.key)
+	}
+
+	// files missing in the index are not listed
+	fds, err := s.List(context.TODO(), "BUCKET", "")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if len(fds) != 0 {
+		t.Errorf("Expected no files to be listed, got %+v", fds)
+	}
+
+	// files encrypted with an older version of the key are recognized
+	ring.current = "2"
+
+	rebuilt, err := s.RebuildIndex(context.TODO(), "BUCKET")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if rebuilt != 2 {
+		t.Errorf("Expected 2 restored records, got %d", rebuilt)
+	}
+
+	list, _ = s.list(context.TODO(), "BUCKET", "")
+	if len(list) != 2 {
+		t.Fatalf("Expected 2 files to be listed, got %d", len(list))
+	}
+	for _, entry := range list {
+		// metadata not kept in the file name is restored from the sidecar
+		if entry.md.contentType != "text/plain" {
+			t.Errorf("Expected content type of %s to equal 'text/plain', got '%s'", entry.md.filename, entry.md.contentType)
+		}
+
+		switch entry.md.filename {
+		case "File1":
+			if entry.md.keyID != "1" || entry.md.ref {
+				t.Errorf("Expected File1 to be encrypted with key '1', got '%s' (ref %v)", entry.md.keyID, entry.md.ref)
+			}
+			if entry.md.archetype != "ARCHETYPE" || !reflect.DeepEqual(entry.md.labels, []string{"label1"}) {
+				t.Errorf("Expected archetype and labels of File1 to be restored, got '%s' and %v", entry.md.archetype, entry.md.labels)
+			}
+		case "File2":
+			if !entry.md.ref || entry.size != 8 {
+				t.Errorf("Expected File2 to refer to contents of size 8, got ref %v, size %d", entry.md.ref, entry.size)
+			}
+		}
+	}
+	for _, fileID := range []string{"File1", "File2"} {
+		r, _, err := s.Read(context.TODO(), "BUCKET", fileID, "V1")
+		if err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+		body, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(body) != "contents" {
+			t.Errorf("Expected contents to equal 'contents', got '%s'", body)
+		}
+	}
+
+	// nothing left to do on the second run
+	if rebuilt, _ := s.RebuildIndex(context.TODO(), "BUCKET"); rebuilt != 0 {
+		t.Errorf("Expected 0 restored records, got %d", rebuilt)
+	}
+
+	// files stored without a sidecar are restored from the file name only
+	entry := list[0]
+	s.index.Delete("BUCKET", entry.key)
+	if err := s.removeObject(context.TODO(), "BUCKET", sidecarKey(entry.key)); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if rebuilt, err := s.RebuildIndex(context.TODO(), "BUCKET"); err != nil || rebuilt != 1 {
+		t.Fatalf("Expected 1 restored record, got %d (%v)", rebuilt, err)
+	}
+	md, err := metadataFromIndex(s.index, "BUCKET", entry.key)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if md.contentType != "" {
+		t.Errorf("Expected content type to be empty, got '%s'", md.contentType)
+	}
+
+	// sidecars are removed with their files
+	if err := s.Purge(context.TODO(), "BUCKET", "File1", "V1"); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	for _, entry := range list {
+		if entry.md.filename != "File1" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(s.cfg.Root, "BUCKET", sidecarKey(entry.key))); !os.IsNotExist(err) {
+			t.Errorf("Expected sidecar to be removed, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package s3
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// ErrRekeyNotSupported indicates key provider does not keep versioned keys
+var ErrRekeyNotSupported = errors.New("Key provider does not support key rotation")
+
+// keyedObjects is implemented by backends to read and write objects using
+// a given key
+type keyedObjects interface {
+	readObject(ctx context.Context, bucketID, objectKey, secret string) (io.ReadCloser, error)
+	writeObject(ctx context.Context, bucketID, objectKey, secret string, r io.Reader) error
+	moveObject(ctx context.Context, bucketID, srcKey, dstKey string) error
+	removeObject(ctx context.Context, bucketID, objectKey string) error
+}
+
+// currentKey returns ID and value of the key new files in the bucket are
+// encrypted with. Key ID is empty for key providers not implementing KeyRing.
+func currentKey(keys KeyProvider, bucketID string) (string, string, error) {
+	ring, ok := keys.(KeyRing)
+	if !ok {
+		secret, err := keys.Get(bucketID)
+		return "", secret, err
+	}
+
+	keyID, err := ring.CurrentID(bucketID)
+	if err != nil {
+		return "", "", err
+	}
+	secret, err := ring.GetVersion(bucketID, keyID)
+	return keyID, secret, err
+}
+
+// fileKey returns the key the file was encrypted with
+func fileKey(keys KeyProvider, bucketID string, md *metadata) (string, error) {
+	if ring, ok := keys.(KeyRing); ok {
+		return ring.GetVersion(bucketID, md.keyID)
+	}
+
+	return keys.Get(bucketID)
+}
+
+// rekey re-encrypts listed objects with the current key of the bucket and
+// returns the number of re-encrypted objects. Object is first marked in the
+// index as being re-encrypted so an interrupted run can be resumed; the key an
+// object is encrypted with is then recognized by its checksum.
+func rekey(ctx context.Context, objects keyedObjects, index MetadataIndex, ring KeyRing, bucketID string, entries []*objectEntry) (int, error) {
+	keyID, err := ring.CurrentID(bucketID)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to get current key ID")
+	}
+	secret, err := ring.GetVersion(bucketID, keyID)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to get current key")
+	}
+
+	var rekeyed int
+	for _, entry := range entries {
+		md := *entry.md
+		// references share contents re-encrypted with their owner
+		if md.ref || (md.keyID == keyID && md.rekeyTo == "") {
+			continue
+		}
+
+		// find out if interrupted run already wrote the object
+		if md.rekeyTo != "" {
+			ok, err := verifyKey(ctx, objects, ring, bucketID, entry.key, md.rekeyTo, md.checksum)
+			if err != nil {
+				return rekeyed, err
+			}
+			if ok {
+				md.keyID = md.rekeyTo
+			}
+			md.rekeyTo = ""
+		}
+
+		if md.keyID != keyID {
+			// mark the object as being re-encrypted
+			md.rekeyTo = keyID
+			if err := writeIndex(index, bucketID, &md); err != nil {
+				return rekeyed, errors.Wrap(err, "Failed to write metadata to the index")
+			}
+
+			if err := reencrypt(ctx, objects, ring, bucketID, entry.key, md.keyID, secret); err != nil {
+				return rekeyed, errors.Wrapf(err, "Failed to re-encrypt %s", entry.key)
+			}
+			md.keyID = keyID
+			md.rekeyTo = ""
+		}
+
+		if err := writeIndex(index, bucketID, &md); err != nil {
+			return rekeyed, errors.Wrap(err, "Failed to write metadata to the index")
+		}
+		rekeyed++
+	}
+
+	return rekeyed, nil
+}
+
+// reencrypt reads the object with the old key and writes it back with the new
+// one. Contents are streamed to a temporary object which then replaces the
+// object, so the object is not written while it is read and the plain text
+// never reaches the disk.
+func reencrypt(ctx context.Context, objects keyedObjects, ring KeyRing, bucketID, objectKey, oldKeyID, secret string) error {
+	oldSecret, err := ring.GetVersion(bucketID, oldKeyID)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get the key")
+	}
+
+	r, err := objects.readObject(ctx, bucketID, objectKey, oldSecret)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmpKey, err := tmpObjectKey()
+	if err != nil {
+		return errors.Wrap(err, "Failed to generate temporary object key")
+	}
+	if err := objects.writeObject(ctx, bucketID, tmpKey, secret, r); err != nil {
+		objects.removeObject(ctx, bucketID, tmpKey)
+		return err
+	}
+
+	return objects.moveObject(ctx, bucketID, tmpKey, objectKey)
+}
+
+// verifyKey checks if the object is encrypted with the key by comparing
+// checksum of decrypted contents
+func verifyKey(ctx context.Context, objects keyedObjects, ring KeyRing, bucketID, objectKey, keyID, checksum string) (bool, error) {
+	secret, err := ring.GetVersion(bucketID, keyID)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to get the key")
+	}
+
+	r, err := objects.readObject(ctx, bucketID, objectKey, secret)
+	if err != nil {
+		// decryption with a wrong key can fail straight away
+		return false, nil
+	}
+	defer r.Close()
+
+	h := newHashReader(r)
+	if _, err := io.Copy(ioutil.Discard, h); err != nil {
+		return false, nil
+	}
+
+	return checksum == "" || h.checksum() == checksum, nil
+}
@@ -2,6 +2,7 @@ package s3
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
@@ -14,7 +15,17 @@ import (
 	"github.com/iryonetwork/wwm/storage/s3/object"
 )
 
+// Object key layouts
+const (
+	// layoutLegacy keeps all the metadata inside the object key
+	layoutLegacy = 1
+	// layoutIndexed keeps only basic metadata inside the object key, the rest
+	// is stored in the metadata index
+	layoutIndexed = 2
+)
+
 type metadata struct {
+	layout      int
 	filename    string
 	version     string
 	operation   Operation
@@ -23,39 +34,74 @@ type metadata struct {
 	contentType string
 	archetype   string
 	labels      []string
+	keyID       string
+	rekeyTo     string
+	ref         bool
+	size        int64
+}
+
+// indexRecord holds metadata stored in the metadata index. New fields can be
+// added freely, records written before the field existed decode with its zero
+// value.
+type indexRecord struct {
+	Layout      int      `json:"layout"`
+	ContentType string   `json:"contentType,omitempty"`
+	Archetype   string   `json:"archetype,omitempty"`
+	Labels      []string `json:"labels,omitempty"`
+	// KeyID identifies the key file was encrypted with, empty for files
+	// encrypted with the bucket's legacy key
+	KeyID string `json:"keyID,omitempty"`
+	// RekeyTo is set while the file is being re-encrypted with another key
+	RekeyTo string `json:"rekeyTo,omitempty"`
+	// Ref is set for files whose contents are kept in another object with
+	// the same checksum, Size then holds the size of the contents
+	Ref  bool  `json:"ref,omitempty"`
+	Size int64 `json:"size,omitempty"`
 }
 
 var utc, _ = time.LoadLocation("UTC")
 
+// errNotIndexed is returned for objects whose metadata is missing in the
+// metadata index; such objects are skipped when listing files
+var errNotIndexed = errors.New("Metadata not found in the index")
+
 func metadataFromKey(key string) (*metadata, error) {
 	items := strings.SplitN(key, ".", 8)
 
-	// decode contentType
-	ct, err := decode(items[5])
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to decode contentType from key")
-	}
-	// decode archetype
-	arch, err := decode(items[6])
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to decode archetype from key")
-	}
-	labelsString, err := decode(items[7])
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to decode archetype from key")
-	}
-	labels := labelsStringToSlice(labelsString)
+	md := &metadata{}
+	switch len(items) {
+	case 5:
+		md.layout = layoutIndexed
+	case 8:
+		md.layout = layoutLegacy
 
-	md := &metadata{
-		filename:    items[0],
-		version:     items[1],
-		operation:   Operation(items[2]),
-		checksum:    items[4],
-		contentType: ct,
-		archetype:   arch,
-		labels:      labels,
+		// decode contentType
+		ct, err := decode(items[5])
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode contentType from key")
+		}
+		// decode archetype
+		arch, err := decode(items[6])
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode archetype from key")
+		}
+		labelsString, err := decode(items[7])
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode archetype from key")
+		}
+
+		md.contentType = ct
+		md.archetype = arch
+		md.labels = labelsStringToSlice(labelsString)
+	default:
+		return nil, fmt.Errorf("Invalid number of fields in key (%d)", len(items))
 	}
 
+	md.filename = items[0]
+	md.version = items[1]
+	md.operation = Operation(items[2])
+	md.checksum = items[4]
+
 	// validate operation
 	if md.operation != Write && md.operation != Delete {
 		return nil, fmt.Errorf("Invalid operation %s", md.operation)
@@ -77,6 +123,7 @@ func metadataFromKey(key string) (*metadata, error) {
 
 func metadataFromNewFile(newFile *object.NewObjectInfo) (*metadata, error) {
 	md := &metadata{
+		layout:      layoutIndexed,
 		filename:    newFile.Name,
 		version:     newFile.Version,
 		operation:   Operation(newFile.Operation),
@@ -95,40 +142,106 @@ func metadataFromNewFile(newFile *object.NewObjectInfo) (*metadata, error) {
 	return md, nil
 }
 
-func metadataFromFileDescriptor(fd *models.FileDescriptor) (*metadata, error) {
-	md := &metadata{
-		filename:    fd.Name,
-		version:     fd.Version,
-		operation:   Operation(fd.Operation),
-		checksum:    fd.Checksum,
-		contentType: fd.ContentType,
-		archetype:   fd.Archetype,
-		labels:      fd.Labels,
-	}
-
-	// parse created
-	c, err := time.Parse(strfmt.RFC3339Millis, fd.Created.String())
-	if err != nil {
-		return nil, err
-	}
-	md.created = c
-
-	return md, nil
-}
-
+// String returns the object key for the metadata's layout
 func (m *metadata) String() string {
-	return fmt.Sprintf("%s.%s.%s.%d.%s.%s.%s.%s",
+	key := fmt.Sprintf("%s.%s.%s.%d.%s",
 		m.filename,
 		m.version,
 		m.operation,
 		m.created.UnixNano()/1000000,
 		m.checksum,
+	)
+
+	if m.layout != layoutLegacy {
+		return key
+	}
+
+	return fmt.Sprintf("%s.%s.%s.%s",
+		key,
 		encode(m.contentType),
 		encode(m.archetype),
 		encode(sliceToLabelsString(m.labels)),
 	)
 }
 
+// fileDescriptor converts the metadata to a file descriptor
+func (m *metadata) fileDescriptor(bucketID string, size int64) *models.FileDescriptor {
+	return &models.FileDescriptor{
+		Size:        size,
+		ContentType: m.contentType,
+		Path:        fmt.Sprintf("%s/%s/%s", bucketID, m.filename, m.version),
+		Name:        m.filename,
+		Version:     m.version,
+		Checksum:    m.checksum,
+		Created:     strfmt.DateTime(m.created),
+		Archetype:   m.archetype,
+		Operation:   string(m.operation),
+		Labels:      m.labels,
+	}
+}
+
+// record returns the part of metadata stored in the metadata index
+func (m *metadata) record() *indexRecord {
+	return &indexRecord{
+		Layout:      m.layout,
+		ContentType: m.contentType,
+		Archetype:   m.archetype,
+		Labels:      m.labels,
+		KeyID:       m.keyID,
+		RekeyTo:     m.rekeyTo,
+		Ref:         m.ref,
+		Size:        m.size,
+	}
+}
+
+// applyRecord fills the metadata with values from the metadata index
+func (m *metadata) applyRecord(r *indexRecord) {
+	m.contentType = r.ContentType
+	m.archetype = r.Archetype
+	m.labels = r.Labels
+	m.keyID = r.KeyID
+	m.rekeyTo = r.RekeyTo
+	m.ref = r.Ref
+	m.size = r.Size
+}
+
+// metadataFromIndex parses the object key and completes the metadata with
+// values from the metadata index. Objects stored with the legacy layout are not
+// looked up in the index. Metadata parsed from the key is returned along with
+// errNotIndexed if the object is missing in the index.
+func metadataFromIndex(index MetadataIndex, bucketID, key string) (*metadata, error) {
+	md, err := metadataFromKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to extract metadata from key")
+	}
+	if md.layout == layoutLegacy {
+		return md, nil
+	}
+
+	value := index.Get(bucketID, key)
+	if value == nil {
+		return md, errNotIndexed
+	}
+
+	r := &indexRecord{}
+	if err := json.Unmarshal(value, r); err != nil {
+		return nil, errors.Wrap(err, "Failed to decode metadata index record")
+	}
+	md.applyRecord(r)
+
+	return md, nil
+}
+
+// writeIndex stores metadata not included in the object key in the metadata index
+func writeIndex(index MetadataIndex, bucketID string, md *metadata) error {
+	value, err := json.Marshal(md.record())
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode metadata index record")
+	}
+
+	return index.Update(bucketID, md.String(), value)
+}
+
 func encode(src string) string {
 	return base64.URLEncoding.EncodeToString([]byte(src))
 }
@@ -0,0 +1,81 @@
+package s3
+
+import (
+	"crypto/aes"
+	"encoding/base64"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Object metadata set by minio-go client side encryption
+const (
+	amzHeaderIV  = "X-Amz-Meta-X-Amz-Iv"
+	amzHeaderKey = "X-Amz-Meta-X-Amz-Key"
+)
+
+// ErrInvalidRange indicates requested range is outside of file contents
+var ErrInvalidRange = errors.New("Requested range is not satisfiable")
+
+// Range selects part of file contents using HTTP byte range semantics
+type Range struct {
+	// Start is the offset of the first byte, negative value selects the last
+	// -Start bytes of the file
+	Start int64
+	// End is the offset of the last byte, negative value selects bytes up to
+	// the end of the file
+	End int64
+}
+
+// Resolve returns offset and length of the range within contents of given
+// size, ErrInvalidRange is returned if the range does not overlap contents
+func (r *Range) Resolve(size int64) (int64, int64, error) {
+	start, end := r.Start, r.End
+	if start < 0 {
+		start, end = size+start, size-1
+		if start < 0 {
+			start = 0
+		}
+	}
+	if end < 0 || end >= size {
+		end = size - 1
+	}
+	if start >= size || start > end {
+		return 0, 0, ErrInvalidRange
+	}
+
+	return start, end - start + 1, nil
+}
+
+// readCloser combines a reader with the closer of the underlying stream
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// addCounter returns the initialization vector of AES-CTR advanced by n blocks
+func addCounter(iv []byte, n uint64) []byte {
+	ctr := make([]byte, len(iv))
+	copy(ctr, iv)
+
+	var carry uint64
+	for i := len(ctr) - 1; i >= 0; i-- {
+		sum := uint64(ctr[i]) + n&0xff + carry
+		ctr[i] = byte(sum)
+		carry = sum >> 8
+		n >>= 8
+	}
+
+	return ctr
+}
+
+// previousBlock reads the ciphertext block preceding a ranged read of AES-CBC
+// encrypted object and returns it encoded as initialization vector
+func previousBlock(r io.Reader) (string, error) {
+	block := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(r, block); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(block), nil
+}
@@ -0,0 +1,115 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/minio/minio-go"
+)
+
+func TestRangeResolve(t *testing.T) {
+	testCases := []struct {
+		description    string
+		rng            Range
+		size           int64
+		expectedOffset int64
+		expectedLength int64
+		errorExpected  bool
+	}{
+		{"whole range", Range{0, -1}, 10, 0, 10, noErrors},
+		{"start and end", Range{2, 5}, 10, 2, 4, noErrors},
+		{"end past contents", Range{2, 50}, 10, 2, 8, noErrors},
+		{"open end", Range{9, -1}, 10, 9, 1, noErrors},
+		{"suffix", Range{-3, -1}, 10, 7, 3, noErrors},
+		{"suffix longer than contents", Range{-30, -1}, 10, 0, 10, noErrors},
+		{"start past contents", Range{10, -1}, 10, 0, 0, withErrors},
+		{"empty contents", Range{-3, -1}, 0, 0, 0, withErrors},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			offset, length, err := test.rng.Resolve(test.size)
+			if test.errorExpected {
+				if err != ErrInvalidRange {
+					t.Errorf("Expected error to equal '%v'; got %v", ErrInvalidRange, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected error to be nil, got %v", err)
+			}
+			if offset != test.expectedOffset || length != test.expectedLength {
+				t.Errorf("Expected offset %d and length %d, got %d and %d", test.expectedOffset, test.expectedLength, offset, length)
+			}
+		})
+	}
+}
+
+func TestAddCounter(t *testing.T) {
+	block, _ := getCipher("SECRET")
+	iv := bytes.Repeat([]byte{0xff}, aes.BlockSize)
+	iv[0] = 0
+
+	// counter advanced by 3 blocks produces the same key stream as skipping
+	// 3 blocks
+	full := make([]byte, 4*aes.BlockSize)
+	cipher.NewCTR(block, iv).XORKeyStream(full, full)
+	part := make([]byte, aes.BlockSize)
+	cipher.NewCTR(block, addCounter(iv, 3)).XORKeyStream(part, part)
+
+	if !bytes.Equal(part, full[3*aes.BlockSize:]) {
+		t.Errorf("Expected key stream to equal\n%x\ngot\n%x", full[3*aes.BlockSize:], part)
+	}
+}
+
+func TestS3ReadRange(t *testing.T) {
+	s, m, k, c := getTestStorage(t)
+	defer c()
+
+	// encrypt contents the way minio does
+	contents := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	em, _ := cbcMaterials("SECRET")
+	em.SetupEncryptMode(bytes.NewReader(contents))
+	encrypted, _ := ioutil.ReadAll(em)
+	metadata := http.Header{}
+	metadata.Set(amzHeaderIV, em.GetIV())
+	metadata.Set(amzHeaderKey, em.GetKey())
+	info := minio.ObjectInfo{Key: info1V1.Key, Size: int64(len(encrypted)), Metadata: metadata}
+
+	infos := make(chan minio.ObjectInfo, 1)
+	infos <- info
+	close(infos)
+
+	gomock.InOrder(
+		m.EXPECT().BucketExists("BUCKET").Return(true, nil),
+		m.EXPECT().ListObjectsV2("BUCKET", "File1.V1.", false, gomock.Any()).Return(infos),
+		k.EXPECT().Get("BUCKET").Return("SECRET", nil),
+		m.EXPECT().StatObject("BUCKET", info1V1.Key, gomock.Any()).Return(info, nil),
+		// last block with the preceding one
+		m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", info1V1.Key, gomock.Any()).
+			Return(noopCloser{bytes.NewReader(encrypted[len(encrypted)-2*aes.BlockSize:])}, nil),
+		// second block is the first one needed, first block is the IV
+		m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", info1V1.Key, gomock.Any()).
+			Return(noopCloser{bytes.NewReader(encrypted)}, nil),
+	)
+
+	r, fd, err := s.ReadRange(context.TODO(), "BUCKET", "File1", "V1", &Range{Start: 20, End: 25})
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	body, _ := ioutil.ReadAll(r)
+	r.Close()
+
+	if string(body) != "klmnop" {
+		t.Errorf("Expected contents to equal 'klmnop', got '%s'", body)
+	}
+	if fd.Size != int64(len(contents)) {
+		t.Errorf("Expected size to equal %d, got %d", len(contents), fd.Size)
+	}
+}
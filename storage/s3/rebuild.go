@@ -0,0 +1,134 @@
+package s3
+
+import (
+	"context"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// rebuildIndex restores metadata index records of listed objects missing in
+// the index and returns the number of restored records. Metadata is restored
+// from the object key and the object's sidecar; content type, archetype and
+// labels of files stored before sidecars were introduced are lost. Empty
+// objects sharing checksum with stored contents are restored as references to
+// them. The key an object is encrypted with is
+// recognized by its checksum, objects encrypted with none of the bucket's keys
+// are left out of the index.
+func rebuildIndex(ctx context.Context, objects keyedObjects, index MetadataIndex, keys KeyProvider, bucketID string, entries, unindexed []*objectEntry) (int, error) {
+	// objects holding contents are restored first so references to them can
+	// be recognized
+	sort.SliceStable(unindexed, func(i, j int) bool {
+		return unindexed[i].size > 0 && unindexed[j].size == 0
+	})
+
+	var rebuilt int
+	for _, entry := range unindexed {
+		ok, err := rebuildEntry(ctx, objects, index, keys, bucketID, entries, unindexed, entry)
+		if err != nil {
+			return rebuilt, err
+		}
+		if ok {
+			rebuilt++
+		}
+	}
+
+	return rebuilt, nil
+}
+
+// rebuildEntry restores metadata index record of the object and returns true,
+// false is returned if the key it is encrypted with is not found
+func rebuildEntry(ctx context.Context, objects keyedObjects, index MetadataIndex, keys KeyProvider, bucketID string, entries, unindexed []*objectEntry, entry *objectEntry) (bool, error) {
+	md := *entry.md
+	if entry.sidecar {
+		if err := readSidecar(ctx, objects, keys, bucketID, entry.key, &md); err != nil {
+			return false, errors.Wrapf(err, "Failed to read sidecar of %s", entry.key)
+		}
+	}
+
+	defer dedupLocks.lock(bucketID, md.checksum)()
+
+	r, err := readBlobRecord(index, bucketID, md.checksum)
+	if err != nil {
+		return false, err
+	}
+
+	if r != nil && entry.size == 0 {
+		// object refers to contents stored by another object
+		md.ref = true
+		md.size = contentsSize(r.Key, entries, unindexed)
+		if err := writeIndex(index, bucketID, &md); err != nil {
+			return false, errors.Wrap(err, "Failed to write metadata to the index")
+		}
+		if !hasRef(r, entry.key) {
+			r.Refs = append(r.Refs, entry.key)
+		}
+		if err := writeBlobRecord(index, bucketID, md.checksum, r); err != nil {
+			return false, errors.Wrap(err, "Failed to record reference")
+		}
+		return true, nil
+	}
+
+	keyID, ok, err := objectKeyID(ctx, objects, keys, bucketID, entry)
+	if err != nil || !ok {
+		return false, err
+	}
+	md.keyID = keyID
+
+	if err := writeIndex(index, bucketID, &md); err != nil {
+		return false, errors.Wrap(err, "Failed to write metadata to the index")
+	}
+	if err := addOwner(index, bucketID, &md); err != nil {
+		return false, errors.Wrap(err, "Failed to record contents")
+	}
+
+	return true, nil
+}
+
+// objectKeyID returns ID of the key the object is encrypted with, false is
+// returned if it is encrypted with none of the bucket's keys. Versions of the
+// key are tried newest first and the legacy key last.
+func objectKeyID(ctx context.Context, objects keyedObjects, keys KeyProvider, bucketID string, entry *objectEntry) (string, bool, error) {
+	ring, ok := keys.(KeyRing)
+	if !ok {
+		return "", true, nil
+	}
+
+	keyIDs, err := ring.KeyIDs(bucketID)
+	if err != nil {
+		return "", false, errors.Wrap(err, "Failed to get key IDs")
+	}
+
+	for _, keyID := range append(keyIDs, "") {
+		ok, err := verifyKey(ctx, objects, ring, bucketID, entry.key, keyID, entry.md.checksum)
+		if err != nil || ok {
+			return keyID, ok, err
+		}
+	}
+
+	return "", false, nil
+}
+
+// contentsSize returns size of the listed object holding the contents
+func contentsSize(key string, lists ...[]*objectEntry) int64 {
+	for _, entries := range lists {
+		for _, entry := range entries {
+			if entry.key == key {
+				return entry.size
+			}
+		}
+	}
+
+	return 0
+}
+
+// hasRef checks if the object is recorded as referring to the contents
+func hasRef(r *blobRecord, key string) bool {
+	for _, ref := range r.Refs {
+		if ref == key {
+			return true
+		}
+	}
+
+	return false
+}
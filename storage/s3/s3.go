@@ -8,35 +8,71 @@ S3 supports following features:
 
     - listing files inside a bucket
     - creating new files
-    - reading files
+    - streaming new files of unknown size and checksum
+    - reading files or their byte ranges
+    - purging old versions of files
+    - storing identical contents of files once
+    - keeping metadata of buckets and archiving them
     - encrypting all files using an external key provider
 
+Backends
+
+Files are stored on S3 compatible storage by default. Storage returned by
+NewFilesystem keeps the same object names on the local filesystem instead,
+one directory per bucket, and can be used where no object store is available.
+
 Encryption
 
 To support encryption s3 requires an external key provider that can provide the
-storage correct key for the current bucket / user ID.
+storage correct key for the current bucket / user ID. Filesystem backend
+encrypts files with AES-CTR using SHA256 hash of the key.
 
 Storing metadata
 
-Metadata is stored inside the file name. The end file name on S3 storage will
-look like this
+Basic metadata is stored inside the file name. The end file name on the storage
+will look like this
+
+	FILENAME.VERSION.OPERATION.TIMESTAMP.CHECKSUM
+	-- 40 --.- 1-40-.--- 1 ---.-- 13 ---.-- 44 --
+
+Remaining metadata (content type, archetype, labels) is stored in the metadata
+index keyed by the file name. Records in the index are JSON encoded, new values
+can be added by extending the record. The same metadata is also kept in a
+sidecar object stored next to the file as
+
+	.meta-FILENAME.VERSION.OPERATION.TIMESTAMP.CHECKSUM
 
-	FILENAME.VERSION.OPERATION.TIMESTAMP.CHECKSUM.ARCHETYPE
-	-- 40 --.- 1-40-.--- 1 ---.-- 13 ---.-- 44 --.--- * ---
+so the index serves as a cache that can be rebuilt from the storage alone.
+Sidecars are encrypted with the legacy key of the bucket. Files are written
+before their record so files missing in the index are skipped when listing;
+RebuildIndex restores their records from the file name and the sidecar.
 
-Filenames on S3 are limited to around 1024 bytes meaning that the last archetype
-value can be up to 886 characters long.
+Files written before the metadata index was introduced keep all the metadata
+inside the file name
 
-@TODO How to add new values to file name?
+	FILENAME.VERSION.OPERATION.TIMESTAMP.CHECKSUM.CONTENTTYPE.ARCHETYPE.LABELS
+
+and are still readable. Migrate rewrites them to the current layout.
+
+Deduplication
+
+Streamed files with the same checksum as contents already stored in the bucket
+are kept as empty objects referring to the stored contents. The metadata index
+keeps a record of the object holding the contents together with the referring
+objects. Purging the object holding the contents moves them to one of the
+referring objects so the contents are removed only with their last reference.
 */
 package s3
 
-//go:generate ../../bin/mockgen.sh storage/s3 Storage,KeyProvider,Minio $GOFILE
+//go:generate ../../bin/mockgen.sh storage/s3 Storage,KeyProvider,KeyRing,MetadataIndex,Minio $GOFILE
 
 import (
+	"bytes"
 	"context"
+	"crypto/aes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"regexp"
 	"sort"
 	"strings"
@@ -61,9 +97,29 @@ type Storage interface {
 	BucketExists(ctx context.Context, bucketID string) (bool, error)
 	MakeBucket(ctx context.Context, bucketID string) error
 	ListBuckets(ctx context.Context) ([]*models.BucketDescriptor, error)
+	// GetBucketMetadata returns metadata of the bucket, ErrNotFound is returned
+	// if the bucket does not exist.
+	GetBucketMetadata(ctx context.Context, bucketID string) (*BucketMetadata, error)
+	// UpdateBucketMetadata replaces metadata of the bucket.
+	UpdateBucketMetadata(ctx context.Context, bucketID string, md *BucketMetadata) error
+	// RemoveBucket removes the bucket together with all its files.
+	RemoveBucket(ctx context.Context, bucketID string) error
 	List(ctx context.Context, bucketID, prefix string) ([]*models.FileDescriptor, error)
+	// Stat returns file descriptor of the latest version of the file or the
+	// requested version without fetching its contents.
+	Stat(ctx context.Context, bucketID, fileID, version string) (*models.FileDescriptor, error)
 	Read(ctx context.Context, bucketID, fileID, version string) (io.ReadCloser, *models.FileDescriptor, error)
+	// ReadRange fetches the selected part of file contents; file descriptor
+	// holds the size of whole contents and is returned with ErrInvalidRange too.
+	ReadRange(ctx context.Context, bucketID, fileID, version string, rng *Range) (io.ReadCloser, *models.FileDescriptor, error)
 	Write(ctx context.Context, bucketID string, newFile *object.NewObjectInfo, r io.Reader) (*models.FileDescriptor, error)
+	// WriteStream creates a new file without knowing its checksum and size in
+	// advance; both are calculated while the contents are written and
+	// newFile.Checksum and newFile.Size are ignored.
+	WriteStream(ctx context.Context, bucketID string, newFile *object.NewObjectInfo, r io.Reader) (*models.FileDescriptor, error)
+	// Purge physically removes the version of the file together with its
+	// metadata; unlike deletion it leaves no trace of the version behind.
+	Purge(ctx context.Context, bucketID, fileID, version string) error
 }
 
 // KeyProvider lists methods required for reading encryption keys
@@ -71,10 +127,59 @@ type KeyProvider interface {
 	Get(string) (string, error)
 }
 
+// KeyRing is implemented by key providers keeping multiple versions of the
+// bucket's key. Storages record ID of the key each file was encrypted with so
+// files stay readable after the key is rotated.
+type KeyRing interface {
+	KeyProvider
+	// CurrentID returns ID of the key new files are encrypted with.
+	CurrentID(bucketID string) (string, error)
+	// GetVersion returns the key with given ID, empty ID stands for the key
+	// used before versioned keys were introduced.
+	GetVersion(bucketID, keyID string) (string, error)
+	// KeyIDs returns IDs of all the versions of the bucket's key, newest
+	// first; the legacy key is not included.
+	KeyIDs(bucketID string) ([]string, error)
+}
+
+// Rekeyer is implemented by storages able to re-encrypt files with the
+// current key of the bucket
+type Rekeyer interface {
+	// Rekey re-encrypts files stored in the bucket with a key other than the
+	// current one and returns the number of re-encrypted files.
+	Rekey(ctx context.Context, bucketID string) (int, error)
+}
+
+// MetadataIndex lists methods required for storing metadata that is not kept
+// in the object key. keyvalue.Storage satisfies the interface.
+type MetadataIndex interface {
+	Get(bucket string, key string) []byte
+	Update(bucket string, key string, value []byte) error
+	Delete(bucket string, key string) error
+}
+
+// Migrator is implemented by storages able to rewrite files stored with the
+// legacy layout to the current one
+type Migrator interface {
+	// Migrate rewrites files stored in the bucket with the legacy layout and
+	// returns the number of migrated files.
+	Migrate(ctx context.Context, bucketID string) (int, error)
+}
+
+// Indexer is implemented by storages able to restore metadata index records
+// of stored files
+type Indexer interface {
+	// RebuildIndex restores metadata index records of files stored in the
+	// bucket that are missing in the index and returns the number of restored
+	// records.
+	RebuildIndex(ctx context.Context, bucketID string) (int, error)
+}
+
 // Minio interface describes functions used in minio-go package for mocking
 // purposes.
 type Minio interface {
 	MakeBucket(bucketName, location string) error
+	RemoveBucket(bucketName string) error
 	BucketExists(bucketName string) (bool, error)
 	ListBuckets() ([]minio.BucketInfo, error)
 	ListObjectsV2(bucketName, prefix string, recursive bool, doneCh <-chan struct{}) <-chan minio.ObjectInfo
@@ -83,6 +188,9 @@ type Minio interface {
 	PutObjectWithContext(ctx context.Context, bucketName, objectName string, reader io.Reader, objectSize int64,
 		opts minio.PutObjectOptions) (n int64, err error)
 	PutEncryptedObject(bucketName, objectName string, reader io.Reader, encryptMaterials encrypt.Materials) (n int64, err error)
+	RemoveObject(bucketName, objectName string) error
+	StatObject(bucketName, objectName string, opts minio.StatObjectOptions) (minio.ObjectInfo, error)
+	CopyObject(dst minio.DestinationInfo, src minio.SourceInfo) error
 }
 
 var nameVersionRE = regexp.MustCompile("^(.*)\\.(\\d+)$")
@@ -100,9 +208,20 @@ type s3storage struct {
 	cfg    *Config
 	client Minio
 	keys   KeyProvider
+	index  MetadataIndex
 	logger zerolog.Logger
 }
 
+// objectEntry holds object's key together with its metadata
+type objectEntry struct {
+	key  string
+	md   *metadata
+	size int64
+	// sidecar is set for objects missing in the metadata index whose
+	// sidecar was listed along with them
+	sidecar bool
+}
+
 // Operation represents a single character operation
 type Operation string
 
@@ -124,7 +243,7 @@ var ErrNotFound = errors.New("File not found")
 var ErrDeleted = errors.New("File was deleted")
 
 // New creates a new instance of s3 storage
-func New(cfg *Config, keys KeyProvider, logger zerolog.Logger) (Storage, error) {
+func New(cfg *Config, keys KeyProvider, index MetadataIndex, logger zerolog.Logger) (Storage, error) {
 	logger = logger.With().Str("component", "storage/s3").Logger()
 
 	c, err := minio.NewWithRegion(cfg.Endpoint, cfg.AccessKey, cfg.AccessSecret, cfg.Secure, cfg.Region)
@@ -137,6 +256,7 @@ func New(cfg *Config, keys KeyProvider, logger zerolog.Logger) (Storage, error)
 		cfg:    cfg,
 		client: iminio{*c},
 		keys:   keys,
+		index:  index,
 		logger: logger,
 	}
 
@@ -206,90 +326,170 @@ func (s *s3storage) ListBuckets(_ context.Context) ([]*models.BucketDescriptor,
 	return buckets, nil
 }
 
-// List returns a list of files stored inside a bucket
-func (s *s3storage) List(_ context.Context, bucketID, prefix string) ([]*models.FileDescriptor, error) {
-	s.logger.Debug().Str("cmd", "s3::List").Msgf("('%s', '%s')", bucketID, prefix)
+// GetBucketMetadata returns metadata of the bucket
+func (s *s3storage) GetBucketMetadata(ctx context.Context, bucketID string) (*BucketMetadata, error) {
+	s.logger.Debug().Str("cmd", "s3::GetBucketMetadata").Msgf("('%s')", bucketID)
 
-	// Check if bucket exists first
-	exists, err := s.client.BucketExists(bucketID)
+	exists, err := s.BucketExists(ctx, bucketID)
 	if err != nil {
-		s.logger.Info().Err(err).Str("cmd", "s3::List").Msg("Failed to check if bucket exists")
-		return nil, errors.Wrap(err, "Failed to check if bucket exists")
+		return nil, err
 	}
 	if !exists {
-		// Nothing to list
-		return []*models.FileDescriptor{}, nil
+		return nil, ErrNotFound
+	}
+
+	md, err := readBucketMetadata(s.index, bucketID)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::GetBucketMetadata").Msg("Failed to read bucket metadata")
+		return nil, err
+	}
+
+	return md, nil
+}
+
+// UpdateBucketMetadata replaces metadata of the bucket
+func (s *s3storage) UpdateBucketMetadata(ctx context.Context, bucketID string, md *BucketMetadata) error {
+	s.logger.Debug().Str("cmd", "s3::UpdateBucketMetadata").Msgf("('%s', '%+v')", bucketID, md)
+
+	exists, err := s.BucketExists(ctx, bucketID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
 	}
 
+	if err := writeBucketMetadata(s.index, bucketID, md); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::UpdateBucketMetadata").Msg("Failed to write bucket metadata to the index")
+		return errors.Wrap(err, "Failed to write bucket metadata to the index")
+	}
+
+	return nil
+}
+
+// RemoveBucket removes all objects of the bucket with their metadata and then
+// the bucket itself
+func (s *s3storage) RemoveBucket(ctx context.Context, bucketID string) error {
+	s.logger.Debug().Str("cmd", "s3::RemoveBucket").Msgf("('%s')", bucketID)
+
+	exists, err := s.BucketExists(ctx, bucketID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+
+	// temporary objects are removed too, hence listing the bucket directly
 	ch := make(chan struct{})
 	defer close(ch)
-	infos := s.client.ListObjectsV2(bucketID, prefix, false, ch)
-
-	files := []*models.FileDescriptor{}
-	for info := range infos {
+	for info := range s.client.ListObjectsV2(bucketID, "", true, ch) {
 		if info.Err != nil {
-			s.logger.Info().Err(info.Err).Str("cmd", "s3::List").Msg("Failed to read object from a list")
-			return nil, errors.Wrap(info.Err, "Failed to read object from a list")
+			s.logger.Info().Err(info.Err).Str("cmd", "s3::RemoveBucket").Msg("Failed to read object from a list")
+			return errors.Wrap(info.Err, "Failed to read object from a list")
 		}
-
-		fd, err := objectInfoToFileDescriptor(info, bucketID)
-		if err != nil {
-			s.logger.Info().Err(err).Str("cmd", "s3::List").Msg("Failed to convert object to fileDescriptor")
-			return nil, errors.Wrap(err, "Failed to convert object to fileDescriptor")
+		if err := s.client.RemoveObject(bucketID, info.Key); err != nil {
+			s.logger.Info().Err(err).Str("cmd", "s3::RemoveBucket").Msgf("Failed to remove %s", info.Key)
+			return errors.Wrapf(err, "Failed to remove %s", info.Key)
+		}
+		if err := s.index.Delete(bucketID, info.Key); err != nil {
+			s.logger.Info().Err(err).Str("cmd", "s3::RemoveBucket").Msgf("Failed to remove metadata of %s", info.Key)
+			return errors.Wrapf(err, "Failed to remove metadata of %s", info.Key)
 		}
+	}
+
+	if err := s.client.RemoveBucket(bucketID); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::RemoveBucket").Msg("Failed to remove the bucket")
+		return errors.Wrap(err, "Failed to remove the bucket")
+	}
+
+	return s.index.Delete(bucketsIndex, bucketID)
+}
 
-		files = append(files, fd)
+// List returns a list of files stored inside a bucket
+func (s *s3storage) List(ctx context.Context, bucketID, prefix string) ([]*models.FileDescriptor, error) {
+	s.logger.Debug().Str("cmd", "s3::List").Msgf("('%s', '%s')", bucketID, prefix)
+
+	entries, err := s.list(ctx, bucketID, prefix)
+	if err != nil {
+		return nil, err
 	}
 
-	sort.Sort(byCreated(files))
-	return files, nil
+	return entriesToFileDescriptors(entries, bucketID), nil
+}
+
+// Stat returns file descriptor without fetching the contents
+func (s *s3storage) Stat(ctx context.Context, bucketID, fileID, version string) (*models.FileDescriptor, error) {
+	s.logger.Debug().Str("cmd", "s3::Stat").Msgf("('%s', '%s', '%s')", bucketID, fileID, version)
+
+	entry, err := s.latest(ctx, bucketID, fileID, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry.md.fileDescriptor(bucketID, entry.size), nil
 }
 
 // Read fetches contents from the storage
 func (s *s3storage) Read(ctx context.Context, bucketID, fileID, version string) (io.ReadCloser, *models.FileDescriptor, error) {
 	s.logger.Debug().Str("cmd", "s3::Read").Msgf("('%s', '%s', '%s')", bucketID, fileID, version)
 
+	return s.ReadRange(ctx, bucketID, fileID, version, nil)
+}
+
+// ReadRange fetches part of contents from the storage, whole contents are
+// returned if rng is nil
+func (s *s3storage) ReadRange(ctx context.Context, bucketID, fileID, version string, rng *Range) (io.ReadCloser, *models.FileDescriptor, error) {
+	s.logger.Debug().Str("cmd", "s3::ReadRange").Msgf("('%s', '%s', '%s', %+v)", bucketID, fileID, version, rng)
+
 	// find the file
-	prefix := fmt.Sprintf("%s.", fileID)
-	if version != "" {
-		prefix += fmt.Sprintf("%s.", version)
-	}
-	list, err := s.List(ctx, bucketID, prefix)
+	entry, err := s.latest(ctx, bucketID, fileID, version)
 	if err != nil {
-		s.logger.Info().Err(err).Str("cmd", "s3::Read").Msg("Failed to list files")
-		return nil, nil, errors.Wrap(err, "Failed to list files")
-	}
-	if len(list) == 0 {
-		return nil, nil, ErrNotFound
+		return nil, nil, err
 	}
-	md, err := metadataFromFileDescriptor(list[0])
+	src, err := contents(s.index, bucketID, entry)
 	if err != nil {
-		s.logger.Info().Err(err).Str("cmd", "s3::Read").Msg("Failed to parse metadata from fileDescriptor")
-		return nil, nil, errors.Wrap(err, "Failed to parse metadata from fileDescriptor")
+		s.logger.Info().Err(err).Str("cmd", "s3::ReadRange").Msg("Failed to find contents")
+		return nil, nil, errors.Wrap(err, "Failed to find contents")
 	}
 
 	// read the key
-	em, err := getCBCKey(bucketID, s.keys)
+	secret, err := fileKey(s.keys, bucketID, src.md)
 	if err != nil {
 		s.logger.Info().Err(err).Str("cmd", "s3::Read").Msg("Failed to set CBC key")
 		return nil, nil, errors.Wrap(err, "Failed to set CBC key")
 	}
 
 	// fetch the file
-	reader, err := s.client.GetObjectWithContext(ctx, bucketID, md.String(), minio.GetObjectOptions{Materials: em})
+	if rng == nil {
+		reader, err := s.readObject(ctx, bucketID, src.key, secret)
+		if err != nil {
+			s.logger.Info().Err(err).Str("cmd", "s3::Read").Msg("Failed to fetch enc. object")
+			return nil, nil, errors.Wrap(err, "Failed to fetch enc. object")
+		}
+		return reader, entry.md.fileDescriptor(bucketID, entry.size), nil
+	}
 
-	if err != nil {
-		s.logger.Info().Err(err).Str("cmd", "s3::Read").Msg("Failed to fetch enc. object")
-		return nil, nil, errors.Wrap(err, "Failed to fetch enc. object")
+	reader, size, err := s.readObjectRange(ctx, bucketID, src.key, secret, rng)
+	switch {
+	case err == ErrInvalidRange:
+		return nil, entry.md.fileDescriptor(bucketID, size), err
+	case err != nil:
+		s.logger.Info().Err(err).Str("cmd", "s3::ReadRange").Msg("Failed to fetch enc. object range")
+		return nil, nil, errors.Wrap(err, "Failed to fetch enc. object range")
 	}
 
-	return reader, list[0], nil
+	return reader, entry.md.fileDescriptor(bucketID, size), nil
 }
 
 // Write creates a new file in the storage
 func (s *s3storage) Write(ctx context.Context, bucketID string, newFile *object.NewObjectInfo, r io.Reader) (*models.FileDescriptor, error) {
 	s.logger.Debug().Str("cmd", "s3::Write").Msgf("('%s', '%+v', reader)", bucketID, newFile)
 
+	if err := checkWritable(s.index, bucketID); err != nil {
+		return nil, err
+	}
+
 	// validate operation
 	op := Operation(newFile.Operation)
 	if op != Write && op != Delete {
@@ -298,7 +498,12 @@ func (s *s3storage) Write(ctx context.Context, bucketID string, newFile *object.
 	}
 
 	// get the key
-	em, err := getCBCKey(bucketID, s.keys)
+	keyID, secret, err := currentKey(s.keys, bucketID)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Write").Msg("Failed to set the CBC key")
+		return nil, errors.Wrap(err, "Failed to set the CBC key")
+	}
+	em, err := cbcMaterials(secret)
 	if err != nil {
 		s.logger.Info().Err(err).Str("cmd", "s3::Write").Msg("Failed to set the CBC key")
 		return nil, errors.Wrap(err, "Failed to set the CBC key")
@@ -310,14 +515,30 @@ func (s *s3storage) Write(ctx context.Context, bucketID string, newFile *object.
 		s.logger.Info().Err(err).Str("cmd", "s3::Write").Msg("Failed to collect metadata from new file")
 		return nil, errors.Wrap(err, "Failed to collect metadata from new file")
 	}
+	meta.keyID = keyID
+
+	// store the metadata not kept in the key next to the file
+	if err := writeSidecar(ctx, s, s.keys, bucketID, meta); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Write").Msg("Failed to write sidecar")
+		return nil, errors.Wrap(err, "Failed to write sidecar")
+	}
 
 	// upload the file
 	_, err = s.client.PutObjectWithContext(ctx, bucketID, meta.String(), r, -1, minio.PutObjectOptions{EncryptMaterials: em})
 	if err != nil {
 		s.logger.Info().Err(err).Str("cmd", "s3::Write").Msg("Failed to call PutObject")
+		s.client.RemoveObject(bucketID, sidecarKey(meta.String()))
 		return nil, errors.Wrap(err, "Failed to call PutObjectWithContext")
 	}
 
+	// store the metadata not kept in the key in the index
+	if err := writeIndex(s.index, bucketID, meta); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Write").Msg("Failed to write metadata to the index")
+		s.client.RemoveObject(bucketID, meta.String())
+		s.client.RemoveObject(bucketID, sidecarKey(meta.String()))
+		return nil, errors.Wrap(err, "Failed to write metadata to the index")
+	}
+
 	// generate the file descriptor
 	fd := &models.FileDescriptor{
 		Name:        newFile.Name,
@@ -335,27 +556,465 @@ func (s *s3storage) Write(ctx context.Context, bucketID string, newFile *object.
 	return fd, nil
 }
 
-func objectInfoToFileDescriptor(info minio.ObjectInfo, bucketID string) (*models.FileDescriptor, error) {
-	meta, err := metadataFromKey(info.Key)
+// WriteStream uploads the file to a temporary object while calculating its
+// checksum and size, the object is then copied to its versioned key. Metadata
+// is written to the index after the copy so a failed upload leaves no record
+// behind; objects are not listed until their metadata is indexed. If the same
+// contents are already stored only a reference is kept.
+func (s *s3storage) WriteStream(ctx context.Context, bucketID string, newFile *object.NewObjectInfo, r io.Reader) (*models.FileDescriptor, error) {
+	s.logger.Debug().Str("cmd", "s3::WriteStream").Msgf("('%s', '%+v', reader)", bucketID, newFile)
+
+	if err := checkWritable(s.index, bucketID); err != nil {
+		return nil, err
+	}
+
+	// collect meta data
+	meta, err := metadataFromNewFile(newFile)
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to extract metadata from key")
+		s.logger.Info().Err(err).Str("cmd", "s3::WriteStream").Msg("Failed to collect metadata from new file")
+		return nil, errors.Wrap(err, "Failed to collect metadata from new file")
 	}
 
-	// copy basic data
-	fd := &models.FileDescriptor{
-		Size:        info.Size,
-		ContentType: meta.contentType,
-		Path:        fmt.Sprintf("%s/%s/%s", bucketID, meta.filename, meta.version),
-		Name:        meta.filename,
-		Version:     meta.version,
-		Checksum:    meta.checksum,
-		Created:     strfmt.DateTime(meta.created),
-		Archetype:   meta.archetype,
-		Operation:   string(meta.operation),
-		Labels:      meta.labels,
+	// get the key
+	keyID, secret, err := currentKey(s.keys, bucketID)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::WriteStream").Msg("Failed to set the CBC key")
+		return nil, errors.Wrap(err, "Failed to set the CBC key")
 	}
+	meta.keyID = keyID
 
-	return fd, nil
+	// upload the file to a temporary object
+	tmpKey, err := tmpObjectKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to generate temporary object key")
+	}
+	h := newHashReader(r)
+	if err := s.writeObject(ctx, bucketID, tmpKey, secret, h); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::WriteStream").Msg("Failed to upload temporary object")
+		s.client.RemoveObject(bucketID, tmpKey)
+		return nil, errors.Wrap(err, "Failed to upload temporary object")
+	}
+	defer func() {
+		if err := s.client.RemoveObject(bucketID, tmpKey); err != nil {
+			s.logger.Info().Err(err).Str("cmd", "s3::WriteStream").Msgf("Failed to remove temporary object %s", tmpKey)
+		}
+	}()
+	meta.checksum = h.checksum()
+
+	// store the metadata not kept in the key next to the file
+	if err := writeSidecar(ctx, s, s.keys, bucketID, meta); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::WriteStream").Msg("Failed to write sidecar")
+		return nil, errors.Wrap(err, "Failed to write sidecar")
+	}
+
+	// keep a reference if the contents are already stored; contents are
+	// not locked while they are moved into place so files with other
+	// contents are not held up, the same contents stored by two files at
+	// once are kept by both and only the first one recorded owns them
+	unlock := dedupLocks.lock(bucketID, meta.checksum)
+	ok, err := addRef(ctx, s, s.index, bucketID, meta, h.size)
+	unlock()
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::WriteStream").Msg("Failed to store reference to existing contents")
+		s.client.RemoveObject(bucketID, sidecarKey(meta.String()))
+		return nil, errors.Wrap(err, "Failed to store reference to existing contents")
+	}
+	if ok {
+		return meta.fileDescriptor(bucketID, h.size), nil
+	}
+
+	// move the object to its versioned key; encryption details are kept in
+	// object's metadata which is copied along
+	dst, err := minio.NewDestinationInfo(bucketID, meta.String(), nil, nil)
+	if err != nil {
+		s.client.RemoveObject(bucketID, sidecarKey(meta.String()))
+		return nil, errors.Wrap(err, "Failed to create copy destination")
+	}
+	if err := s.client.CopyObject(dst, minio.NewSourceInfo(bucketID, tmpKey, nil)); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::WriteStream").Msg("Failed to copy temporary object")
+		s.client.RemoveObject(bucketID, sidecarKey(meta.String()))
+		return nil, errors.Wrap(err, "Failed to copy temporary object")
+	}
+
+	// store the metadata not kept in the key in the index
+	if err := writeIndex(s.index, bucketID, meta); err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::WriteStream").Msg("Failed to write metadata to the index")
+		s.client.RemoveObject(bucketID, meta.String())
+		s.client.RemoveObject(bucketID, sidecarKey(meta.String()))
+		return nil, errors.Wrap(err, "Failed to write metadata to the index")
+	}
+
+	unlock = dedupLocks.lock(bucketID, meta.checksum)
+	err = addOwner(s.index, bucketID, meta)
+	unlock()
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::WriteStream").Msg("Failed to record contents")
+		return nil, errors.Wrap(err, "Failed to record contents")
+	}
+
+	return meta.fileDescriptor(bucketID, h.size), nil
+}
+
+// Purge removes objects of the file's version and their metadata index records.
+// Contents shared with other files are kept.
+func (s *s3storage) Purge(ctx context.Context, bucketID, fileID, version string) error {
+	s.logger.Debug().Str("cmd", "s3::Purge").Msgf("('%s', '%s', '%s')", bucketID, fileID, version)
+
+	list, err := s.list(ctx, bucketID, fmt.Sprintf("%s.%s.", fileID, version))
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Purge").Msg("Failed to list files")
+		return errors.Wrap(err, "Failed to list files")
+	}
+	if len(list) == 0 {
+		return ErrNotFound
+	}
+
+	for _, entry := range list {
+		if err := purgeObject(ctx, s, s.index, bucketID, entry); err != nil {
+			s.logger.Info().Err(err).Str("cmd", "s3::Purge").Msgf("Failed to remove %s", entry.key)
+			return errors.Wrapf(err, "Failed to remove %s", entry.key)
+		}
+	}
+
+	return nil
+}
+
+// Migrate rewrites files stored in the bucket with the legacy layout and
+// returns the number of migrated files. Migrated files are encrypted with
+// the current key of the bucket.
+func (s *s3storage) Migrate(ctx context.Context, bucketID string) (int, error) {
+	s.logger.Debug().Str("cmd", "s3::Migrate").Msgf("('%s')", bucketID)
+
+	list, err := s.list(ctx, bucketID, "")
+	if err != nil {
+		return 0, err
+	}
+
+	keyID, secret, err := currentKey(s.keys, bucketID)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Migrate").Msg("Failed to get the key")
+		return 0, errors.Wrap(err, "Failed to get the key")
+	}
+
+	var migrated int
+	for _, entry := range list {
+		if entry.md.layout != layoutLegacy {
+			continue
+		}
+
+		md := *entry.md
+		md.layout = layoutIndexed
+		md.keyID = keyID
+		if err := writeIndex(s.index, bucketID, &md); err != nil {
+			s.logger.Info().Err(err).Str("cmd", "s3::Migrate").Msg("Failed to write metadata to the index")
+			return migrated, errors.Wrap(err, "Failed to write metadata to the index")
+		}
+		if err := writeSidecar(ctx, s, s.keys, bucketID, &md); err != nil {
+			s.logger.Info().Err(err).Str("cmd", "s3::Migrate").Msg("Failed to write sidecar")
+			return migrated, errors.Wrap(err, "Failed to write sidecar")
+		}
+
+		if err := s.copyObject(ctx, bucketID, entry, md.String(), secret); err != nil {
+			s.logger.Info().Err(err).Str("cmd", "s3::Migrate").Msgf("Failed to copy %s", entry.key)
+			return migrated, errors.Wrapf(err, "Failed to copy %s", entry.key)
+		}
+
+		if err := s.client.RemoveObject(bucketID, entry.key); err != nil {
+			s.logger.Info().Err(err).Str("cmd", "s3::Migrate").Msgf("Failed to remove %s", entry.key)
+			return migrated, errors.Wrapf(err, "Failed to remove %s", entry.key)
+		}
+
+		migrated++
+	}
+
+	return migrated, nil
+}
+
+// Rekey migrates files stored with the legacy layout and re-encrypts files not
+// encrypted with the current key of the bucket. Returns the number of
+// re-encrypted files.
+func (s *s3storage) Rekey(ctx context.Context, bucketID string) (int, error) {
+	s.logger.Debug().Str("cmd", "s3::Rekey").Msgf("('%s')", bucketID)
+
+	ring, ok := s.keys.(KeyRing)
+	if !ok {
+		return 0, ErrRekeyNotSupported
+	}
+
+	// files need to be in the index to record the key
+	migrated, err := s.Migrate(ctx, bucketID)
+	if err != nil {
+		return migrated, err
+	}
+
+	list, err := s.list(ctx, bucketID, "")
+	if err != nil {
+		return migrated, err
+	}
+
+	rekeyed, err := rekey(ctx, s, s.index, ring, bucketID, list)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Rekey").Msg("Failed to re-encrypt files")
+	}
+	return migrated + rekeyed, err
+}
+
+// RebuildIndex restores metadata index records of objects stored in the bucket
+// that are missing in the index and returns the number of restored records.
+func (s *s3storage) RebuildIndex(ctx context.Context, bucketID string) (int, error) {
+	s.logger.Debug().Str("cmd", "s3::RebuildIndex").Msgf("('%s')", bucketID)
+
+	entries, unindexed, err := s.scan(ctx, bucketID, "")
+	if err != nil {
+		return 0, err
+	}
+
+	rebuilt, err := rebuildIndex(ctx, s, s.index, s.keys, bucketID, entries, unindexed)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::RebuildIndex").Msg("Failed to rebuild metadata index")
+	}
+	return rebuilt, err
+}
+
+// list returns objects stored inside a bucket sorted by created time, newest
+// first. Objects missing in the metadata index are skipped.
+func (s *s3storage) list(ctx context.Context, bucketID, prefix string) ([]*objectEntry, error) {
+	entries, _, err := s.scan(ctx, bucketID, prefix)
+	return entries, err
+}
+
+// scan returns objects stored inside a bucket sorted by created time, newest
+// first, and objects missing in the metadata index
+func (s *s3storage) scan(_ context.Context, bucketID, prefix string) ([]*objectEntry, []*objectEntry, error) {
+	// Check if bucket exists first
+	exists, err := s.client.BucketExists(bucketID)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::List").Msg("Failed to check if bucket exists")
+		return nil, nil, errors.Wrap(err, "Failed to check if bucket exists")
+	}
+	if !exists {
+		// Nothing to list
+		return []*objectEntry{}, nil, nil
+	}
+
+	ch := make(chan struct{})
+	defer close(ch)
+	infos := s.client.ListObjectsV2(bucketID, prefix, false, ch)
+
+	entries := []*objectEntry{}
+	unindexed := []*objectEntry{}
+	sidecars := map[string]bool{}
+	for info := range infos {
+		if info.Err != nil {
+			s.logger.Info().Err(info.Err).Str("cmd", "s3::List").Msg("Failed to read object from a list")
+			return nil, nil, errors.Wrap(info.Err, "Failed to read object from a list")
+		}
+
+		if strings.HasPrefix(info.Key, sidecarPrefix) {
+			sidecars[strings.TrimPrefix(info.Key, sidecarPrefix)] = true
+			continue
+		}
+
+		// skip objects that are still being written
+		if strings.HasPrefix(info.Key, tmpPrefix) {
+			continue
+		}
+
+		md, err := metadataFromIndex(s.index, bucketID, info.Key)
+		if err == errNotIndexed {
+			s.logger.Info().Str("cmd", "s3::List").Msgf("Skipping %s/%s missing in the metadata index", bucketID, info.Key)
+			unindexed = append(unindexed, &objectEntry{key: info.Key, md: md, size: info.Size})
+			continue
+		}
+		if err != nil {
+			s.logger.Info().Err(err).Str("cmd", "s3::List").Msg("Failed to convert object to fileDescriptor")
+			return nil, nil, errors.Wrap(err, "Failed to convert object to fileDescriptor")
+		}
+
+		size := info.Size
+		if md.ref {
+			size = md.size
+		}
+
+		entries = append(entries, &objectEntry{key: info.Key, md: md, size: size})
+	}
+	for _, entry := range unindexed {
+		entry.sidecar = sidecars[entry.key]
+	}
+
+	sort.Sort(entriesByCreated(entries))
+	return entries, unindexed, nil
+}
+
+// latest returns the latest version of the file or the requested version
+func (s *s3storage) latest(ctx context.Context, bucketID, fileID, version string) (*objectEntry, error) {
+	prefix := fmt.Sprintf("%s.", fileID)
+	if version != "" {
+		prefix += fmt.Sprintf("%s.", version)
+	}
+	list, err := s.list(ctx, bucketID, prefix)
+	if err != nil {
+		s.logger.Info().Err(err).Str("cmd", "s3::Read").Msg("Failed to list files")
+		return nil, errors.Wrap(err, "Failed to list files")
+	}
+	if len(list) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return list[0], nil
+}
+
+// copyObject decrypts the object and stores it again under a new key
+func (s *s3storage) copyObject(ctx context.Context, bucketID string, src *objectEntry, dstKey, secret string) error {
+	srcSecret, err := fileKey(s.keys, bucketID, src.md)
+	if err != nil {
+		return errors.Wrap(err, "Failed to set CBC key")
+	}
+	reader, err := s.readObject(ctx, bucketID, src.key, srcSecret)
+	if err != nil {
+		return errors.Wrap(err, "Failed to fetch enc. object")
+	}
+	defer reader.Close()
+
+	return s.writeObject(ctx, bucketID, dstKey, secret, reader)
+}
+
+// readObject fetches the object decrypting it with the key
+func (s *s3storage) readObject(ctx context.Context, bucketID, objectKey, secret string) (io.ReadCloser, error) {
+	em, err := cbcMaterials(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.client.GetObjectWithContext(ctx, bucketID, objectKey, minio.GetObjectOptions{Materials: em})
+}
+
+// readObjectRange fetches part of the object decrypting it with the key and
+// returns it together with the size of decrypted contents. Objects are
+// encrypted with AES-CBC, so decryption can start at any block using the
+// preceding ciphertext block as the initialization vector. Size of contents is
+// found by decrypting the last block which holds the padding.
+func (s *s3storage) readObjectRange(ctx context.Context, bucketID, objectKey, secret string, rng *Range) (io.ReadCloser, int64, error) {
+	info, err := s.client.StatObject(bucketID, objectKey, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Failed to stat object")
+	}
+	if info.Size < aes.BlockSize {
+		return nil, 0, fmt.Errorf("Invalid size of encrypted object %s", objectKey)
+	}
+
+	// find the size of contents
+	last := info.Size - aes.BlockSize
+	r, err := s.decryptFrom(ctx, bucketID, objectKey, secret, &info, last)
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := io.Copy(ioutil.Discard, r)
+	r.Close()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Failed to decrypt last block")
+	}
+	size := last + n
+
+	offset, length, err := rng.Resolve(size)
+	if err != nil {
+		return nil, size, err
+	}
+
+	// fetch from the block holding the first byte and skip to it
+	block := offset / aes.BlockSize * aes.BlockSize
+	r, err = s.decryptFrom(ctx, bucketID, objectKey, secret, &info, block)
+	if err != nil {
+		return nil, size, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, offset-block); err != nil {
+		r.Close()
+		return nil, size, errors.Wrap(err, "Failed to decrypt object")
+	}
+
+	return &readCloser{Reader: io.LimitReader(r, length), Closer: r}, size, nil
+}
+
+// decryptFrom fetches the object from the block at offset to the end and
+// decrypts it
+func (s *s3storage) decryptFrom(ctx context.Context, bucketID, objectKey, secret string, info *minio.ObjectInfo, offset int64) (io.ReadCloser, error) {
+	iv := info.Metadata.Get(amzHeaderIV)
+	start := offset
+	if offset > 0 {
+		start -= aes.BlockSize
+	}
+
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(start, info.Size-1); err != nil {
+		return nil, err
+	}
+	body, err := s.client.GetObjectWithContext(ctx, bucketID, objectKey, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > 0 {
+		if iv, err = previousBlock(body); err != nil {
+			body.Close()
+			return nil, errors.Wrap(err, "Failed to read initialization vector")
+		}
+	}
+
+	em, err := cbcMaterials(secret)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	if err := em.SetupDecryptMode(body, iv, info.Metadata.Get(amzHeaderKey)); err != nil {
+		body.Close()
+		return nil, errors.Wrap(err, "Failed to set up decryption")
+	}
+
+	return &readCloser{Reader: em, Closer: body}, nil
+}
+
+// writeObject uploads the object encrypting it with the key
+func (s *s3storage) writeObject(ctx context.Context, bucketID, objectKey, secret string, r io.Reader) error {
+	em, err := cbcMaterials(secret)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutObjectWithContext(ctx, bucketID, objectKey, r, -1, minio.PutObjectOptions{EncryptMaterials: em})
+	return err
+}
+
+// putRef stores an empty object referring to shared contents
+func (s *s3storage) putRef(ctx context.Context, bucketID, objectKey string) error {
+	_, err := s.client.PutObjectWithContext(ctx, bucketID, objectKey, bytes.NewReader(nil), 0, minio.PutObjectOptions{})
+	return err
+}
+
+// moveObject copies the object to another key and removes it
+func (s *s3storage) moveObject(_ context.Context, bucketID, srcKey, dstKey string) error {
+	dst, err := minio.NewDestinationInfo(bucketID, dstKey, nil, nil)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create copy destination")
+	}
+	if err := s.client.CopyObject(dst, minio.NewSourceInfo(bucketID, srcKey, nil)); err != nil {
+		return errors.Wrap(err, "Failed to copy object")
+	}
+
+	return s.client.RemoveObject(bucketID, srcKey)
+}
+
+// removeObject removes the object
+func (s *s3storage) removeObject(_ context.Context, bucketID, objectKey string) error {
+	return s.client.RemoveObject(bucketID, objectKey)
+}
+
+func entriesToFileDescriptors(entries []*objectEntry, bucketID string) []*models.FileDescriptor {
+	files := make([]*models.FileDescriptor, len(entries))
+	for i, entry := range entries {
+		files[i] = entry.md.fileDescriptor(bucketID, entry.size)
+	}
+
+	return files
 }
 
 func bucketInfoToBucketDescriptor(info minio.BucketInfo) (*models.BucketDescriptor, error) {
@@ -368,13 +1027,7 @@ func bucketInfoToBucketDescriptor(info minio.BucketInfo) (*models.BucketDescript
 	return bd, nil
 }
 
-func getCBCKey(bucketID string, keys KeyProvider) (encrypt.Materials, error) {
-	// read the key
-	secret, err := keys.Get(bucketID)
-	if err != nil {
-		return nil, err
-	}
-
+func cbcMaterials(secret string) (encrypt.Materials, error) {
 	// create the materials
 	return encrypt.NewCBCSecureMaterials(encrypt.NewSymmetricKey([]byte(secret)))
 }
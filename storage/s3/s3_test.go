@@ -34,6 +34,23 @@ func (n noopCloser) Close() error {
 	return nil
 }
 
+// memIndex is an in-memory metadata index
+type memIndex map[string][]byte
+
+func (i memIndex) Get(bucket, key string) []byte {
+	return i[bucket+"/"+key]
+}
+
+func (i memIndex) Update(bucket, key string, value []byte) error {
+	i[bucket+"/"+key] = value
+	return nil
+}
+
+func (i memIndex) Delete(bucket, key string) error {
+	delete(i, bucket+"/"+key)
+	return nil
+}
+
 var (
 	time1, _ = strfmt.ParseDateTime("2018-01-18T15:22:46.123Z")
 	time2, _ = strfmt.ParseDateTime("2018-01-26T15:16:15.123Z")
@@ -134,6 +151,7 @@ func getTestStorage(t *testing.T) (*s3storage, *mock.MockMinio, *mock.MockKeyPro
 		cfg:    &Config{Region: "REGION"},
 		client: minio,
 		keys:   keyProvider,
+		index:  memIndex{},
 		logger: zerolog.New(os.Stdout),
 	}
 
@@ -645,10 +663,13 @@ func TestS3Write(t *testing.T) {
 			func(r io.Reader, m *mock.MockMinio, k *mock.MockKeyProvider) []*gomock.Call {
 				return []*gomock.Call{
 					k.EXPECT().Get("BUCKET").Return("SECRET", nil),
+					k.EXPECT().Get("BUCKET").Return("SECRET", nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", ".meta-File1.V1.w.1516288966123.CHS", gomock.Any(), int64(-1), gomock.Any()).
+						Return(int64(0), nil),
 					m.EXPECT().PutObjectWithContext(
 						gomock.Any(),
 						"BUCKET",
-						"File1.V1.w.1516288966123.CHS.dGV4dC9vcGVuRWhyWG1s.b3BlbkVIUi1FSFItT0JTRVJWQVRJT04uYmxvb2RfcHJlc3N1cmUudjE=.dml0YWxTaWduLGJhc2ljUGF0aWVudEluZm8=",
+						"File1.V1.w.1516288966123.CHS",
 						r,
 						int64(-1),
 						gomock.Any(),
@@ -673,14 +694,18 @@ func TestS3Write(t *testing.T) {
 			func(r io.Reader, m *mock.MockMinio, k *mock.MockKeyProvider) []*gomock.Call {
 				return []*gomock.Call{
 					k.EXPECT().Get("BUCKET").Return("SECRET", nil),
+					k.EXPECT().Get("BUCKET").Return("SECRET", nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", ".meta-File1.V1.w.1516288966123.CHS", gomock.Any(), int64(-1), gomock.Any()).
+						Return(int64(0), nil),
 					m.EXPECT().PutObjectWithContext(
 						gomock.Any(),
 						"BUCKET",
-						"File1.V1.w.1516288966123.CHS.dGV4dC9vcGVuRWhyWG1s.b3BlbkVIUi1FSFItT0JTRVJWQVRJT04uYmxvb2RfcHJlc3N1cmUudjE=.dml0YWxTaWduLGJhc2ljUGF0aWVudEluZm8=",
+						"File1.V1.w.1516288966123.CHS",
 						r,
 						int64(-1),
 						gomock.Any(),
 					).Return(int64(0), errors.New("Error")),
+					m.EXPECT().RemoveObject("BUCKET", ".meta-File1.V1.w.1516288966123.CHS").Return(nil),
 				}
 			},
 			withErrors,
@@ -703,6 +728,17 @@ func TestS3Write(t *testing.T) {
 			// call List method
 			_, err := s.Write(context.TODO(), "BUCKET", test.newObject, reader)
 
+			// check metadata was stored in the index
+			if !test.errorExpected {
+				md, err := metadataFromIndex(s.index, "BUCKET", "File1.V1.w.1516288966123.CHS")
+				if err != nil {
+					t.Fatalf("Expected metadata to be found in the index, got %v", err)
+				}
+				if md.archetype != test.newObject.Archetype || md.contentType != test.newObject.ContentType || !reflect.DeepEqual(md.labels, test.newObject.Labels) {
+					t.Errorf("Expected index metadata to match the new object, got %+v", md)
+				}
+			}
+
 			// assert error
 			if test.errorExpected && err == nil {
 				t.Error("Expected error, got nil")
@@ -718,6 +754,187 @@ func TestS3Write(t *testing.T) {
 	}
 }
 
+func TestS3WriteStream(t *testing.T) {
+	newObject := &object.NewObjectInfo{
+		Name:        "File1",
+		Version:     "V1",
+		Operation:   "w",
+		Created:     time1,
+		ContentType: "text/openEhrXml",
+		Labels:      []string{"vitalSign"},
+	}
+	checksum := "0bKln76n4gB3r5-Rsn6V6GUGGycL4D_1Oas7c1h4gug="
+	key := "File1.V1.w.1516288966123." + checksum
+
+	testCases := []struct {
+		description   string
+		calls         func(*mock.MockMinio, *mock.MockKeyProvider) []*gomock.Call
+		errorExpected bool
+	}{
+		{
+			"valid call",
+			func(m *mock.MockMinio, k *mock.MockKeyProvider) []*gomock.Call {
+				return []*gomock.Call{
+					k.EXPECT().Get("BUCKET").Return("SECRET", nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any(), int64(-1), gomock.Any()).
+						Do(func(_ context.Context, _, _ string, r io.Reader, _ int64, _ minio.PutObjectOptions) {
+							ioutil.ReadAll(r)
+						}).
+						Return(int64(8), nil),
+					k.EXPECT().Get("BUCKET").Return("SECRET", nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", sidecarKey(key), gomock.Any(), int64(-1), gomock.Any()).
+						Return(int64(0), nil),
+					m.EXPECT().CopyObject(gomock.Any(), gomock.Any()).Return(nil),
+					m.EXPECT().RemoveObject("BUCKET", gomock.Any()).Return(nil),
+				}
+			},
+			noErrors,
+		},
+		{
+			"upload fails",
+			func(m *mock.MockMinio, k *mock.MockKeyProvider) []*gomock.Call {
+				return []*gomock.Call{
+					k.EXPECT().Get("BUCKET").Return("SECRET", nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any(), int64(-1), gomock.Any()).
+						Return(int64(0), errors.New("Error")),
+					m.EXPECT().RemoveObject("BUCKET", gomock.Any()).Return(nil),
+				}
+			},
+			withErrors,
+		},
+		{
+			"copy fails",
+			func(m *mock.MockMinio, k *mock.MockKeyProvider) []*gomock.Call {
+				return []*gomock.Call{
+					k.EXPECT().Get("BUCKET").Return("SECRET", nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", gomock.Any(), gomock.Any(), int64(-1), gomock.Any()).
+						Do(func(_ context.Context, _, _ string, r io.Reader, _ int64, _ minio.PutObjectOptions) {
+							ioutil.ReadAll(r)
+						}).
+						Return(int64(0), nil),
+					k.EXPECT().Get("BUCKET").Return("SECRET", nil),
+					m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", sidecarKey(key), gomock.Any(), int64(-1), gomock.Any()).
+						Return(int64(0), nil),
+					m.EXPECT().CopyObject(gomock.Any(), gomock.Any()).Return(errors.New("Error")),
+					m.EXPECT().RemoveObject("BUCKET", sidecarKey(key)).Return(nil),
+					m.EXPECT().RemoveObject("BUCKET", gomock.Any()).Return(nil),
+				}
+			},
+			withErrors,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			// init storage
+			s, m, k, c := getTestStorage(t)
+			defer c()
+
+			// setup calls
+			gomock.InOrder(test.calls(m, k)...)
+
+			fd, err := s.WriteStream(context.TODO(), "BUCKET", newObject, bytes.NewBufferString("contents"))
+
+			// assert error
+			if test.errorExpected {
+				if err == nil {
+					t.Error("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected error to be nil, got %v", err)
+			}
+
+			// checksum and size are calculated while uploading
+			if fd.Checksum != checksum || fd.Size != 8 {
+				t.Errorf("Expected checksum '%s' and size 8, got '%s' and %d", checksum, fd.Checksum, fd.Size)
+			}
+			if _, err := metadataFromIndex(s.index, "BUCKET", key); err != nil {
+				t.Errorf("Expected metadata to be found in the index, got %v", err)
+			}
+		})
+	}
+}
+
+func TestS3ListIndexed(t *testing.T) {
+	s, m, _, c := getTestStorage(t)
+	defer c()
+
+	info := minio.ObjectInfo{Key: "File1.V1.w.1516288966123.CHS", Size: 8}
+	infos := make(chan minio.ObjectInfo, 1)
+	infos <- info
+	close(infos)
+
+	m.EXPECT().BucketExists("BUCKET").Return(true, nil).Times(2)
+	m.EXPECT().ListObjectsV2("BUCKET", "PREFIX", false, gomock.Any()).Return(infos)
+
+	// record is missing in the index, object is skipped
+	list, err := s.List(context.TODO(), "BUCKET", "PREFIX")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if len(list) != 0 {
+		t.Errorf("Expected list to be empty, got %+v", list)
+	}
+
+	infos = make(chan minio.ObjectInfo, 1)
+	infos <- info
+	close(infos)
+	m.EXPECT().ListObjectsV2("BUCKET", "PREFIX", false, gomock.Any()).Return(infos)
+
+	s.index.Update("BUCKET", info.Key, []byte(`{"layout":2,"contentType":"text/openEhrXml","archetype":"openEHR-EHR-OBSERVATION.blood_pressure.v1","labels":["vitalSign"]}`))
+	list, err = s.List(context.TODO(), "BUCKET", "PREFIX")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if !reflect.DeepEqual(list, []*models.FileDescriptor{file1V1}) {
+		t.Errorf("Expected list to equal\n%+v\ngot\n%+v", []*models.FileDescriptor{file1V1}, list)
+	}
+}
+
+func TestS3Migrate(t *testing.T) {
+	s, m, k, c := getTestStorage(t)
+	defer c()
+
+	indexedKey := "File1.V2.w.1516979775123.CHS"
+	s.index.Update("BUCKET", indexedKey, []byte(`{"layout":2}`))
+
+	infos := make(chan minio.ObjectInfo, 2)
+	infos <- info1V1
+	infos <- minio.ObjectInfo{Key: indexedKey, Size: 8}
+	close(infos)
+
+	rc := noopCloser{bytes.NewBuffer([]byte("contents"))}
+	gomock.InOrder(
+		m.EXPECT().BucketExists("BUCKET").Return(true, nil),
+		m.EXPECT().ListObjectsV2("BUCKET", "", false, gomock.Any()).Return(infos),
+		k.EXPECT().Get("BUCKET").Return("SECRET", nil),
+		k.EXPECT().Get("BUCKET").Return("SECRET", nil),
+		m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", ".meta-File1.V1.w.1516288966123.CHS", gomock.Any(), int64(-1), gomock.Any()).Return(int64(0), nil),
+		k.EXPECT().Get("BUCKET").Return("SECRET", nil),
+		m.EXPECT().GetObjectWithContext(gomock.Any(), "BUCKET", info1V1.Key, gomock.Any()).Return(rc, nil),
+		m.EXPECT().PutObjectWithContext(gomock.Any(), "BUCKET", "File1.V1.w.1516288966123.CHS", rc, int64(-1), gomock.Any()).Return(int64(8), nil),
+		m.EXPECT().RemoveObject("BUCKET", info1V1.Key).Return(nil),
+	)
+
+	migrated, err := s.Migrate(context.TODO(), "BUCKET")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if migrated != 1 {
+		t.Errorf("Expected 1 migrated file, got %d", migrated)
+	}
+
+	md, err := metadataFromIndex(s.index, "BUCKET", "File1.V1.w.1516288966123.CHS")
+	if err != nil {
+		t.Fatalf("Expected metadata to be found in the index, got %v", err)
+	}
+	if !reflect.DeepEqual(md.fileDescriptor("BUCKET", 8), file1V1) {
+		t.Errorf("Expected migrated metadata to equal\n%+v\ngot\n%+v", file1V1, md.fileDescriptor("BUCKET", 8))
+	}
+}
+
 func printJson(item interface{}) {
 	enc := json.NewEncoder(os.Stdout)
 	_ = enc.Encode(item)
@@ -0,0 +1,85 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// sidecarPrefix prefixes keys of objects holding metadata of the object stored
+// under the rest of the key; such objects are never listed
+const sidecarPrefix = ".meta-"
+
+// sidecarRecord holds metadata not kept in the object key. It is stored next to
+// the object so the metadata index can be rebuilt from the storage alone; the
+// index remains the source of metadata when files are listed or read. New
+// fields can be added freely as with indexRecord.
+type sidecarRecord struct {
+	ContentType string   `json:"contentType,omitempty"`
+	Archetype   string   `json:"archetype,omitempty"`
+	Labels      []string `json:"labels,omitempty"`
+}
+
+// sidecarKey returns the key of the object's sidecar
+func sidecarKey(objectKey string) string {
+	return sidecarPrefix + objectKey
+}
+
+// sidecarSecret returns the key sidecars of the bucket are encrypted with. The
+// legacy key of the bucket is never rotated so sidecars stay readable whatever
+// key their object is encrypted with.
+func sidecarSecret(keys KeyProvider, bucketID string) (string, error) {
+	return fileKey(keys, bucketID, &metadata{})
+}
+
+// writeSidecar stores metadata of the file not kept in the object key next to
+// its object
+func writeSidecar(ctx context.Context, objects keyedObjects, keys KeyProvider, bucketID string, md *metadata) error {
+	secret, err := sidecarSecret(keys, bucketID)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get the key")
+	}
+
+	value, err := json.Marshal(&sidecarRecord{
+		ContentType: md.contentType,
+		Archetype:   md.archetype,
+		Labels:      md.labels,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode sidecar record")
+	}
+
+	return objects.writeObject(ctx, bucketID, sidecarKey(md.String()), secret, bytes.NewReader(value))
+}
+
+// readSidecar fills the metadata with values stored next to the object
+func readSidecar(ctx context.Context, objects keyedObjects, keys KeyProvider, bucketID, objectKey string, md *metadata) error {
+	secret, err := sidecarSecret(keys, bucketID)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get the key")
+	}
+
+	body, err := objects.readObject(ctx, bucketID, sidecarKey(objectKey), secret)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	value, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	r := &sidecarRecord{}
+	if err := json.Unmarshal(value, r); err != nil {
+		return errors.Wrap(err, "Failed to decode sidecar record")
+	}
+	md.contentType = r.ContentType
+	md.archetype = r.Archetype
+	md.labels = r.Labels
+
+	return nil
+}
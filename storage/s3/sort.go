@@ -1,11 +1,9 @@
 package s3
 
-import "github.com/iryonetwork/wwm/gen/storage/models"
+// entriesByCreated implements sort.Interface for []*objectEntry based on
+// the created metadata field.
+type entriesByCreated []*objectEntry
 
-// byCreated implements sort.Interface for []*model.FileDescriptor based on
-// the Created field.
-type byCreated []*models.FileDescriptor
-
-func (c byCreated) Len() int           { return len(c) }
-func (c byCreated) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
-func (c byCreated) Less(i, j int) bool { return c[i].Created.String() > c[j].Created.String() }
+func (c entriesByCreated) Len() int           { return len(c) }
+func (c entriesByCreated) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c entriesByCreated) Less(i, j int) bool { return c[i].md.created.After(c[j].md.created) }
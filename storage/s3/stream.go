@@ -0,0 +1,48 @@
+package s3
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+)
+
+// tmpPrefix is used for objects that are still being written; such objects
+// are never listed
+const tmpPrefix = ".tmp-"
+
+// hashReader calculates checksum and size of contents read through it so files
+// can be written without knowing either in advance
+type hashReader struct {
+	r    io.Reader
+	hash hash.Hash
+	size int64
+}
+
+func newHashReader(r io.Reader) *hashReader {
+	return &hashReader{r: r, hash: sha256.New()}
+}
+
+func (h *hashReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	h.size += int64(n)
+	return n, err
+}
+
+// checksum returns base64 URL encoded sha256 checksum of contents read so far
+func (h *hashReader) checksum() string {
+	return base64.URLEncoding.EncodeToString(h.hash.Sum(nil))
+}
+
+// tmpObjectKey returns a random key of a temporary object
+func tmpObjectKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+
+	return tmpPrefix + hex.EncodeToString(b), nil
+}
@@ -21,22 +21,28 @@ type syncError struct {
 
 type batchStorageSync struct {
 	handlers          storageSync.Handlers
+	listBuckets       bucketLister
+	detectConflicts   bool
 	logger            zerolog.Logger
 	metricsCollection map[metrics.ID]prometheus.Collector
 }
 
+// bucketLister returns IDs of the buckets to sync with the time after which
+// their files need to be synced
+type bucketLister func(ctx context.Context, lastSuccessfulRun time.Time) (map[string]time.Time, error)
+
 const syncSeconds metrics.ID = "syncSeconds"
+const conflicts metrics.ID = "conflicts"
 
 func (s *batchStorageSync) Sync(ctx context.Context, lastSuccessfulRun time.Time) error {
-	buckets, err := s.handlers.ListSourceBuckets(ctx)
+	buckets, err := s.listBuckets(ctx, lastSuccessfulRun)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("failed to list source buckets")
-		return errors.Wrap(err, "failed to list source buckets")
+		return err
 	}
 
 	ch := make(chan *syncError)
-	for _, b := range buckets {
-		go s.syncBucket(ctx, lastSuccessfulRun, b.Name, ch)
+	for bucketID, since := range buckets {
+		go s.syncBucket(ctx, since, bucketID, ch)
 	}
 
 	var errCount int
@@ -61,7 +67,16 @@ func (s *batchStorageSync) GetPrometheusMetricsCollection() map[metrics.ID]prome
 	return s.metricsCollection
 }
 
+// New returns BatchSync syncing all the buckets of the source storage to the
+// destination storage.
 func New(handlers storageSync.Handlers, logger zerolog.Logger) storageSync.BatchSync {
+	s := newBatchStorageSync(handlers, logger)
+	s.listBuckets = s.sourceBuckets
+
+	return s
+}
+
+func newBatchStorageSync(handlers storageSync.Handlers, logger zerolog.Logger) *batchStorageSync {
 	logger = logger.With().Str("component", "sync/storage/batch").Logger()
 
 	metricsCollection := make(map[metrics.ID]prometheus.Collector)
@@ -72,6 +87,13 @@ func New(handlers storageSync.Handlers, logger zerolog.Logger) storageSync.Batch
 	}, []string{"operation", "success", "result"})
 	metricsCollection[syncSeconds] = h
 
+	c := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "batch",
+		Name:      "file_conflicts_total",
+		Help:      "Number of files with new versions written in both source and destination storage",
+	})
+	metricsCollection[conflicts] = c
+
 	return &batchStorageSync{
 		handlers:          handlers,
 		logger:            logger,
@@ -79,6 +101,22 @@ func New(handlers storageSync.Handlers, logger zerolog.Logger) storageSync.Batch
 	}
 }
 
+// sourceBuckets returns all the buckets of the source storage
+func (s *batchStorageSync) sourceBuckets(ctx context.Context, lastSuccessfulRun time.Time) (map[string]time.Time, error) {
+	buckets, err := s.handlers.ListSourceBuckets(ctx)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to list source buckets")
+		return nil, errors.Wrap(err, "failed to list source buckets")
+	}
+
+	since := make(map[string]time.Time, len(buckets))
+	for _, b := range buckets {
+		since[b.Name] = lastSuccessfulRun
+	}
+
+	return since, nil
+}
+
 func (s *batchStorageSync) syncBucket(ctx context.Context, lastSuccessfulRun time.Time, bucketID string, errCh chan *syncError) {
 	files, err := s.handlers.ListSourceFilesAsc(ctx, bucketID)
 	if err != nil {
@@ -122,6 +160,10 @@ func (s *batchStorageSync) syncFile(ctx context.Context, lastSuccessfulRun time.
 		return
 	}
 
+	if s.detectConflicts {
+		s.checkConflict(ctx, bucketID, fileID, versions, lastSuccessfulRun)
+	}
+
 	var syncCount int
 	var errCount int
 
@@ -170,7 +212,15 @@ func (s *batchStorageSync) syncFileVersion(ctx context.Context, bucketID, fileID
 		result, err = s.handlers.SyncFileDelete(ctx, bucketID, fileID, f.Version, f.Created)
 	}
 
-	if err != nil {
+	if result == storageSync.ResultDeferred {
+		// run is not successful so the version is synced again by the next one
+		s.logger.Info().
+			Str("bucket", bucketID).
+			Str("file", fileID).
+			Str("version", f.Version).
+			Str("operation", string(f.Operation)).
+			Msg("sync deferred until sync window opens")
+	} else if err != nil {
 		s.logger.Error().Err(err).
 			Str("bucket", bucketID).
 			Str("file", fileID).
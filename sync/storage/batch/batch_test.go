@@ -351,6 +351,142 @@ func TestContextCancelled(t *testing.T) {
 	time.Sleep(time.Duration(50 * time.Millisecond))
 }
 
+func TestPull(t *testing.T) {
+	localFile1V2 := &models.FileDescriptor{
+		Checksum:  "CHS2",
+		Created:   time2,
+		Name:      "File1",
+		Path:      "Bucket1/File1/LV2",
+		Version:   "LV2",
+		Size:      8,
+		Operation: "w",
+	}
+
+	testCases := []struct {
+		description   string
+		linked        []string
+		linkedErr     error
+		mockCalls     func(*mock.MockHandlers) []*gomock.Call
+		errorExpected bool
+		exactError    error
+	}{
+		{
+			"Pull succesful",
+			[]string{bucket1.Name, bucket2.Name},
+			nil,
+			func(c *mock.MockHandlers) []*gomock.Call {
+				return []*gomock.Call{
+					// bucket2 is missing in destination so it is synced in full
+					c.EXPECT().
+						ListDestinationBuckets(gomock.Any()).
+						Return([]*models.BucketDescriptor{bucket1}, nil).
+						Times(1),
+					c.EXPECT().
+						ListSourceFilesAsc(gomock.Any(), bucket1.Name).
+						Return([]*models.FileDescriptor{file2V2, file1V3}, nil).
+						Times(1),
+					c.EXPECT().
+						ListSourceFilesAsc(gomock.Any(), bucket2.Name).
+						Return([]*models.FileDescriptor{file3V3}, nil).
+						Times(1),
+					c.EXPECT().
+						ListSourceFileVersionsAsc(gomock.Any(), bucket1.Name, file1V3.Name).
+						Return([]*models.FileDescriptor{file1V1, file1V2, file1V3}, nil).
+						Times(1),
+					// destination has its own new version of the file
+					c.EXPECT().
+						ListDestinationFileVersionsAsc(gomock.Any(), bucket1.Name, file1V3.Name).
+						Return([]*models.FileDescriptor{file1V1, localFile1V2}, nil).
+						Times(1),
+					c.EXPECT().
+						SyncFile(gomock.Any(), bucket1.Name, file1V2.Name, file1V2.Version, file1V2.Created).
+						Return(storageSync.ResultSynced, nil).
+						Times(1),
+					c.EXPECT().
+						SyncFileDelete(gomock.Any(), bucket1.Name, file1V3.Name, file1V3.Version, file1V3.Created).
+						Return(storageSync.ResultSynced, nil).
+						Times(1),
+					c.EXPECT().
+						ListSourceFileVersionsAsc(gomock.Any(), bucket2.Name, file3V3.Name).
+						Return([]*models.FileDescriptor{file3V1, file3V2, file3V3}, nil).
+						Times(1),
+					c.EXPECT().
+						ListDestinationFileVersionsAsc(gomock.Any(), bucket2.Name, file3V3.Name).
+						Return([]*models.FileDescriptor{}, nil).
+						Times(1),
+					c.EXPECT().
+						SyncFile(gomock.Any(), bucket2.Name, file3V1.Name, file3V1.Version, file3V1.Created).
+						Return(storageSync.ResultSynced, nil).
+						Times(1),
+					c.EXPECT().
+						SyncFile(gomock.Any(), bucket2.Name, file3V2.Name, file3V2.Version, file3V2.Created).
+						Return(storageSync.ResultSynced, nil).
+						Times(1),
+					c.EXPECT().
+						SyncFile(gomock.Any(), bucket2.Name, file3V3.Name, file3V3.Version, file3V3.Created).
+						Return(storageSync.ResultSynced, nil).
+						Times(1),
+				}
+			},
+			noErrors,
+			nil,
+		},
+		{
+			"Failed to list linked buckets",
+			nil,
+			errors.Errorf("fail"),
+			func(c *mock.MockHandlers) []*gomock.Call {
+				return []*gomock.Call{}
+			},
+			withErrors,
+			errors.Errorf("failed to list linked buckets: fail"),
+		},
+		{
+			"Failed to list destination buckets",
+			[]string{bucket1.Name},
+			nil,
+			func(c *mock.MockHandlers) []*gomock.Call {
+				return []*gomock.Call{
+					c.EXPECT().
+						ListDestinationBuckets(gomock.Any()).
+						Return(nil, errors.Errorf("fail")).
+						Times(1),
+				}
+			},
+			withErrors,
+			errors.Errorf("failed to list destination buckets: fail"),
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			h, cleanup := getMockHandlers(t)
+			defer cleanup()
+			linked := func(_ context.Context) ([]string, error) {
+				return test.linked, test.linkedErr
+			}
+			s := NewPull(h, linked, 24*time.Hour, zerolog.New(os.Stdout))
+
+			test.mockCalls(h)
+
+			// call sync; files created a day before the last run are synced
+			err := s.Sync(context.Background(), time.Time(time4))
+
+			// assert error
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+
+			// assert actual error
+			if test.exactError != nil && err.Error() != test.exactError.Error() {
+				t.Errorf("Expected error to equal '%v'; got %v", test.exactError, err)
+			}
+		})
+	}
+}
+
 func getMockHandlers(t *testing.T) (*mock.MockHandlers, func()) {
 	mockHandlersCtrl := gomock.NewController(t)
 	mockHandlers := mock.NewMockHandlers(mockHandlersCtrl)
@@ -0,0 +1,195 @@
+package batch
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/storage/keyvalue"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+)
+
+// changesPageSize is the number of changes requested in a single list call
+const changesPageSize = 500
+
+// Checkpoint keeps the sequence number of the last change synced by
+// incremental batch sync
+type Checkpoint interface {
+	// Load returns the sequence number, false is returned if there is none
+	Load() (int64, bool)
+	// Save stores the sequence number
+	Save(seq int64) error
+}
+
+type keyValueCheckpoint struct {
+	storage keyvalue.Storage
+	bucket  string
+	key     string
+}
+
+// KeyValueCheckpoint returns Checkpoint kept under the key in the bucket of
+// key value storage
+func KeyValueCheckpoint(storage keyvalue.Storage, bucket, key string) Checkpoint {
+	return &keyValueCheckpoint{storage: storage, bucket: bucket, key: key}
+}
+
+func (c *keyValueCheckpoint) Load() (int64, bool) {
+	value := c.storage.Get(c.bucket, c.key)
+	if value == nil {
+		return 0, false
+	}
+
+	seq, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
+
+func (c *keyValueCheckpoint) Save(seq int64) error {
+	return c.storage.Update(c.bucket, c.key, []byte(strconv.FormatInt(seq, 10)))
+}
+
+type incrementalStorageSync struct {
+	*batchStorageSync
+	checkpoint Checkpoint
+}
+
+// NewIncremental returns BatchSync syncing only the files changed in the
+// source storage since the checkpoint, following its change log. All the
+// buckets are synced as by New if there is no checkpoint yet, the change log
+// was reset or it is not available.
+func NewIncremental(handlers storageSync.Handlers, checkpoint Checkpoint, logger zerolog.Logger) storageSync.BatchSync {
+	s := newBatchStorageSync(handlers, logger)
+	s.listBuckets = s.sourceBuckets
+
+	return &incrementalStorageSync{batchStorageSync: s, checkpoint: checkpoint}
+}
+
+func (s *incrementalStorageSync) Sync(ctx context.Context, lastSuccessfulRun time.Time) error {
+	since, ok := s.checkpoint.Load()
+
+	changes, last, err := s.handlers.ListSourceChanges(ctx, since, changesPageSize)
+	switch {
+	case err == storageSync.ErrNoChangeLog:
+		s.logger.Warn().Msg("change log of source storage is not available, syncing all the buckets")
+		return s.batchStorageSync.Sync(ctx, lastSuccessfulRun)
+	case err != nil:
+		s.logger.Error().Err(err).Msg("failed to list source changes")
+		return errors.Wrap(err, "failed to list source changes")
+	case !ok || since > last:
+		// changes up to the latest one are covered by syncing all the buckets
+		s.logger.Info().Int64("since", since).Int64("last", last).Msg("no valid checkpoint, syncing all the buckets")
+		if err := s.batchStorageSync.Sync(ctx, lastSuccessfulRun); err != nil {
+			return err
+		}
+		return s.saveCheckpoint(last)
+	}
+
+	// checkpoint is held before the first deferred change while the
+	// following changes are synced; they are synced again by the next run
+	// without transferring the files
+	var deferred bool
+	for {
+		for _, c := range changes {
+			select {
+			case <-ctx.Done():
+				s.saveCheckpoint(since)
+				s.logger.Error().Int64("sequence", c.Sequence).Msg("aborting changes sync due to context cancellation")
+				return errors.Wrap(ctx.Err(), "aborting changes sync due to context cancellation")
+			default:
+			}
+
+			err := s.syncChange(ctx, c)
+			switch {
+			case err == storageSync.ErrDeferred:
+				deferred = true
+			case err != nil:
+				// the change is synced again on the next run
+				s.saveCheckpoint(since)
+				return errors.Wrapf(err, "failed to sync change %d", c.Sequence)
+			case !deferred:
+				since = c.Sequence
+			}
+			last = c.Sequence
+		}
+
+		if err := s.saveCheckpoint(since); err != nil {
+			return err
+		}
+		if len(changes) < changesPageSize {
+			return nil
+		}
+
+		changes, _, err = s.handlers.ListSourceChanges(ctx, last, changesPageSize)
+		if err != nil {
+			s.logger.Error().Err(err).Msg("failed to list source changes")
+			return errors.Wrap(err, "failed to list source changes")
+		}
+	}
+}
+
+// syncChange syncs the change to the destination storage; changes that can
+// not be synced because of a conflict are skipped and ErrDeferred is returned
+// for changes that can not be synced now
+func (s *incrementalStorageSync) syncChange(ctx context.Context, c *models.Change) error {
+	// Make sure we record duration metrics even if processing fails, set default values for labels
+	start := time.Now()
+	success := false
+	result := storageSync.ResultSyncNotNeeded
+	defer func() {
+		duration := time.Since(start)
+		s.metricsCollection[syncSeconds].(*prometheus.HistogramVec).
+			With(prometheus.Labels{"operation": c.Type, "success": fmt.Sprintf("%t", success), "result": string(result)}).
+			Observe(duration.Seconds())
+	}()
+
+	var err error
+	switch storageSync.EventType(c.Type) {
+	case storageSync.FileNew, storageSync.FileUpdate:
+		result, err = s.handlers.SyncFile(ctx, c.Bucket, c.FileID, c.Version, c.Created)
+	case storageSync.FileDelete:
+		result, err = s.handlers.SyncFileDelete(ctx, c.Bucket, c.FileID, c.Version, c.Created)
+	case storageSync.FilePurge:
+		result, err = s.handlers.SyncFilePurge(ctx, c.Bucket, c.FileID, c.Version, c.Created)
+	}
+
+	logger := s.logger.With().
+		Int64("sequence", c.Sequence).
+		Str("bucket", c.Bucket).
+		Str("file", c.FileID).
+		Str("version", c.Version).
+		Str("operation", c.Type).
+		Logger()
+
+	switch {
+	case err == nil:
+		success = true
+		logger.Info().Msg("successfully synced")
+	case result == storageSync.ResultDeferred:
+		logger.Info().Msg("sync deferred until sync window opens")
+	case result == storageSync.ResultConflict:
+		// another attempt at sync would fail the same way
+		logger.Error().Err(err).Msg("skipping change that conflicts with destination storage")
+		err = nil
+	default:
+		logger.Error().Err(err).Msg("failed to sync")
+	}
+
+	return err
+}
+
+func (s *incrementalStorageSync) saveCheckpoint(seq int64) error {
+	if err := s.checkpoint.Save(seq); err != nil {
+		s.logger.Error().Err(err).Int64("sequence", seq).Msg("failed to save checkpoint")
+		return errors.Wrap(err, "failed to save checkpoint")
+	}
+
+	return nil
+}
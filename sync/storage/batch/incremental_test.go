@@ -0,0 +1,257 @@
+package batch
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	"github.com/iryonetwork/wwm/sync/storage/mock"
+)
+
+type testCheckpoint struct {
+	seq   int64
+	saved bool
+}
+
+func (c *testCheckpoint) Load() (int64, bool) {
+	return c.seq, c.saved
+}
+
+func (c *testCheckpoint) Save(seq int64) error {
+	c.seq = seq
+	c.saved = true
+	return nil
+}
+
+func TestIncremental(t *testing.T) {
+	change3 := &models.Change{Sequence: 3, Type: string(storageSync.FileUpdate), Bucket: bucket1.Name, FileID: file1V2.Name, Version: file1V2.Version, Created: file1V2.Created}
+	change4 := &models.Change{Sequence: 4, Type: string(storageSync.FileDelete), Bucket: bucket1.Name, FileID: file1V3.Name, Version: file1V3.Version, Created: file1V3.Created}
+	change5 := &models.Change{Sequence: 5, Type: string(storageSync.FilePurge), Bucket: bucket2.Name, FileID: file3V1.Name, Version: file3V1.Version, Created: file3V1.Created}
+
+	testCases := []struct {
+		description        string
+		checkpoint         *testCheckpoint
+		mockCalls          func(*mock.MockHandlers) []*gomock.Call
+		expectedCheckpoint int64
+		errorExpected      bool
+		exactError         error
+	}{
+		{
+			"Changes since checkpoint synced",
+			&testCheckpoint{2, true},
+			func(c *mock.MockHandlers) []*gomock.Call {
+				return []*gomock.Call{
+					c.EXPECT().
+						ListSourceChanges(gomock.Any(), int64(2), changesPageSize).
+						Return([]*models.Change{change3, change4, change5}, int64(5), nil).
+						Times(1),
+					c.EXPECT().
+						SyncFile(gomock.Any(), bucket1.Name, file1V2.Name, file1V2.Version, file1V2.Created).
+						Return(storageSync.ResultSynced, nil).
+						Times(1),
+					c.EXPECT().
+						SyncFileDelete(gomock.Any(), bucket1.Name, file1V3.Name, file1V3.Version, file1V3.Created).
+						Return(storageSync.ResultSynced, nil).
+						Times(1),
+					c.EXPECT().
+						SyncFilePurge(gomock.Any(), bucket2.Name, file3V1.Name, file3V1.Version, file3V1.Created).
+						Return(storageSync.ResultSynced, nil).
+						Times(1),
+				}
+			},
+			5,
+			noErrors,
+			nil,
+		},
+		{
+			"Conflicting change skipped",
+			&testCheckpoint{2, true},
+			func(c *mock.MockHandlers) []*gomock.Call {
+				return []*gomock.Call{
+					c.EXPECT().
+						ListSourceChanges(gomock.Any(), int64(2), changesPageSize).
+						Return([]*models.Change{change3, change4}, int64(4), nil).
+						Times(1),
+					c.EXPECT().
+						SyncFile(gomock.Any(), bucket1.Name, file1V2.Name, file1V2.Version, file1V2.Created).
+						Return(storageSync.ResultConflict, errors.Errorf("conflict")).
+						Times(1),
+					c.EXPECT().
+						SyncFileDelete(gomock.Any(), bucket1.Name, file1V3.Name, file1V3.Version, file1V3.Created).
+						Return(storageSync.ResultSynced, nil).
+						Times(1),
+				}
+			},
+			4,
+			noErrors,
+			nil,
+		},
+		{
+			"Deferred change holds checkpoint",
+			&testCheckpoint{2, true},
+			func(c *mock.MockHandlers) []*gomock.Call {
+				return []*gomock.Call{
+					c.EXPECT().
+						ListSourceChanges(gomock.Any(), int64(2), changesPageSize).
+						Return([]*models.Change{change3, change4}, int64(4), nil).
+						Times(1),
+					c.EXPECT().
+						SyncFile(gomock.Any(), bucket1.Name, file1V2.Name, file1V2.Version, file1V2.Created).
+						Return(storageSync.ResultDeferred, storageSync.ErrDeferred).
+						Times(1),
+					c.EXPECT().
+						SyncFileDelete(gomock.Any(), bucket1.Name, file1V3.Name, file1V3.Version, file1V3.Created).
+						Return(storageSync.ResultSynced, nil).
+						Times(1),
+				}
+			},
+			2,
+			noErrors,
+			nil,
+		},
+		{
+			"Failed change stops sync at the previous change",
+			&testCheckpoint{2, true},
+			func(c *mock.MockHandlers) []*gomock.Call {
+				return []*gomock.Call{
+					c.EXPECT().
+						ListSourceChanges(gomock.Any(), int64(2), changesPageSize).
+						Return([]*models.Change{change3, change4, change5}, int64(5), nil).
+						Times(1),
+					c.EXPECT().
+						SyncFile(gomock.Any(), bucket1.Name, file1V2.Name, file1V2.Version, file1V2.Created).
+						Return(storageSync.ResultSynced, nil).
+						Times(1),
+					c.EXPECT().
+						SyncFileDelete(gomock.Any(), bucket1.Name, file1V3.Name, file1V3.Version, file1V3.Created).
+						Return(storageSync.ResultError, errors.Errorf("fail")).
+						Times(1),
+				}
+			},
+			3,
+			withErrors,
+			errors.Errorf("failed to sync change 4: fail"),
+		},
+		{
+			"No checkpoint yet",
+			&testCheckpoint{},
+			func(c *mock.MockHandlers) []*gomock.Call {
+				return []*gomock.Call{
+					c.EXPECT().
+						ListSourceChanges(gomock.Any(), int64(0), changesPageSize).
+						Return([]*models.Change{change3}, int64(3), nil).
+						Times(1),
+					c.EXPECT().
+						ListSourceBuckets(gomock.Any()).
+						Return([]*models.BucketDescriptor{bucket2}, nil).
+						Times(1),
+					c.EXPECT().
+						ListSourceFilesAsc(gomock.Any(), bucket2.Name).
+						Return([]*models.FileDescriptor{file3V2}, nil).
+						Times(1),
+				}
+			},
+			3,
+			noErrors,
+			nil,
+		},
+		{
+			"Change log was reset",
+			&testCheckpoint{10, true},
+			func(c *mock.MockHandlers) []*gomock.Call {
+				return []*gomock.Call{
+					c.EXPECT().
+						ListSourceChanges(gomock.Any(), int64(10), changesPageSize).
+						Return([]*models.Change{}, int64(3), nil).
+						Times(1),
+					c.EXPECT().
+						ListSourceBuckets(gomock.Any()).
+						Return([]*models.BucketDescriptor{bucket2}, nil).
+						Times(1),
+					c.EXPECT().
+						ListSourceFilesAsc(gomock.Any(), bucket2.Name).
+						Return([]*models.FileDescriptor{file3V2}, nil).
+						Times(1),
+				}
+			},
+			3,
+			noErrors,
+			nil,
+		},
+		{
+			"Change log not available",
+			&testCheckpoint{2, true},
+			func(c *mock.MockHandlers) []*gomock.Call {
+				return []*gomock.Call{
+					c.EXPECT().
+						ListSourceChanges(gomock.Any(), int64(2), changesPageSize).
+						Return(nil, int64(0), storageSync.ErrNoChangeLog).
+						Times(1),
+					c.EXPECT().
+						ListSourceBuckets(gomock.Any()).
+						Return([]*models.BucketDescriptor{bucket2}, nil).
+						Times(1),
+					c.EXPECT().
+						ListSourceFilesAsc(gomock.Any(), bucket2.Name).
+						Return([]*models.FileDescriptor{file3V2}, nil).
+						Times(1),
+				}
+			},
+			2,
+			noErrors,
+			nil,
+		},
+		{
+			"Failed to list changes",
+			&testCheckpoint{2, true},
+			func(c *mock.MockHandlers) []*gomock.Call {
+				return []*gomock.Call{
+					c.EXPECT().
+						ListSourceChanges(gomock.Any(), int64(2), changesPageSize).
+						Return(nil, int64(0), errors.Errorf("fail")).
+						Times(1),
+				}
+			},
+			2,
+			withErrors,
+			errors.Errorf("failed to list source changes: fail"),
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			h, cleanup := getMockHandlers(t)
+			defer cleanup()
+			s := NewIncremental(h, test.checkpoint, zerolog.New(os.Stdout))
+
+			test.mockCalls(h)
+
+			// call sync; full sync only covers files created after the last run
+			err := s.Sync(context.Background(), time.Time(time4))
+
+			// assert error
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+
+			// assert actual error
+			if test.exactError != nil && err.Error() != test.exactError.Error() {
+				t.Errorf("Expected error to equal '%v'; got %v", test.exactError, err)
+			}
+
+			// assert checkpoint
+			if test.checkpoint.seq != test.expectedCheckpoint {
+				t.Errorf("Expected checkpoint to be %d, got %d", test.expectedCheckpoint, test.checkpoint.seq)
+			}
+		})
+	}
+}
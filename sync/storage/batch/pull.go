@@ -0,0 +1,121 @@
+package batch
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/storage/models"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+)
+
+// LinkedBuckets returns IDs of the buckets of patients linked to the location
+type LinkedBuckets func(ctx context.Context) ([]string, error)
+
+// NewPull returns BatchSync pulling files of patients linked to the location
+// from cloud storage to local storage; handlers need to use cloud storage as
+// the source and local storage as the destination. Files created since last
+// successful run less lookback are synced to cover files that reached cloud
+// storage late from other locations; buckets missing in local storage are
+// synced in full. Files with new versions written on both sides keep all the
+// versions, the latest created one being current.
+func NewPull(handlers storageSync.Handlers, linked LinkedBuckets, lookback time.Duration, logger zerolog.Logger) storageSync.BatchSync {
+	s := newBatchStorageSync(handlers, logger)
+	s.detectConflicts = true
+	s.listBuckets = func(ctx context.Context, lastSuccessfulRun time.Time) (map[string]time.Time, error) {
+		return s.linkedBuckets(ctx, linked, lastSuccessfulRun.Add(-lookback))
+	}
+
+	return s
+}
+
+// linkedBuckets returns linked buckets; buckets that exist in the destination
+// storage are synced since the time
+func (s *batchStorageSync) linkedBuckets(ctx context.Context, linked LinkedBuckets, since time.Time) (map[string]time.Time, error) {
+	bucketIDs, err := linked(ctx)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to list linked buckets")
+		return nil, errors.Wrap(err, "failed to list linked buckets")
+	}
+
+	existing, err := s.handlers.ListDestinationBuckets(ctx)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to list destination buckets")
+		return nil, errors.Wrap(err, "failed to list destination buckets")
+	}
+	exists := make(map[string]bool, len(existing))
+	for _, b := range existing {
+		exists[b.Name] = true
+	}
+
+	buckets := make(map[string]time.Time, len(bucketIDs))
+	for _, bucketID := range bucketIDs {
+		if exists[bucketID] {
+			buckets[bucketID] = since
+		} else {
+			// patient was linked since the last run
+			buckets[bucketID] = time.Time{}
+		}
+	}
+
+	return buckets, nil
+}
+
+// checkConflict logs the conflict if both source and destination storage
+// have new versions of the file since the latest version they share
+func (s *batchStorageSync) checkConflict(ctx context.Context, bucketID, fileID string, sourceVersions []*models.FileDescriptor, since time.Time) {
+	// only files with versions to sync can be in conflict
+	if len(sourceVersions) == 0 || !time.Time(sourceVersions[len(sourceVersions)-1].Created).After(since) {
+		return
+	}
+
+	destinationVersions, err := s.handlers.ListDestinationFileVersionsAsc(ctx, bucketID, fileID)
+	if err != nil {
+		s.logger.Error().Err(err).Str("bucket", bucketID).Str("file", fileID).Msg("failed to list destination versions")
+		return
+	}
+
+	inSource := make(map[string]bool, len(sourceVersions))
+	for _, v := range sourceVersions {
+		inSource[v.Version] = true
+	}
+	inDestination := make(map[string]bool, len(destinationVersions))
+	var shared time.Time
+	for _, v := range destinationVersions {
+		inDestination[v.Version] = true
+		if inSource[v.Version] && time.Time(v.Created).After(shared) {
+			shared = time.Time(v.Created)
+		}
+	}
+
+	sourceOnly := newVersionsMissingIn(sourceVersions, inDestination, shared)
+	destinationOnly := newVersionsMissingIn(destinationVersions, inSource, shared)
+	if len(sourceOnly) == 0 || len(destinationOnly) == 0 {
+		return
+	}
+
+	s.metricsCollection[conflicts].(prometheus.Counter).Inc()
+	s.logger.Warn().
+		Str("bucket", bucketID).
+		Str("file", fileID).
+		Str("sourceVersions", strings.Join(sourceOnly, ",")).
+		Str("destinationVersions", strings.Join(destinationOnly, ",")).
+		Msg("file has new versions in both storages, keeping all of them")
+}
+
+// newVersionsMissingIn returns versions created after the time that are not
+// in the set
+func newVersionsMissingIn(versions []*models.FileDescriptor, set map[string]bool, after time.Time) []string {
+	missing := []string{}
+	for _, v := range versions {
+		if !set[v.Version] && time.Time(v.Created).After(after) {
+			missing = append(missing, v.Version)
+		}
+	}
+
+	return missing
+}
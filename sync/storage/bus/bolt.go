@@ -0,0 +1,223 @@
+package bus
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/rs/zerolog"
+)
+
+// boltLockTimeout is the time to wait for another service to release the
+// database file
+const boltLockTimeout = 5 * time.Second
+
+// boltBatchSize is the maximum number of messages claimed by one poll
+const boltBatchSize = 100
+
+// boltBus keeps messages in bolt database file; each message is stored in
+// the bucket of its subject under its sequence number and prefixed with the
+// time until which it is claimed by a subscription. The file is opened only
+// for each operation so it can be shared by publishing and consuming services
+// running on the same host.
+type boltBus struct {
+	path         string
+	pollInterval time.Duration
+	logger       zerolog.Logger
+
+	mu   sync.Mutex
+	subs map[*boltSubscription]bool
+}
+
+type boltSubscription struct {
+	bus     *boltBus
+	subject string
+	ackWait time.Duration
+	handler MsgHandler
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewBolt returns the bus keeping messages in bolt database file. All the
+// subscriptions of a subject share a single queue; subscriptions poll for
+// new messages at the interval.
+func NewBolt(path string, pollInterval time.Duration, logger zerolog.Logger) (Bus, error) {
+	b := &boltBus{
+		path:         path,
+		pollInterval: pollInterval,
+		logger:       logger,
+		subs:         make(map[*boltSubscription]bool),
+	}
+
+	// make sure the database can be opened
+	if err := b.update(func(tx *bolt.Tx) error { return nil }); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Publish appends the message to the bucket of the subject
+func (b *boltBus) Publish(subject string, data []byte) error {
+	return b.update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists([]byte(subject))
+		if err != nil {
+			return err
+		}
+		seq, err := bkt.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		// zero claim time, message can be delivered right away
+		return bkt.Put(itob(seq), append(make([]byte, 8), data...))
+	})
+}
+
+// QueueSubscribe starts polling for messages of the subject
+func (b *boltBus) QueueSubscribe(subject, _ string, ackWait time.Duration, h MsgHandler) (Subscription, error) {
+	s := &boltSubscription{
+		bus:     b,
+		subject: subject,
+		ackWait: ackWait,
+		handler: h,
+		done:    make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	b.subs[s] = true
+	b.mu.Unlock()
+
+	go s.run()
+
+	return s, nil
+}
+
+// Close closes all the subscriptions
+func (b *boltBus) Close() error {
+	b.mu.Lock()
+	subs := b.subs
+	b.subs = make(map[*boltSubscription]bool)
+	b.mu.Unlock()
+
+	for s := range subs {
+		s.Close()
+	}
+
+	return nil
+}
+
+// update runs the function in a writable transaction of the database
+func (b *boltBus) update(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(b.path, 0600, &bolt.Options{Timeout: boltLockTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(fn)
+}
+
+// Close stops polling; messages claimed by the subscription are delivered
+// again once their ack wait expires
+func (s *boltSubscription) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+
+		s.bus.mu.Lock()
+		delete(s.bus.subs, s)
+		s.bus.mu.Unlock()
+	})
+
+	return nil
+}
+
+func (s *boltSubscription) run() {
+	ticker := time.NewTicker(s.bus.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		msgs, err := s.claim()
+		if err != nil {
+			s.bus.logger.Error().Err(err).Str("subject", s.subject).Msg("Failed to claim messages")
+		}
+		for _, msg := range msgs {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			s.handler(msg)
+		}
+
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim returns messages that are not claimed by other subscriptions and
+// claims them until their ack wait expires
+func (s *boltSubscription) claim() ([]*Msg, error) {
+	now := time.Now()
+	msgs := []*Msg{}
+
+	err := s.bus.update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(s.subject))
+		if bkt == nil {
+			return nil
+		}
+
+		claimed := map[string][]byte{}
+		c := bkt.Cursor()
+		for k, v := c.First(); k != nil && len(claimed) < boltBatchSize; k, v = c.Next() {
+			if time.Unix(0, int64(binary.BigEndian.Uint64(v[:8]))).After(now) {
+				continue
+			}
+
+			// values are valid only during the transaction
+			value := make([]byte, len(v))
+			copy(value, v)
+			binary.BigEndian.PutUint64(value[:8], uint64(now.Add(s.ackWait).UnixNano()))
+			claimed[string(k)] = value
+
+			key := append([]byte{}, k...)
+			msgs = append(msgs, &Msg{Subject: s.subject, Data: value[8:], ack: func() error { return s.ack(key) }})
+		}
+
+		// keys are not changed while iterating over the bucket
+		for k, v := range claimed {
+			if err := bkt.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return msgs, nil
+}
+
+// ack removes the message from the bucket
+func (s *boltSubscription) ack(key []byte) error {
+	return s.bus.update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(s.subject))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.Delete(key)
+	})
+}
+
+// itob returns 8-byte big endian representation of v so keys are sorted by
+// sequence number
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
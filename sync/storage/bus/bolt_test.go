@@ -0,0 +1,83 @@
+package bus
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestBolt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bus")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.db")
+
+	// publisher and consumer are separate services sharing the file
+	publisher, err := NewBolt(path, 10*time.Millisecond, zerolog.New(os.Stdout))
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	consumer, err := NewBolt(path, 10*time.Millisecond, zerolog.New(os.Stdout))
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	defer consumer.Close()
+
+	for _, data := range []string{"first", "second"} {
+		if err := publisher.Publish("file.new", []byte(data)); err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+	}
+	if err := publisher.Publish("file.delete", []byte("other")); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	received := make(chan *Msg, 10)
+	_, err = consumer.QueueSubscribe("file.new", "file.new", 50*time.Millisecond, func(msg *Msg) {
+		received <- msg
+	})
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	next := func() *Msg {
+		select {
+		case msg := <-received:
+			return msg
+		case <-time.After(time.Second):
+			t.Fatal("Message was not delivered during specified time")
+		}
+		return nil
+	}
+
+	// messages are delivered in order they were published
+	if msg := next(); string(msg.Data) != "first" {
+		t.Fatalf("Expected message 'first', got '%s'", msg.Data)
+	} else if err := msg.Ack(); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if msg := next(); string(msg.Data) != "second" {
+		t.Fatalf("Expected message 'second', got '%s'", msg.Data)
+	}
+
+	// message that was not acknowledged is delivered again
+	msg := next()
+	if string(msg.Data) != "second" {
+		t.Fatalf("Expected message 'second' to be redelivered, got '%s'", msg.Data)
+	}
+	if err := msg.Ack(); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	select {
+	case msg := <-received:
+		t.Fatalf("Expected no more messages, got '%s'", msg.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,94 @@
+// Package bus provides transports of storage sync events between publishers
+// and consumers
+package bus
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Transports of the bus
+const (
+	// TransportStan uses nats-streaming server
+	TransportStan = "stan"
+	// TransportBolt uses bolt database file shared by the services
+	TransportBolt = "bolt"
+)
+
+// Bus carries messages of subjects from publishers to queue subscriptions.
+// Messages are delivered at least once; each message is delivered to one
+// subscription of the queue and redelivered if it is not acknowledged in time.
+type Bus interface {
+	// Publish stores the message so it can be delivered to subscriptions.
+	Publish(subject string, data []byte) error
+	// QueueSubscribe starts durable subscription of the queue to messages
+	// of the subject.
+	QueueSubscribe(subject, queue string, ackWait time.Duration, h MsgHandler) (Subscription, error)
+	// Close closes subscriptions and the connection.
+	Close() error
+}
+
+// Subscription is a subscription to messages of a subject
+type Subscription interface {
+	// Close stops delivering messages to the subscription. Messages of
+	// durable subscriptions are kept until it is started again.
+	Close() error
+}
+
+// MsgHandler handles messages delivered to the subscription
+type MsgHandler func(msg *Msg)
+
+// Msg is a message delivered to the subscription
+type Msg struct {
+	Subject string
+	Data    []byte
+	ack     func() error
+}
+
+// Ack acknowledges the message so it is not delivered again
+func (m *Msg) Ack() error {
+	return m.ack()
+}
+
+// String returns the message formatted for logs
+func (m *Msg) String() string {
+	return fmt.Sprintf("%s: %s", m.Subject, m.Data)
+}
+
+// Cfg holds configuration of the connection to the bus
+type Cfg struct {
+	Transport string
+
+	// NATS connection used by stan transport
+	NatsAddr      string
+	NatsUsername  string
+	NatsSecret    string
+	NatsClusterID string
+	NatsClientID  string
+	CertPath      string
+	KeyPath       string
+
+	// bolt database used by bolt transport
+	BoltPath         string
+	BoltPollInterval time.Duration
+
+	ConnRetries    int
+	ConnWait       time.Duration
+	ConnWaitFactor float32
+}
+
+// Connect returns the bus using the transport set in configuration
+func Connect(cfg Cfg, logger zerolog.Logger) (Bus, error) {
+	logger = logger.With().Str("component", "sync/storage/bus").Str("transport", cfg.Transport).Logger()
+
+	switch cfg.Transport {
+	case TransportStan:
+		return connectStan(cfg, logger)
+	case TransportBolt:
+		return NewBolt(cfg.BoltPath, cfg.BoltPollInterval, logger)
+	}
+
+	return nil, fmt.Errorf("invalid event bus transport '%s'", cfg.Transport)
+}
@@ -0,0 +1,75 @@
+package bus
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/go-nats"
+	"github.com/nats-io/go-nats-streaming"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/utils"
+)
+
+type stanBus struct {
+	conn stan.Conn
+}
+
+// NewStan returns the bus using the nats-streaming connection; durable name
+// of subscriptions is the name of their queue
+func NewStan(conn stan.Conn) Bus {
+	return &stanBus{conn: conn}
+}
+
+// Publish publishes the message to nats-streaming
+func (b *stanBus) Publish(subject string, data []byte) error {
+	return b.conn.Publish(subject, data)
+}
+
+// QueueSubscribe starts nats-streaming queue subscription
+func (b *stanBus) QueueSubscribe(subject, queue string, ackWait time.Duration, h MsgHandler) (Subscription, error) {
+	return b.conn.QueueSubscribe(
+		subject,
+		queue,
+		func(m *stan.Msg) {
+			h(&Msg{Subject: m.Subject, Data: m.Data, ack: m.Ack})
+		},
+		stan.SetManualAckMode(),
+		stan.AckWait(ackWait),
+		stan.DurableName(queue),
+	)
+}
+
+// Close closes nats-streaming connection
+func (b *stanBus) Close() error {
+	return b.conn.Close()
+}
+
+func connectStan(cfg Cfg, logger zerolog.Logger) (Bus, error) {
+	URLs := fmt.Sprintf("tls://%s:%s@%s", cfg.NatsUsername, cfg.NatsSecret, cfg.NatsAddr)
+	var nc *nats.Conn
+	var sc stan.Conn
+
+	// retry connecting to nats if unsuccesful
+	err := utils.Retry(cfg.ConnRetries, cfg.ConnWait, cfg.ConnWaitFactor, logger.With().Str("connection", "nats").Logger(), func() error {
+		var err error
+		nc, err = nats.Connect(URLs, nats.ClientCert(cfg.CertPath, cfg.KeyPath))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// retry connecting to nats-streaming if unsuccesful
+	err = utils.Retry(cfg.ConnRetries, cfg.ConnWait, cfg.ConnWaitFactor, logger.With().Str("connection", "nats-streaming").Logger(), func() error {
+		var err error
+		sc, err = stan.Connect(cfg.NatsClusterID, cfg.NatsClientID, stan.NatsConn(nc))
+		return err
+	})
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	return NewStan(sc), nil
+}
@@ -0,0 +1,144 @@
+// Package conflicts parks storage sync conflicts for manual resolution
+package conflicts
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/agext/uuid"
+	bolt "github.com/coreos/bbolt"
+	"github.com/go-openapi/strfmt"
+
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+)
+
+// lockTimeout is the time to wait for another service to release the
+// database file
+const lockTimeout = 5 * time.Second
+
+var conflictsBucket = []byte("conflicts")
+
+// boltStore keeps conflicts in bolt database file. The file is opened only
+// for each operation so it can be shared by storageSync and batchStorageSync.
+type boltStore struct {
+	path string
+}
+
+// NewBolt returns ConflictStore keeping conflicts in the database file
+func NewBolt(path string) (storageSync.ConflictStore, error) {
+	s := &boltStore{path: path}
+
+	// make sure the database can be opened
+	err := s.update(func(b *bolt.Bucket) error { return nil })
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Park stores the conflict; conflict of the same file version that is already
+// parked is replaced keeping its ID
+func (s *boltStore) Park(c *storageSync.Conflict) error {
+	if time.Time(c.Detected).IsZero() {
+		c.Detected = strfmt.DateTime(time.Now())
+	}
+
+	return s.update(func(b *bolt.Bucket) error {
+		err := b.ForEach(func(k, v []byte) error {
+			existing := &storageSync.Conflict{}
+			if err := json.Unmarshal(v, existing); err != nil {
+				return err
+			}
+			if existing.BucketID == c.BucketID && existing.FileID == c.FileID && existing.Version == c.Version {
+				c.ID = existing.ID
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if c.ID == "" {
+			c.ID = uuid.NewCrypto().String()
+		}
+		value, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(c.ID), value)
+	})
+}
+
+// List returns all the parked conflicts ordered by the time they were detected
+func (s *boltStore) List() ([]*storageSync.Conflict, error) {
+	conflicts := []*storageSync.Conflict{}
+
+	err := s.update(func(b *bolt.Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			c := &storageSync.Conflict{}
+			if err := json.Unmarshal(v, c); err != nil {
+				return err
+			}
+			conflicts = append(conflicts, c)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		return time.Time(conflicts[i].Detected).Before(time.Time(conflicts[j].Detected))
+	})
+
+	return conflicts, nil
+}
+
+// Get returns the parked conflict
+func (s *boltStore) Get(id string) (*storageSync.Conflict, error) {
+	var c *storageSync.Conflict
+
+	err := s.update(func(b *bolt.Bucket) error {
+		v := b.Get([]byte(id))
+		if v == nil {
+			return storageSync.ErrConflictNotFound
+		}
+		c = &storageSync.Conflict{}
+		return json.Unmarshal(v, c)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Remove removes the conflict
+func (s *boltStore) Remove(id string) error {
+	return s.update(func(b *bolt.Bucket) error {
+		if b.Get([]byte(id)) == nil {
+			return storageSync.ErrConflictNotFound
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// update runs the function with the conflicts bucket in a writable
+// transaction of the database
+func (s *boltStore) update(fn func(b *bolt.Bucket) error) error {
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: lockTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(conflictsBucket)
+		if err != nil {
+			return err
+		}
+		return fn(b)
+	})
+}
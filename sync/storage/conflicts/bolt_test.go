@@ -0,0 +1,77 @@
+package conflicts
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-openapi/strfmt"
+
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+)
+
+var (
+	time1, _ = strfmt.ParseDateTime("2018-02-18T12:36:12.143Z")
+	time2, _ = strfmt.ParseDateTime("2018-02-19T12:36:12.143Z")
+)
+
+func TestBolt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conflicts")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewBolt(filepath.Join(dir, "conflicts.db"))
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	c1 := &storageSync.Conflict{BucketID: "bucket", FileID: "file1", Version: "V1", Detected: time2}
+	c2 := &storageSync.Conflict{BucketID: "bucket", FileID: "file2", Version: "V1", Detected: time1}
+	for _, c := range []*storageSync.Conflict{c1, c2} {
+		if err := s.Park(c); err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+		if c.ID == "" {
+			t.Fatal("Expected parked conflict to get ID")
+		}
+	}
+
+	// parking conflict of the same version again keeps its ID
+	again := &storageSync.Conflict{BucketID: "bucket", FileID: "file1", Version: "V1", SourceChecksum: "CHS", Detected: time2}
+	if err := s.Park(again); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if again.ID != c1.ID {
+		t.Fatalf("Expected conflict ID '%s', got '%s'", c1.ID, again.ID)
+	}
+
+	// conflicts are listed oldest first
+	list, err := s.List()
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if len(list) != 2 || list[0].ID != c2.ID || list[1].ID != c1.ID {
+		t.Fatalf("Expected conflicts [%s %s], got %+v", c2.ID, c1.ID, list)
+	}
+
+	c, err := s.Get(c1.ID)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if c.SourceChecksum != "CHS" {
+		t.Fatalf("Expected source checksum 'CHS', got '%s'", c.SourceChecksum)
+	}
+
+	if err := s.Remove(c1.ID); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if _, err := s.Get(c1.ID); err != storageSync.ErrConflictNotFound {
+		t.Fatalf("Expected error to be '%v', got %v", storageSync.ErrConflictNotFound, err)
+	}
+	if err := s.Remove(c1.ID); err != storageSync.ErrConflictNotFound {
+		t.Fatalf("Expected error to be '%v', got %v", storageSync.ErrConflictNotFound, err)
+	}
+}
@@ -0,0 +1,145 @@
+package conflicts
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-openapi/runtime/middleware"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/storageSync/models"
+	"github.com/iryonetwork/wwm/gen/storageSync/restapi/operations"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+)
+
+// Handlers describes the actions supported by the conflicts API
+type Handlers interface {
+	ConflictList() operations.ConflictListHandler
+	ConflictGet() operations.ConflictGetHandler
+	ConflictResolve() operations.ConflictResolveHandler
+}
+
+type handlers struct {
+	store  storageSync.ConflictStore
+	push   storageSync.Handlers
+	pull   storageSync.Handlers
+	logger zerolog.Logger
+}
+
+func (h *handlers) ConflictList() operations.ConflictListHandler {
+	return operations.ConflictListHandlerFunc(func(params operations.ConflictListParams, principal *string) middleware.Responder {
+		list, err := h.store.List()
+		if err != nil {
+			return operations.NewConflictListInternalServerError().WithPayload(&models.Error{
+				Code:    "server_error",
+				Message: err.Error(),
+			})
+		}
+
+		payload := make([]*models.Conflict, len(list))
+		for i, c := range list {
+			payload[i] = toModel(c)
+		}
+		return operations.NewConflictListOK().WithPayload(payload)
+	})
+}
+
+func (h *handlers) ConflictGet() operations.ConflictGetHandler {
+	return operations.ConflictGetHandlerFunc(func(params operations.ConflictGetParams, principal *string) middleware.Responder {
+		c, err := h.store.Get(params.ConflictID)
+		if err == storageSync.ErrConflictNotFound {
+			return operations.NewConflictGetNotFound().WithPayload(&models.Error{
+				Code:    "not_found",
+				Message: err.Error(),
+			})
+		} else if err != nil {
+			return operations.NewConflictGetInternalServerError().WithPayload(&models.Error{
+				Code:    "server_error",
+				Message: err.Error(),
+			})
+		}
+
+		return operations.NewConflictGetOK().WithPayload(toModel(c))
+	})
+}
+
+func (h *handlers) ConflictResolve() operations.ConflictResolveHandler {
+	return operations.ConflictResolveHandlerFunc(func(params operations.ConflictResolveParams, principal *string) middleware.Responder {
+		c, err := h.store.Get(params.ConflictID)
+		if err == storageSync.ErrConflictNotFound {
+			return operations.NewConflictResolveNotFound().WithPayload(&models.Error{
+				Code:    "not_found",
+				Message: err.Error(),
+			})
+		} else if err != nil {
+			return operations.NewConflictResolveInternalServerError().WithPayload(&models.Error{
+				Code:    "server_error",
+				Message: err.Error(),
+			})
+		}
+
+		// source and destination of the sync handlers must match the conflict
+		syncHandlers := h.push
+		if direction(c) == storageSync.DirectionPull {
+			syncHandlers = h.pull
+		}
+		if syncHandlers == nil {
+			return operations.NewConflictResolveConflict().WithPayload(&models.Error{
+				Code:    "conflict",
+				Message: fmt.Sprintf("Conflicts found by %s can not be resolved here", direction(c)),
+			})
+		}
+
+		_, err = syncHandlers.ResolveConflict(context.Background(), c, storageSync.Resolution(params.Resolution))
+		if err == nil {
+			err = h.store.Remove(c.ID)
+		}
+		if err != nil {
+			h.logger.Error().Err(err).Str("conflict", c.ID).Msg("Failed to resolve conflict")
+			return operations.NewConflictResolveInternalServerError().WithPayload(&models.Error{
+				Code:    "server_error",
+				Message: err.Error(),
+			})
+		}
+
+		return operations.NewConflictResolveNoContent()
+	})
+}
+
+// NewHandlers returns handlers of the conflicts API resolving conflicts
+// parked in the store; conflicts found by push are resolved by push handlers
+// and the ones found by pull by pull handlers. Conflicts are not resolved if
+// handlers of their direction are nil.
+func NewHandlers(store storageSync.ConflictStore, push, pull storageSync.Handlers, logger zerolog.Logger) Handlers {
+	return &handlers{
+		store:  store,
+		push:   push,
+		pull:   pull,
+		logger: logger.With().Str("component", "sync/storage/conflicts/handlers").Logger(),
+	}
+}
+
+func toModel(c *storageSync.Conflict) *models.Conflict {
+	return &models.Conflict{
+		ID:                  c.ID,
+		Direction:           string(direction(c)),
+		BucketID:            c.BucketID,
+		FileID:              c.FileID,
+		Version:             c.Version,
+		SourceChecksum:      c.SourceChecksum,
+		SourceCreated:       c.SourceCreated,
+		DestinationChecksum: c.DestinationChecksum,
+		DestinationCreated:  c.DestinationCreated,
+		Detected:            c.Detected,
+	}
+}
+
+// direction returns direction of the conflict; conflicts parked before it was
+// recorded were found by push
+func direction(c *storageSync.Conflict) storageSync.Direction {
+	if c.Direction == "" {
+		return storageSync.DirectionPush
+	}
+
+	return c.Direction
+}
@@ -6,12 +6,12 @@ import (
 	"sync"
 	"time"
 
-	"github.com/nats-io/go-nats-streaming"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 
 	"github.com/iryonetwork/wwm/metrics"
 	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	"github.com/iryonetwork/wwm/sync/storage/bus"
 )
 
 type contextKey string
@@ -20,30 +20,48 @@ const subID contextKey = "ID"
 const taskSeconds metrics.ID = "taskSeconds"
 
 type Cfg struct {
-	Connection stan.Conn
+	Connection bus.Bus
 	AckWait    time.Duration
 	Handlers   storageSync.Handlers
+	// MaxDeliveries is the number of failed deliveries after which the message
+	// is moved to dead letters; 0 disables dead letters
+	MaxDeliveries int
+	// DeadLetterAfter is the minimum time the message has to be failing before
+	// it is moved to dead letters, so outages do not move every message
+	DeadLetterAfter time.Duration
+	DeadLetters     storageSync.DeadLetterStore
 }
 
-type stanConsumer struct {
+// failure counts failed deliveries of the message
+type failure struct {
+	count int
+	first time.Time
+}
+
+type busConsumer struct {
 	ctx               context.Context
-	conn              stan.Conn
+	conn              bus.Bus
 	ackWait           time.Duration
 	handlers          storageSync.Handlers
-	subs              []stan.Subscription
+	maxDeliveries     int
+	deadLetterAfter   time.Duration
+	deadLetters       storageSync.DeadLetterStore
+	failures          map[string]*failure
+	failuresLock      sync.Mutex
+	subs              []bus.Subscription
 	subsLock          sync.Mutex
 	logger            zerolog.Logger
 	metricsCollection map[metrics.ID]prometheus.Collector
 }
 
-// Start starts new nats-streaming queue subscription.
-func (c *stanConsumer) StartSubscription(typ storageSync.EventType) error {
+// Start starts new event bus queue subscription.
+func (c *busConsumer) StartSubscription(typ storageSync.EventType) error {
 	c.subsLock.Lock()
 
 	// ID is a sequential number of subscription within consumer.
 	ID := len(c.subs) + 1
 	ctx := context.WithValue(c.ctx, subID, ID)
-	var mh stan.MsgHandler
+	var mh bus.MsgHandler
 	switch typ {
 	case storageSync.FileNew:
 		mh = c.getMsgHandler(ctx, typ, c.handlers.SyncFile)
@@ -51,26 +69,21 @@ func (c *stanConsumer) StartSubscription(typ storageSync.EventType) error {
 		mh = c.getMsgHandler(ctx, typ, c.handlers.SyncFile)
 	case storageSync.FileDelete:
 		mh = c.getMsgHandler(ctx, typ, c.handlers.SyncFileDelete)
+	case storageSync.FilePurge:
+		mh = c.getMsgHandler(ctx, typ, c.handlers.SyncFilePurge)
 	default:
 		c.subsLock.Unlock()
 		return fmt.Errorf("Invalid event type")
 	}
 
 	// Subscribe to subject:EventType, queueGroup:EventType, durableName:EventType
-	sub, err := c.conn.QueueSubscribe(
-		string(typ),
-		string(typ),
-		mh,
-		stan.SetManualAckMode(),
-		stan.AckWait(c.ackWait),
-		stan.DurableName(string(typ)),
-	)
+	sub, err := c.conn.QueueSubscribe(string(typ), string(typ), c.ackWait, mh)
 
 	if err != nil {
 		c.logger.Error().Err(err).
 			Str("subscription", fmt.Sprintf("%s:%d", typ, ID)).
 			Str("cmd", "StartSubscription").
-			Msg("Failed to start nats-streaming subscription")
+			Msg("Failed to start event bus subscription")
 	} else {
 		c.subs = append(c.subs, sub)
 	}
@@ -80,28 +93,28 @@ func (c *stanConsumer) StartSubscription(typ storageSync.EventType) error {
 }
 
 // Returns number of subscriptions within consumer instance.
-func (c *stanConsumer) GetNumberOfSubsriptions() int {
+func (c *busConsumer) GetNumberOfSubsriptions() int {
 	return len(c.subs)
 }
 
-// Close closes nats-streaming connection
-func (c *stanConsumer) Close() {
+// Close closes event bus connection
+func (c *busConsumer) Close() {
 	c.subsLock.Lock()
 	for _, sub := range c.subs {
 		sub.Close()
 	}
-	c.subs = []stan.Subscription{}
+	c.subs = []bus.Subscription{}
 	c.subsLock.Unlock()
 	c.conn.Close()
 }
 
 // GetPrometheusMetricsCollection returns all prometheus metrics collectors to be registered
-func (c *stanConsumer) GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector {
+func (c *busConsumer) GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector {
 	return c.metricsCollection
 }
 
-func (c *stanConsumer) getMsgHandler(ctx context.Context, typ storageSync.EventType, h storageSync.Handler) stan.MsgHandler {
-	return func(msg *stan.Msg) {
+func (c *busConsumer) getMsgHandler(ctx context.Context, typ storageSync.EventType, h storageSync.Handler) bus.MsgHandler {
+	return func(msg *bus.Msg) {
 		// Make sure we record duration metrics even if processing fails, set default values for labels
 		start := time.Now()
 		ack := false
@@ -127,10 +140,22 @@ func (c *stanConsumer) getMsgHandler(ctx context.Context, typ storageSync.EventT
 				Str("subscription", fmt.Sprintf("%s:%d", typ, ID)).
 				Msg("Failed to unmarshal message")
 
+			if c.fail(typ, msg, f, err) {
+				ack = true
+				msg.Ack()
+			}
 			return
 		}
 
 		result, err = h(ctx, f.BucketID, f.FileID, f.Version, f.Created)
+		if result == storageSync.ResultDeferred {
+			// message is delivered again after ack wait
+			c.logger.Debug().
+				Str("subscription", fmt.Sprintf("%s:%d", typ, ID)).
+				Str("cmd", "MsgHandler").
+				Msgf("Deferred message: %s", msg)
+			return
+		}
 		if err != nil {
 			c.logger.Error().Err(err).
 				Str("cmd", "MsgHandler").
@@ -141,6 +166,10 @@ func (c *stanConsumer) getMsgHandler(ctx context.Context, typ storageSync.EventT
 				// nothing can be done about this error, ack the message
 				ack = true
 				msg.Ack()
+				c.forget(msg)
+			} else if c.fail(typ, msg, f, err) {
+				ack = true
+				msg.Ack()
 			}
 
 			return
@@ -148,6 +177,7 @@ func (c *stanConsumer) getMsgHandler(ctx context.Context, typ storageSync.EventT
 
 		// Change ack and result variables values for metrics
 		ack = true
+		c.forget(msg)
 
 		// Acknowledge the message
 		msg.Ack()
@@ -158,7 +188,69 @@ func (c *stanConsumer) getMsgHandler(ctx context.Context, typ storageSync.EventT
 	}
 }
 
-// New returns new consumer service with provided nats-streaming connection as underlying backend.
+// fail counts failed delivery of the message and moves it to dead letters once
+// it failed MaxDeliveries times for at least DeadLetterAfter. Returns true if
+// the message was moved and should be acknowledged.
+func (c *busConsumer) fail(typ storageSync.EventType, msg *bus.Msg, f *storageSync.FileInfo, err error) bool {
+	if c.maxDeliveries <= 0 || c.deadLetters == nil {
+		return false
+	}
+
+	key := msg.String()
+	c.failuresLock.Lock()
+	fl, ok := c.failures[key]
+	if !ok {
+		fl = &failure{first: time.Now()}
+		c.failures[key] = fl
+	}
+	fl.count++
+	deliveries := fl.count
+	first := fl.first
+	c.failuresLock.Unlock()
+
+	if deliveries < c.maxDeliveries || time.Since(first) < c.deadLetterAfter {
+		return false
+	}
+
+	l := &storageSync.DeadLetter{
+		Type:       typ,
+		Data:       string(msg.Data),
+		BucketID:   f.BucketID,
+		FileID:     f.FileID,
+		Version:    f.Version,
+		Created:    f.Created,
+		Deliveries: deliveries,
+		Error:      err.Error(),
+	}
+	if storeErr := c.deadLetters.Add(l); storeErr != nil {
+		c.logger.Error().Err(storeErr).
+			Str("cmd", "MsgHandler").
+			Msgf("Failed to move message to dead letters: %s", msg)
+		return false
+	}
+
+	c.forget(msg)
+	c.logger.Error().Err(err).
+		Str("cmd", "MsgHandler").
+		Str("deadLetter", l.ID).
+		Int("deliveries", deliveries).
+		Msgf("Moved message to dead letters: %s", msg)
+
+	return true
+}
+
+// forget drops the count of failed deliveries of the message
+func (c *busConsumer) forget(msg *bus.Msg) {
+	if c.maxDeliveries <= 0 {
+		return
+	}
+
+	c.failuresLock.Lock()
+	delete(c.failures, msg.String())
+	c.failuresLock.Unlock()
+}
+
+// New returns new consumer service with provided event bus connection as underlying backend.
 func New(ctx context.Context, cfg Cfg, logger zerolog.Logger) storageSync.Consumer {
 	logger = logger.With().Str("component", "sync/storage/consumer").Logger()
 
@@ -170,11 +262,15 @@ func New(ctx context.Context, cfg Cfg, logger zerolog.Logger) storageSync.Consum
 	}, []string{"event", "ack", "result"})
 	metricsCollection[taskSeconds] = h
 
-	c := &stanConsumer{
+	c := &busConsumer{
 		ctx:               ctx,
 		conn:              cfg.Connection,
 		handlers:          cfg.Handlers,
 		ackWait:           cfg.AckWait,
+		maxDeliveries:     cfg.MaxDeliveries,
+		deadLetterAfter:   cfg.DeadLetterAfter,
+		deadLetters:       cfg.DeadLetters,
+		failures:          make(map[string]*failure),
 		logger:            logger,
 		metricsCollection: metricsCollection,
 	}
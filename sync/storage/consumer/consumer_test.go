@@ -17,6 +17,7 @@ import (
 	"github.com/rs/zerolog"
 
 	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	"github.com/iryonetwork/wwm/sync/storage/bus"
 	"github.com/iryonetwork/wwm/sync/storage/mock"
 	"github.com/iryonetwork/wwm/sync/storage/publisher"
 )
@@ -308,6 +309,60 @@ func TestMessageHandlingNack(t *testing.T) {
 	<-time.After(time.Duration(50 * time.Millisecond))
 }
 
+func TestMessageHandlingDeadLetter(t *testing.T) {
+	h, cleanHandlers := getMockHandlers(t)
+	defer cleanHandlers()
+	c, cleanService := getTestService(t, context.Background(), "Consumer", h)
+	defer cleanService()
+	p, cleanPublisher := getTestPublisher(t)
+	defer cleanPublisher()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	s := mock.NewMockDeadLetterStore(ctrl)
+	c.maxDeliveries = 2
+	c.deadLetters = s
+
+	// Expect handler to fail twice and message to be moved to dead letters
+	moved := make(chan bool)
+	h.EXPECT().
+		SyncFile(gomock.Any(), file1.BucketID, file1.FileID, file1.Version, time1).
+		Return(storageSync.ResultError, fmt.Errorf("error")).
+		Times(2)
+	s.EXPECT().
+		Add(gomock.Any()).
+		Return(nil).
+		Do(func(l *storageSync.DeadLetter) {
+			if l.Type != storageSync.FileNew || l.FileID != file1.FileID || l.Deliveries != 2 || l.Error != "error" {
+				t.Errorf("Unexpected dead letter %+v", l)
+			}
+			moved <- true
+		}).
+		Times(1)
+
+	// start consumer
+	err := c.StartSubscription(storageSync.FileNew)
+	if err != nil {
+		t.Fatal("Failed to start subscription")
+	}
+
+	err = p.Publish(context.Background(), storageSync.FileNew, file1)
+	if err != nil {
+		t.Fatal("Failed to publish to test nats-streaming server")
+	}
+
+	// Wait 1 second (minimum AckWait time) for redelivery.
+	select {
+	case <-moved:
+		// all good
+	case <-time.After(time.Duration(1100 * time.Millisecond)):
+		t.Fatal("Message was not moved to dead letters during specified time")
+	}
+
+	// wait to ensure message acked with dead letter is not delivered again
+	<-time.After(time.Duration(1100 * time.Millisecond))
+}
+
 func TestDurability(t *testing.T) {
 	h, cleanHandlers := getMockHandlers(t)
 	defer cleanHandlers()
@@ -423,7 +478,7 @@ func getMockHandlers(t *testing.T) (*mock.MockHandlers, func()) {
 	return mockHandlers, cleanup
 }
 
-func getTestService(t *testing.T, ctx context.Context, clientID string, h storageSync.Handlers) (*stanConsumer, func()) {
+func getTestService(t *testing.T, ctx context.Context, clientID string, h storageSync.Handlers) (*busConsumer, func()) {
 	conn, err := stan.Connect(clusterID, clientID)
 	if err != nil {
 		t.Fatal("Connection to test stan-straming server failed")
@@ -431,7 +486,7 @@ func getTestService(t *testing.T, ctx context.Context, clientID string, h storag
 
 	// initalize consumer
 	cfg := Cfg{
-		Connection: conn,
+		Connection: bus.NewStan(conn),
 		AckWait:    time.Duration(time.Second),
 		Handlers:   h,
 	}
@@ -442,7 +497,7 @@ func getTestService(t *testing.T, ctx context.Context, clientID string, h storag
 		c.Close()
 	}
 
-	return c.(*stanConsumer), cleanup
+	return c.(*busConsumer), cleanup
 }
 
 func getTestPublisher(t *testing.T) (storageSync.Publisher, func()) {
@@ -452,7 +507,7 @@ func getTestPublisher(t *testing.T) (storageSync.Publisher, func()) {
 	}
 
 	cfg := publisher.Cfg{
-		Connection:      conn,
+		Connection:      bus.NewStan(conn),
 		Retries:         5,
 		StartRetryWait:  time.Duration(time.Millisecond),
 		RetryWaitFactor: 1.0,
@@ -0,0 +1,132 @@
+// Package deadletters keeps storage sync events that repeatedly failed to be
+// handled so they can be inspected and replayed or discarded
+package deadletters
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/agext/uuid"
+	bolt "github.com/coreos/bbolt"
+	"github.com/go-openapi/strfmt"
+
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+)
+
+// lockTimeout is the time to wait for another process to release the
+// database file
+const lockTimeout = 5 * time.Second
+
+var deadLettersBucket = []byte("deadLetters")
+
+// boltStore keeps dead letters in bolt database file. The file is opened only
+// for each operation so it can be shared by the service and the command line.
+type boltStore struct {
+	path string
+}
+
+// NewBolt returns DeadLetterStore keeping dead letters in the database file
+func NewBolt(path string) (storageSync.DeadLetterStore, error) {
+	s := &boltStore{path: path}
+
+	// make sure the database can be opened
+	err := s.update(func(b *bolt.Bucket) error { return nil })
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Add stores the dead letter; ID and the time of failure are set if they are
+// missing
+func (s *boltStore) Add(l *storageSync.DeadLetter) error {
+	if l.ID == "" {
+		l.ID = uuid.NewCrypto().String()
+	}
+	if time.Time(l.Failed).IsZero() {
+		l.Failed = strfmt.DateTime(time.Now())
+	}
+
+	value, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	return s.update(func(b *bolt.Bucket) error {
+		return b.Put([]byte(l.ID), value)
+	})
+}
+
+// List returns all the dead letters ordered by the time they failed
+func (s *boltStore) List() ([]*storageSync.DeadLetter, error) {
+	letters := []*storageSync.DeadLetter{}
+
+	err := s.update(func(b *bolt.Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			l := &storageSync.DeadLetter{}
+			if err := json.Unmarshal(v, l); err != nil {
+				return err
+			}
+			letters = append(letters, l)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(letters, func(i, j int) bool {
+		return time.Time(letters[i].Failed).Before(time.Time(letters[j].Failed))
+	})
+
+	return letters, nil
+}
+
+// Get returns the dead letter
+func (s *boltStore) Get(id string) (*storageSync.DeadLetter, error) {
+	var l *storageSync.DeadLetter
+
+	err := s.update(func(b *bolt.Bucket) error {
+		v := b.Get([]byte(id))
+		if v == nil {
+			return storageSync.ErrDeadLetterNotFound
+		}
+		l = &storageSync.DeadLetter{}
+		return json.Unmarshal(v, l)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Remove removes the dead letter
+func (s *boltStore) Remove(id string) error {
+	return s.update(func(b *bolt.Bucket) error {
+		if b.Get([]byte(id)) == nil {
+			return storageSync.ErrDeadLetterNotFound
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// update runs the function with the dead letters bucket in a writable
+// transaction of the database
+func (s *boltStore) update(fn func(b *bolt.Bucket) error) error {
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: lockTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(deadLettersBucket)
+		if err != nil {
+			return err
+		}
+		return fn(b)
+	})
+}
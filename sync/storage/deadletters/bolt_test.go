@@ -0,0 +1,170 @@
+package deadletters
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/golang/mock/gomock"
+
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+	"github.com/iryonetwork/wwm/sync/storage/mock"
+)
+
+var (
+	time1, _ = strfmt.ParseDateTime("2018-02-18T12:36:12.143Z")
+	time2, _ = strfmt.ParseDateTime("2018-02-19T12:36:12.143Z")
+)
+
+func TestBolt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletters")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewBolt(filepath.Join(dir, "deadLetters.db"))
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	l1 := &storageSync.DeadLetter{Type: storageSync.FileNew, FileID: "file1", Failed: time2}
+	l2 := &storageSync.DeadLetter{Type: storageSync.FileDelete, FileID: "file2", Failed: time1}
+	for _, l := range []*storageSync.DeadLetter{l1, l2} {
+		if err := s.Add(l); err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+		if l.ID == "" {
+			t.Fatal("Expected added dead letter to get ID")
+		}
+	}
+
+	// dead letters are listed oldest first
+	list, err := s.List()
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if len(list) != 2 || list[0].ID != l2.ID || list[1].ID != l1.ID {
+		t.Fatalf("Expected dead letters [%s %s], got %+v", l2.ID, l1.ID, list)
+	}
+
+	// dead letter with the same ID is replaced
+	l1.Error = "failed again"
+	if err := s.Add(l1); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	l, err := s.Get(l1.ID)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if l.Error != "failed again" {
+		t.Fatalf("Expected error 'failed again', got '%s'", l.Error)
+	}
+
+	if err := s.Remove(l1.ID); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if _, err := s.Get(l1.ID); err != storageSync.ErrDeadLetterNotFound {
+		t.Fatalf("Expected error to be '%v', got %v", storageSync.ErrDeadLetterNotFound, err)
+	}
+	if err := s.Remove(l1.ID); err != storageSync.ErrDeadLetterNotFound {
+		t.Fatalf("Expected error to be '%v', got %v", storageSync.ErrDeadLetterNotFound, err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	testCases := []struct {
+		description    string
+		calls          func(*mock.MockHandlers) []*gomock.Call
+		errorExpected  bool
+		expectedResult storageSync.SyncResult
+		expectedKept   bool
+	}{
+		{
+			"Replay succeeds",
+			func(h *mock.MockHandlers) []*gomock.Call {
+				return []*gomock.Call{
+					h.EXPECT().SyncFile(gomock.Any(), "bucket", "file", "V1", time1).Return(storageSync.ResultSynced, nil),
+				}
+			},
+			false,
+			storageSync.ResultSynced,
+			false,
+		},
+		{
+			"Replay finds conflict",
+			func(h *mock.MockHandlers) []*gomock.Call {
+				return []*gomock.Call{
+					h.EXPECT().SyncFile(gomock.Any(), "bucket", "file", "V1", time1).Return(storageSync.ResultConflict, errors.New("conflict")),
+				}
+			},
+			false,
+			storageSync.ResultConflict,
+			false,
+		},
+		{
+			"Replay fails",
+			func(h *mock.MockHandlers) []*gomock.Call {
+				return []*gomock.Call{
+					h.EXPECT().SyncFile(gomock.Any(), "bucket", "file", "V1", time1).Return(storageSync.ResultError, errors.New("failed again")),
+				}
+			},
+			true,
+			storageSync.ResultError,
+			true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "deadletters")
+			if err != nil {
+				t.Fatalf("Failed to create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			s, err := NewBolt(filepath.Join(dir, "deadLetters.db"))
+			if err != nil {
+				t.Fatalf("Expected error to be nil, got %v", err)
+			}
+
+			f := &storageSync.FileInfo{BucketID: "bucket", FileID: "file", Version: "V1", Created: time1}
+			data, _ := f.Marshal()
+			l := &storageSync.DeadLetter{Type: storageSync.FileUpdate, Data: string(data), Error: "failed"}
+			if err := s.Add(l); err != nil {
+				t.Fatalf("Expected error to be nil, got %v", err)
+			}
+
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			h := mock.NewMockHandlers(ctrl)
+			test.calls(h)
+
+			result, err := Replay(context.Background(), s, h, l.ID)
+			if test.errorExpected && err == nil {
+				t.Error("Expected error, got nil")
+			} else if !test.errorExpected && err != nil {
+				t.Errorf("Expected error to be nil, got %v", err)
+			}
+			if result != test.expectedResult {
+				t.Errorf("Expected result '%s', got '%s'", test.expectedResult, result)
+			}
+
+			kept, err := s.Get(l.ID)
+			if test.expectedKept {
+				if err != nil {
+					t.Fatalf("Expected dead letter to be kept, got %v", err)
+				}
+				if kept.Error != "failed again" {
+					t.Errorf("Expected error 'failed again', got '%s'", kept.Error)
+				}
+			} else if err != storageSync.ErrDeadLetterNotFound {
+				t.Errorf("Expected dead letter to be removed, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package deadletters
+
+import (
+	"context"
+
+	"github.com/go-openapi/runtime/middleware"
+	"github.com/rs/zerolog"
+
+	"github.com/iryonetwork/wwm/gen/storageSync/models"
+	"github.com/iryonetwork/wwm/gen/storageSync/restapi/operations"
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+)
+
+// Handlers describes the actions supported by the dead letters API
+type Handlers interface {
+	DeadLetterList() operations.DeadLetterListHandler
+	DeadLetterGet() operations.DeadLetterGetHandler
+	DeadLetterReplay() operations.DeadLetterReplayHandler
+	DeadLetterDiscard() operations.DeadLetterDiscardHandler
+}
+
+type handlers struct {
+	store    storageSync.DeadLetterStore
+	handlers storageSync.Handlers
+	logger   zerolog.Logger
+}
+
+func (h *handlers) DeadLetterList() operations.DeadLetterListHandler {
+	return operations.DeadLetterListHandlerFunc(func(params operations.DeadLetterListParams, principal *string) middleware.Responder {
+		list, err := h.store.List()
+		if err != nil {
+			return operations.NewDeadLetterListInternalServerError().WithPayload(&models.Error{
+				Code:    "server_error",
+				Message: err.Error(),
+			})
+		}
+
+		payload := make([]*models.DeadLetter, len(list))
+		for i, l := range list {
+			payload[i] = toModel(l)
+		}
+		return operations.NewDeadLetterListOK().WithPayload(payload)
+	})
+}
+
+func (h *handlers) DeadLetterGet() operations.DeadLetterGetHandler {
+	return operations.DeadLetterGetHandlerFunc(func(params operations.DeadLetterGetParams, principal *string) middleware.Responder {
+		l, err := h.store.Get(params.DeadLetterID)
+		if err == storageSync.ErrDeadLetterNotFound {
+			return operations.NewDeadLetterGetNotFound().WithPayload(&models.Error{
+				Code:    "not_found",
+				Message: err.Error(),
+			})
+		} else if err != nil {
+			return operations.NewDeadLetterGetInternalServerError().WithPayload(&models.Error{
+				Code:    "server_error",
+				Message: err.Error(),
+			})
+		}
+
+		return operations.NewDeadLetterGetOK().WithPayload(toModel(l))
+	})
+}
+
+func (h *handlers) DeadLetterReplay() operations.DeadLetterReplayHandler {
+	return operations.DeadLetterReplayHandlerFunc(func(params operations.DeadLetterReplayParams, principal *string) middleware.Responder {
+		_, err := Replay(context.Background(), h.store, h.handlers, params.DeadLetterID)
+		if err == storageSync.ErrDeadLetterNotFound {
+			return operations.NewDeadLetterReplayNotFound().WithPayload(&models.Error{
+				Code:    "not_found",
+				Message: err.Error(),
+			})
+		} else if err != nil {
+			h.logger.Error().Err(err).Str("deadLetter", params.DeadLetterID).Msg("Failed to replay dead letter")
+			return operations.NewDeadLetterReplayInternalServerError().WithPayload(&models.Error{
+				Code:    "server_error",
+				Message: err.Error(),
+			})
+		}
+
+		return operations.NewDeadLetterReplayNoContent()
+	})
+}
+
+func (h *handlers) DeadLetterDiscard() operations.DeadLetterDiscardHandler {
+	return operations.DeadLetterDiscardHandlerFunc(func(params operations.DeadLetterDiscardParams, principal *string) middleware.Responder {
+		err := h.store.Remove(params.DeadLetterID)
+		if err == storageSync.ErrDeadLetterNotFound {
+			return operations.NewDeadLetterDiscardNotFound().WithPayload(&models.Error{
+				Code:    "not_found",
+				Message: err.Error(),
+			})
+		} else if err != nil {
+			return operations.NewDeadLetterDiscardInternalServerError().WithPayload(&models.Error{
+				Code:    "server_error",
+				Message: err.Error(),
+			})
+		}
+
+		h.logger.Info().Str("deadLetter", params.DeadLetterID).Msg("Discarded dead letter")
+		return operations.NewDeadLetterDiscardNoContent()
+	})
+}
+
+// NewHandlers returns handlers of the dead letters API replaying dead letters
+// kept in the store with the sync handlers
+func NewHandlers(store storageSync.DeadLetterStore, syncHandlers storageSync.Handlers, logger zerolog.Logger) Handlers {
+	return &handlers{
+		store:    store,
+		handlers: syncHandlers,
+		logger:   logger.With().Str("component", "sync/storage/deadletters/handlers").Logger(),
+	}
+}
+
+func toModel(l *storageSync.DeadLetter) *models.DeadLetter {
+	return &models.DeadLetter{
+		ID:         l.ID,
+		Type:       string(l.Type),
+		Data:       l.Data,
+		BucketID:   l.BucketID,
+		FileID:     l.FileID,
+		Version:    l.Version,
+		Created:    l.Created,
+		Deliveries: int64(l.Deliveries),
+		Error:      l.Error,
+		Failed:     l.Failed,
+	}
+}
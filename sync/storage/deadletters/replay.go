@@ -0,0 +1,49 @@
+package deadletters
+
+import (
+	"context"
+	"fmt"
+
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+)
+
+// Replay handles the dead letter again with the sync handlers and removes it
+// if it succeeds. The dead letter is kept with the error if it fails again.
+func Replay(ctx context.Context, store storageSync.DeadLetterStore, handlers storageSync.Handlers, id string) (storageSync.SyncResult, error) {
+	l, err := store.Get(id)
+	if err != nil {
+		return storageSync.ResultError, err
+	}
+
+	result, err := handle(ctx, handlers, l)
+	// conflicts are handled following the conflict policy
+	if err == nil || result == storageSync.ResultConflict {
+		return result, store.Remove(l.ID)
+	}
+
+	l.Error = err.Error()
+	if storeErr := store.Add(l); storeErr != nil {
+		return result, storeErr
+	}
+
+	return result, err
+}
+
+// handle runs the sync handler of the event type
+func handle(ctx context.Context, handlers storageSync.Handlers, l *storageSync.DeadLetter) (storageSync.SyncResult, error) {
+	f := storageSync.NewFileInfo()
+	if err := f.Unmarshal([]byte(l.Data)); err != nil {
+		return storageSync.ResultError, err
+	}
+
+	switch l.Type {
+	case storageSync.FileNew, storageSync.FileUpdate:
+		return handlers.SyncFile(ctx, f.BucketID, f.FileID, f.Version, f.Created)
+	case storageSync.FileDelete:
+		return handlers.SyncFileDelete(ctx, f.BucketID, f.FileID, f.Version, f.Created)
+	case storageSync.FilePurge:
+		return handlers.SyncFilePurge(ctx, f.BucketID, f.FileID, f.Version, f.Created)
+	}
+
+	return storageSync.ResultError, fmt.Errorf("invalid event type '%s'", l.Type)
+}
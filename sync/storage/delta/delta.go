@@ -0,0 +1,309 @@
+// Package delta encodes file contents as rsync style block deltas against a
+// base version already held by the receiving side
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math"
+)
+
+// Block sizes used for signatures
+const (
+	MinBlockSize = 2 * 1024
+	MaxBlockSize = 1024 * 1024
+)
+
+// maxLiteral is the maximum length of literal data in a single operation
+const maxLiteral = 1024 * 1024
+
+// magic starts every delta, the last byte is version of the format
+var magic = []byte{'W', 'W', 'M', 'D', 1}
+
+// operations of the delta
+const (
+	opEnd byte = iota
+	opCopy
+	opLiteral
+)
+
+// ErrInvalidDelta is returned when delta can not be applied
+var ErrInvalidDelta = errors.New("invalid delta")
+
+// Block holds checksums of a block of the base contents
+type Block struct {
+	// Weak is rolling checksum of the block
+	Weak uint32
+	// Strong is hex encoded truncated SHA256 checksum of the block
+	Strong string
+}
+
+// Signature describes base contents by checksums of its blocks; the last
+// block may be shorter than BlockSize
+type Signature struct {
+	BlockSize int
+	Size      int64
+	Blocks    []Block
+}
+
+// BlockSize returns block size suitable for contents of the size, i.e. square
+// root of the size within the block size bounds
+func BlockSize(size int64) int {
+	bs := int(math.Sqrt(float64(size)))
+	switch {
+	case bs < MinBlockSize:
+		return MinBlockSize
+	case bs > MaxBlockSize:
+		return MaxBlockSize
+	}
+
+	return bs
+}
+
+// NewSignature reads the base contents from r and returns its signature
+func NewSignature(r io.Reader, blockSize int) (*Signature, error) {
+	if blockSize <= 0 || blockSize > MaxBlockSize {
+		return nil, errors.New("block size is out of range")
+	}
+
+	sig := &Signature{BlockSize: blockSize}
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, Block{Weak: weakSum(buf[:n]), Strong: strongSum(buf[:n])})
+			sig.Size += int64(n)
+		}
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return sig, nil
+		default:
+			return nil, err
+		}
+	}
+}
+
+// Write writes delta of the contents against the base described by the
+// signature to w
+func Write(w io.Writer, sig *Signature, contents []byte) error {
+	bs := sig.BlockSize
+	if bs <= 0 || bs > MaxBlockSize {
+		return errors.New("block size is out of range")
+	}
+
+	e := &encoder{w: bufio.NewWriter(w), copyIndex: -1}
+	e.write(magic)
+	e.uvarint(uint64(bs))
+
+	// only full blocks are matched while rolling; the last block is matched
+	// at the end of the contents
+	index := make(map[uint32][]int)
+	last := -1
+	for i, b := range sig.Blocks {
+		if int64(i+1)*int64(bs) <= sig.Size {
+			index[b.Weak] = append(index[b.Weak], i)
+		} else {
+			last = i
+		}
+	}
+	match := func(weak uint32, block []byte) int {
+		candidates, ok := index[weak]
+		if !ok {
+			return -1
+		}
+		strong := strongSum(block)
+		for _, i := range candidates {
+			if sig.Blocks[i].Strong == strong {
+				return i
+			}
+		}
+		return -1
+	}
+
+	start := 0
+	i := 0
+	var a, b uint32
+	if len(contents) >= bs {
+		a, b = sums(contents[:bs])
+	}
+	for i+bs <= len(contents) {
+		if m := match(a&0xffff|b<<16, contents[i:i+bs]); m >= 0 {
+			e.literal(contents[start:i])
+			e.copy(m)
+			i += bs
+			start = i
+			if i+bs <= len(contents) {
+				a, b = sums(contents[i : i+bs])
+			}
+			continue
+		}
+
+		if i+bs < len(contents) {
+			out, in := uint32(contents[i]), uint32(contents[i+bs])
+			a = a - out + in
+			b = b - uint32(bs)*out + a
+		}
+		i++
+	}
+
+	end := len(contents)
+	if last >= 0 {
+		n := int(sig.Size - int64(last)*int64(bs))
+		if end-start >= n {
+			tail := contents[end-n:]
+			if weakSum(tail) == sig.Blocks[last].Weak && strongSum(tail) == sig.Blocks[last].Strong {
+				e.literal(contents[start : end-n])
+				e.copy(last)
+				start = end
+			}
+		}
+	}
+	e.literal(contents[start:end])
+	e.flushCopy()
+	e.write([]byte{opEnd})
+
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// Apply reads the delta from r and writes contents reconstructed from the
+// base to w
+func Apply(w io.Writer, base io.ReaderAt, r io.Reader) error {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(br, header); err != nil || !bytes.Equal(header, magic) {
+		return ErrInvalidDelta
+	}
+	bs, err := binary.ReadUvarint(br)
+	if err != nil || bs == 0 || bs > MaxBlockSize {
+		return ErrInvalidDelta
+	}
+
+	for {
+		op, err := br.ReadByte()
+		if err != nil {
+			return ErrInvalidDelta
+		}
+
+		switch op {
+		case opEnd:
+			return nil
+		case opCopy:
+			index, err := binary.ReadUvarint(br)
+			if err != nil || index > math.MaxInt32 {
+				return ErrInvalidDelta
+			}
+			count, err := binary.ReadUvarint(br)
+			if err != nil || count == 0 || count > math.MaxInt32 {
+				return ErrInvalidDelta
+			}
+			n, err := io.Copy(w, io.NewSectionReader(base, int64(index*bs), int64(count*bs)))
+			if err != nil {
+				return err
+			}
+			if n <= int64((count-1)*bs) {
+				// base is shorter than the blocks to copy
+				return ErrInvalidDelta
+			}
+		case opLiteral:
+			n, err := binary.ReadUvarint(br)
+			if err != nil || n == 0 || n > maxLiteral {
+				return ErrInvalidDelta
+			}
+			if _, err := io.CopyN(w, br, int64(n)); err == io.EOF {
+				return ErrInvalidDelta
+			} else if err != nil {
+				return err
+			}
+		default:
+			return ErrInvalidDelta
+		}
+	}
+}
+
+// encoder writes delta operations, merging copies of consecutive blocks; the
+// first error is kept and the following writes are skipped
+type encoder struct {
+	w         *bufio.Writer
+	err       error
+	copyIndex int
+	copyCount int
+}
+
+func (e *encoder) write(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+func (e *encoder) uvarint(v uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	e.write(buf[:binary.PutUvarint(buf, v)])
+}
+
+func (e *encoder) copy(index int) {
+	if e.copyIndex >= 0 && index == e.copyIndex+e.copyCount {
+		e.copyCount++
+		return
+	}
+	e.flushCopy()
+	e.copyIndex = index
+	e.copyCount = 1
+}
+
+func (e *encoder) flushCopy() {
+	if e.copyIndex < 0 {
+		return
+	}
+	e.write([]byte{opCopy})
+	e.uvarint(uint64(e.copyIndex))
+	e.uvarint(uint64(e.copyCount))
+	e.copyIndex = -1
+	e.copyCount = 0
+}
+
+func (e *encoder) literal(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	e.flushCopy()
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxLiteral {
+			n = maxLiteral
+		}
+		e.write([]byte{opLiteral})
+		e.uvarint(uint64(n))
+		e.write(b[:n])
+		b = b[n:]
+	}
+}
+
+// sums returns components of the rolling checksum as in rsync
+func sums(b []byte) (uint32, uint32) {
+	var a, s uint32
+	for i, c := range b {
+		a += uint32(c)
+		s += uint32(len(b)-i) * uint32(c)
+	}
+	return a, s
+}
+
+func weakSum(b []byte) uint32 {
+	a, s := sums(b)
+	return a&0xffff | s<<16
+}
+
+func strongSum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,88 @@
+package delta
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestDelta(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rnd.Read(b)
+		return b
+	}
+	base := random(10*MinBlockSize + 100)
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	testCases := []struct {
+		description string
+		contents    []byte
+		maxSize     int
+	}{
+		{"Same contents", base, 100},
+		{"Bytes inserted", join(base[:3000], random(10), base[3000:]), MinBlockSize + 100},
+		{"Bytes removed", join(base[:3000], base[3100:]), MinBlockSize + 100},
+		{"Bytes appended", join(base, random(500)), 700},
+		{"Bytes prepended", join(random(500), base), 600},
+		{"Block replaced", join(base[:MinBlockSize], random(MinBlockSize), base[2*MinBlockSize:]), 2*MinBlockSize + 100},
+		{"Different contents", random(5000), 5100},
+		{"Empty contents", []byte{}, 20},
+	}
+
+	sig, err := NewSignature(bytes.NewReader(base), MinBlockSize)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if sig.Size != int64(len(base)) || len(sig.Blocks) != 11 {
+		t.Fatalf("Expected signature of 11 blocks and %d bytes, got %d blocks and %d bytes", len(base), len(sig.Blocks), sig.Size)
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			var d bytes.Buffer
+			if err := Write(&d, sig, test.contents); err != nil {
+				t.Fatalf("Expected error to be nil, got %v", err)
+			}
+			if d.Len() > test.maxSize {
+				t.Errorf("Expected delta of at most %d bytes, got %d", test.maxSize, d.Len())
+			}
+
+			var out bytes.Buffer
+			if err := Apply(&out, bytes.NewReader(base), &d); err != nil {
+				t.Fatalf("Expected error to be nil, got %v", err)
+			}
+			if !bytes.Equal(out.Bytes(), test.contents) {
+				t.Errorf("Expected reconstructed contents to equal the contents")
+			}
+		})
+	}
+}
+
+func TestApplyInvalid(t *testing.T) {
+	base := bytes.NewReader(make([]byte, MinBlockSize))
+
+	testCases := []struct {
+		description string
+		delta       []byte
+	}{
+		{"Empty delta", []byte{}},
+		{"Invalid magic", []byte{'W', 'W', 'M', 'D', 2, 1, opEnd}},
+		{"Missing end", append(append([]byte{}, magic...), 0x80, 0x10)},
+		{"Copy beyond base", append(append([]byte{}, magic...), 0x80, 0x10, opCopy, 5, 1, opEnd)},
+		{"Truncated literal", append(append([]byte{}, magic...), 0x80, 0x10, opLiteral, 10, 'a')},
+		{"Unknown operation", append(append([]byte{}, magic...), 0x80, 0x10, 9)},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := Apply(&out, base, bytes.NewReader(test.delta)); err != ErrInvalidDelta {
+				t.Errorf("Expected error to be '%v', got '%v'", ErrInvalidDelta, err)
+			}
+		})
+	}
+}
@@ -2,16 +2,23 @@ package storage
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"fmt"
+	"io"
 	"sort"
 	"strings"
+	"time"
 
+	"github.com/agext/uuid"
 	"github.com/go-openapi/runtime"
 	strfmt "github.com/go-openapi/strfmt"
+	"github.com/go-openapi/swag"
 	"github.com/rs/zerolog"
 
 	"github.com/iryonetwork/wwm/gen/storage/client/operations"
 	"github.com/iryonetwork/wwm/gen/storage/models"
+	"github.com/iryonetwork/wwm/sync/storage/delta"
 )
 
 // Handlers describes public API for sync/storage event handlers
@@ -20,16 +27,30 @@ type Handlers interface {
 	SyncFile(ctx context.Context, bucketID, fileID, version string, timestamp strfmt.DateTime) (SyncResult, error)
 	// SyncFileDelete synchronizes file deletion to destination operations.
 	SyncFileDelete(ctx context.Context, bucketID, fileID, version string, timestamp strfmt.DateTime) (SyncResult, error)
+	// SyncFilePurge synchronizes removal of file version by retention policy to destination storage.
+	SyncFilePurge(ctx context.Context, bucketID, fileID, version string, timestamp strfmt.DateTime) (SyncResult, error)
 	// ListSourceBuckets lists all the buckets in source storage.
 	ListSourceBuckets(ctx context.Context) ([]*models.BucketDescriptor, error)
+	// ListDestinationBuckets lists all the buckets in destination storage.
+	ListDestinationBuckets(ctx context.Context) ([]*models.BucketDescriptor, error)
 	// ListSourceFiles lists all the files in the bucket of source storage including files marked as delete, ascending order by Created timestamp ensured.
 	ListSourceFilesAsc(ctx context.Context, bucketID string) ([]*models.FileDescriptor, error)
 	// ListSourceFileVersions lists all the file versions in the source storage ascending order by Created timestamp ensured.
 	ListSourceFileVersionsAsc(ctx context.Context, bucketID, fileID string) ([]*models.FileDescriptor, error)
 	// ListDestinationFileVersions lists all the file versions in the destination storage ascending order by Created timestamp ensured.
 	ListDestinationFileVersionsAsc(ctx context.Context, bucketID, fileID string) ([]*models.FileDescriptor, error)
+	// ListSourceChanges lists up to limit changes recorded in the change log of source storage after the sequence number since,
+	// together with the sequence number of the latest change. ErrNoChangeLog is returned if source storage does not record changes.
+	ListSourceChanges(ctx context.Context, since int64, limit int) ([]*models.Change, int64, error)
+	// ResolveConflict resolves the conflict found during sync.
+	ResolveConflict(ctx context.Context, c *Conflict, resolution Resolution) (SyncResult, error)
+	// FetchDestinationFile writes contents of the file version stored in destination storage to w.
+	FetchDestinationFile(ctx context.Context, bucketID, fileID, version string, w io.Writer) error
 }
 
+// listPageSize is the number of files requested in a single list call
+const listPageSize = 500
+
 // Handler describes sync/storage sync handler function
 type Handler func(ctx context.Context, bucketID, fileID, version string, created strfmt.DateTime) (SyncResult, error)
 
@@ -38,23 +59,49 @@ type handlers struct {
 	sourceAuth      runtime.ClientAuthInfoWriter
 	destination     *operations.Client
 	destinationAuth runtime.ClientAuthInfoWriter
+	direction       Direction
+	conflictPolicy  ConflictPolicy
+	conflicts       ConflictStore
+	throttle        Throttle
+	transfer        TransferOptions
 	logger          zerolog.Logger
 }
 
+// payload is contents of the source file version to upload
+type payload struct {
+	contents []byte
+	priority int
+	// accepted are encodings accepted by destination storage
+	accepted []string
+}
+
 // SyncFile synchronizes new files and file updates to destination storage
 func (h *handlers) SyncFile(ctx context.Context, bucketID, fileID, version string, timestamp strfmt.DateTime) (SyncResult, error) {
+	// Check if file can be transferred now
+	priority, err := h.admit(ctx, bucketID, fileID, version)
+	if err == ErrDeferred {
+		h.logger.Debug().
+			Str("bucket", bucketID).
+			Str("fileID", fileID).
+			Str("version", version).
+			Msg("File sync deferred until sync window opens")
+		return ResultDeferred, err
+	} else if err != nil {
+		return ResultError, err
+	}
+
 	// Get file from source storage
 	var buf bytes.Buffer
 
-	getParams := operations.NewFileGetVersionParams().
+	getParams := operations.NewSyncFileGetParams().
 		WithBucket(bucketID).
 		WithFileID(fileID).
 		WithVersion(version).
 		WithContext(ctx)
-	resp, err := h.source.FileGetVersion(getParams, h.sourceAuth, &buf)
+	resp, err := h.source.SyncFileGet(getParams, h.sourceAuth, &buf)
 
 	if err != nil {
-		if _, ok := err.(*operations.FileGetVersionNotFound); ok {
+		if _, ok := err.(*operations.SyncFileGetNotFound); ok {
 			h.logger.Error().Err(err).
 				Str("bucket", bucketID).
 				Str("fileID", fileID).
@@ -74,33 +121,163 @@ func (h *handlers) SyncFile(ctx context.Context, bucketID, fileID, version strin
 	}
 
 	// Check if sync is needed
-	needsSync, err := h.needsSync(ctx, bucketID, fileID, version, resp.XChecksum)
+	existing, accepted, err := h.destinationMetadata(ctx, bucketID, fileID, version)
 	if err != nil {
 		return ResultError, err
 	}
-	// Nothing to do
-	if !needsSync {
-		// all is good but nothing was synced
+	p := &payload{contents: buf.Bytes(), priority: priority, accepted: accepted}
+	if existing != nil {
+		if existing.XChecksum == resp.XChecksum {
+			// all is good but nothing was synced
+			return ResultSyncNotNeeded, nil
+		}
+
+		c := &Conflict{
+			Direction:           h.direction,
+			BucketID:            bucketID,
+			FileID:              fileID,
+			Version:             version,
+			SourceChecksum:      resp.XChecksum,
+			SourceCreated:       resp.XCreated,
+			DestinationChecksum: existing.XChecksum,
+			DestinationCreated:  existing.XCreated,
+		}
+		return h.handleConflict(ctx, c, resp, p)
+	}
+
+	return h.upload(ctx, bucketID, fileID, version, resp, p)
+}
+
+// ResolveConflict resolves the conflict found during sync.
+func (h *handlers) ResolveConflict(ctx context.Context, c *Conflict, resolution Resolution) (SyncResult, error) {
+	if resolution == ResolutionDestination {
+		h.logger.Info().
+			Str("cmd", "ResolveConflict").
+			Str("bucket", c.BucketID).
+			Str("fileID", c.FileID).
+			Str("version", c.Version).
+			Msg("Keeping destination contents of conflicting version")
 		return ResultSyncNotNeeded, nil
 	}
 
-	// Sync file
-	syncParams := operations.NewSyncFileParams().
-		WithBucket(bucketID).
-		WithFileID(fileID).
-		WithVersion(version).
-		WithContext(ctx).
-		WithCreated(resp.XCreated)
-	if resp.XArchetype != "" {
-		syncParams.SetArchetype(&resp.XArchetype)
+	// Get file from source storage
+	var buf bytes.Buffer
+
+	getParams := operations.NewSyncFileGetParams().
+		WithBucket(c.BucketID).
+		WithFileID(c.FileID).
+		WithVersion(c.Version).
+		WithContext(ctx)
+	resp, err := h.source.SyncFileGet(getParams, h.sourceAuth, &buf)
+	if err != nil {
+		h.logger.Error().Err(err).
+			Str("cmd", "ResolveConflict").
+			Str("bucket", c.BucketID).
+			Str("fileID", c.FileID).
+			Str("version", c.Version).
+			Msg("Error on trying to fetch file from source operations.")
+		return ResultError, err
 	}
-	if resp.XLabels != "" {
-		syncParams.SetLabels(formatLabelsFromHeader(resp.XLabels))
+
+	p := &payload{contents: buf.Bytes()}
+	switch resolution {
+	case ResolutionSource:
+		return h.replace(ctx, c, resp, p)
+	case ResolutionBoth:
+		return h.keepBoth(ctx, c, resp, p)
 	}
 
-	syncParams.SetContentType(resp.ContentType)
-	syncParams.SetFile(runtime.NamedReader("FileReader", &buf))
-	ok, created, err := h.destination.SyncFile(syncParams, h.destinationAuth)
+	return ResultError, fmt.Errorf("invalid resolution '%s'", resolution)
+}
+
+// handleConflict resolves the conflict following the conflict policy
+func (h *handlers) handleConflict(ctx context.Context, c *Conflict, src *operations.SyncFileGetOK, p *payload) (SyncResult, error) {
+	h.logger.Error().
+		Str("bucket", c.BucketID).
+		Str("fileID", c.FileID).
+		Str("version", c.Version).
+		Str("policy", string(h.conflictPolicy)).
+		Msg("File already exists in destination storage and has different checksum.")
+
+	switch h.conflictPolicy {
+	case ConflictKeepBoth:
+		return h.keepBoth(ctx, c, src, p)
+	case ConflictLastWriterWins:
+		if time.Time(c.SourceCreated).After(time.Time(c.DestinationCreated)) {
+			return h.replace(ctx, c, src, p)
+		}
+		return h.ResolveConflict(ctx, c, ResolutionDestination)
+	case ConflictPark:
+		if h.conflicts == nil {
+			break
+		}
+		if err := h.conflicts.Park(c); err != nil {
+			h.logger.Error().Err(err).
+				Str("bucket", c.BucketID).
+				Str("fileID", c.FileID).
+				Str("version", c.Version).
+				Msg("Failed to park conflict")
+			return ResultError, err
+		}
+		return ResultConflict, nil
+	}
+
+	// Nothing to do
+	return ResultSyncNotNeeded, nil
+}
+
+// replace replaces the destination contents of the version with the source contents
+func (h *handlers) replace(ctx context.Context, c *Conflict, src *operations.SyncFileGetOK, p *payload) (SyncResult, error) {
+	params := operations.NewSyncFilePurgeParams().
+		WithBucket(c.BucketID).
+		WithFileID(c.FileID).
+		WithVersion(c.Version).
+		WithContext(ctx)
+	_, err := h.destination.SyncFilePurge(params, h.destinationAuth)
+
+	if err != nil {
+		if _, ok := err.(*operations.SyncFilePurgeNotFound); !ok {
+			h.logger.Error().Err(err).
+				Str("cmd", "replace").
+				Str("bucket", c.BucketID).
+				Str("fileID", c.FileID).
+				Str("version", c.Version).
+				Msg("Failed to remove conflicting version from destination storage")
+			return ResultError, err
+		}
+	}
+
+	return h.upload(ctx, c.BucketID, c.FileID, c.Version, src, p)
+}
+
+// keepBoth stores the source contents as a new sibling version in destination storage
+func (h *handlers) keepBoth(ctx context.Context, c *Conflict, src *operations.SyncFileGetOK, p *payload) (SyncResult, error) {
+	sibling := uuid.NewCrypto().String()
+	h.logger.Info().
+		Str("cmd", "keepBoth").
+		Str("bucket", c.BucketID).
+		Str("fileID", c.FileID).
+		Str("version", c.Version).
+		Str("sibling", sibling).
+		Msg("Storing source contents of conflicting version as sibling version")
+
+	return h.upload(ctx, c.BucketID, c.FileID, sibling, src, p)
+}
+
+// upload stores the source contents of the file version in destination storage
+func (h *handlers) upload(ctx context.Context, bucketID, fileID, version string, src *operations.SyncFileGetOK, p *payload) (SyncResult, error) {
+	body, encodings, base := h.encode(ctx, bucketID, fileID, version, p)
+	ok, created, err := h.syncFile(ctx, bucketID, fileID, version, src, h.limit(ctx, bytes.NewReader(body), p.priority), encodings, base)
+	if _, bad := err.(*operations.SyncFileBadRequest); bad && len(encodings) > 0 {
+		h.logger.Error().Err(err).
+			Str("cmd", "SyncFile").
+			Str("bucket", bucketID).
+			Str("fileID", fileID).
+			Str("version", version).
+			Str("encodings", strings.Join(encodings, ",")).
+			Msg("Destination storage failed to decode contents, uploading them unencoded")
+		ok, created, err = h.syncFile(ctx, bucketID, fileID, version, src, h.limit(ctx, bytes.NewReader(p.contents), p.priority), nil, "")
+	}
 
 	switch {
 	case ok != nil:
@@ -125,7 +302,7 @@ func (h *handlers) SyncFile(ctx context.Context, bucketID, fileID, version strin
 			Str("version", version).
 			Msg("Failed to sync file to destination storage")
 		switch err.(type) {
-		case *operations.SyncFileConflict:
+		case *operations.SyncFileConflict, *operations.SyncFileUnprocessableEntity:
 			// another attempt at sync should not be performed
 			return ResultConflict, err
 		default:
@@ -136,6 +313,118 @@ func (h *handlers) SyncFile(ctx context.Context, bucketID, fileID, version strin
 	return ResultSynced, nil
 }
 
+// syncFile uploads the contents encoded with the encodings to destination storage
+func (h *handlers) syncFile(ctx context.Context, bucketID, fileID, version string, src *operations.SyncFileGetOK, body io.Reader, encodings []string, base string) (*operations.SyncFileOK, *operations.SyncFileCreated, error) {
+	syncParams := operations.NewSyncFileParams().
+		WithBucket(bucketID).
+		WithFileID(fileID).
+		WithVersion(version).
+		WithContext(ctx).
+		WithCreated(src.XCreated)
+	if src.XArchetype != "" {
+		syncParams.SetArchetype(&src.XArchetype)
+	}
+	if src.XLabels != "" {
+		syncParams.SetLabels(formatLabelsFromHeader(src.XLabels))
+	}
+	if len(encodings) > 0 {
+		// destination storage verifies the decoded contents
+		syncParams.SetEncoding(encodings)
+		syncParams.SetChecksum(&src.XChecksum)
+	}
+	if base != "" {
+		syncParams.SetBase(&base)
+	}
+
+	syncParams.SetContentType(src.ContentType)
+	syncParams.SetFile(runtime.NamedReader("FileReader", body))
+	return h.destination.SyncFile(syncParams, h.destinationAuth)
+}
+
+// encode returns the contents encoded for upload together with the applied
+// encodings and the version delta is computed against; contents are left as
+// they are if encoding does not make them smaller
+func (h *handlers) encode(ctx context.Context, bucketID, fileID, version string, p *payload) ([]byte, []string, string) {
+	body := p.contents
+	var encodings []string
+	var base string
+
+	if h.transfer.DeltaMinSize > 0 && int64(len(body)) >= h.transfer.DeltaMinSize && accepts(p.accepted, EncodingDelta) {
+		d, b, err := h.delta(ctx, bucketID, fileID, version, body)
+		switch {
+		case err != nil:
+			h.logger.Error().Err(err).
+				Str("cmd", "SyncFile").
+				Str("bucket", bucketID).
+				Str("fileID", fileID).
+				Str("version", version).
+				Msg("Failed to compute delta, uploading whole contents")
+		case d != nil && len(d) < len(body):
+			body = d
+			base = b
+			encodings = append(encodings, EncodingDelta)
+		}
+	}
+
+	if h.transfer.Compress && accepts(p.accepted, EncodingGzip) {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(body); err == nil && gz.Close() == nil && buf.Len() < len(body) {
+			body = buf.Bytes()
+			encodings = append(encodings, EncodingGzip)
+		}
+	}
+
+	return body, encodings, base
+}
+
+// delta returns delta of the contents against the latest other version of
+// the file held by destination storage and that version; nil is returned if
+// there is no such version
+func (h *handlers) delta(ctx context.Context, bucketID, fileID, version string, contents []byte) ([]byte, string, error) {
+	versions, err := h.ListDestinationFileVersionsAsc(ctx, bucketID, fileID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var base string
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Version != version {
+			base = versions[i].Version
+			break
+		}
+	}
+	if base == "" {
+		return nil, "", nil
+	}
+
+	params := operations.NewSyncFileSignatureParams().
+		WithBucket(bucketID).
+		WithFileID(fileID).
+		WithVersion(base).
+		WithContext(ctx)
+	resp, err := h.destination.SyncFileSignature(params, h.destinationAuth)
+	if err != nil {
+		if _, ok := err.(*operations.SyncFileSignatureNotFound); ok {
+			// base version was deleted
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+
+	sig := &delta.Signature{BlockSize: int(resp.Payload.BlockSize), Size: resp.Payload.Size}
+	for _, b := range resp.Payload.Blocks {
+		sig.Blocks = append(sig.Blocks, delta.Block{Weak: uint32(b.Weak), Strong: b.Strong})
+	}
+
+	var buf bytes.Buffer
+	if err := delta.Write(&buf, sig, contents); err != nil {
+		return nil, "", err
+	}
+
+	return buf.Bytes(), base, nil
+}
+
 // SyncFileDelete synchronizes file deletion to destination operations.
 func (h *handlers) SyncFileDelete(ctx context.Context, bucketID, fileID, version string, timestamp strfmt.DateTime) (SyncResult, error) {
 	params := operations.NewSyncFileDeleteParams().
@@ -172,11 +461,50 @@ func (h *handlers) SyncFileDelete(ctx context.Context, bucketID, fileID, version
 	return ResultSynced, nil
 }
 
+// SyncFilePurge synchronizes removal of file version by retention policy to destination storage.
+func (h *handlers) SyncFilePurge(ctx context.Context, bucketID, fileID, version string, timestamp strfmt.DateTime) (SyncResult, error) {
+	params := operations.NewSyncFilePurgeParams().
+		WithBucket(bucketID).
+		WithFileID(fileID).
+		WithVersion(version).
+		WithContext(ctx)
+	_, err := h.destination.SyncFilePurge(params, h.destinationAuth)
+
+	if err != nil {
+		if _, ok := err.(*operations.SyncFilePurgeNotFound); ok {
+			// version was never synced or is already purged
+			return ResultSyncNotNeeded, nil
+		}
+
+		h.logger.Error().Err(err).
+			Str("cmd", "SyncFilePurge").
+			Str("bucket", bucketID).
+			Str("fileID", fileID).
+			Str("version", version).
+			Msg("Failed to sync file purge")
+		return ResultError, err
+	}
+
+	h.logger.Debug().
+		Str("cmd", "SyncFilePurge").
+		Str("bucket", bucketID).
+		Str("fileID", fileID).
+		Str("version", version).
+		Msg("Succesfully synced file purge to destination storage")
+
+	return ResultSynced, nil
+}
+
 // ListSourceBuckets lists all the buckets in source storage.
 func (h *handlers) ListSourceBuckets(ctx context.Context) ([]*models.BucketDescriptor, error) {
 	return h.listBuckets(ctx, h.source, h.sourceAuth)
 }
 
+// ListDestinationBuckets lists all the buckets in destination storage.
+func (h *handlers) ListDestinationBuckets(ctx context.Context) ([]*models.BucketDescriptor, error) {
+	return h.listBuckets(ctx, h.destination, h.destinationAuth)
+}
+
 // ListSourceFiles lists all the files in the bucket of source storage including files marked as delete.
 func (h *handlers) ListSourceFilesAsc(ctx context.Context, bucketID string) ([]*models.FileDescriptor, error) {
 	return h.listFilesAsc(ctx, h.source, h.sourceAuth, bucketID)
@@ -192,21 +520,129 @@ func (h *handlers) ListDestinationFileVersionsAsc(ctx context.Context, bucketID,
 	return h.listFileVersionsAsc(ctx, h.destination, h.destinationAuth, bucketID, fileID)
 }
 
+// ListSourceChanges lists changes recorded in the change log of source storage after the sequence number.
+func (h *handlers) ListSourceChanges(ctx context.Context, since int64, limit int) ([]*models.Change, int64, error) {
+	params := operations.NewSyncChangeListParams().
+		WithSince(swag.Int64(since)).
+		WithLimit(swag.Int64(int64(limit))).
+		WithContext(ctx)
+	resp, err := h.source.SyncChangeList(params, h.sourceAuth)
+	if err != nil {
+		if _, ok := err.(*operations.SyncChangeListNotFound); ok {
+			return nil, 0, ErrNoChangeLog
+		}
+		return nil, 0, err
+	}
+
+	return resp.Payload, resp.XLastSequence, nil
+}
+
+// FetchDestinationFile writes contents of the file version stored in destination storage to w.
+func (h *handlers) FetchDestinationFile(ctx context.Context, bucketID, fileID, version string, w io.Writer) error {
+	params := operations.NewSyncFileGetParams().
+		WithBucket(bucketID).
+		WithFileID(fileID).
+		WithVersion(version).
+		WithContext(ctx)
+	_, err := h.destination.SyncFileGet(params, h.destinationAuth, w)
+
+	if err != nil {
+		h.logger.Error().Err(err).
+			Str("cmd", "FetchDestinationFile").
+			Str("bucket", bucketID).
+			Str("fileID", fileID).
+			Str("version", version).
+			Msg("Failed to fetch file from destination storage")
+		return err
+	}
+
+	return nil
+}
+
+// Options holds optional features of sync handlers; zero value disables all
+// of them.
+type Options struct {
+	// Direction is recorded with parked conflicts so they are resolved by
+	// handlers syncing the same way, DirectionPush is used if empty.
+	Direction Direction
+	// ConflictPolicy defines how conflicting versions are resolved, they are
+	// left untouched if empty.
+	ConflictPolicy ConflictPolicy
+	// Conflicts keeps conflicts parked by ConflictPark policy.
+	Conflicts ConflictStore
+	// Throttle admits and limits transfers, files are transferred right away
+	// if nil.
+	Throttle Throttle
+	// Transfer defines how contents are encoded for upload.
+	Transfer TransferOptions
+}
+
 // NewApiHandlers returns Handlers with cloudStorage and localStorage API used.
-func NewHandlers(source *operations.Client, sourceAuth runtime.ClientAuthInfoWriter, destination *operations.Client, destinationAuth runtime.ClientAuthInfoWriter, logger zerolog.Logger) Handlers {
+func NewHandlers(source *operations.Client, sourceAuth runtime.ClientAuthInfoWriter, destination *operations.Client, destinationAuth runtime.ClientAuthInfoWriter, opts Options, logger zerolog.Logger) Handlers {
 	logger = logger.With().Str("component", "sync/storage/handlers").Logger()
 
+	direction := opts.Direction
+	if direction == "" {
+		direction = DirectionPush
+	}
+
 	return &handlers{
 		source:          source,
 		sourceAuth:      sourceAuth,
 		destination:     destination,
 		destinationAuth: destinationAuth,
+		direction:       direction,
+		conflictPolicy:  opts.ConflictPolicy,
+		conflicts:       opts.Conflicts,
+		throttle:        opts.Throttle,
+		transfer:        opts.Transfer,
 		logger:          logger,
 	}
 }
 
-func (h *handlers) needsSync(ctx context.Context, bucketID, fileID, version, sourceChecksum string) (bool, error) {
-	// Verify in case file already exists in destination storage
+// admit returns priority of the file version stored in source storage or
+// ErrDeferred if it can not be transferred now; files are always admitted
+// without throttle
+func (h *handlers) admit(ctx context.Context, bucketID, fileID, version string) (int, error) {
+	if h.throttle == nil {
+		return 0, nil
+	}
+
+	params := operations.NewSyncFileMetadataParams().
+		WithBucket(bucketID).
+		WithFileID(fileID).
+		WithVersion(version).
+		WithContext(ctx)
+	resp, err := h.source.SyncFileMetadata(params, h.sourceAuth)
+	if err != nil {
+		if _, ok := err.(*operations.SyncFileMetadataNotFound); ok {
+			// missing file is handled when fetching it
+			return 0, nil
+		}
+		h.logger.Error().Err(err).
+			Str("bucket", bucketID).
+			Str("fileID", fileID).
+			Str("version", version).
+			Msg("Failed to get metadata of the file from source storage")
+		return 0, err
+	}
+
+	return h.throttle.Admit(resp.ContentType, resp.XSize)
+}
+
+// limit returns reader of the file contents limited by throttle
+func (h *handlers) limit(ctx context.Context, r io.Reader, priority int) io.Reader {
+	if h.throttle == nil {
+		return r
+	}
+
+	return h.throttle.Reader(ctx, r, priority)
+}
+
+// destinationMetadata returns metadata of the file version in destination
+// storage or nil if it does not exist there, together with encodings of file
+// contents accepted by destination storage
+func (h *handlers) destinationMetadata(ctx context.Context, bucketID, fileID, version string) (*operations.SyncFileMetadataOK, []string, error) {
 	params := operations.NewSyncFileMetadataParams().
 		WithBucket(bucketID).
 		WithFileID(fileID).
@@ -216,23 +652,15 @@ func (h *handlers) needsSync(ctx context.Context, bucketID, fileID, version, sou
 
 	// File already exists
 	if resp != nil {
-		if resp.XChecksum != sourceChecksum {
-			// There is conflict, log error
-			h.logger.Error().
-				Str("bucket", bucketID).
-				Str("fileID", fileID).
-				Str("version", version).
-				Msg("File already exists in destination storage and has different checksum.")
-		}
-		// Nothing to do
-		return false, nil
+		return resp, formatEncodingsFromHeader(resp.AcceptEncoding), nil
 	}
 	// If file not found it needs sync, otherwise return error
-	if _, ok := err.(*operations.SyncFileMetadataNotFound); !ok {
-		return false, err
+	notFound, ok := err.(*operations.SyncFileMetadataNotFound)
+	if !ok {
+		return nil, nil, err
 	}
 
-	return true, nil
+	return nil, formatEncodingsFromHeader(notFound.AcceptEncoding), nil
 }
 
 func (h *handlers) listBuckets(ctx context.Context, c *operations.Client, auth runtime.ClientAuthInfoWriter) ([]*models.BucketDescriptor, error) {
@@ -252,20 +680,32 @@ func (h *handlers) listBuckets(ctx context.Context, c *operations.Client, auth r
 }
 
 func (h *handlers) listFilesAsc(ctx context.Context, c *operations.Client, auth runtime.ClientAuthInfoWriter, bucketID string) ([]*models.FileDescriptor, error) {
-	params := operations.NewSyncFileListParams().WithBucket(bucketID).WithContext(ctx)
-	resp, err := c.SyncFileList(params, auth)
+	files := []*models.FileDescriptor{}
+	params := operations.NewSyncFileListParams().
+		WithBucket(bucketID).
+		WithLimit(swag.Int64(listPageSize)).
+		WithContext(ctx)
 
-	if err != nil {
-		// If not found return empty, otherwise return error
-		if _, ok := err.(*operations.SyncFileListNotFound); !ok {
-			return nil, err
+	// fetch the list page by page
+	for {
+		resp, err := c.SyncFileList(params, auth)
+
+		if err != nil {
+			// If not found there are no more files, otherwise return error
+			if _, ok := err.(*operations.SyncFileListNotFound); !ok {
+				return nil, err
+			}
+			break
 		}
 
-		return []*models.FileDescriptor{}, nil
+		files = append(files, resp.Payload...)
+		if resp.XNextCursor == "" {
+			break
+		}
+		params.SetCursor(swag.String(resp.XNextCursor))
 	}
 
 	// ensure ascending order by created time
-	files := resp.Payload
 	sort.Sort(ascByCreated(files))
 
 	return files, nil
@@ -280,7 +720,7 @@ func (h *handlers) listFileVersionsAsc(ctx context.Context, c *operations.Client
 
 	if err != nil {
 		// If not found return empty, otherwise return error
-		if _, ok := err.(*operations.FileListVersionsNotFound); !ok {
+		if _, ok := err.(*operations.SyncFileListVersionsNotFound); !ok {
 			return nil, err
 		}
 
@@ -297,3 +737,21 @@ func (h *handlers) listFileVersionsAsc(ctx context.Context, c *operations.Client
 func formatLabelsFromHeader(h string) []string {
 	return strings.Split(h, "|")
 }
+
+func formatEncodingsFromHeader(h string) []string {
+	if h == "" {
+		return nil
+	}
+	return strings.Split(h, ",")
+}
+
+// accepts returns true if the encoding is one of the accepted ones
+func accepts(accepted []string, encoding string) bool {
+	for _, e := range accepted {
+		if strings.TrimSpace(e) == encoding {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,10 +1,12 @@
 package storage
 
-//go:generate ../../bin/mockgen.sh sync/storage Publisher,Consumer,Handlers $GOFILE
+//go:generate ../../bin/mockgen.sh sync/storage Publisher,Consumer,Handlers,ConflictStore,DeadLetterStore $GOFILE
 
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"time"
 
 	strfmt "github.com/go-openapi/strfmt"
@@ -24,6 +26,7 @@ const (
 	FileNew    EventType = "file.new"
 	FileUpdate EventType = "file.update"
 	FileDelete EventType = "file.delete"
+	FilePurge  EventType = "file.purge"
 )
 
 // Publisher describes sync/storage publisher public methods.
@@ -56,6 +59,72 @@ type BatchSync interface {
 	GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector
 }
 
+// ConflictStore keeps conflicts parked for manual resolution.
+type ConflictStore interface {
+	// Park stores the conflict.
+	Park(c *Conflict) error
+	// List returns all the parked conflicts ordered by the time they were detected.
+	List() ([]*Conflict, error)
+	// Get returns the parked conflict or ErrConflictNotFound.
+	Get(id string) (*Conflict, error)
+	// Remove removes the conflict once it is resolved.
+	Remove(id string) error
+}
+
+// DeadLetterStore keeps sync events that repeatedly failed to be handled.
+type DeadLetterStore interface {
+	// Add stores the dead letter; dead letter with the same ID is replaced.
+	Add(l *DeadLetter) error
+	// List returns all the dead letters ordered by the time they failed.
+	List() ([]*DeadLetter, error)
+	// Get returns the dead letter or ErrDeadLetterNotFound.
+	Get(id string) (*DeadLetter, error)
+	// Remove removes the dead letter once it is replayed or discarded.
+	Remove(id string) error
+}
+
+// Throttle schedules transfers of files to destination storage over link
+// with limited bandwidth.
+type Throttle interface {
+	// Admit returns priority of the file of the content type and size, lower
+	// number going first, or ErrDeferred if it can not be transferred now.
+	Admit(contentType string, size int64) (int, error)
+	// Reader returns reader limiting the rate at which r is read; readers of
+	// lower priority wait for the others.
+	Reader(ctx context.Context, r io.Reader, priority int) io.Reader
+}
+
+// Conflict describes version of a file stored with different contents in
+// source and destination storage. Direction tells which storage is the source;
+// conflicts parked without it were found by push.
+type Conflict struct {
+	ID                  string          `json:"id"`
+	Direction           Direction       `json:"direction,omitempty"`
+	BucketID            string          `json:"bucketID"`
+	FileID              string          `json:"fileID"`
+	Version             string          `json:"version"`
+	SourceChecksum      string          `json:"sourceChecksum"`
+	SourceCreated       strfmt.DateTime `json:"sourceCreated"`
+	DestinationChecksum string          `json:"destinationChecksum"`
+	DestinationCreated  strfmt.DateTime `json:"destinationCreated"`
+	Detected            strfmt.DateTime `json:"detected"`
+}
+
+// DeadLetter describes sync event moved out of the event bus after it failed
+// to be handled too many times
+type DeadLetter struct {
+	ID         string          `json:"id"`
+	Type       EventType       `json:"type"`
+	Data       string          `json:"data"`
+	BucketID   string          `json:"bucketID"`
+	FileID     string          `json:"fileID"`
+	Version    string          `json:"version"`
+	Created    strfmt.DateTime `json:"created"`
+	Deliveries int             `json:"deliveries"`
+	Error      string          `json:"error"`
+	Failed     strfmt.DateTime `json:"failed"`
+}
+
 type FileInfo struct {
 	BucketID string          `json:"bucketID,omitempty"`
 	FileID   string          `json:"fileID,omitempty"`
@@ -67,6 +136,81 @@ var ResultSynced SyncResult = "synced"
 var ResultConflict SyncResult = "conflict"
 var ResultError SyncResult = "error"
 var ResultSyncNotNeeded SyncResult = "syncNotNeeded"
+var ResultDeferred SyncResult = "deferred"
+
+// Direction defines which storage files are synced from
+type Direction string
+
+// Sync directions
+const (
+	// DirectionPush syncs files from local storage to cloud storage
+	DirectionPush Direction = "push"
+	// DirectionPull syncs files from cloud storage to local storage
+	DirectionPull Direction = "pull"
+)
+
+// ConflictPolicy defines how conflicts found during sync are resolved
+type ConflictPolicy string
+
+// Conflict policies
+const (
+	// ConflictKeepBoth stores the source contents as a new sibling version in
+	// destination storage
+	ConflictKeepBoth ConflictPolicy = "keepBoth"
+	// ConflictLastWriterWins keeps contents of the version created later
+	ConflictLastWriterWins ConflictPolicy = "lastWriterWins"
+	// ConflictPark parks the conflict in ConflictStore for manual resolution
+	ConflictPark ConflictPolicy = "park"
+)
+
+// Resolution defines how a single conflict is resolved
+type Resolution string
+
+// Resolutions of a conflict
+const (
+	// ResolutionSource replaces the destination contents with the source contents
+	ResolutionSource Resolution = "source"
+	// ResolutionDestination keeps the destination contents
+	ResolutionDestination Resolution = "destination"
+	// ResolutionBoth keeps both as sibling versions
+	ResolutionBoth Resolution = "both"
+)
+
+// Encodings of file contents uploaded to destination storage. zstd is not
+// offered yet: its pure Go implementations need a newer Go release than the
+// services are built with and cgo bindings do not build for the images. It can
+// be added here and to storage.SyncEncodings as encodings are negotiated.
+const (
+	// EncodingGzip compresses the contents with gzip
+	EncodingGzip = "gzip"
+	// EncodingDelta encodes the contents as delta against a version of the
+	// file held by destination storage
+	EncodingDelta = "delta"
+)
+
+// TransferOptions define how file contents are encoded for upload; only the
+// encodings accepted by destination storage are used
+type TransferOptions struct {
+	// Compress enables gzip compression of the contents
+	Compress bool
+	// DeltaMinSize is the size in bytes from which files are uploaded as
+	// delta against the latest version held by destination storage; deltas
+	// are not used if it is 0
+	DeltaMinSize int64
+}
+
+// ErrConflictNotFound is returned when the conflict is not parked
+var ErrConflictNotFound = errors.New("conflict not found")
+
+// ErrDeadLetterNotFound is returned when the dead letter is not stored
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// ErrDeferred is returned when the file is transferred only later in the
+// sync window of its priority class
+var ErrDeferred = errors.New("transfer deferred until sync window opens")
+
+// ErrNoChangeLog is returned when source storage does not record changes
+var ErrNoChangeLog = errors.New("change log is not available")
 
 func NewFileInfo() *FileInfo {
 	return &FileInfo{}
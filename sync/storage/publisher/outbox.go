@@ -0,0 +1,108 @@
+package publisher
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/pkg/errors"
+)
+
+var outboxBucket = []byte("events")
+
+// Outbox keeps storage sync events in bolt database file until they are
+// published, so events are not lost when the event bus is not reachable or
+// the service restarts.
+type Outbox struct {
+	db *bolt.DB
+}
+
+type outboxEvent struct {
+	key     []byte
+	Subject string `json:"subject"`
+	Data    []byte `json:"data"`
+}
+
+// OpenOutbox opens the outbox stored in the file, events left there by the
+// previous run are published first
+func OpenOutbox(path string) (*Outbox, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open outbox")
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(outboxBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "failed to ensure outbox bucket")
+	}
+
+	return &Outbox{db: db}, nil
+}
+
+// Close closes the database file
+func (o *Outbox) Close() error {
+	return o.db.Close()
+}
+
+// add appends the event to the outbox
+func (o *Outbox) add(subject string, data []byte) error {
+	value, err := json.Marshal(&outboxEvent{Subject: subject, Data: data})
+	if err != nil {
+		return err
+	}
+
+	return o.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return b.Put(key, value)
+	})
+}
+
+// list returns up to limit oldest events
+func (o *Outbox) list(limit int) ([]*outboxEvent, error) {
+	events := []*outboxEvent{}
+
+	err := o.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(outboxBucket).Cursor()
+		for k, v := c.First(); k != nil && len(events) < limit; k, v = c.Next() {
+			e := &outboxEvent{}
+			if err := json.Unmarshal(v, e); err != nil {
+				return err
+			}
+			e.key = append([]byte{}, k...)
+			events = append(events, e)
+		}
+		return nil
+	})
+
+	return events, err
+}
+
+// remove removes the published event
+func (o *Outbox) remove(e *outboxEvent) error {
+	return o.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).Delete(e.key)
+	})
+}
+
+// len returns number of events waiting in the outbox
+func (o *Outbox) len() int {
+	var n int
+	o.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(outboxBucket).Stats().KeyN
+		return nil
+	})
+
+	return n
+}
@@ -1,9 +1,10 @@
 package publisher
 
-//go:generate ../../../bin/mockgen.sh sync/storage/publisher StanConnection $GOFILE
+//go:generate ../../../bin/mockgen.sh sync/storage/publisher Connection $GOFILE
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"time"
 
@@ -16,23 +17,47 @@ import (
 
 const publishSeconds metrics.ID = "publishSeconds"
 const publishCalls metrics.ID = "publishCalls"
+const outboxEvents metrics.ID = "outboxEvents"
 
-// Connection interface describes actions that have to be supported by underlying connection with nats-streaming. For testing purposes.
-type StanConnection interface {
+// outboxBatchSize is the number of events read from the outbox at once
+const outboxBatchSize = 100
+
+// maxOutboxRetryWait limits the wait between attempts to publish events from
+// the outbox
+const maxOutboxRetryWait = 5 * time.Minute
+
+// ErrNotConnected is returned when the connection to the event bus was not
+// established yet
+var ErrNotConnected = errors.New("Not connected to the event bus")
+
+// Connection interface describes actions that have to be supported by underlying connection with the event bus; it is satisfied by bus.Bus.
+type Connection interface {
 	Publish(subject string, data []byte) error
 	Close() error
 }
 
 type Cfg struct {
-	Connection      StanConnection
+	Connection Connection
+	// Connect establishes the connection if Connection is not set; it is
+	// retried until it succeeds, events wait in the outbox meanwhile.
+	Connect func() (Connection, error)
+	// Outbox keeps events until they are published; events are published
+	// in order from the outbox without limiting retries if it is set.
+	Outbox          *Outbox
 	Retries         int
 	StartRetryWait  time.Duration
 	RetryWaitFactor float32
 }
 
-type stanPublisher struct {
+type busPublisher struct {
 	ctx               context.Context
-	conn              StanConnection
+	conn              Connection
+	connect           func() (Connection, error)
+	connLock          sync.Mutex
+	outbox            *Outbox
+	wake              chan struct{}
+	done              chan struct{}
+	closeOnce         sync.Once
 	retries           int
 	startRetryWait    time.Duration
 	retryWaitFactor   float32
@@ -66,7 +91,7 @@ func (p *nullPublisher) GetPrometheusMetricsCollection() map[metrics.ID]promethe
 }
 
 // Publish pushes sync/storage event and returns synchronous response.
-func (p *stanPublisher) Publish(_ context.Context, typ storageSync.EventType, f *storageSync.FileInfo) error {
+func (p *busPublisher) Publish(_ context.Context, typ storageSync.EventType, f *storageSync.FileInfo) error {
 	// Make sure we record duration metrics even if processing fails
 	start := time.Now()
 	defer func() {
@@ -83,8 +108,11 @@ func (p *stanPublisher) Publish(_ context.Context, typ storageSync.EventType, f
 		return err
 	}
 
-	err = p.conn.Publish(string(typ), msg)
-	p.metricsCollection[publishCalls].(prometheus.Counter).Inc() // increase publish calls counter metrics
+	conn, err := p.connection()
+	if err == nil {
+		err = conn.Publish(string(typ), msg)
+		p.metricsCollection[publishCalls].(prometheus.Counter).Inc() // increase publish calls counter metrics
+	}
 
 	if err != nil {
 		p.logger.Error().Err(err).
@@ -96,7 +124,7 @@ func (p *stanPublisher) Publish(_ context.Context, typ storageSync.EventType, f
 }
 
 // Publish starts goroutine that pushes sync/storage events and retries if publishing failed.
-func (p *stanPublisher) PublishAsyncWithRetries(ctx context.Context, typ storageSync.EventType, f *storageSync.FileInfo) error {
+func (p *busPublisher) PublishAsyncWithRetries(ctx context.Context, typ storageSync.EventType, f *storageSync.FileInfo) error {
 	// Make sure we record duration metrics even if processing fails
 	start := time.Now()
 	defer func() {
@@ -111,6 +139,24 @@ func (p *stanPublisher) PublishAsyncWithRetries(ctx context.Context, typ storage
 		return err
 	}
 
+	// event is stored before returning and published from the outbox
+	if p.outbox != nil {
+		if err := p.outbox.add(string(typ), msg); err != nil {
+			p.logger.Error().Err(err).
+				Str("cmd", "PublishAsyncWithRetries").
+				Str("type", string(typ)).
+				Msg("Failed to store storage sync event in outbox")
+			return err
+		}
+		p.metricsCollection[outboxEvents].(prometheus.Gauge).Inc()
+
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+
 	p.wg.Add(1)
 	go func() {
 		var err error
@@ -125,7 +171,11 @@ func (p *stanPublisher) PublishAsyncWithRetries(ctx context.Context, typ storage
 					Msg("Async publishing stopped due to context cancellation")
 				break RetryLoop
 			default:
-				err = p.conn.Publish(string(typ), msg)
+				var conn Connection
+				conn, err = p.connection()
+				if err == nil {
+					err = conn.Publish(string(typ), msg)
+				}
 				p.metricsCollection[publishCalls].(prometheus.Counter).Inc() // increase publish calls counter metrics
 
 				if err == nil {
@@ -158,17 +208,119 @@ func (p *stanPublisher) PublishAsyncWithRetries(ctx context.Context, typ storage
 }
 
 // Close waits for all async publish routines to finish and closes underlying connection.
-func (p *stanPublisher) Close() {
+// Events that were not published yet are kept in the outbox.
+func (p *busPublisher) Close() {
+	p.closeOnce.Do(func() { close(p.done) })
 	p.wg.Wait()
-	p.conn.Close()
+
+	if p.outbox != nil {
+		p.outbox.Close()
+	}
+	p.connLock.Lock()
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.connLock.Unlock()
+}
+
+// drain publishes events from the outbox until the publisher is closed,
+// failed attempts are retried with increasing wait
+func (p *busPublisher) drain() {
+	defer p.wg.Done()
+	retryWait := p.startRetryWait
+
+	for {
+		var wait <-chan time.Time
+		if err := p.publishOutbox(); err != nil {
+			p.logger.Error().Err(err).
+				Str("cmd", "drain").
+				Msgf("Failed to publish storage sync events from outbox, retry in %s", retryWait)
+
+			wait = time.After(retryWait)
+			retryWait = time.Duration(float32(retryWait) * p.retryWaitFactor)
+			if retryWait > maxOutboxRetryWait {
+				retryWait = maxOutboxRetryWait
+			}
+		} else {
+			retryWait = p.startRetryWait
+		}
+
+		select {
+		case <-p.done:
+			return
+		case <-p.wake:
+		case <-wait:
+		}
+	}
+}
+
+// publishOutbox publishes all the events from the outbox in order they were
+// added
+func (p *busPublisher) publishOutbox() error {
+	for {
+		select {
+		case <-p.done:
+			return nil
+		default:
+		}
+
+		conn, err := p.connection()
+		if err != nil {
+			return err
+		}
+
+		events, err := p.outbox.list(outboxBatchSize)
+		if err != nil || len(events) == 0 {
+			return err
+		}
+
+		for _, e := range events {
+			err := conn.Publish(e.Subject, e.Data)
+			p.metricsCollection[publishCalls].(prometheus.Counter).Inc() // increase publish calls counter metrics
+			if err != nil {
+				return err
+			}
+
+			if err := p.outbox.remove(e); err != nil {
+				return err
+			}
+			p.metricsCollection[outboxEvents].(prometheus.Gauge).Dec()
+			p.logger.Debug().
+				Str("cmd", "publishOutbox").
+				Str("type", e.Subject).
+				Msgf("%s", e.Data)
+		}
+	}
+}
+
+// connection returns the connection to the event bus, establishing it first
+// if needed
+func (p *busPublisher) connection() (Connection, error) {
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+
+	if p.conn != nil {
+		return p.conn, nil
+	}
+	if p.connect == nil {
+		return nil, ErrNotConnected
+	}
+
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+	p.conn = conn
+
+	return conn, nil
 }
 
 // GetPrometheusMetricsCollection returns all prometheus metrics collectors needed to be registered
-func (p *stanPublisher) GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector {
+func (p *busPublisher) GetPrometheusMetricsCollection() map[metrics.ID]prometheus.Collector {
 	return p.metricsCollection
 }
 
-// New returns new stanPublisher with provided nats-streaming connectiom as underlying backend.
+// New returns new busPublisher with provided event bus connection as underlying backend.
 func New(ctx context.Context, cfg Cfg, logger zerolog.Logger) storageSync.Publisher {
 	logger = logger.With().Str("component", "sync/storage/publisher").Logger()
 
@@ -183,19 +335,37 @@ func New(ctx context.Context, cfg Cfg, logger zerolog.Logger) storageSync.Publis
 	c := prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "publisher",
 		Name:      "publish_calls",
-		Help:      "Number of publish calls to nats-streaming",
+		Help:      "Number of publish calls to the event bus",
 	})
 	metricsCollection[publishCalls] = c
 
-	p := &stanPublisher{
+	metricsCollection[outboxEvents] = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "publisher",
+		Name:      "outbox_events",
+		Help:      "Number of events waiting in the outbox to be published",
+	})
+
+	p := &busPublisher{
 		ctx:               ctx,
 		conn:              cfg.Connection,
+		connect:           cfg.Connect,
+		outbox:            cfg.Outbox,
+		wake:              make(chan struct{}, 1),
+		done:              make(chan struct{}),
 		retries:           cfg.Retries,
 		startRetryWait:    cfg.StartRetryWait,
 		retryWaitFactor:   cfg.RetryWaitFactor,
 		logger:            logger,
 		metricsCollection: metricsCollection,
 	}
+
+	// publish events from the outbox in the background
+	if p.outbox != nil {
+		metricsCollection[outboxEvents].(prometheus.Gauge).Set(float64(p.outbox.len()))
+		p.wg.Add(1)
+		go p.drain()
+	}
+
 	// Close if context is Done()
 	go func() {
 		<-ctx.Done()
@@ -3,7 +3,9 @@ package publisher
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -27,13 +29,13 @@ func TestPublish(t *testing.T) {
 
 	testCases := []struct {
 		description   string
-		mockCalls     func(*mock.MockStanConnection) []*gomock.Call
+		mockCalls     func(*mock.MockConnection) []*gomock.Call
 		errorExpected bool
 		exactError    error
 	}{
 		{
 			"Publish succeeds",
-			func(c *mock.MockStanConnection) []*gomock.Call {
+			func(c *mock.MockConnection) []*gomock.Call {
 				msg, _ := file.Marshal()
 				return []*gomock.Call{
 					c.EXPECT().Publish(string(storageSync.FileNew), msg).Return(nil).Times(1),
@@ -44,7 +46,7 @@ func TestPublish(t *testing.T) {
 		},
 		{
 			"Publish fails",
-			func(c *mock.MockStanConnection) []*gomock.Call {
+			func(c *mock.MockConnection) []*gomock.Call {
 				msg, _ := file.Marshal()
 				return []*gomock.Call{
 					c.EXPECT().Publish(string(storageSync.FileNew), msg).Return(expectedError).Times(1),
@@ -83,12 +85,12 @@ func TestPublish(t *testing.T) {
 func TestPublishAsyncWithRetries(t *testing.T) {
 	testCases := []struct {
 		description   string
-		mockCalls     func(*mock.MockStanConnection) []*gomock.Call
+		mockCalls     func(*mock.MockConnection) []*gomock.Call
 		errorExpected bool
 	}{
 		{
 			"Publish succeeds without retries",
-			func(c *mock.MockStanConnection) []*gomock.Call {
+			func(c *mock.MockConnection) []*gomock.Call {
 				msg, _ := file.Marshal()
 				return []*gomock.Call{
 					c.EXPECT().Publish(string(storageSync.FileNew), msg).Return(nil).Times(1),
@@ -98,7 +100,7 @@ func TestPublishAsyncWithRetries(t *testing.T) {
 		},
 		{
 			"Publish succeeds on second retry",
-			func(c *mock.MockStanConnection) []*gomock.Call {
+			func(c *mock.MockConnection) []*gomock.Call {
 				msg, _ := file.Marshal()
 				return []*gomock.Call{
 					c.EXPECT().Publish(string(storageSync.FileNew), msg).Return(fmt.Errorf("error")).Times(2),
@@ -109,7 +111,7 @@ func TestPublishAsyncWithRetries(t *testing.T) {
 		},
 		{
 			"Publish fails after retry limit",
-			func(c *mock.MockStanConnection) []*gomock.Call {
+			func(c *mock.MockConnection) []*gomock.Call {
 				msg, _ := file.Marshal()
 				return []*gomock.Call{
 					c.EXPECT().Publish(string(storageSync.FileNew), msg).Return(fmt.Errorf("error")).Times(5),
@@ -191,9 +193,97 @@ func TestGeneralContextCancelled(t *testing.T) {
 	time.Sleep(time.Duration(50 * time.Millisecond))
 }
 
-func getTestPublisher(t *testing.T, ctx context.Context) (*stanPublisher, *mock.MockStanConnection, func()) {
+func TestOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "publisher")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "outbox.db")
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	conn := mock.NewMockConnection(mockCtrl)
+	msg, _ := file.Marshal()
+
+	// event bus is not reachable, events are kept in the outbox
+	outbox, err := OpenOutbox(path)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	connectCalled := make(chan bool, 1)
+	p := New(context.Background(), Cfg{
+		Connect: func() (Connection, error) {
+			select {
+			case connectCalled <- true:
+			default:
+			}
+			return nil, fmt.Errorf("error")
+		},
+		Outbox:          outbox,
+		StartRetryWait:  time.Millisecond,
+		RetryWaitFactor: 1.0,
+	}, zerolog.New(os.Stdout))
+
+	if err := p.PublishAsyncWithRetries(context.Background(), storageSync.FileNew, file); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if err := p.PublishAsyncWithRetries(context.Background(), storageSync.FileDelete, file); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	<-connectCalled
+	p.Close()
+
+	// events are published in order after restart, failed publish is retried
+	outbox, err = OpenOutbox(path)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if n := outbox.len(); n != 2 {
+		t.Fatalf("Expected 2 events in outbox, got %d", n)
+	}
+
+	published := make(chan bool)
+	gomock.InOrder(
+		conn.EXPECT().Publish(string(storageSync.FileNew), msg).Return(fmt.Errorf("error")).Times(1),
+		conn.EXPECT().Publish(string(storageSync.FileNew), msg).Return(nil).Times(1),
+		conn.EXPECT().Publish(string(storageSync.FileDelete), msg).
+			Do(func(subject string, data []byte) error {
+				published <- true
+				return nil
+			}).Return(nil).Times(1),
+		conn.EXPECT().Close().Return(nil).Times(1),
+	)
+	p = New(context.Background(), Cfg{
+		Connect: func() (Connection, error) {
+			return conn, nil
+		},
+		Outbox:          outbox,
+		StartRetryWait:  time.Millisecond,
+		RetryWaitFactor: 1.0,
+	}, zerolog.New(os.Stdout))
+
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("Events were not published during specified time")
+	}
+	p.Close()
+
+	// published events are removed from the outbox
+	outbox, err = OpenOutbox(path)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	defer outbox.Close()
+	if n := outbox.len(); n != 0 {
+		t.Fatalf("Expected outbox to be empty, got %d events", n)
+	}
+}
+
+func getTestPublisher(t *testing.T, ctx context.Context) (*busPublisher, *mock.MockConnection, func()) {
 	mockCtrl := gomock.NewController(t)
-	mockConn := mock.NewMockStanConnection(mockCtrl)
+	mockConn := mock.NewMockConnection(mockCtrl)
 
 	cfg := Cfg{
 		Connection:      mockConn,
@@ -210,5 +300,5 @@ func getTestPublisher(t *testing.T, ctx context.Context) (*stanPublisher, *mock.
 		mockCtrl.Finish()
 	}
 
-	return publisher.(*stanPublisher), mockConn, cleanup
+	return publisher.(*busPublisher), mockConn, cleanup
 }
@@ -0,0 +1,132 @@
+package throttle
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// chunkSize is the maximum number of bytes read at once by limited reader
+const chunkSize = 32 * 1024
+
+// retryWait is the time waiter of lower priority waits before it checks
+// again if it can proceed
+const retryWait = 10 * time.Millisecond
+
+// limiter limits the rate of transferred bytes shared by all the transfers.
+// Bytes are taken in advance so the rate is kept on average; transfers of
+// lower priority, i.e. higher number, wait while there are others waiting.
+type limiter struct {
+	rate    float64 // bytes per second
+	lock    sync.Mutex
+	tokens  float64 // available bytes, negative if taken in advance
+	last    time.Time
+	waiting map[int]int // number of waiters per priority
+	now     func() time.Time
+}
+
+func newLimiter(bytesPerSecond int64) *limiter {
+	return &limiter{
+		rate:    float64(bytesPerSecond),
+		waiting: make(map[int]int),
+		now:     time.Now,
+	}
+}
+
+// wait blocks until n bytes can be transferred or the context is cancelled
+func (l *limiter) wait(ctx context.Context, priority int, n int) error {
+	registered := false
+	defer func() {
+		if registered {
+			l.lock.Lock()
+			l.waiting[priority]--
+			l.lock.Unlock()
+		}
+	}()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		l.lock.Lock()
+		l.refill()
+		if l.tokens >= 0 && !l.othersFirst(priority) {
+			l.tokens -= float64(n)
+			l.lock.Unlock()
+			return nil
+		}
+
+		if !registered {
+			l.waiting[priority]++
+			registered = true
+		}
+		d := retryWait
+		if l.tokens < 0 {
+			d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+		}
+		l.lock.Unlock()
+
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// refill adds bytes available since the last refill; at most one second
+// worth of bytes is kept
+func (l *limiter) refill() {
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+}
+
+// giveBack returns bytes taken but not transferred
+func (l *limiter) giveBack(n int) {
+	l.lock.Lock()
+	l.tokens += float64(n)
+	l.lock.Unlock()
+}
+
+// othersFirst returns true if waiters of higher priority are waiting
+func (l *limiter) othersFirst(priority int) bool {
+	for p, n := range l.waiting {
+		if p < priority && n > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+type limitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiter  *limiter
+	priority int
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+	if err := r.limiter.wait(r.ctx, r.priority, len(p)); err != nil {
+		return 0, err
+	}
+
+	n, err := r.r.Read(p)
+	if n < len(p) {
+		r.limiter.giveBack(len(p) - n)
+	}
+	return n, err
+}
@@ -0,0 +1,151 @@
+// Package throttle schedules storage sync transfers over link with limited
+// bandwidth
+package throttle
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Class is a priority class of files. Empty ContentTypes matches files of any
+// content type and zero MaxSize matches files of any size.
+type Class struct {
+	Name string `yaml:"name"`
+	// ContentTypes are patterns of content types as in path.Match, e.g.
+	// "image/*"
+	ContentTypes []string `yaml:"contentTypes"`
+	// MaxSize is the size in bytes up to which files belong to the class
+	MaxSize int64 `yaml:"maxSize"`
+	// Windows are time of day ranges in local time, e.g. "20:00-06:00",
+	// during which files of the class are transferred; files are transferred
+	// any time if there are none
+	Windows []string `yaml:"windows"`
+
+	windows []window
+}
+
+// Schedule holds priority classes in the order of priority. Files are
+// assigned to the first class they match; files not matched by any class
+// have the lowest priority and are transferred any time.
+type Schedule struct {
+	Classes []*Class `yaml:"classes"`
+}
+
+// window is a time of day range given by offsets from midnight
+type window struct {
+	start time.Duration
+	end   time.Duration
+}
+
+// LoadSchedule reads the schedule from a yaml file
+func LoadSchedule(filepath string) (*Schedule, error) {
+	b, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read sync schedule")
+	}
+
+	schedule := &Schedule{}
+	if err := yaml.Unmarshal(b, schedule); err != nil {
+		return nil, errors.Wrap(err, "failed to parse sync schedule")
+	}
+
+	for _, c := range schedule.Classes {
+		if c.MaxSize < 0 {
+			return nil, errors.Errorf("max size of class '%s' can not be negative", c.Name)
+		}
+		for _, pattern := range c.ContentTypes {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.Errorf("invalid content type pattern '%s' of class '%s'", pattern, c.Name)
+			}
+		}
+		for _, w := range c.Windows {
+			parsed, err := parseWindow(w)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid window of class '%s'", c.Name)
+			}
+			c.windows = append(c.windows, parsed)
+		}
+	}
+
+	return schedule, nil
+}
+
+// priority returns index of the class the file belongs to and the class,
+// nil is returned if no class matches
+func (s *Schedule) priority(contentType string, size int64) (int, *Class) {
+	for i, c := range s.Classes {
+		if c.matches(contentType, size) {
+			return i, c
+		}
+	}
+
+	return len(s.Classes), nil
+}
+
+func (c *Class) matches(contentType string, size int64) bool {
+	if c.MaxSize > 0 && size > c.MaxSize {
+		return false
+	}
+	if len(c.ContentTypes) == 0 {
+		return true
+	}
+	for _, pattern := range c.ContentTypes {
+		if ok, _ := path.Match(pattern, contentType); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// open returns true if files of the class can be transferred at the time
+func (c *Class) open(t time.Time) bool {
+	if len(c.windows) == 0 {
+		return true
+	}
+	for _, w := range c.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseWindow parses window given as "HH:MM-HH:MM"
+func parseWindow(s string) (window, error) {
+	var w window
+	var sh, sm, eh, em int
+	if _, err := fmt.Sscanf(s, "%d:%d-%d:%d", &sh, &sm, &eh, &em); err != nil {
+		return w, errors.Errorf("window '%s' is not in HH:MM-HH:MM format", s)
+	}
+	if sh < 0 || sh > 23 || eh < 0 || eh > 24 || sm < 0 || sm > 59 || em < 0 || em > 59 || (eh == 24 && em != 0) {
+		return w, errors.Errorf("window '%s' is out of range", s)
+	}
+
+	w.start = time.Duration(sh)*time.Hour + time.Duration(sm)*time.Minute
+	w.end = time.Duration(eh)*time.Hour + time.Duration(em)*time.Minute
+	return w, nil
+}
+
+// contains returns true if time of day of t is within the window; windows
+// ending before they start span midnight and windows starting and ending at
+// the same time span the whole day
+func (w window) contains(t time.Time) bool {
+	h, m, sec := t.Clock()
+	d := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second
+
+	switch {
+	case w.start == w.end:
+		return true
+	case w.start < w.end:
+		return d >= w.start && d < w.end
+	default:
+		return d >= w.start || d < w.end
+	}
+}
@@ -0,0 +1,52 @@
+package throttle
+
+import (
+	"context"
+	"io"
+	"time"
+
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+)
+
+type throttle struct {
+	schedule *Schedule
+	limiter  *limiter
+	now      func() time.Time
+}
+
+// New returns Throttle admitting files following the schedule and limiting
+// the rate of all the transfers to bytesPerSecond. Files are admitted any
+// time if schedule is nil and the rate is not limited if bytesPerSecond is
+// not positive.
+func New(schedule *Schedule, bytesPerSecond int64) storageSync.Throttle {
+	t := &throttle{
+		schedule: schedule,
+		now:      time.Now,
+	}
+	if bytesPerSecond > 0 {
+		t.limiter = newLimiter(bytesPerSecond)
+	}
+
+	return t
+}
+
+func (t *throttle) Admit(contentType string, size int64) (int, error) {
+	if t.schedule == nil {
+		return 0, nil
+	}
+
+	priority, class := t.schedule.priority(contentType, size)
+	if class != nil && !class.open(t.now()) {
+		return priority, storageSync.ErrDeferred
+	}
+
+	return priority, nil
+}
+
+func (t *throttle) Reader(ctx context.Context, r io.Reader, priority int) io.Reader {
+	if t.limiter == nil {
+		return r
+	}
+
+	return &limitedReader{ctx: ctx, r: r, limiter: t.limiter, priority: priority}
+}
@@ -0,0 +1,134 @@
+package throttle
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	storageSync "github.com/iryonetwork/wwm/sync/storage"
+)
+
+const testSchedule = `
+classes:
+  - name: records
+    contentTypes: ["application/json", "text/*"]
+    maxSize: 1024
+  - name: imaging
+    contentTypes: ["image/*"]
+    windows: ["20:00-06:00"]
+  - name: other
+    windows: ["12:00-13:00", "20:00-06:00"]
+`
+
+func TestAdmit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "throttle")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "schedule.yml")
+	if err := ioutil.WriteFile(path, []byte(testSchedule), 0600); err != nil {
+		t.Fatalf("Failed to write schedule: %v", err)
+	}
+	schedule, err := LoadSchedule(path)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+
+	day := time.Date(2018, 2, 18, 10, 30, 0, 0, time.Local)
+	noon := time.Date(2018, 2, 18, 12, 30, 0, 0, time.Local)
+	night := time.Date(2018, 2, 18, 2, 30, 0, 0, time.Local)
+
+	testCases := []struct {
+		description      string
+		contentType      string
+		size             int64
+		now              time.Time
+		expectedPriority int
+		expectedError    error
+	}{
+		{"Small record during the day", "application/json", 512, day, 0, nil},
+		{"Text record during the day", "text/openEhrXml", 512, day, 0, nil},
+		{"Image during the day", "image/jpeg", 512, day, 1, storageSync.ErrDeferred},
+		{"Image at night", "image/jpeg", 4096, night, 1, nil},
+		{"Large record during the day", "application/json", 4096, day, 2, storageSync.ErrDeferred},
+		{"Large record at noon", "application/json", 4096, noon, 2, nil},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			th := New(schedule, 0).(*throttle)
+			th.now = func() time.Time { return test.now }
+
+			priority, err := th.Admit(test.contentType, test.size)
+			if err != test.expectedError {
+				t.Errorf("Expected error to be '%v', got '%v'", test.expectedError, err)
+			}
+			if priority != test.expectedPriority {
+				t.Errorf("Expected priority %d, got %d", test.expectedPriority, priority)
+			}
+		})
+	}
+}
+
+func TestLoadScheduleInvalidWindow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "throttle")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "schedule.yml")
+	if err := ioutil.WriteFile(path, []byte("classes:\n  - name: imaging\n    windows: [\"25:00-06:00\"]\n"), 0600); err != nil {
+		t.Fatalf("Failed to write schedule: %v", err)
+	}
+	if _, err := LoadSchedule(path); err == nil {
+		t.Error("Expected error, got nil")
+	}
+}
+
+func TestReader(t *testing.T) {
+	th := New(nil, 10000)
+	data := make([]byte, 1000)
+
+	// first read takes bytes in advance, the second one waits for them
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		b, err := ioutil.ReadAll(th.Reader(context.Background(), bytes.NewReader(data), 0))
+		if err != nil {
+			t.Fatalf("Expected error to be nil, got %v", err)
+		}
+		if len(b) != len(data) {
+			t.Fatalf("Expected to read %d bytes, got %d", len(data), len(b))
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("Expected reads to be limited to take 100ms, took %s", elapsed)
+	}
+
+	// reader of higher priority goes first
+	done := make(chan int, 2)
+	read := func(priority int) {
+		ioutil.ReadAll(th.Reader(context.Background(), bytes.NewReader(data), priority))
+		done <- priority
+	}
+	go read(1)
+	time.Sleep(10 * time.Millisecond)
+	go read(0)
+	if first := <-done; first != 0 {
+		t.Errorf("Expected reader of priority 0 to finish first, got %d", first)
+	}
+	<-done
+
+	// waiting is cancelled with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ioutil.ReadAll(th.Reader(ctx, bytes.NewReader(data), 0)); err != context.Canceled {
+		t.Errorf("Expected error to be '%v', got %v", context.Canceled, err)
+	}
+}
@@ -0,0 +1,216 @@
+package keyProvider
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// keysBucket is the bucket of key value storage holding bucket keys; storage
+// buckets can not start with a dot so it does not clash with metadata index
+const keysBucket = ".keys"
+
+// keySize is the size of generated keys in bytes
+const keySize = 32
+
+// Storage lists methods of key value storage used to keep wrapped keys.
+// keyvalue.Storage satisfies the interface.
+type Storage interface {
+	Get(bucket string, key string) []byte
+	Update(bucket string, key string, value []byte) error
+}
+
+// Wrapper encrypts keys before they are stored
+type Wrapper interface {
+	// Wrap encrypts the bucket's key.
+	Wrap(bucketID string, key []byte) (string, error)
+	// Unwrap decrypts the bucket's key.
+	Unwrap(bucketID string, wrapped string) ([]byte, error)
+}
+
+// keyRecord holds all versions of bucket's key
+type keyRecord struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+type bucketKeys struct {
+	legacy  string
+	storage Storage
+	wrapper Wrapper
+	logger  zerolog.Logger
+
+	mu    sync.Mutex
+	cache map[string]string
+}
+
+// NewBucketKeys returns key provider generating a distinct key for each bucket.
+// Keys are wrapped and kept in the storage; new version of the key is created
+// on rotation and old versions are kept to read files encrypted with them.
+// Legacy key is returned for files encrypted before bucket keys were used.
+func NewBucketKeys(legacy string, storage Storage, wrapper Wrapper, logger zerolog.Logger) *bucketKeys {
+	logger = logger.With().Str("component", "utils/keyProvider").Logger()
+
+	return &bucketKeys{
+		legacy:  legacy,
+		storage: storage,
+		wrapper: wrapper,
+		logger:  logger,
+		cache:   map[string]string{},
+	}
+}
+
+// Get returns the current key of the bucket
+func (k *bucketKeys) Get(bucketID string) (string, error) {
+	keyID, err := k.CurrentID(bucketID)
+	if err != nil {
+		return "", err
+	}
+
+	return k.GetVersion(bucketID, keyID)
+}
+
+// CurrentID returns ID of the bucket's current key, the key is created if the
+// bucket does not have one yet
+func (k *bucketKeys) CurrentID(bucketID string) (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	r, err := k.record(bucketID)
+	if err != nil {
+		return "", err
+	}
+	if r.Current != "" {
+		return r.Current, nil
+	}
+
+	return k.addKey(bucketID, r)
+}
+
+// GetVersion returns the bucket's key with given ID
+func (k *bucketKeys) GetVersion(bucketID, keyID string) (string, error) {
+	if keyID == "" {
+		return k.legacy, nil
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if key, ok := k.cache[bucketID+"/"+keyID]; ok {
+		return key, nil
+	}
+
+	r, err := k.record(bucketID)
+	if err != nil {
+		return "", err
+	}
+	wrapped, ok := r.Keys[keyID]
+	if !ok {
+		return "", errors.Errorf("key %s of bucket %s not found", keyID, bucketID)
+	}
+
+	key, err := k.wrapper.Unwrap(bucketID, wrapped)
+	if err != nil {
+		k.logger.Error().Err(err).Str("bucket", bucketID).Str("keyID", keyID).Msg("failed to unwrap key")
+		return "", errors.Wrapf(err, "failed to unwrap key %s of bucket %s", keyID, bucketID)
+	}
+	k.cache[bucketID+"/"+keyID] = string(key)
+
+	return string(key), nil
+}
+
+// KeyIDs returns IDs of all the versions of the bucket's key, newest first
+func (k *bucketKeys) KeyIDs(bucketID string) ([]string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	r, err := k.record(bucketID)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(r.Keys))
+	for id := range r.Keys {
+		ids = append(ids, id)
+	}
+	// key IDs are sequential numbers
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := strconv.Atoi(ids[i])
+		b, _ := strconv.Atoi(ids[j])
+		return a > b
+	})
+
+	return ids, nil
+}
+
+// Rotate creates a new version of the bucket's key and returns its ID
+func (k *bucketKeys) Rotate(bucketID string) (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	r, err := k.record(bucketID)
+	if err != nil {
+		return "", err
+	}
+
+	return k.addKey(bucketID, r)
+}
+
+// record reads the bucket's key record
+func (k *bucketKeys) record(bucketID string) (*keyRecord, error) {
+	r := &keyRecord{Keys: map[string]string{}}
+
+	value := k.storage.Get(keysBucket, bucketID)
+	if value == nil {
+		return r, nil
+	}
+	if err := json.Unmarshal(value, r); err != nil {
+		k.logger.Error().Err(err).Str("bucket", bucketID).Msg("failed to decode key record")
+		return nil, errors.Wrapf(err, "failed to decode key record of bucket %s", bucketID)
+	}
+
+	return r, nil
+}
+
+// addKey generates a new key, makes it current and stores the record
+func (k *bucketKeys) addKey(bucketID string, r *keyRecord) (string, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", errors.Wrap(err, "failed to generate key")
+	}
+
+	wrapped, err := k.wrapper.Wrap(bucketID, key)
+	if err != nil {
+		k.logger.Error().Err(err).Str("bucket", bucketID).Msg("failed to wrap key")
+		return "", errors.Wrapf(err, "failed to wrap key of bucket %s", bucketID)
+	}
+
+	// key IDs are sequential numbers
+	var last int
+	for id := range r.Keys {
+		if n, err := strconv.Atoi(id); err == nil && n > last {
+			last = n
+		}
+	}
+	keyID := strconv.Itoa(last + 1)
+	r.Keys[keyID] = wrapped
+	r.Current = keyID
+
+	value, err := json.Marshal(r)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode key record")
+	}
+	if err := k.storage.Update(keysBucket, bucketID, value); err != nil {
+		k.logger.Error().Err(err).Str("bucket", bucketID).Msg("failed to store key record")
+		return "", errors.Wrapf(err, "failed to store key record of bucket %s", bucketID)
+	}
+	k.cache[bucketID+"/"+keyID] = string(key)
+
+	return keyID, nil
+}
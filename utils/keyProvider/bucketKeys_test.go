@@ -0,0 +1,188 @@
+package keyProvider
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// memStorage is an in-memory key value storage
+type memStorage map[string][]byte
+
+func (s memStorage) Get(bucket, key string) []byte {
+	return s[bucket+"/"+key]
+}
+
+func (s memStorage) Update(bucket, key string, value []byte) error {
+	s[bucket+"/"+key] = value
+	return nil
+}
+
+func TestBucketKeys(t *testing.T) {
+	storage := memStorage{}
+	wrapper, err := NewLocalWrapper("MASTER")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	k := NewBucketKeys("LEGACY", storage, wrapper, zerolog.New(os.Stdout))
+
+	// legacy key
+	if key, _ := k.GetVersion("BUCKET1", ""); key != "LEGACY" {
+		t.Errorf("Expected legacy key to equal 'LEGACY', got '%s'", key)
+	}
+
+	// keys are created on first use and differ between buckets
+	key1, err := k.Get("BUCKET1")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	key2, _ := k.Get("BUCKET2")
+	if len(key1) != keySize || key1 == key2 {
+		t.Errorf("Expected distinct keys of size %d, got '%x' and '%x'", keySize, key1, key2)
+	}
+	if id, _ := k.CurrentID("BUCKET1"); id != "1" {
+		t.Errorf("Expected current key ID to equal '1', got '%s'", id)
+	}
+
+	// keys are not stored in plain text
+	if strings.Contains(string(storage.Get(keysBucket, "BUCKET1")), key1) {
+		t.Error("Expected stored key to be wrapped")
+	}
+
+	// rotation
+	id, err := k.Rotate("BUCKET1")
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if id != "2" {
+		t.Errorf("Expected new key ID to equal '2', got '%s'", id)
+	}
+	rotated, _ := k.Get("BUCKET1")
+	if rotated == key1 {
+		t.Error("Expected rotated key to differ from the old one")
+	}
+	if ids, _ := k.KeyIDs("BUCKET1"); !reflect.DeepEqual(ids, []string{"2", "1"}) {
+		t.Errorf("Expected key IDs [2 1], got %v", ids)
+	}
+
+	// keys survive restart
+	k = NewBucketKeys("LEGACY", storage, wrapper, zerolog.New(os.Stdout))
+	if key, _ := k.GetVersion("BUCKET1", "1"); key != key1 {
+		t.Errorf("Expected old key to be readable after restart")
+	}
+	if key, _ := k.Get("BUCKET1"); key != rotated {
+		t.Errorf("Expected current key to be the rotated one after restart")
+	}
+
+	// unknown key
+	if _, err := k.GetVersion("BUCKET1", "3"); err == nil {
+		t.Error("Expected error, got nil")
+	}
+
+	// wrapped key can not be used with another bucket
+	storage.Update(keysBucket, "BUCKET3", storage.Get(keysBucket, "BUCKET2"))
+	if _, err := k.GetVersion("BUCKET3", "1"); err == nil {
+		t.Error("Expected error, got nil")
+	}
+}
+
+func TestBackedUpStorage(t *testing.T) {
+	primary, backup := memStorage{}, memStorage{}
+	s := NewBackedUpStorage(primary, backup, zerolog.New(os.Stdout))
+
+	// records are mirrored to the backup
+	if err := s.Update(keysBucket, "BUCKET1", []byte("RECORD1")); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if string(backup.Get(keysBucket, "BUCKET1")) != "RECORD1" {
+		t.Errorf("Expected record to be backed up")
+	}
+
+	// lost records are restored from the backup
+	delete(primary, keysBucket+"/BUCKET1")
+	if value := s.Get(keysBucket, "BUCKET1"); string(value) != "RECORD1" {
+		t.Errorf("Expected record to equal 'RECORD1', got '%s'", value)
+	}
+	if string(primary.Get(keysBucket, "BUCKET1")) != "RECORD1" {
+		t.Errorf("Expected record to be restored")
+	}
+
+	// missing records
+	if value := s.Get(keysBucket, "BUCKET2"); value != nil {
+		t.Errorf("Expected record to be nil, got '%s'", value)
+	}
+}
+
+func TestMigratedStorage(t *testing.T) {
+	storage, legacy := memStorage{}, memStorage{}
+	legacy.Update(keysBucket, "BUCKET1", []byte("RECORD1"))
+	s := NewMigratedStorage(storage, legacy, zerolog.New(os.Stdout))
+
+	// records are moved on first read
+	if value := s.Get(keysBucket, "BUCKET1"); string(value) != "RECORD1" {
+		t.Errorf("Expected record to equal 'RECORD1', got '%s'", value)
+	}
+	if string(storage.Get(keysBucket, "BUCKET1")) != "RECORD1" {
+		t.Errorf("Expected record to be migrated")
+	}
+
+	// legacy storage is not written to
+	if err := s.Update(keysBucket, "BUCKET2", []byte("RECORD2")); err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if legacy.Get(keysBucket, "BUCKET2") != nil {
+		t.Errorf("Expected legacy storage not to be written to")
+	}
+}
+
+func TestVaultWrapper(t *testing.T) {
+	// transit stand-in prefixing the plaintext
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "TOKEN" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(vaultResponse{Errors: []string{"permission denied"}})
+			return
+		}
+
+		req := &vaultRequest{}
+		json.NewDecoder(r.Body).Decode(req)
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/storage":
+			json.NewEncoder(w).Encode(vaultResponse{Data: vaultRequest{Ciphertext: "vault:v1:" + req.Plaintext}})
+		case "/v1/transit/decrypt/storage":
+			json.NewEncoder(w).Encode(vaultResponse{Data: vaultRequest{Plaintext: strings.TrimPrefix(req.Ciphertext, "vault:v1:")}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	w := NewVaultWrapper(&VaultConfig{Address: server.URL, Token: "TOKEN", Mount: "transit", Key: "storage"}, zerolog.New(os.Stdout))
+	wrapped, err := w.Wrap("BUCKET", []byte("KEY"))
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if wrapped != "vault:v1:"+base64.StdEncoding.EncodeToString([]byte("KEY")) {
+		t.Errorf("Unexpected wrapped key '%s'", wrapped)
+	}
+	key, err := w.Unwrap("BUCKET", wrapped)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, got %v", err)
+	}
+	if string(key) != "KEY" {
+		t.Errorf("Expected key to equal 'KEY', got '%s'", key)
+	}
+
+	// invalid token
+	w = NewVaultWrapper(&VaultConfig{Address: server.URL, Token: "INVALID", Mount: "transit", Key: "storage"}, zerolog.New(os.Stdout))
+	if _, err := w.Wrap("BUCKET", []byte("KEY")); err == nil {
+		t.Error("Expected error, got nil")
+	}
+}
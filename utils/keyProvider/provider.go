@@ -1,4 +1,6 @@
-// Provides dummy implementation of KeyProvider interface from "github.com/iryonetwork/wwm/storage/s3" that always returns the same key
+// Package keyProvider provides implementations of KeyProvider interface from "github.com/iryonetwork/wwm/storage/s3".
+// Provider returned by New is a dummy that always returns the same key, NewBucketKeys returns provider keeping
+// a distinct versioned key for each bucket.
 package keyProvider
 
 type keyProvider struct {
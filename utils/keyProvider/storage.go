@@ -0,0 +1,61 @@
+package keyProvider
+
+import (
+	"github.com/rs/zerolog"
+)
+
+// fallbackStorage reads records missing in the primary storage from the
+// fallback storage and restores them in the primary storage
+type fallbackStorage struct {
+	primary  Storage
+	fallback Storage
+	mirror   bool
+	logger   zerolog.Logger
+}
+
+// NewBackedUpStorage returns storage keeping a copy of every record in the
+// backup storage. Records lost in the primary storage are read from the backup
+// and restored.
+func NewBackedUpStorage(primary, backup Storage, logger zerolog.Logger) Storage {
+	logger = logger.With().Str("component", "utils/keyProvider").Logger()
+
+	return &fallbackStorage{primary: primary, fallback: backup, mirror: true, logger: logger}
+}
+
+// NewMigratedStorage returns storage moving records from the legacy storage on
+// first read. Records are never written to the legacy storage.
+func NewMigratedStorage(storage, legacy Storage, logger zerolog.Logger) Storage {
+	logger = logger.With().Str("component", "utils/keyProvider").Logger()
+
+	return &fallbackStorage{primary: storage, fallback: legacy, logger: logger}
+}
+
+// Get returns the record from the primary storage or the fallback storage
+func (s *fallbackStorage) Get(bucket string, key string) []byte {
+	if value := s.primary.Get(bucket, key); value != nil {
+		return value
+	}
+
+	value := s.fallback.Get(bucket, key)
+	if value == nil {
+		return nil
+	}
+
+	if err := s.primary.Update(bucket, key, value); err != nil {
+		s.logger.Error().Err(err).Str("key", key).Msg("Failed to restore record")
+	}
+
+	return value
+}
+
+// Update writes the record to the primary storage and mirrors it to the backup
+func (s *fallbackStorage) Update(bucket string, key string, value []byte) error {
+	if err := s.primary.Update(bucket, key, value); err != nil {
+		return err
+	}
+	if s.mirror {
+		return s.fallback.Update(bucket, key, value)
+	}
+
+	return nil
+}
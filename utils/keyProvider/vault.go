@@ -0,0 +1,107 @@
+package keyProvider
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// VaultConfig holds all details required to use Vault's transit secrets engine
+type VaultConfig struct {
+	Address string
+	Token   string
+	Mount   string
+	Key     string
+}
+
+type vaultWrapper struct {
+	cfg    *VaultConfig
+	client *http.Client
+	logger zerolog.Logger
+}
+
+// vaultRequest is the body of transit encrypt and decrypt requests
+type vaultRequest struct {
+	Plaintext  string `json:"plaintext,omitempty"`
+	Ciphertext string `json:"ciphertext,omitempty"`
+}
+
+// vaultResponse is the body of transit encrypt and decrypt responses
+type vaultResponse struct {
+	Data   vaultRequest `json:"data"`
+	Errors []string     `json:"errors"`
+}
+
+// NewVaultWrapper returns wrapper encrypting keys with Vault's transit secrets
+// engine; any service implementing transit encrypt and decrypt endpoints can be
+// used.
+func NewVaultWrapper(cfg *VaultConfig, logger zerolog.Logger) Wrapper {
+	logger = logger.With().Str("component", "utils/keyProvider/vault").Logger()
+
+	return &vaultWrapper{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		logger: logger,
+	}
+}
+
+// Wrap encrypts the bucket's key
+func (w *vaultWrapper) Wrap(bucketID string, key []byte) (string, error) {
+	resp, err := w.call("encrypt", &vaultRequest{Plaintext: base64.StdEncoding.EncodeToString(key)})
+	if err != nil {
+		return "", err
+	}
+
+	return resp.Ciphertext, nil
+}
+
+// Unwrap decrypts the bucket's key
+func (w *vaultWrapper) Unwrap(bucketID string, wrapped string) ([]byte, error) {
+	resp, err := w.call("decrypt", &vaultRequest{Ciphertext: wrapped})
+	if err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+}
+
+// call sends request to the transit endpoint and returns response data
+func (w *vaultWrapper) call(operation string, body *vaultRequest) (*vaultRequest, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/v1/%s/%s/%s", strings.TrimRight(w.cfg.Address, "/"), w.cfg.Mount, operation, w.cfg.Key)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", w.cfg.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		w.logger.Error().Err(err).Str("operation", operation).Msg("failed to call vault")
+		return nil, errors.Wrapf(err, "failed to call vault %s", operation)
+	}
+	defer resp.Body.Close()
+
+	out := &vaultResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, errors.Wrap(err, "failed to decode vault response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		w.logger.Error().Int("status", resp.StatusCode).Str("errors", strings.Join(out.Errors, ", ")).Str("operation", operation).Msg("vault returned an error")
+		return nil, errors.Errorf("vault %s returned status %d: %s", operation, resp.StatusCode, strings.Join(out.Errors, ", "))
+	}
+
+	return &out.Data, nil
+}
@@ -0,0 +1,57 @@
+package keyProvider
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+type localWrapper struct {
+	aead cipher.AEAD
+}
+
+// NewLocalWrapper returns wrapper encrypting keys with AES-GCM using the master
+// key. Bucket ID is used as additional data so the wrapped key can not be
+// moved to another bucket.
+func NewLocalWrapper(masterKey string) (Wrapper, error) {
+	key := sha256.Sum256([]byte(masterKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &localWrapper{aead: aead}, nil
+}
+
+// Wrap encrypts the bucket's key
+func (w *localWrapper) Wrap(bucketID string, key []byte) (string, error) {
+	nonce := make([]byte, w.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(w.aead.Seal(nonce, nonce, key, []byte(bucketID))), nil
+}
+
+// Unwrap decrypts the bucket's key
+func (w *localWrapper) Unwrap(bucketID string, wrapped string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < w.aead.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+
+	nonce := b[:w.aead.NonceSize()]
+	return w.aead.Open(nil, nonce, b[w.aead.NonceSize():], []byte(bucketID))
+}